@@ -104,6 +104,50 @@ namespace GithubRunnerRegistration.Tests
             Directory.Delete(tmp, true);
         }
 
+        [Fact]
+        public async Task ShouldSetOrganizationRunnerRegistrationToken()
+        {
+            const string token = "foo";
+            var request = new RegistrationRequest { AdminPat = Pat, Labels = new string[] { "foo" }, Owner = Owner };
+            var register = new Register(request, Assembly.GetExecutingAssembly().Location);
+            var mockClient = new Mock<IGitHubClient>();
+            var response = new Mock<IApiResponse<TokenResult>>();
+            response.SetupGet(r => r.Body).Returns(new TokenResult { Token = token });
+            mockClient.Setup(c => c.Connection.Post<TokenResult>(new Uri($"https://api.github.com/orgs/{Owner}/actions/runners/registration-token"), It.IsAny<CancellationToken>())).Returns(Task.FromResult(response.Object)).Verifiable();
+            await register.Setup(mockClient.Object);
+            Assert.Equal(token, register.RunnerRegistrationToken);
+            mockClient.Verify(c => c.Repository.Get(It.IsAny<string>(), It.IsAny<string>()), Times.Never);
+            mockClient.Verify();
+        }
+
+        [Fact]
+        public async Task ShouldRegisterOrganizationRunnerInGroup()
+        {
+            const string binaryName = "binary";
+            const string name = "orgrunner";
+            var tmp = Path.Combine(Path.GetTempPath(), Guid.NewGuid().ToString());
+            Directory.CreateDirectory(tmp);
+            var binary = Path.Combine(tmp, binaryName);
+            File.WriteAllText(binary, "this isn't actually executable");
+
+            var request = new RegistrationRequest { AdminPat = Pat, Labels = new string[] { "foo" }, Owner = Owner, RunnerGroup = "Build Agents" };
+            var register = new Register(request, binary);
+            register.RunnerRegistrationToken = "RunnerRegistrationToken";
+            var secretGenerator = new Mock<IGetCredentials>();
+            secretGenerator.Setup(g => g.GetCredentialsFromPath(It.IsAny<string>())).Returns(Task.FromResult(new RunnerRegistrationSecretData { Credentials = "foo" }));
+            void mockRun(ProcessStartInfo startInfo)
+            {
+                Assert.Equal($"{binaryName} configure --name \"{name}\" --token {register.RunnerRegistrationToken} --url \"https://github.com/{Owner}\" --labels \"foo\" --runnergroup \"Build Agents\" --replace --unattended", startInfo.Arguments);
+            }
+            await register.RegisterRunner(name, secretGenerator.Object, false, mockRun);
+            Directory.Delete(tmp, true);
+        }
+
+        [Fact]
+        public void ShouldErrorIfRunnerGroupContainsQuotes()
+        {
+            Assert.Throws<InvalidOperationException>(() => new Register(new RegistrationRequest { AdminPat = Pat, Labels = new string[] { }, Owner = Owner, RunnerGroup = "foo\"" }, "a"));
+        }
 
         [Fact]
         public async Task ShouldNotExecuteBinaryOnDryRun()
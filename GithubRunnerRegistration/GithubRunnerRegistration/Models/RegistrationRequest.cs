@@ -29,11 +29,20 @@ namespace GithubRunnerRegistration.Models
         public string Owner { get; set; }
 
         /// <summary>
-        /// Github Repository
+        /// Github Repository. If unset then the runners are registered with the organization named by Owner.
         /// </summary>
-        [Required]
         public string Repository { get; set; }
 
+        /// <summary>
+        /// Runner group to add organization runners to. If unset then the organization's default group is used.
+        /// </summary>
+        public string RunnerGroup { get; set; }
+
+        /// <summary>
+        /// URL of the Github Enterprise Server e.g. https://github.example.com. If unset then https://github.com is used.
+        /// </summary>
+        public string GithubUrl { get; set; }
+
         /// <summary>
         /// Runner labels to add to the runner (in addition to the standard 'self-hosted' etc)
         /// </summary>
@@ -20,11 +20,23 @@ namespace GithubRunnerRegistration
 		public Register(RegistrationRequest request, string binary = "/actions-runner/bin/Runner.Listener.dll")
 		{
 			Array.ForEach(request.Labels, this.validateString);
+			if (request.RunnerGroup != null && Regex.IsMatch(request.RunnerGroup, "[\"\\\\]"))
+			{
+				throw new InvalidOperationException($"'{request.RunnerGroup}' contains invalid chars");
+			}
 			this.request = request;
 			this.binary = new FileInfo(binary);
 		}
 
-		private GitHubClient getClient() => new GitHubClient(new ProductHeaderValue(nameof(GithubRunnerRegistration))) { Credentials = new Credentials(this.request.AdminPat) };
+		private string serverUrl => string.IsNullOrEmpty(this.request.GithubUrl) ? "https://github.com" : this.request.GithubUrl.TrimEnd('/');
+
+		private string apiUrl => string.IsNullOrEmpty(this.request.GithubUrl) ? "https://api.github.com" : $"{this.serverUrl}/api/v3";
+
+		private bool isOrganization => string.IsNullOrEmpty(this.request.Repository);
+
+		private string scope => this.isOrganization ? this.request.Owner : $"{this.request.Owner}/{this.request.Repository}";
+
+		private GitHubClient getClient() => new GitHubClient(new ProductHeaderValue(nameof(GithubRunnerRegistration)), new Uri(this.serverUrl)) { Credentials = new Credentials(this.request.AdminPat) };
 
 		private void validateString(string str)
 		{
@@ -38,6 +50,11 @@ namespace GithubRunnerRegistration
 		public async Task Setup(IGitHubClient clnt = default)
 		{
 			var client = clnt != default ? clnt : this.getClient();
+			if (this.isOrganization)
+			{
+				await this.setupOrganization(client);
+				return;
+			}
 			Repository repository;
 			try
 			{
@@ -51,7 +68,22 @@ namespace GithubRunnerRegistration
 			{
 				throw new SetupException("Not admin", default);
 			}
-			var tokenResult = await client.Connection.Post<TokenResult>(new Uri($"https://api.github.com/repos/{this.request.Owner}/{this.request.Repository}/actions/runners/registration-token"));
+			var tokenResult = await client.Connection.Post<TokenResult>(new Uri($"{this.apiUrl}/repos/{this.request.Owner}/{this.request.Repository}/actions/runners/registration-token"));
+			this.RunnerRegistrationToken = tokenResult.Body.Token;
+		}
+
+		private async Task setupOrganization(IGitHubClient client)
+		{
+			IApiResponse<TokenResult> tokenResult;
+			try
+			{
+				// Only organization owners can create registration tokens so there is no need to check permissions first
+				tokenResult = await client.Connection.Post<TokenResult>(new Uri($"{this.apiUrl}/orgs/{this.request.Owner}/actions/runners/registration-token"));
+			}
+			catch (Exception ex)
+			{
+				throw new SetupException("Error getting organization registration token", ex);
+			}
 			this.RunnerRegistrationToken = tokenResult.Body.Token;
 		}
 
@@ -78,7 +110,7 @@ namespace GithubRunnerRegistration
 			Directory.CreateDirectory(tmp);
 			DirectoryCopy(binary.Directory.FullName, Path.Combine(tmp, "runner"));
 
-			var startInfo = new ProcessStartInfo("dotnet", $"{this.binary.Name} configure --name \"{name}\" --token {this.RunnerRegistrationToken} --url \"https://github.com/{this.request.Owner}/{this.request.Repository}\" --labels \"{string.Join(",", this.request.Labels)}\" --replace --unattended");
+			var startInfo = new ProcessStartInfo("dotnet", $"{this.binary.Name} configure --name \"{name}\" --token {this.RunnerRegistrationToken} --url \"{this.serverUrl}/{this.scope}\" --labels \"{string.Join(",", this.request.Labels)}\"{this.runnerGroupArg} --replace --unattended");
 			startInfo.WorkingDirectory = Path.Combine(tmp, "runner");
 			try
 			{
@@ -97,6 +129,8 @@ namespace GithubRunnerRegistration
 			}
 		}
 
+		private string runnerGroupArg => this.isOrganization && !string.IsNullOrEmpty(this.request.RunnerGroup) ? $" --runnergroup \"{this.request.RunnerGroup}\"" : "";
+
 		private RunnerRegistrationSecretData createDryRunRunner()
 		{
 			var data = Convert.ToBase64String(Encoding.Default.GetBytes("{\"dryRun\":1}"));
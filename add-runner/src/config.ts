@@ -7,9 +7,11 @@ export type Config = {
 	adminPat: string;
 	maxRunners: number;
 	owner: string;
-	repo: string;
+	repo?: string;
+	runnerGroup?: string;
 	labels?: string;
 	githubPatNs?: string;
+	githubUrl?: string;
 	statefulSetNs: string;
 	output: string;
 	help: boolean;
@@ -43,7 +45,17 @@ export function GetConfig(): Config {
 			},
 			maxRunners: { type: Number, alias: "m", description: "Maximum number of runners" },
 			owner: { type: String, alias: "o", description: "Repo owner" },
-			repo: { type: String, alias: "r", description: "Repo name" },
+			repo: {
+				type: String,
+				optional: true,
+				alias: "r",
+				description: "Repo name. If omitted the runners are shared by every repo in the owner's organization",
+			},
+			runnerGroup: {
+				type: String,
+				optional: true,
+				description: "Organization runner group to add the runners to (defaults to the organization's default group)",
+			},
 			labels: { type: String, optional: true, alias: "l", description: "Labels to add to runner" },
 			githubPatNs: {
 				type: String,
@@ -51,6 +63,12 @@ export function GetConfig(): Config {
 				alias: "g",
 				description: "Namespace to create the github PAT in",
 			},
+			githubUrl: {
+				type: String,
+				optional: true,
+				alias: "u",
+				description: "URL of the Github Enterprise Server e.g. https://github.example.com (defaults to https://github.com)",
+			},
 			statefulSetNs: { type: String, alias: "s", description: "StatefulSet namespace" },
 			help: {
 				type: Boolean,
@@ -87,5 +105,20 @@ export function GetConfig(): Config {
 	if (!config.githubPatNs || config.githubPatNs == "") {
 		config.githubPatNs = config.statefulSetNs;
 	}
+	if (config.githubUrl) {
+		config.githubUrl = config.githubUrl.replace(/\/+$/, "");
+	}
 	return config;
 }
+
+export function isOrganization(config: Config): boolean {
+	return !config.repo;
+}
+
+export function getServerUrl(config: Config): string {
+	return config.githubUrl ? config.githubUrl : "https://github.com";
+}
+
+export function getApiUrl(config: Config): string | undefined {
+	return config.githubUrl ? `${config.githubUrl}/api/v3` : undefined;
+}
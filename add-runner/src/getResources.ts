@@ -1,19 +1,23 @@
 import Runner, { RunnerCreds } from "./runner";
 import { getRegToken } from "./githubRegistration";
 import generateResources from "./resources";
-import { Config } from "./config";
+import { Config, getApiUrl, getServerUrl } from "./config";
 
 export default async function (config: Config): Promise<string[]> {
-	const token = await getRegToken(config.adminPat, config.owner, config.repo);
+	const token = await getRegToken(config.adminPat, config.owner, config.repo, getApiUrl(config));
 	const runners = new Runner(token);
 	await runners.setup();
 	const creds = [] as Array<RunnerCreds>;
+	// The API server ignores runners with another namespace's label when org runners share a name across namespaces
+	const labels = [config.labels, `k8s-namespace-${config.statefulSetNs}`].filter((l) => l).join(",");
 	for (let i = 0; i < config.maxRunners; i++) {
 		const c = await runners.addRunner(
+			getServerUrl(config),
 			config.owner,
 			config.repo,
 			`${config.name}-${i}`,
-			config.labels
+			labels,
+			config.runnerGroup
 		);
 		creds.push(c);
 	}
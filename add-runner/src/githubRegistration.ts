@@ -1,10 +1,17 @@
 import { Octokit } from "@octokit/rest";
 
-export async function getRegToken(ghToken: string, owner: string, repo: string): Promise<string> {
-	const github = new Octokit({ auth: ghToken });
-	const regToken = await github.actions.createRegistrationTokenForRepo({
-		owner,
-		repo,
-	});
+export async function getRegToken(
+	ghToken: string,
+	owner: string,
+	repo: string | undefined,
+	baseUrl?: string
+): Promise<string> {
+	const github = new Octokit({ auth: ghToken, baseUrl });
+	const regToken = repo
+		? await github.actions.createRegistrationTokenForRepo({
+				owner,
+				repo,
+		  })
+		: await github.actions.createRegistrationTokenForOrg({ org: owner });
 	return regToken.data.token;
 }
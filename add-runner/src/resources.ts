@@ -1,5 +1,5 @@
 import YAML from "yaml";
-import { Config } from "./config";
+import { Config, getApiUrl, isOrganization } from "./config";
 import { RunnerCreds } from "./runner";
 
 const btoa = (input: string): string => Buffer.from(input).toString("base64");
@@ -36,13 +36,21 @@ function generateScaledActionRunner(config: Config): ScaledActionRunner {
 			githubTokenSecret: config.name,
 			maxRunners: config.maxRunners,
 			owner: config.owner,
-			repo: config.repo,
 			runnerSecrets: [],
 		},
 	} as ScaledActionRunner;
+	if (isOrganization(config)) {
+		runner.spec.organization = config.runnerGroup ? { runnerGroup: config.runnerGroup } : {};
+	} else {
+		runner.spec.repo = config.repo;
+	}
 	for (let i = 0; i < config.maxRunners; i++) {
 		runner.spec.runnerSecrets.push(`${config.name}-${i}`);
 	}
+	const apiUrl = getApiUrl(config);
+	if (apiUrl) {
+		runner.spec.github = { baseUrl: apiUrl };
+	}
 	if (config.labels) {
 		runner.spec.runner = { labels: config.labels };
 		runner.spec.selector = config.labels
@@ -80,11 +88,19 @@ type ScaledActionRunnerSpec = {
 	githubTokenSecret: string;
 	maxRunners: number;
 	owner: string;
-	repo: string;
+	repo?: string;
+	organization?: Organization;
 	runner?: Runner;
 	runnerSecrets: string[];
+	github?: GithubConnection;
 	selector?: string;
 };
+type Organization = {
+	runnerGroup?: string;
+};
+type GithubConnection = {
+	baseUrl: string;
+};
 type Secret = {
 	apiVersion: string;
 	kind: string;
@@ -23,10 +23,12 @@ export default class Runner {
 		await this.docker.pull(this.image);
 	}
 	async addRunner(
+		serverUrl: string,
 		owner: string,
-		repo: string,
+		repo: string | undefined,
 		runnerName: string,
-		labels?: string
+		labels?: string,
+		runnerGroup?: string
 	): Promise<RunnerCreds> {
 		const output = tmp.dirSync({ unsafeCleanup: true });
 		const overwriteOutputUid = process.platform === "linux" ? process.getuid() : 0;
@@ -36,12 +38,14 @@ export default class Runner {
 				"/config_output": {},
 			},
 			Env: [
-				`REPO_URL=https://github.com/${owner}/${repo}`,
+				`REPO_URL=${serverUrl}/${repo ? `${owner}/${repo}` : owner}`,
 				`RUNNER_NAME=${runnerName}`,
 				`RUNNER_TOKEN=${this.runnerToken}`,
 				"RETURN_CONFIG=1",
 				`OVERWRITE_OUTPUT_UID=${overwriteOutputUid || ""}`,
-			].concat(labels ? [`LABELS=${labels}`] : []),
+			]
+				.concat(labels ? [`LABELS=${labels}`] : [])
+				.concat(runnerGroup ? [`RUNNER_GROUP=${runnerGroup}`] : []),
 			Hostconfig: {
 				Binds: ["/var/run/docker.sock:/var/run/docker.sock", `${output.name}:/config_output`],
 			},
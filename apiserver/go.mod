@@ -3,16 +3,20 @@ module github.com/devjoes/github-runner-autoscaler/apiserver
 go 1.15
 
 require (
+	github.com/alicebob/miniredis/v2 v2.16.0
 	github.com/devjoes/github-runner-autoscaler/operator v0.0.0-20210328184102-78147cd553f6
-	github.com/golang/protobuf v1.5.1 // indirect
+	github.com/go-redis/redis/v8 v8.11.4
 	github.com/google/go-github/v33 v33.0.0
+	github.com/kedacore/keda/v2 v2.2.0
 	github.com/kubernetes-sigs/custom-metrics-apiserver v0.0.0-20210311094424-0ca2b1909cdc
 	github.com/memcachier/mc/v3 v3.0.3
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.10.0
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
 	golang.org/x/oauth2 v0.0.0-20210313182246-cd4f82c27b84
-	golang.org/x/sys v0.0.0-20210319071255-635bc2c9138d // indirect
+	google.golang.org/grpc v1.36.0
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 	k8s.io/api v0.20.5
 	k8s.io/apimachinery v0.20.5
 	k8s.io/apiserver v0.20.5
@@ -27,3 +31,5 @@ replace k8s.io/client-go => k8s.io/client-go v0.20.5
 replace google.golang.org/grpc => google.golang.org/grpc v1.26.0
 
 replace github.com/googleapis/gnostic => github.com/googleapis/gnostic v0.4.1
+
+replace github.com/devjoes/github-runner-autoscaler/operator => ../operator
@@ -19,12 +19,14 @@ type ClientMock struct {
 	RecordGetWorkQueueLength bool
 	RecordRefreshAccessToken bool
 	ErrorOnGetQueuedJobs     bool
+	ErrorOnGetRunners        bool
+	Runners                  []*github.Runner
 }
 
 func (c *ClientMock) GetRemainingCreditsForToken(ctx context.Context) (string, string, int, error) {
 	return "Qgw+4u9Aw0jqoYTfJwVFLsjW067wO4YwXLYCNw", "324****************************************j23", 123, nil
 }
-func (c *ClientMock) GetQueuedJobs(ctx context.Context) ([]*github.WorkflowRun, error) {
+func (c *ClientMock) GetQueuedJobs(ctx context.Context) ([]*utils.WorkflowJob, error) {
 	if c.ErrorOnGetQueuedJobs {
 		return nil, fmt.Errorf("%s Bang", c.GetState("foo").Name)
 	}
@@ -34,6 +36,15 @@ func (c *ClientMock) GetQueuedJobs(ctx context.Context) ([]*github.WorkflowRun,
 	}
 	return FakeQueueData(c.QueueLength), nil
 }
+func (c *ClientMock) GetWorkflowIDForRun(ctx context.Context, repository string, runID int64) (int64, error) {
+	return 123, nil
+}
+func (c *ClientMock) GetRunners(ctx context.Context) ([]*github.Runner, error) {
+	if c.ErrorOnGetRunners {
+		return nil, fmt.Errorf("Bang")
+	}
+	return c.Runners, nil
+}
 func (c *ClientMock) GetState(name string) *state.ClientState { return &c.State }
 func (c *ClientMock) SaveState(state *state.ClientState)      {}
 func (c *ClientMock) GetWorkflowData(ctx context.Context) (*map[int64]utils.WorkflowInfo, error) {
@@ -43,12 +54,12 @@ func (c *ClientMock) GetWorkflowData(ctx context.Context) (*map[int64]utils.Work
 const WfIdLabel = "wf_id"
 const JobStatusLabel = "job_status"
 
-func FakeQueueData(size int) []*github.WorkflowRun {
+func FakeQueueData(size int) []*utils.WorkflowJob {
 	queued := "queued"
 	wfId := int64(123)
-	data := make([]*github.WorkflowRun, size)
+	data := make([]*utils.WorkflowJob, size)
 	for i := 0; i < size; i++ {
-		data[int64(i)] = &github.WorkflowRun{Status: &queued, WorkflowID: &wfId}
+		data[int64(i)] = &utils.WorkflowJob{WorkflowJob: &github.WorkflowJob{Status: &queued}, WorkflowID: &wfId}
 	}
 	return data
 }
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 
+	"github.com/kedacore/keda/v2/pkg/scalers/externalscaler"
 	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/apiserver"
 	basecmd "github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/cmd"
 	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
 	generatedopenapi "github.com/kubernetes-sigs/custom-metrics-apiserver/test-adapter/generated/openapi"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"k8s.io/apimachinery/pkg/util/wait"
 	openapinamer "k8s.io/apiserver/pkg/endpoints/openapi"
 	genericapiserver "k8s.io/apiserver/pkg/server"
@@ -20,6 +27,9 @@ import (
 	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/health"
 	host "github.com/devjoes/github-runner-autoscaler/apiserver/pkg/host"
 	k8sProvider "github.com/devjoes/github-runner-autoscaler/apiserver/pkg/k8sprovider"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/simulator"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/webhook"
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
 )
 
 type WorkflowMetricsAdapter struct {
@@ -30,6 +40,13 @@ type WorkflowMetricsAdapter struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		if err := simulator.Run(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	logs.InitLogs()
 	defer logs.FlushLogs()
 
@@ -54,11 +71,27 @@ func main() {
 		klog.Fatal(err)
 	}
 
-	go cmd.initHandlers(conf)
+	go cmd.initHandlers(conf, h)
+	if conf.WebhookPort > 0 {
+		go cmd.initWebhook(conf, h)
+	}
+	if conf.ExternalScalerPort > 0 {
+		go cmd.initExternalScaler(conf, h)
+	}
+	if conf.RefreshInterval > 0 {
+		go h.RunRefresher(context.Background(), conf.RefreshInterval)
+	}
 	testProvider := cmd.makeK8sProvider(h)
 	cmd.Authorization.WithAlwaysAllowGroups("system:unauthenticated")
 	//TODO: Auth - currently this is required for keda. Could remove above and use cmd.Authentication.ClientCert.ClientCA  or   - '--client-ca-file=/apiserver.local.config/certificates/ca'
-	cmd.WithCustomMetrics(testProvider)
+	for _, api := range conf.MetricsApis {
+		switch api {
+		case runnerv1alpha1.MetricsApiCustom:
+			cmd.WithCustomMetrics(testProvider)
+		case runnerv1alpha1.MetricsApiExternal:
+			cmd.WithExternalMetrics(testProvider)
+		}
+	}
 
 	klog.Infof(cmd.Message)
 	if err := cmd.Run(wait.NeverStop); err != nil {
@@ -66,14 +99,45 @@ func main() {
 	}
 }
 
-func (a *WorkflowMetricsAdapter) makeK8sProvider(orchestrator *host.Host) provider.CustomMetricsProvider {
+func (a *WorkflowMetricsAdapter) makeK8sProvider(orchestrator *host.Host) provider.MetricsProvider {
 	return k8sProvider.NewProvider(orchestrator)
 }
 
-func (a *WorkflowMetricsAdapter) initHandlers(conf config.Config) {
-	h := health.NewHealth(conf)
+func (a *WorkflowMetricsAdapter) initHandlers(conf config.Config, orchestrator *host.Host) {
+	h := health.NewHealth(conf, orchestrator)
 	http.HandleFunc("/readyz", h.Readyz())
 	http.HandleFunc("/livez", h.Livez())
 	http.Handle("/metrics", promhttp.Handler())
 	http.ListenAndServe(":2112", nil)
 }
+
+func (a *WorkflowMetricsAdapter) initWebhook(conf config.Config, h *host.Host) {
+	wh := webhook.NewWebhook(conf.WebhookSecret, h)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook", wh.Handler())
+	certKey := a.SecureServing.ServerCert.CertKey
+	klog.Infof("Receiving webhooks on :%d/webhook", conf.WebhookPort)
+	err := http.ListenAndServeTLS(fmt.Sprintf(":%d", conf.WebhookPort), certKey.CertFile, certKey.KeyFile, mux)
+	klog.Errorf("Webhook server stopped: %v", err)
+}
+
+func (a *WorkflowMetricsAdapter) initExternalScaler(conf config.Config, h *host.Host) {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", conf.ExternalScalerPort))
+	if err != nil {
+		klog.Errorf("External scaler could not listen on :%d: %v", conf.ExternalScalerPort, err)
+		return
+	}
+	// KEDA verifies the API server's serving certificate with the caCert of the ClusterTriggerAuthentication
+	certKey := a.SecureServing.ServerCert.CertKey
+	cert, err := tls.LoadX509KeyPair(certKey.CertFile, certKey.KeyFile)
+	if err != nil {
+		lis.Close()
+		klog.Errorf("External scaler could not load the serving certificate: %v", err)
+		return
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	externalscaler.RegisterExternalScalerServer(server, k8sProvider.NewExternalScaler(h, conf.ExternalScalerInterval))
+	klog.Infof("Serving KEDA external scaler on :%d", conf.ExternalScalerPort)
+	err = server.Serve(lis)
+	klog.Errorf("External scaler stopped: %v", err)
+}
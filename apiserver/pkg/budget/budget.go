@@ -0,0 +1,170 @@
+// Package budget shares out the runners, CPU and memory allowed by the budget in ScaledActionRunnerCore between the
+// ScaledActionRunners that want them.
+package budget
+
+import (
+	"fmt"
+	"sort"
+
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+)
+
+const (
+	ScopeCluster   = "cluster"
+	ScopeNamespace = "namespace"
+)
+
+// Claim is how many runners a ScaledActionRunner wants and what each of them requests
+type Claim struct {
+	Name      string
+	Namespace string
+	Priority  int32
+	// Min runners are always running so they are never throttled, but they do use up the budget
+	Min    int32
+	Wanted int32
+	// MilliCpu and Memory (in bytes) are requested by each runner
+	MilliCpu int64
+	Memory   int64
+}
+
+// Key identifies the claim in the allocations
+func (c Claim) Key() string {
+	return fmt.Sprintf("%s/%s", c.Namespace, c.Name)
+}
+
+// Allocation is how many runners a claim was given
+type Allocation struct {
+	Runners int32
+	// Throttled is how many of the runners that were wanted weren't given
+	Throttled int32
+	// ThrottledBy is the scope of the budget that ran out, cluster or namespace
+	ThrottledBy string
+}
+
+type limits struct {
+	runners  int64
+	milliCpu int64
+	memory   int64
+}
+
+func newLimits(l *runnerv1alpha1.BudgetLimits) *limits {
+	if l == nil {
+		return nil
+	}
+	// -1 is unlimited
+	result := limits{runners: -1, milliCpu: -1, memory: -1}
+	if l.MaxRunners != nil {
+		result.runners = int64(*l.MaxRunners)
+	}
+	if l.Cpu != nil {
+		result.milliCpu = l.Cpu.MilliValue()
+	}
+	if l.Memory != nil {
+		result.memory = l.Memory.Value()
+	}
+	return &result
+}
+
+type usage struct {
+	runners  int64
+	milliCpu int64
+	memory   int64
+}
+
+func (u *usage) add(c Claim, runners int32) {
+	u.runners += int64(runners)
+	u.milliCpu += int64(runners) * c.MilliCpu
+	u.memory += int64(runners) * c.Memory
+}
+
+func (u *usage) fits(l *limits, c Claim) bool {
+	if l == nil {
+		return true
+	}
+	return (l.runners < 0 || u.runners+1 <= l.runners) &&
+		(l.milliCpu < 0 || u.milliCpu+c.MilliCpu <= l.milliCpu) &&
+		(l.memory < 0 || u.memory+c.Memory <= l.memory)
+}
+
+// Allocate gives every claim its min runners and then shares out what is left of the budget. Higher priorities are
+// given as many runners as they want, or as the budget allows, before lower priorities get any. Claims with the same
+// priority are given one runner at a time in turn so that they get a fair share. Allocations are keyed by Claim.Key.
+func Allocate(b *runnerv1alpha1.RunnerBudget, claims []Claim) map[string]Allocation {
+	allocations := map[string]Allocation{}
+	if b == nil {
+		for _, c := range claims {
+			allocations[c.Key()] = Allocation{Runners: max(c.Min, c.Wanted)}
+		}
+		return allocations
+	}
+
+	cluster := newLimits(b.Cluster)
+	namespaces := map[string]*limits{}
+	for ns, l := range b.Namespaces {
+		l := l
+		namespaces[ns] = newLimits(&l)
+	}
+	clusterUsage := usage{}
+	nsUsage := map[string]*usage{}
+	given := map[string]int32{}
+	for _, c := range claims {
+		if nsUsage[c.Namespace] == nil {
+			nsUsage[c.Namespace] = &usage{}
+		}
+		given[c.Key()] = c.Min
+		clusterUsage.add(c, c.Min)
+		nsUsage[c.Namespace].add(c, c.Min)
+	}
+
+	sorted := append([]Claim{}, claims...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Priority != sorted[j].Priority {
+			return sorted[i].Priority > sorted[j].Priority
+		}
+		return sorted[i].Key() < sorted[j].Key()
+	})
+	throttledBy := map[string]string{}
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+		for progress := true; progress; {
+			progress = false
+			for _, c := range sorted[start:end] {
+				if given[c.Key()] >= c.Wanted || throttledBy[c.Key()] != "" {
+					continue
+				}
+				switch {
+				case !clusterUsage.fits(cluster, c):
+					throttledBy[c.Key()] = ScopeCluster
+				case !nsUsage[c.Namespace].fits(namespaces[c.Namespace], c):
+					throttledBy[c.Key()] = ScopeNamespace
+				default:
+					given[c.Key()]++
+					clusterUsage.add(c, 1)
+					nsUsage[c.Namespace].add(c, 1)
+					progress = true
+				}
+			}
+		}
+		start = end
+	}
+
+	for _, c := range claims {
+		a := Allocation{Runners: given[c.Key()]}
+		if c.Wanted > a.Runners {
+			a.Throttled = c.Wanted - a.Runners
+			a.ThrottledBy = throttledBy[c.Key()]
+		}
+		allocations[c.Key()] = a
+	}
+	return allocations
+}
+
+func max(a int32, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,60 @@
+package budget
+
+import (
+	"testing"
+
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func TestSharesClusterBudgetFairly(t *testing.T) {
+	b := runnerv1alpha1.RunnerBudget{Cluster: &runnerv1alpha1.BudgetLimits{MaxRunners: int32Ptr(10)}}
+	claims := []Claim{
+		{Name: "a", Namespace: "ns", Wanted: 10},
+		{Name: "b", Namespace: "ns", Min: 1, Wanted: 3},
+		{Name: "c", Namespace: "ns", Wanted: 10},
+	}
+	allocations := Allocate(&b, claims)
+	assert.Equal(t, Allocation{Runners: 4, Throttled: 6, ThrottledBy: ScopeCluster}, allocations["ns/a"])
+	assert.Equal(t, Allocation{Runners: 3}, allocations["ns/b"])
+	assert.Equal(t, Allocation{Runners: 3, Throttled: 7, ThrottledBy: ScopeCluster}, allocations["ns/c"])
+}
+
+func TestHigherPrioritiesGoFirst(t *testing.T) {
+	b := runnerv1alpha1.RunnerBudget{Cluster: &runnerv1alpha1.BudgetLimits{MaxRunners: int32Ptr(10)}}
+	claims := []Claim{
+		{Name: "low", Namespace: "ns", Wanted: 10},
+		{Name: "high", Namespace: "ns", Priority: 10, Wanted: 8},
+	}
+	allocations := Allocate(&b, claims)
+	assert.Equal(t, int32(8), allocations["ns/high"].Runners)
+	assert.Equal(t, int32(2), allocations["ns/low"].Runners)
+	assert.Equal(t, int32(8), allocations["ns/low"].Throttled)
+}
+
+func TestEnforcesNamespaceCpuAndMemory(t *testing.T) {
+	cpu, memory := resource.MustParse("1"), resource.MustParse("1Gi")
+	b := runnerv1alpha1.RunnerBudget{Namespaces: map[string]runnerv1alpha1.BudgetLimits{
+		"small": {Cpu: &cpu},
+		"tiny":  {Memory: &memory},
+	}}
+	claims := []Claim{
+		{Name: "a", Namespace: "small", Wanted: 10, MilliCpu: 200, Memory: 200 * 1024 * 1024},
+		{Name: "b", Namespace: "tiny", Wanted: 10, MilliCpu: 200, Memory: 300 * 1024 * 1024},
+		{Name: "c", Namespace: "other", Wanted: 10, MilliCpu: 200, Memory: 200 * 1024 * 1024},
+	}
+	allocations := Allocate(&b, claims)
+	assert.Equal(t, Allocation{Runners: 5, Throttled: 5, ThrottledBy: ScopeNamespace}, allocations["small/a"])
+	assert.Equal(t, Allocation{Runners: 3, Throttled: 7, ThrottledBy: ScopeNamespace}, allocations["tiny/b"])
+	assert.Equal(t, Allocation{Runners: 10}, allocations["other/c"])
+}
+
+func TestNoBudgetGivesEverythingWanted(t *testing.T) {
+	allocations := Allocate(nil, []Claim{{Name: "a", Namespace: "ns", Min: 2, Wanted: 1}})
+	assert.Equal(t, Allocation{Runners: 2}, allocations["ns/a"])
+}
@@ -3,14 +3,19 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"flag"
 
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/gitclient"
 	runnerClient "github.com/devjoes/github-runner-autoscaler/apiserver/pkg/runnerclient"
 	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/scaling"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/state"
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	cache "k8s.io/client-go/tools/cache"
@@ -27,39 +32,122 @@ type Config struct {
 	MemcachedUser        string        `json:"memcachedUser"`
 	MemcachedPass        string        `json:"memcachedPass"`
 	GithubPatNamespace   string        `json:"githubPatNamespace"`
+	// Github is the default connection for runners which do not specify their own
+	Github runnerv1alpha1.GithubConnection `json:"github"`
+	// Redis is used instead of memcached when it has any addresses
+	Redis state.RedisOptions `json:"redis"`
+
+	WebhookPort            int           `json:"webhookPort"`
+	WebhookSecret          string        `json:"-"`
+	WebhookReconcileWindow time.Duration `json:"webhookReconcileWindow"`
+
+	ExternalScalerPort     int           `json:"externalScalerPort"`
+	ExternalScalerInterval time.Duration `json:"externalScalerInterval"`
+
+	// RefreshInterval is how often the background refresher looks for expired workflows, metrics requests query Github
+	// themselves when it is 0
+	RefreshInterval time.Duration `json:"refreshInterval"`
 
 	AllNs           bool     `json:"allNs"`
 	InClusterConfig bool     `json:"inClusterConfig"`
 	Kubeconfig      string   `json:"kubeconfig"`
 	RunnerNSs       []string `json:"runnerNSs"`
+	// Budget caps the runners of every workflow, it is nil when there is no budget
+	Budget *runnerv1alpha1.RunnerBudget `json:"budget,omitempty"`
+	// MetricsApis are the metrics APIs to serve, custom and/or external
+	MetricsApis []string `json:"metricsApis"`
 
-	flagMemcachedServers     *string
-	flagMemcachedUser        *string
-	flagMemcachedPass        *string
-	flagCacheWindow          *string
-	flagCacheWindowWhenEmpty *string
-	flagResyncIntervalStr    *string
-	flagKubeconfig           *string
-	flagGithubPatNamespace   *string
-	flagRunnerNSs            *ArrayFlags
-	flagAllNs                *bool
-	flagInClusterConfig      *bool
+	flagMemcachedServers       *string
+	flagMemcachedUser          *string
+	flagMemcachedPass          *string
+	flagRedisAddrs             *string
+	flagRedisMode              *string
+	flagRedisMasterName        *string
+	flagRedisUser              *string
+	flagRedisPass              *string
+	flagRedisTLS               *bool
+	flagRedisCaFile            *string
+	flagRedisSentinelUser      *string
+	flagRedisSentinelPass      *string
+	flagRedisSentinelTLS       *bool
+	flagRedisSentinelCaFile    *string
+	flagCacheWindow            *string
+	flagCacheWindowWhenEmpty   *string
+	flagResyncIntervalStr      *string
+	flagKubeconfig             *string
+	flagGithubPatNamespace     *string
+	flagGithubBaseUrl          *string
+	flagGithubUploadUrl        *string
+	flagGithubProxy            *string
+	flagGithubNoProxy          *string
+	flagWebhookPort            *int
+	flagWebhookReconcile       *string
+	flagExternalScalerPort     *int
+	flagExternalScalerInterval *string
+	flagRefreshInterval        *string
+	flagBudget                 *string
+	flagMetricsApis            *string
+	flagRunnerNSs              *ArrayFlags
+	flagAllNs                  *bool
+	flagInClusterConfig        *bool
 
-	store cache.Store
+	store        cache.Store
+	runnerClient runnerClient.IRunnersV1Alpha1Client
 }
 
 type GithubWorkflowConfig struct {
-	Name       string          `json:"name"`
-	Namespace  string          `json:"namespace"`
-	Token      string          `json:"token"`
-	Owner      string          `json:"owner"`
-	Repository string          `json:"repository"`
-	Scaling    scaling.Scaling `json:"scaling"`
+	Name         string                           `json:"name"`
+	Namespace    string                           `json:"namespace"`
+	Tokens       []string                         `json:"tokens"`
+	GithubApp    *gitclient.GithubAppCredentials  `json:"githubApp,omitempty"`
+	Github       *runnerv1alpha1.GithubConnection `json:"github,omitempty"`
+	Owner        string                           `json:"owner"`
+	Repository   string                           `json:"repository"`
+	Organization *runnerv1alpha1.Organization     `json:"organization,omitempty"`
+	Scaling      scaling.Scaling                  `json:"scaling"`
+	// Jobs which have been queued or in progress for longer than these are assumed to be stuck and aren't counted
+	MaxPendingAge    time.Duration `json:"maxPendingAge"`
+	MaxInProgressAge time.Duration `json:"maxInProgressAge"`
+	// RunnersLastSeen is when each ordinal was last online, as recorded in the ScaledActionRunner's status
+	RunnersLastSeen map[int]time.Time `json:"runnersLastSeen"`
+	// Priority decides who gets capacity first when the budget runs out
+	Priority int32 `json:"priority"`
+	// MilliCpu and Memory (in bytes) are requested by each runner, they count against the budget
+	MilliCpu int64 `json:"milliCpu"`
+	Memory   int64 `json:"memory"`
+	// Throttled is how many runners were held back by the budget, as recorded in the ScaledActionRunner's status
+	Throttled int32 `json:"throttled"`
+}
+
+// Key identifies the ScaledActionRunner that the workflow was loaded from, runners in different namespaces can have the
+// same name
+func (wf *GithubWorkflowConfig) Key() string {
+	return fmt.Sprintf("%s/%s", wf.Namespace, wf.Name)
+}
+
+// GitOwnerRepo identifies the repo, or for organizations the set of repos, that jobs are counted across
+func (wf *GithubWorkflowConfig) GitOwnerRepo() string {
+	if wf.Organization != nil {
+		// Each organization can filter its repos differently
+		return fmt.Sprintf("%s/*/%s/%s", wf.Owner, wf.Namespace, wf.Name)
+	}
+	return fmt.Sprintf("%s/%s", wf.Owner, wf.Repository)
+}
+
+// Matches returns true if jobs in the repo are counted by this workflow
+func (wf *GithubWorkflowConfig) Matches(owner string, repository string, topics []string) bool {
+	if !strings.EqualFold(wf.Owner, owner) {
+		return false
+	}
+	if wf.Organization != nil {
+		return wf.Organization.Includes(repository, topics)
+	}
+	return strings.EqualFold(wf.Repository, repository)
 }
 
 type IWorkflowSource interface {
 	GetAllWorkflows() []GithubWorkflowConfig
-	GetWorkflow(key string) (*GithubWorkflowConfig, error)
+	GetWorkflow(namespace string, name string) (*GithubWorkflowConfig, error)
 }
 
 func getClients(inCluster bool, kubeconfig string) (kubernetes.Interface, runnerClient.IRunnersV1Alpha1Client, error) {
@@ -118,7 +206,29 @@ func (c *Config) AddFlags() {
 	c.flagMemcachedServers = flag.String("memcached-servers", "", "Memcached servers to use. If unspecified a local in memory cache is used.")
 	c.flagMemcachedUser = flag.String("memcached-user", "", "Memcached user to use.")
 	c.flagMemcachedPass = flag.String("memcached-password", "", "Memcached password to use.")
+	c.flagRedisAddrs = flag.String("redis-addrs", "", "Comma separated list of Redis servers, sentinels or cluster nodes to use instead of memcached.")
+	c.flagRedisMode = flag.String("redis-mode", state.RedisStandalone, "How to connect to redis-addrs, standalone, sentinel or cluster.")
+	c.flagRedisMasterName = flag.String("redis-master-name", "", "Name of the master monitored by the sentinels in sentinel mode.")
+	c.flagRedisUser = flag.String("redis-user", "", "Redis ACL user to use.")
+	c.flagRedisPass = flag.String("redis-password", "", "Redis password to use, if unspecified it is read from REDIS_PASSWORD.")
+	c.flagRedisTLS = flag.Bool("redis-tls", false, "Connect to Redis with TLS.")
+	c.flagRedisCaFile = flag.String("redis-ca-file", "", "CA bundle to verify Redis' certificate with, if unspecified the system's CAs are used.")
+	c.flagRedisSentinelUser = flag.String("redis-sentinel-user", "", "ACL user to authenticate with the sentinels as in sentinel mode.")
+	c.flagRedisSentinelPass = flag.String("redis-sentinel-password", "", "Password of the sentinels in sentinel mode, if unspecified it is read from REDIS_SENTINEL_PASSWORD.")
+	c.flagRedisSentinelTLS = flag.Bool("redis-sentinel-tls", false, "Connect to the sentinels with TLS in sentinel mode.")
+	c.flagRedisSentinelCaFile = flag.String("redis-sentinel-ca-file", "", "CA bundle to verify the sentinels' certificates with, if unspecified the system's CAs are used.")
 	c.flagGithubPatNamespace = flag.String("github-pat-namespace", "", "Namespace to find GithubTokenSecret, if unspecified then the namespace of the runner is used instead.")
+	c.flagGithubBaseUrl = flag.String("github-base-url", "", "Base URL of the Github API e.g. https://github.example.com/api/v3/. If unspecified then github.com is used.")
+	c.flagGithubUploadUrl = flag.String("github-upload-url", "", "Upload URL of the Github API, defaults to github-base-url.")
+	c.flagGithubProxy = flag.String("github-proxy", "", "HTTP(S) proxy to use when connecting to Github.")
+	c.flagGithubNoProxy = flag.String("github-no-proxy", "", "Comma separated list of hosts that should not use github-proxy.")
+	c.flagWebhookPort = flag.Int("webhook-port", 0, "Port to receive Github workflow_job and workflow_run webhooks on. The secret is read from GITHUB_WEBHOOK_SECRET. If unspecified then webhooks are disabled.")
+	c.flagWebhookReconcile = flag.String("webhook-reconcile-window", "10m", "How often to poll Github for jobs whilst webhooks are being received")
+	c.flagExternalScalerPort = flag.Int("external-scaler-port", 0, "Port to serve KEDA's external scaler gRPC API on, over TLS with the serving certificate. If unspecified then the external scaler is disabled.")
+	c.flagExternalScalerInterval = flag.String("external-scaler-interval", "5s", "How often StreamIsActive checks whether a workflow is active, webhooks are pushed straight away")
+	c.flagRefreshInterval = flag.String("refresh-interval", "10s", "How often to look for workflows whose cache has expired and refresh them in the background, metrics are then always served from the cache. 0 disables this and Github is queried when metrics are requested.")
+	c.flagMetricsApis = flag.String("metrics-apis", runnerv1alpha1.MetricsApiCustom, "Comma separated list of the metrics APIs to serve, custom (custom.metrics.k8s.io) and/or external (external.metrics.k8s.io).")
+	c.flagBudget = flag.String("budget", "", "JSON encoded budget from ScaledActionRunnerCore capping the runners, CPU and memory across the cluster and in each namespace.")
 }
 
 func validateArgs(runnerNSs []string, allNs bool) error {
@@ -131,6 +241,26 @@ func validateArgs(runnerNSs []string, allNs bool) error {
 	return nil
 }
 
+// parseList splits a comma separated list, ignoring blank items
+func parseList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseMetricsApis splits a comma separated list of metrics APIs, custom is served if none are given
+func parseMetricsApis(value string) []string {
+	apis := parseList(value)
+	if len(apis) == 0 {
+		apis = append(apis, runnerv1alpha1.MetricsApiCustom)
+	}
+	return apis
+}
+
 func parseDuration(flag *string, value time.Duration) time.Duration {
 	if flag == nil {
 		return value
@@ -144,6 +274,13 @@ func parseDuration(flag *string, value time.Duration) time.Duration {
 	}
 	return parsed
 }
+func stringFlag(flag *string) string {
+	if flag == nil {
+		return ""
+	}
+	return *flag
+}
+
 func (c *Config) SetupConfig(params ...interface{}) error {
 	c.RunnerNSs = make([]string, 0)
 	if c.flagRunnerNSs != nil && len((*c.flagRunnerNSs).String()) > 0 {
@@ -152,6 +289,30 @@ func (c *Config) SetupConfig(params ...interface{}) error {
 	c.MemcachedServers = *c.flagMemcachedServers
 	c.MemcachedUser = *c.flagMemcachedUser
 	c.MemcachedPass = *c.flagMemcachedPass
+	c.Redis = state.RedisOptions{
+		Addrs:            parseList(stringFlag(c.flagRedisAddrs)),
+		Mode:             stringFlag(c.flagRedisMode),
+		MasterName:       stringFlag(c.flagRedisMasterName),
+		Username:         stringFlag(c.flagRedisUser),
+		Password:         stringFlag(c.flagRedisPass),
+		TLS:              c.flagRedisTLS != nil && *c.flagRedisTLS,
+		CaFile:           stringFlag(c.flagRedisCaFile),
+		SentinelUsername: stringFlag(c.flagRedisSentinelUser),
+		SentinelPassword: stringFlag(c.flagRedisSentinelPass),
+		SentinelTLS:      c.flagRedisSentinelTLS != nil && *c.flagRedisSentinelTLS,
+		SentinelCaFile:   stringFlag(c.flagRedisSentinelCaFile),
+	}
+	if c.Redis.Mode == "" {
+		c.Redis.Mode = state.RedisStandalone
+	}
+	if len(c.Redis.Addrs) > 0 {
+		if c.MemcachedServers != "" {
+			return errors.New("Can't specify --memcached-servers and --redis-addrs")
+		}
+		if err := c.Redis.Validate(); err != nil {
+			return fmt.Errorf("Invalid redis options. %s", err.Error())
+		}
+	}
 	c.ResyncInterval = parseDuration(c.flagResyncIntervalStr, c.ResyncInterval)
 	c.CacheWindow = parseDuration(c.flagCacheWindow, c.CacheWindow)
 	c.CacheWindowWhenEmpty = parseDuration(c.flagCacheWindowWhenEmpty, c.CacheWindowWhenEmpty)
@@ -163,6 +324,45 @@ func (c *Config) SetupConfig(params ...interface{}) error {
 		c.GithubPatNamespace = *c.flagGithubPatNamespace
 	}
 	c.RunnerNSs = *c.flagRunnerNSs
+	if c.flagWebhookPort != nil {
+		c.WebhookPort = *c.flagWebhookPort
+	}
+	c.WebhookSecret = os.Getenv("GITHUB_WEBHOOK_SECRET")
+	c.WebhookReconcileWindow = parseDuration(c.flagWebhookReconcile, c.WebhookReconcileWindow)
+	if c.WebhookPort > 0 && c.WebhookSecret == "" {
+		return errors.New("GITHUB_WEBHOOK_SECRET must be set when --webhook-port is specified")
+	}
+	if c.flagExternalScalerPort != nil {
+		c.ExternalScalerPort = *c.flagExternalScalerPort
+	}
+	c.ExternalScalerInterval = parseDuration(c.flagExternalScalerInterval, 5*time.Second)
+	if c.ExternalScalerInterval <= 0 {
+		return fmt.Errorf("--external-scaler-interval must be positive, not %s", c.ExternalScalerInterval)
+	}
+	c.RefreshInterval = parseDuration(c.flagRefreshInterval, c.RefreshInterval)
+	c.Github = runnerv1alpha1.GithubConnection{
+		BaseUrl:   stringFlag(c.flagGithubBaseUrl),
+		UploadUrl: stringFlag(c.flagGithubUploadUrl),
+		Proxy:     stringFlag(c.flagGithubProxy),
+		NoProxy:   stringFlag(c.flagGithubNoProxy),
+		// Certificates are too unwieldy to pass as an argument
+		CaBundle: os.Getenv("GITHUB_CA_BUNDLE"),
+	}
+
+	if budget := stringFlag(c.flagBudget); budget != "" {
+		c.Budget = &runnerv1alpha1.RunnerBudget{}
+		if err := json.Unmarshal([]byte(budget), c.Budget); err != nil {
+			return fmt.Errorf("Could not parse --budget. %s", err.Error())
+		}
+		if err := c.Budget.Validate(); err != nil {
+			return fmt.Errorf("Invalid budget. %s", err.Error())
+		}
+	}
+
+	c.MetricsApis = parseMetricsApis(stringFlag(c.flagMetricsApis))
+	if err := runnerv1alpha1.ValidateMetricsApis(c.MetricsApis); err != nil {
+		return fmt.Errorf("Invalid --metrics-apis. %s", err.Error())
+	}
 
 	if err := validateArgs(c.RunnerNSs, c.AllNs); err != nil {
 		return err
@@ -2,6 +2,11 @@ package config
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
 	"testing"
 	"time"
 
@@ -9,6 +14,7 @@ import (
 	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes/fake"
@@ -16,7 +22,9 @@ import (
 
 func createConfig(runnerNSsStr string, allNs bool, kubeconfig string, inCluster bool, resyncInterval time.Duration, params ...interface{}) (Config, error) {
 	flagRunnerNSs := &ArrayFlags{}
-	flagRunnerNSs.Set(runnerNSsStr)
+	for _, ns := range strings.Split(runnerNSsStr, ",") {
+		flagRunnerNSs.Set(ns)
+	}
 	rs := resyncInterval.String()
 	empty := ""
 	config := Config{
@@ -45,6 +53,37 @@ func TestErrorsOnInvalidArgs(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestParsesMetricsApis(t *testing.T) {
+	newConfig := func(apis string) Config {
+		allNs, empty := true, ""
+		return Config{flagRunnerNSs: &ArrayFlags{}, flagAllNs: &allNs, flagKubeconfig: &empty, flagInClusterConfig: new(bool),
+			flagMemcachedServers: &empty, flagMemcachedUser: &empty, flagMemcachedPass: &empty, flagMetricsApis: &apis}
+	}
+	c := newConfig("")
+	assert.Nil(t, c.SetupConfig())
+	assert.Equal(t, []string{runnerv1alpha1.MetricsApiCustom}, c.MetricsApis)
+	c = newConfig("external, custom")
+	assert.Nil(t, c.SetupConfig())
+	assert.Equal(t, []string{runnerv1alpha1.MetricsApiExternal, runnerv1alpha1.MetricsApiCustom}, c.MetricsApis)
+	c = newConfig("prometheus")
+	assert.NotNil(t, c.SetupConfig())
+}
+
+func TestRejectsNonPositiveExternalScalerInterval(t *testing.T) {
+	newConfig := func(interval string) Config {
+		allNs, empty := true, ""
+		return Config{flagRunnerNSs: &ArrayFlags{}, flagAllNs: &allNs, flagKubeconfig: &empty, flagInClusterConfig: new(bool),
+			flagMemcachedServers: &empty, flagMemcachedUser: &empty, flagMemcachedPass: &empty, flagExternalScalerInterval: &interval}
+	}
+	c := newConfig("2s")
+	assert.Nil(t, c.SetupConfig())
+	assert.Equal(t, 2*time.Second, c.ExternalScalerInterval)
+	c = newConfig("0s")
+	assert.NotNil(t, c.SetupConfig())
+	c = newConfig("-1s")
+	assert.NotNil(t, c.SetupConfig())
+}
+
 const (
 	namespace    = "wfNamespace"
 	name         = "wfName"
@@ -88,13 +127,32 @@ func setup() {
 		[]runnerv1alpha1.ScaledActionRunner{runner})
 }
 
+func TestGetsWorkflowsWithTheSameNameInEachNamespace(t *testing.T) {
+	setup()
+	other := runner.DeepCopy()
+	other.Namespace = foo
+	other.Spec.Repo = "otherRepo"
+	otherSecret := secret.DeepCopy()
+	otherSecret.Namespace = foo
+	runnerClient, _ := runnerclient.NewFakeRunnersV1Alpha1Client([]runnerv1alpha1.ScaledActionRunner{runner, *other})
+	config, err := createConfig(namespace+","+foo, false, "", false, time.Hour, fake.NewSimpleClientset(&secret, otherSecret), runnerClient)
+	assert.Nil(t, err)
+	assert.Len(t, config.GetAllWorkflows(), 2)
+	wf, _ := config.GetWorkflow(namespace, name)
+	assert.Equal(t, wfRepo, wf.Repository)
+	wf, _ = config.GetWorkflow(foo, name)
+	assert.Equal(t, "otherRepo", wf.Repository)
+	wf, _ = config.GetWorkflow("missing", name)
+	assert.Nil(t, wf)
+}
+
 func TestLoadsWorkflowFromRunners(t *testing.T) {
 	setup()
 	config, err := createConfig(namespace, false, "", false, time.Hour, fakeclient, fakeRunnerClient)
 	assert.Nil(t, err)
 	wfs := config.GetAllWorkflows()
 	assert.Len(t, wfs, 1)
-	assert.Equal(t, wfToken, wfs[0].Token)
+	assert.Equal(t, []string{wfToken}, wfs[0].Tokens)
 	assert.Equal(t, wfOwner, wfs[0].Owner)
 	assert.Equal(t, wfRepo, wfs[0].Repository)
 }
@@ -103,13 +161,12 @@ func TestGetsWorkflowByName(t *testing.T) {
 	setup()
 	config, err := createConfig(namespace, false, "", false, time.Hour, fakeclient, fakeRunnerClient)
 	assert.Nil(t, err)
-	key := name
-	wf, err := config.GetWorkflow(key)
+	wf, err := config.GetWorkflow(namespace, name)
 	assert.Nil(t, err)
 	assert.NotNil(t, wf)
 	assert.Equal(t, name, wf.Name)
 	assert.Equal(t, namespace, wf.Namespace)
-	assert.Equal(t, wfToken, wf.Token)
+	assert.Equal(t, []string{wfToken}, wf.Tokens)
 	assert.Equal(t, wfOwner, wf.Owner)
 	assert.Equal(t, wfRepo, wf.Repository)
 }
@@ -124,11 +181,11 @@ func TestReSyncsWorkflowFromRunners(t *testing.T) {
 	secret.Data["token"] = []byte(foo)
 	fakeclient.CoreV1().Secrets(secret.Namespace).Update(context.TODO(), &secret, metav1.UpdateOptions{})
 	assert.NotEqual(t, foo, wfs[0].Name)
-	assert.NotEqual(t, foo, wfs[0].Token)
+	assert.NotEqual(t, []string{foo}, wfs[0].Tokens)
 	time.Sleep(time.Millisecond * 1200)
 	wfs = config.GetAllWorkflows()
 	assert.Equal(t, foo, wfs[0].Name)
-	assert.Equal(t, foo, wfs[0].Token)
+	assert.Equal(t, []string{foo}, wfs[0].Tokens)
 }
 
 func TestWatcherUpdatesWorkflowOnChange(t *testing.T) {
@@ -153,3 +210,136 @@ func TestWatcherUpdatesWorkflowOnChange(t *testing.T) {
 	time.Sleep(time.Second)
 	assert.Equal(t, wfOwner, config.GetAllWorkflows()[0].Owner)
 }
+
+func TestLoadsGithubAppCredentialsFromRunners(t *testing.T) {
+	setup()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	appSecret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "wfAppSecretName",
+			Namespace: namespace,
+		},
+		Data: map[string][]byte{
+			runnerv1alpha1.GithubAppIdKey:             []byte("123"),
+			runnerv1alpha1.GithubAppInstallationIdKey: []byte("456\n"),
+			runnerv1alpha1.GithubAppPrivateKeyKey:     keyPem,
+		},
+	}
+	fakeclient = fake.NewSimpleClientset(&appSecret)
+	appRunner := runner.DeepCopy()
+	appRunner.Spec.GithubTokenSecret = ""
+	appRunner.Spec.GithubAppSecret = appSecret.Name
+	fakeRunnerClient, fakeRunnerClientWatch = runnerclient.NewFakeRunnersV1Alpha1Client(
+		[]runnerv1alpha1.ScaledActionRunner{*appRunner})
+
+	config, err := createConfig(namespace, false, "", false, time.Hour, fakeclient, fakeRunnerClient)
+	assert.Nil(t, err)
+	wfs := config.GetAllWorkflows()
+	assert.Len(t, wfs, 1)
+	assert.Empty(t, wfs[0].Tokens)
+	assert.NotNil(t, wfs[0].GithubApp)
+	assert.Equal(t, int64(123), wfs[0].GithubApp.AppID)
+	assert.Equal(t, int64(456), wfs[0].GithubApp.InstallationID)
+	assert.True(t, key.Equal(wfs[0].GithubApp.PrivateKey))
+}
+
+func TestRunnerGithubConnectionOverridesDefaults(t *testing.T) {
+	setup()
+	defaults := runnerv1alpha1.GithubConnection{
+		BaseUrl: "https://github.example.com/api/v3/",
+		Proxy:   "http://proxy:3128",
+	}
+	wf, err := workflowFromScaledActionRunner(context.Background(), fakeclient, runner, "", &defaults)
+	assert.Nil(t, err)
+	assert.Equal(t, defaults, *wf.Github)
+
+	override := runner.DeepCopy()
+	override.Spec.Github = &runnerv1alpha1.GithubConnection{BaseUrl: "https://other.example.com/api/v3/"}
+	wf, err = workflowFromScaledActionRunner(context.Background(), fakeclient, *override, "", &defaults)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://other.example.com/api/v3/", wf.Github.BaseUrl)
+	assert.Equal(t, "http://proxy:3128", wf.Github.Proxy)
+}
+
+func TestMatchesOrganizationRepos(t *testing.T) {
+	wf := GithubWorkflowConfig{Name: "n", Namespace: "ns", Owner: "Owner", Repository: "repo"}
+	assert.True(t, wf.Matches("owner", "Repo", nil))
+	assert.False(t, wf.Matches("owner", "other", nil))
+	assert.Equal(t, "Owner/repo", wf.GitOwnerRepo())
+
+	wf.Repository = ""
+	wf.Organization = &runnerv1alpha1.Organization{Repos: []string{"a", "b"}, ExcludeRepos: []string{"b"}}
+	assert.True(t, wf.Matches("owner", "a", nil))
+	assert.False(t, wf.Matches("owner", "b", nil))
+	assert.False(t, wf.Matches("other", "a", nil))
+	assert.Equal(t, "Owner/*/ns/n", wf.GitOwnerRepo())
+
+	wf.Organization = &runnerv1alpha1.Organization{Topics: []string{"ci"}}
+	assert.True(t, wf.Matches("owner", "anything", []string{"go", "CI"}))
+	assert.False(t, wf.Matches("owner", "anything", []string{"go"}))
+}
+
+func TestCopiesMaxAgesFromRunner(t *testing.T) {
+	setup()
+	wf, err := workflowFromScaledActionRunner(context.Background(), fakeclient, runner, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), wf.MaxPendingAge)
+	assert.Equal(t, time.Duration(0), wf.MaxInProgressAge)
+
+	withAges := runner.DeepCopy()
+	withAges.Spec.MaxPendingAge = &metav1.Duration{Duration: time.Hour}
+	withAges.Spec.MaxInProgressAge = &metav1.Duration{Duration: 6 * time.Hour}
+	wf, err = workflowFromScaledActionRunner(context.Background(), fakeclient, *withAges, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, wf.MaxPendingAge)
+	assert.Equal(t, 6*time.Hour, wf.MaxInProgressAge)
+}
+
+func TestSavesAndLoadsRunnersLastSeen(t *testing.T) {
+	setup()
+	config, err := createConfig(namespace, false, "", false, time.Hour, fakeclient, fakeRunnerClient)
+	assert.Nil(t, err)
+	wf, _ := config.GetWorkflow(namespace, name)
+	assert.Empty(t, wf.RunnersLastSeen)
+
+	seen := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = config.SaveRunnersLastSeen(context.Background(), wf, map[int]time.Time{0: seen})
+	assert.Nil(t, err)
+	patch := fakeRunnerClient.StatusPatches[namespace+"/"+name]
+	assert.JSONEq(t, `{"status":{"runnersLastSeen":{"`+name+`-0":"2021-01-02T03:04:05Z"}}}`, string(patch))
+
+	withStatus := runner.DeepCopy()
+	withStatus.Status.RunnersLastSeen = map[string]metav1.Time{
+		name + "-0":  metav1.NewTime(seen),
+		name + "-12": metav1.NewTime(seen),
+		"other-1":    metav1.NewTime(seen),
+	}
+	wf, err = workflowFromScaledActionRunner(context.Background(), fakeclient, *withStatus, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]time.Time{0: seen, 12: seen}, wf.RunnersLastSeen)
+}
+
+func TestSavesThrottledAndCopiesBudgetFields(t *testing.T) {
+	setup()
+	config, err := createConfig(namespace, false, "", false, time.Hour, fakeclient, fakeRunnerClient)
+	assert.Nil(t, err)
+	wf, _ := config.GetWorkflow(namespace, name)
+	assert.Equal(t, int64(200), wf.MilliCpu)
+	assert.Equal(t, int64(200*1024*1024), wf.Memory)
+
+	err = config.SaveThrottled(context.Background(), wf, 3, "cluster")
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"status":{"throttled":3,"throttledBy":"cluster"}}`, string(fakeRunnerClient.StatusPatches[namespace+"/"+name]))
+	err = config.SaveThrottled(context.Background(), wf, 0, "")
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"status":{"throttled":0,"throttledBy":null}}`, string(fakeRunnerClient.StatusPatches[namespace+"/"+name]))
+
+	withPriority := runner.DeepCopy()
+	withPriority.Spec.Priority = 5
+	withPriority.Spec.Runner = &runnerv1alpha1.Runner{Requests: &map[corev1.ResourceName]resource.Quantity{corev1.ResourceCPU: resource.MustParse("1.5")}}
+	wf, err = workflowFromScaledActionRunner(context.Background(), fakeclient, *withPriority, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(5), wf.Priority)
+	assert.Equal(t, int64(1500), wf.MilliCpu)
+}
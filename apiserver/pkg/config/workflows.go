@@ -3,15 +3,22 @@ package config
 //TODO: Poss seperate this from the config package
 import (
 	"context"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
-	"math/rand"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/gitclient"
 	runnerclient "github.com/devjoes/github-runner-autoscaler/apiserver/pkg/runnerclient"
 	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/scaling"
 	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
@@ -34,6 +41,7 @@ func (c *Config) InitWorkflows(params ...interface{}) error {
 		runnerClient = params[1].(runnerclient.IRunnersV1Alpha1Client)
 	}
 
+	c.runnerClient = runnerClient
 	err := c.syncWorkflows(k8sClient, runnerClient, c.RunnerNSs)
 	if err != nil {
 		return err
@@ -50,7 +58,9 @@ func (c *Config) GetAllWorkflows() []GithubWorkflowConfig {
 	return wfs
 }
 
-func (c *Config) GetWorkflow(key string) (*GithubWorkflowConfig, error) {
+// GetWorkflow returns the workflow of the ScaledActionRunner name in namespace, it is nil if there isn't one
+func (c *Config) GetWorkflow(namespace string, name string) (*GithubWorkflowConfig, error) {
+	key := fmt.Sprintf("%s/%s", namespace, name)
 	item, found, err := c.store.GetByKey(key)
 	//klog.Infof("GetWorkflow %s %t %v %v", key, found, item, err)
 	if !found {
@@ -63,9 +73,69 @@ func (c *Config) GetWorkflow(key string) (*GithubWorkflowConfig, error) {
 	return &wf, nil
 }
 
+// SaveRunnersLastSeen records when each of a workflow's runners was last online in its ScaledActionRunner's status so
+// that it survives the cache being lost
+func (c *Config) SaveRunnersLastSeen(ctx context.Context, wf *GithubWorkflowConfig, lastSeen map[int]time.Time) error {
+	if c.runnerClient == nil {
+		return errors.New("no ScaledActionRunner client")
+	}
+	seen := map[string]metav1.Time{}
+	for ordinal, t := range lastSeen {
+		seen[fmt.Sprintf("%s-%d", wf.Name, ordinal)] = metav1.NewTime(t)
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": runnerv1alpha1.ScaledActionRunnerStatus{RunnersLastSeen: seen},
+	})
+	if err != nil {
+		return err
+	}
+	if err = c.runnerClient.ScaledActionRunners(wf.Namespace).PatchStatus(ctx, wf.Name, patch); err != nil {
+		return fmt.Errorf("error updating status of %s/%s. %s", wf.Namespace, wf.Name, err.Error())
+	}
+	return nil
+}
+
+// SaveThrottled records how many of a workflow's runners are being held back by the budget in its ScaledActionRunner's
+// status
+func (c *Config) SaveThrottled(ctx context.Context, wf *GithubWorkflowConfig, throttled int32, throttledBy string) error {
+	if c.runnerClient == nil {
+		return errors.New("no ScaledActionRunner client")
+	}
+	// Omitted fields are left alone by a merge patch so they have to be cleared explicitly
+	var by interface{}
+	if throttledBy != "" {
+		by = throttledBy
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{"throttled": throttled, "throttledBy": by},
+	})
+	if err != nil {
+		return err
+	}
+	if err = c.runnerClient.ScaledActionRunners(wf.Namespace).PatchStatus(ctx, wf.Name, patch); err != nil {
+		return fmt.Errorf("error updating status of %s/%s. %s", wf.Namespace, wf.Name, err.Error())
+	}
+	return nil
+}
+
+// runnersLastSeen maps the runner names in a ScaledActionRunner's status back to the ordinals of its StatefulSet's pods
+func runnersLastSeen(crd runnerv1alpha1.ScaledActionRunner) map[int]time.Time {
+	lastSeen := map[int]time.Time{}
+	prefix := crd.ObjectMeta.Name + "-"
+	for name, t := range crd.Status.RunnersLastSeen {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if ordinal, err := strconv.Atoi(strings.TrimPrefix(name, prefix)); err == nil {
+			lastSeen[ordinal] = t.Time
+		}
+	}
+	return lastSeen
+}
+
 func getKey(obj interface{}) (string, error) {
 	wfc := obj.(GithubWorkflowConfig)
-	return wfc.Name, nil
+	return wfc.Key(), nil
 }
 
 func getNamespacedClients(runnerClient runnerclient.IRunnersV1Alpha1Client, runnerNSs []string) []runnerclient.IScaledActionRunnerClient {
@@ -96,7 +166,7 @@ func (c *Config) copyAllWorkflows(ctx context.Context, k8sClient kubernetes.Inte
 	purgeOld := true
 	var toCache []interface{}
 	for _, r := range runners {
-		wf, err := workflowFromScaledActionRunner(ctx, k8sClient, r, c.GithubPatNamespace)
+		wf, err := workflowFromScaledActionRunner(ctx, k8sClient, r, c.GithubPatNamespace, &c.Github)
 		if err != nil {
 			klog.Errorf("Failed to copy workflow from runner %s/%s: %s", r.ObjectMeta.Namespace, r.ObjectMeta.Name, err.Error())
 			purgeOld = false
@@ -163,7 +233,7 @@ func (c *Config) setupWatcher(k8sClient kubernetes.Interface, runnerClient runne
 			obj := event.Object
 			runner = obj.(*runnerv1alpha1.ScaledActionRunner)
 
-			wf, err := workflowFromScaledActionRunner(context.TODO(), k8sClient, *runner, c.GithubPatNamespace)
+			wf, err := workflowFromScaledActionRunner(context.TODO(), k8sClient, *runner, c.GithubPatNamespace, &c.Github)
 			if err != nil {
 				klog.Errorf("Error %s from watch. %s %s", event.Type, event.Object, err.Error())
 				continue
@@ -192,7 +262,7 @@ func (c *Config) setupWatcher(k8sClient kubernetes.Interface, runnerClient runne
 	}
 }
 
-func workflowFromScaledActionRunner(ctx context.Context, client kubernetes.Interface, crd runnerv1alpha1.ScaledActionRunner, githubPatNamespace string) (*GithubWorkflowConfig, error) {
+func workflowFromScaledActionRunner(ctx context.Context, client kubernetes.Interface, crd runnerv1alpha1.ScaledActionRunner, githubPatNamespace string, defaultGithub *runnerv1alpha1.GithubConnection) (*GithubWorkflowConfig, error) {
 	if crd.Spec.ScaleFactor == nil {
 		point8 := "0.8"
 		crd.Spec.ScaleFactor = &point8
@@ -202,24 +272,63 @@ func workflowFromScaledActionRunner(ctx context.Context, client kubernetes.Inter
 		githubPatNs = crd.Namespace
 	}
 
-	token, err := getToken(ctx, client, crd.Spec.GithubTokenSecret, githubPatNs)
+	var tokens []string
+	var app *gitclient.GithubAppCredentials
+	var err error
+	if crd.Spec.GithubAppSecret != "" {
+		app, err = getGithubApp(ctx, client, crd.Spec.GithubAppSecret, githubPatNs)
+	} else {
+		tokens, err = getTokens(ctx, client, crd.Spec.GithubTokenSecret, githubPatNs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	scale, err := scaling.NewScaling(&crd)
 	if err != nil {
 		return nil, err
 	}
+	// The operator defaults the requests when it creates the StatefulSet but doesn't save them in the CR
+	milliCpu, memory := runnerv1alpha1.DefaultRunnerCpu.MilliValue(), runnerv1alpha1.DefaultRunnerMemory.Value()
+	if crd.Spec.Runner != nil && crd.Spec.Runner.Requests != nil {
+		if q, found := (*crd.Spec.Runner.Requests)[corev1.ResourceCPU]; found {
+			milliCpu = q.MilliValue()
+		}
+		if q, found := (*crd.Spec.Runner.Requests)[corev1.ResourceMemory]; found {
+			memory = q.Value()
+		}
+	}
+	var maxPendingAge, maxInProgressAge time.Duration
+	if crd.Spec.MaxPendingAge != nil {
+		maxPendingAge = crd.Spec.MaxPendingAge.Duration
+	}
+	if crd.Spec.MaxInProgressAge != nil {
+		maxInProgressAge = crd.Spec.MaxInProgressAge.Duration
+	}
 	return &GithubWorkflowConfig{
-		Name:       crd.ObjectMeta.Name,
-		Namespace:  crd.ObjectMeta.Namespace,
-		Token:      token,
-		Owner:      crd.Spec.Owner,
-		Repository: crd.Spec.Repo,
-		Scaling:    scaling.NewScaling(&crd),
+		Name:             crd.ObjectMeta.Name,
+		Namespace:        crd.ObjectMeta.Namespace,
+		Tokens:           tokens,
+		GithubApp:        app,
+		Github:           crd.Spec.Github.WithDefaults(defaultGithub),
+		Owner:            crd.Spec.Owner,
+		Repository:       crd.Spec.Repo,
+		Organization:     crd.Spec.Organization,
+		Scaling:          scale,
+		MaxPendingAge:    maxPendingAge,
+		MaxInProgressAge: maxInProgressAge,
+		RunnersLastSeen:  runnersLastSeen(crd),
+		Priority:         crd.Spec.Priority,
+		MilliCpu:         milliCpu,
+		Memory:           memory,
+		Throttled:        crd.Status.Throttled,
 	}, nil
 }
 
-func getToken(ctx context.Context, client kubernetes.Interface, githubPatName string, githubPatNamespace string) (string, error) {
+// getTokens returns every field begining with 'token', the client spreads its requests across them
+func getTokens(ctx context.Context, client kubernetes.Interface, githubPatName string, githubPatNamespace string) ([]string, error) {
 	secret, err := client.CoreV1().Secrets(githubPatNamespace).Get(ctx, githubPatName, metav1.GetOptions{})
 	if err != nil {
-		return "", fmt.Errorf("error reading secret %s in namespace %s. %s", githubPatName, githubPatNamespace, err.Error())
+		return nil, fmt.Errorf("error reading secret %s in namespace %s. %s", githubPatName, githubPatNamespace, err.Error())
 	}
 	var fields []string
 	for k, _ := range secret.Data {
@@ -228,8 +337,62 @@ func getToken(ctx context.Context, client kubernetes.Interface, githubPatName st
 		}
 	}
 	if len(fields) == 0 {
-		return "", fmt.Errorf("no fields begining with 'token' found in secret %s in namespace %s.", githubPatName, githubPatNamespace)
+		return nil, fmt.Errorf("no fields begining with 'token' found in secret %s in namespace %s.", githubPatName, githubPatNamespace)
+	}
+	sort.Strings(fields)
+	tokens := make([]string, len(fields))
+	for i, f := range fields {
+		tokens[i] = strings.TrimSpace(string(secret.Data[f]))
+	}
+	return tokens, nil
+}
+
+func getGithubApp(ctx context.Context, client kubernetes.Interface, githubAppSecretName string, githubAppSecretNamespace string) (*gitclient.GithubAppCredentials, error) {
+	secret, err := client.CoreV1().Secrets(githubAppSecretNamespace).Get(ctx, githubAppSecretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error reading secret %s in namespace %s. %s", githubAppSecretName, githubAppSecretNamespace, err.Error())
+	}
+	getInt := func(key string) (int64, error) {
+		val, err := strconv.ParseInt(strings.TrimSpace(string(secret.Data[key])), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse '%s' in secret %s in namespace %s. %s", key, githubAppSecretName, githubAppSecretNamespace, err.Error())
+		}
+		return val, nil
+	}
+	appID, err := getInt(runnerv1alpha1.GithubAppIdKey)
+	if err != nil {
+		return nil, err
+	}
+	installationID, err := getInt(runnerv1alpha1.GithubAppInstallationIdKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(secret.Data[runnerv1alpha1.GithubAppPrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse '%s' in secret %s in namespace %s. %s", runnerv1alpha1.GithubAppPrivateKeyKey, githubAppSecretName, githubAppSecretNamespace, err.Error())
+	}
+	return &gitclient.GithubAppCredentials{
+		AppID:          appID,
+		InstallationID: installationID,
+		PrivateKey:     key,
+	}, nil
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
 	}
-	index := rand.Intn(len(fields))
-	return string(secret.Data[fields[index]]), nil
+	return key, nil
 }
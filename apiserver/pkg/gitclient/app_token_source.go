@@ -0,0 +1,129 @@
+package gitclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	"github.com/google/go-github/v33/github"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Github rejects JWTs which expire more than 10 minutes in the future
+	appJwtLifetime = 9 * time.Minute
+	// Allow for some clock drift between us and Github
+	appJwtClockSkew = time.Minute
+	// Refresh installation tokens a little before they actually expire
+	installationTokenExpiryDelta = 5 * time.Minute
+)
+
+type GithubAppCredentials struct {
+	AppID          int64           `json:"appId"`
+	InstallationID int64           `json:"installationId"`
+	PrivateKey     *rsa.PrivateKey `json:"-"`
+}
+
+func (a GithubAppCredentials) key() string {
+	return fmt.Sprintf("%d/%d", a.AppID, a.InstallationID)
+}
+
+type installationTokenSource struct {
+	credentials GithubAppCredentials
+	newClient   func(jwt string) (*github.Client, error)
+}
+
+// Token mints a new installation access token using a JWT signed with the app's private key
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	jwt, err := createAppJwt(s.credentials.AppID, s.credentials.PrivateKey, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.newClient(jwt)
+	if err != nil {
+		return nil, err
+	}
+	installationToken, _, err := client.Apps.CreateInstallationToken(context.Background(), s.credentials.InstallationID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating installation token for app %s. %s", s.credentials.key(), err.Error())
+	}
+	token := &oauth2.Token{AccessToken: installationToken.GetToken()}
+	if installationToken.ExpiresAt != nil {
+		token.Expiry = installationToken.ExpiresAt.Add(-installationTokenExpiryDelta)
+	}
+	return token, nil
+}
+
+func createAppJwt(appID int64, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-appJwtClockSkew).Unix(),
+		"exp": now.Add(appJwtLifetime).Unix(),
+		"iss": strconv.FormatInt(appID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+type cachedTokenSource struct {
+	privateKey  *rsa.PrivateKey
+	tokenSource oauth2.TokenSource
+}
+
+var installationTokenSources = map[string]cachedTokenSource{}
+var installationTokenSourcesMutex = sync.Mutex{}
+
+// connectionKey identifies every setting in conn as the token source's client is built from the first caller's
+func connectionKey(conn *runnerv1alpha1.GithubConnection) string {
+	if conn == nil {
+		return ""
+	}
+	j, _ := json.Marshal(conn)
+	hash := sha256.Sum256(j)
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// GetInstallationTokenSource returns a token source that is shared by every client using the same installation
+// so that installation tokens are only minted when the current one is about to expire
+func GetInstallationTokenSource(credentials GithubAppCredentials, conn *runnerv1alpha1.GithubConnection) oauth2.TokenSource {
+	installationTokenSourcesMutex.Lock()
+	defer installationTokenSourcesMutex.Unlock()
+	key := fmt.Sprintf("%s@%s", credentials.key(), connectionKey(conn))
+	cached, found := installationTokenSources[key]
+	if found && cached.privateKey.Equal(credentials.PrivateKey) {
+		return cached.tokenSource
+	}
+	ts := oauth2.ReuseTokenSource(nil, &installationTokenSource{
+		credentials: credentials,
+		newClient: func(jwt string) (*github.Client, error) {
+			httpClient, err := getHttpClient(conn)
+			if err != nil {
+				return nil, err
+			}
+			ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+			return newGithubClient(conn, oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: jwt})))
+		},
+	})
+	installationTokenSources[key] = cachedTokenSource{privateKey: credentials.PrivateKey, tokenSource: ts}
+	return ts
+}
@@ -33,13 +33,17 @@ type Client struct {
 	innerClient          IStatelessClient
 	cacheWindow          time.Duration
 	cacheWindowWhenEmpty time.Duration
+	reconcileWindow      time.Duration
 	stateProvider        state.IStateProvider
 	name                 string
+	namespace            string
 	gitOwnerRepo         string
+	// githubHost is the server that gitOwnerRepo is on, entries shared by repo are also keyed by it
+	githubHost string
 }
 
 func (c *Client) GetWorkflowInfo(ctx context.Context) (map[int64]utils.WorkflowInfo, error) {
-	wfData, err := c.stateProvider.GetWorkflowInfo(c.gitOwnerRepo)
+	wfData, err := c.stateProvider.GetWorkflowInfo(state.SharedKey(state.KindWorkflows, c.sharedRepo()))
 	if err != nil {
 		return nil, err
 	}
@@ -49,15 +53,15 @@ func (c *Client) GetWorkflowInfo(ctx context.Context) (map[int64]utils.WorkflowI
 			return nil, err
 		}
 	}
-	err = c.stateProvider.SetWorkflowInfo(c.gitOwnerRepo, wfData)
+	err = c.stateProvider.SetWorkflowInfo(state.SharedKey(state.KindWorkflows, c.sharedRepo()), wfData)
 	if err != nil {
 		return nil, err
 	}
 	return *wfData, err
 }
 
-func (c *Client) GetQueuedJobs(ctx context.Context) ([]*github.WorkflowRun, *time.Time, error) {
-	var jobQueue []*github.WorkflowRun
+func (c *Client) GetQueuedJobs(ctx context.Context) ([]*utils.WorkflowJob, *time.Time, error) {
+	var jobQueue []*utils.WorkflowJob
 	cached := true
 	var err error
 	defer c.instrument(&jobQueue, &cached, &err)
@@ -65,28 +69,31 @@ func (c *Client) GetQueuedJobs(ctx context.Context) ([]*github.WorkflowRun, *tim
 	if err != nil {
 		return nil, nil, err
 	}
-	cacheUntil := s.LastRequest.Add(c.cacheWindow)
-	if s.LastValue == nil || len(s.LastValue) == 0 {
-		cacheUntil = s.LastRequest.Add(c.cacheWindowWhenEmpty)
-	}
 
-	if s.Status != state.Valid || time.Now().UTC().After(cacheUntil) {
+	if c.expired(s) {
 		cached = false
-		klog.V(5).Infof("Cache miss %d %s %s %v", s.Status, cacheUntil.String(), time.Now().UTC().String(), s.LastValue)
+		klog.V(5).Infof("Cache miss %d %s %s %v", s.Status, c.cacheUntil(s).String(), time.Now().UTC().String(), s.LastValue)
 
-		jobQueue, err = c.innerClient.GetQueuedJobs(ctx)
-		if err != nil {
-			s.Status = state.Errored
-		} else {
-			s.LastRequest = time.Now().UTC()
-			s.LastValue = jobQueue
-			s.Status = state.Valid
-		}
-		if saveErr := c.SaveState(s); saveErr != nil {
+		var retrievedAt time.Time
+		jobQueue, retrievedAt, err = c.getRepoJobs(ctx, s)
+		// Polling Github is slow so the update is applied to whatever was saved in the meantime
+		updated, saveErr := c.UpdateState(func(latest *state.ClientState) error {
+			if err != nil {
+				latest.Status = state.Errored
+			} else {
+				latest.LastRequest = retrievedAt
+				latest.LastValue = jobQueue
+				latest.Status = state.Valid
+			}
+			return nil
+		})
+		if saveErr != nil {
 			if err != nil {
 				saveErr = errors.Wrapf(err, "Encountered error %s. Also errored on save %s", err.Error(), saveErr.Error())
 			}
 			err = saveErr
+		} else {
+			s = updated
 		}
 		if err != nil {
 			klog.Warningf("Error whilst processing %s %s", c.name, err.Error())
@@ -96,25 +103,171 @@ func (c *Client) GetQueuedJobs(ctx context.Context) ([]*github.WorkflowRun, *tim
 	return s.LastValue, &s.LastRequest, err
 }
 
+// cacheUntil is when the jobs in s need to be polled again
+func (c *Client) cacheUntil(s *state.ClientState) time.Time {
+	cacheUntil := s.LastRequest.Add(c.cacheWindow)
+	if s.LastValue == nil || len(s.LastValue) == 0 {
+		cacheUntil = s.LastRequest.Add(c.cacheWindowWhenEmpty)
+	}
+	if c.reconcileWindow > 0 && time.Now().UTC().Sub(s.LastWebhook) < c.reconcileWindow {
+		// Webhooks are keeping LastValue up to date so we only need to poll occasionally to catch missed events
+		cacheUntil = s.LastRequest.Add(c.reconcileWindow)
+	}
+	return cacheUntil
+}
+
+func (c *Client) expired(s *state.ClientState) bool {
+	return s.Status != state.Valid || time.Now().UTC().After(c.cacheUntil(s))
+}
+
+// Snapshot is what was cached for a workflow as of the last refresh
+type Snapshot struct {
+	Jobs          []*utils.WorkflowJob
+	RetrievalTime time.Time
+	// Runners is nil if they couldn't be listed, RunnersErr says why
+	Runners    []utils.RunnerStatus
+	RunnersErr error
+	// Loaded is false until the jobs have been polled successfully at least once
+	Loaded bool
+	// Stale is true once the cache has expired, the snapshot is still served whilst it is refreshed
+	Stale bool
+}
+
+// ErrRunnersNotListed is the RunnersErr of snapshots taken before the runners were listed successfully
+var ErrRunnersNotListed = errors.New("runners have not been listed")
+
+// GetSnapshot returns the cached jobs and runners without querying Github
+func (c *Client) GetSnapshot() (*Snapshot, error) {
+	s, err := c.GetState()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := Snapshot{
+		Jobs:          s.LastValue,
+		RetrievalTime: s.LastRequest,
+		Runners:       s.Runners,
+		Loaded:        s.Status == state.Valid || !s.LastRequest.IsZero(),
+		Stale:         c.expired(s),
+	}
+	if s.Runners == nil {
+		snapshot.RunnersErr = ErrRunnersNotListed
+	}
+	return &snapshot, nil
+}
+
+// Refresh polls Github for the jobs if they have expired, along with the runners and workflow info so that they are
+// ready for the next metrics request. Only errors getting the jobs are returned, the rest are logged.
+func (c *Client) Refresh(ctx context.Context) error {
+	if _, _, err := c.GetQueuedJobs(ctx); err != nil {
+		return err
+	}
+	if _, err := c.GetRunners(ctx); err != nil {
+		klog.Warningf("Error listing runners for %s, counting in progress jobs instead. %s", c.name, err.Error())
+	}
+	if _, err := c.GetWorkflowInfo(ctx); err != nil {
+		klog.Warningf("Error getting workflow info for %s. %s", c.gitOwnerRepo, err.Error())
+	}
+	return nil
+}
+
+// StateKey is the key that the workflow's state is stored under
+func (c *Client) StateKey() string {
+	return state.Key(c.namespace, state.KindState, c.name)
+}
+
 func (c *Client) GetState() (*state.ClientState, error) {
-	return c.stateProvider.GetState(c.name)
+	return c.stateProvider.GetState(c.StateKey())
+}
+func (c *Client) SaveState(s *state.ClientState) error {
+	return c.stateProvider.SetState(c.StateKey(), s)
 }
-func (c *Client) SaveState(state *state.ClientState) error {
-	return c.stateProvider.SetState(c.name, state)
+
+// UpdateState applies update to the latest state and saves it, retrying if the state was changed in the meantime
+func (c *Client) UpdateState(update func(s *state.ClientState) error) (*state.ClientState, error) {
+	return state.UpdateState(c.stateProvider, c.StateKey(), update)
+}
+
+// ApplyJobEvent updates the cached jobs with a job from a workflow_job webhook
+func (c *Client) ApplyJobEvent(ctx context.Context, repository string, job *github.WorkflowJob) error {
+	var lookedUp *int64
+	_, err := c.UpdateState(func(s *state.ClientState) error {
+		var workflowID *int64
+		var queuedAt *time.Time
+		if job.StartedAt != nil {
+			queuedAt = &job.StartedAt.Time
+		}
+		jobs := []*utils.WorkflowJob{}
+		for _, j := range s.LastValue {
+			if j.GetRunID() == job.GetRunID() {
+				workflowID = j.WorkflowID
+			}
+			if j.GetID() == job.GetID() && j.GetQueuedAt() != nil {
+				// StartedAt changes when the job is picked up by a runner
+				queuedAt = j.GetQueuedAt()
+			}
+			// Runs which were blocked before any jobs were created are stood in for by a job without an ID
+			placeholder := j.GetID() == 0 && j.GetRunID() == job.GetRunID()
+			if j.GetID() != job.GetID() && !placeholder {
+				jobs = append(jobs, j)
+			}
+		}
+		if job.GetStatus() != "completed" {
+			if workflowID == nil && lookedUp == nil {
+				// Only looked up once even if the update is retried
+				id, err := c.innerClient.GetWorkflowIDForRun(ctx, repository, job.GetRunID())
+				if err != nil {
+					return err
+				}
+				lookedUp = &id
+			}
+			if workflowID == nil {
+				workflowID = lookedUp
+			}
+			jobs = append(jobs, &utils.WorkflowJob{WorkflowJob: job, WorkflowID: workflowID, Repository: repository, BlockedReason: blockedReason(nil, job), QueuedAt: queuedAt})
+		}
+		s.LastValue = jobs
+		s.LastWebhook = time.Now().UTC()
+		return nil
+	})
+	return err
+}
+
+// ApplyRunEvent updates the cached jobs with a run from a workflow_run webhook
+func (c *Client) ApplyRunEvent(ctx context.Context, run *github.WorkflowRun) error {
+	_, err := c.UpdateState(func(s *state.ClientState) error {
+		jobs := []*utils.WorkflowJob{}
+		for _, j := range s.LastValue {
+			if j.GetRunID() != run.GetID() {
+				jobs = append(jobs, j)
+			}
+		}
+		if run.GetStatus() != "completed" && len(jobs) == len(s.LastValue) {
+			// We don't know what jobs this run contains, workflow_job events will tell us but in case they aren't
+			// being sent expire the cache so that they are fetched on the next request
+			s.LastRequest = time.Time{}
+		}
+		s.LastValue = jobs
+		s.LastWebhook = time.Now().UTC()
+		return nil
+	})
+	return err
 }
 
-func NewClient(innerClient IStatelessClient, name string, gitOwnerRepo string, cacheWindow time.Duration, cacheWindowWhenEmpty time.Duration, stateProvider state.IStateProvider) Client {
+func NewClient(innerClient IStatelessClient, name string, namespace string, gitOwnerRepo string, githubHost string, cacheWindow time.Duration, cacheWindowWhenEmpty time.Duration, reconcileWindow time.Duration, stateProvider state.IStateProvider) Client {
 	return Client{
 		innerClient:          innerClient,
 		cacheWindow:          cacheWindow,
 		cacheWindowWhenEmpty: cacheWindowWhenEmpty,
+		reconcileWindow:      reconcileWindow,
 		name:                 name,
+		namespace:            namespace,
 		gitOwnerRepo:         gitOwnerRepo,
+		githubHost:           githubHost,
 		stateProvider:        stateProvider,
 	}
 }
 
-func (c *Client) instrument(labeledJobIds *[]*github.WorkflowRun, cached *bool, err *error) {
+func (c *Client) instrument(labeledJobIds *[]*utils.WorkflowJob, cached *bool, err *error) {
 	labels := append([]string{c.name, strconv.FormatBool(*cached), strconv.FormatBool(*err != nil)})
 
 	guageQueueLength.WithLabelValues(labels...).Set(float64(len(*labeledJobIds)))
@@ -7,12 +7,16 @@ import (
 
 	"github.com/devjoes/github-runner-autoscaler/apiserver/internal/testutils"
 	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/state"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	"github.com/google/go-github/v33/github"
 	"github.com/stretchr/testify/assert"
 )
 
 const (
 	StateName     = "foo"
+	Namespace     = "default"
 	GitOwnerRepo  = "bar/baz"
+	GithubHost    = "github.com"
 	GetQueuedJobs = "GetQueuedJobs"
 )
 
@@ -20,14 +24,14 @@ func TestCallsInnerClientIfLastRequestInvalid(t *testing.T) {
 	test := func(status state.Status) {
 		queueLength := 321
 		stateProvider := state.NewInMemoryStateProvider()
-		stateProvider.SetState(StateName, &state.ClientState{
+		stateProvider.SetState(state.Key(Namespace, state.KindState, StateName), &state.ClientState{
 			LastValue: testutils.FakeQueueData(123),
 			Status:    status,
 		})
 		innerClient := testutils.ClientMock{
 			QueueLength: queueLength,
 			State:       state.ClientState{}}
-		client := NewClient(&innerClient, StateName, GitOwnerRepo, time.Hour, time.Hour, stateProvider)
+		client := NewClient(&innerClient, StateName, Namespace, GitOwnerRepo, GithubHost, time.Hour, time.Hour, 0, stateProvider)
 		result, _, err := client.GetQueuedJobs(context.TODO())
 		assert.Nil(t, err)
 		assert.Equal(t, queueLength, len(result))
@@ -41,7 +45,7 @@ func TestCallsInnerClientIfLastRequestInvalid(t *testing.T) {
 func callEvery100Ms(t *testing.T, lastTotalQueueSize int, cacheWindowMs int, cacheWindowWhenEmptyMs int, callCount int) int {
 	stateProvider := state.NewInMemoryStateProvider()
 	lastValue := testutils.FakeQueueData(lastTotalQueueSize)
-	stateProvider.SetState(StateName, &state.ClientState{
+	stateProvider.SetState(state.Key(Namespace, state.KindState, StateName), &state.ClientState{
 		LastValue: lastValue,
 		Status:    state.Valid,
 	})
@@ -51,7 +55,7 @@ func callEvery100Ms(t *testing.T, lastTotalQueueSize int, cacheWindowMs int, cac
 		State:                    state.ClientState{},
 		QueueLength:              lastTotalQueueSize,
 	}
-	client := NewClient(&innerClient, StateName, GitOwnerRepo, time.Duration(cacheWindowMs)*time.Millisecond, time.Duration(cacheWindowWhenEmptyMs)*time.Millisecond, stateProvider)
+	client := NewClient(&innerClient, StateName, Namespace, GitOwnerRepo, GithubHost, time.Duration(cacheWindowMs)*time.Millisecond, time.Duration(cacheWindowWhenEmptyMs)*time.Millisecond, 0, stateProvider)
 
 	innerClient.On(GetQueuedJobs).Return(lastTotalQueueSize, nil)
 	for i := 0; i < callCount; i++ {
@@ -73,3 +77,100 @@ func TestCachesDataFor200MsIfQueueIsNotEmpty(t *testing.T) {
 	cacheMisses := callEvery100Ms(t, 123, 200, 500, 10)
 	assert.Equal(t, 5, cacheMisses)
 }
+
+func TestAppliesWebhookEventsToState(t *testing.T) {
+	stateProvider := state.NewInMemoryStateProvider()
+	stateProvider.SetState(state.Key(Namespace, state.KindState, StateName), &state.ClientState{
+		LastValue:   testutils.FakeQueueData(0),
+		LastRequest: time.Now().UTC(),
+		Status:      state.Valid,
+	})
+	innerClient := testutils.ClientMock{RecordGetWorkQueueLength: true}
+	client := NewClient(&innerClient, StateName, Namespace, GitOwnerRepo, GithubHost, time.Hour, time.Hour, time.Hour, stateProvider)
+	id, runID, queued, completed := int64(1), int64(2), "queued", "completed"
+
+	err := client.ApplyJobEvent(context.TODO(), "repo", &github.WorkflowJob{ID: &id, RunID: &runID, Status: &queued})
+	assert.Nil(t, err)
+	jobs, _, err := client.GetQueuedJobs(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, int64(123), *jobs[0].WorkflowID)
+
+	err = client.ApplyJobEvent(context.TODO(), "repo", &github.WorkflowJob{ID: &id, RunID: &runID, Status: &completed})
+	assert.Nil(t, err)
+	jobs, _, _ = client.GetQueuedJobs(context.TODO())
+	assert.Len(t, jobs, 0)
+
+	client.ApplyJobEvent(context.TODO(), "repo", &github.WorkflowJob{ID: &id, RunID: &runID, Status: &queued})
+	err = client.ApplyRunEvent(context.TODO(), &github.WorkflowRun{ID: &runID, Status: &completed})
+	assert.Nil(t, err)
+	jobs, _, _ = client.GetQueuedJobs(context.TODO())
+	assert.Len(t, jobs, 0)
+
+	waiting := "waiting"
+	client.ApplyJobEvent(context.TODO(), "repo", &github.WorkflowJob{ID: &id, RunID: &runID, Status: &waiting})
+	jobs, _, _ = client.GetQueuedJobs(context.TODO())
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, utils.BlockedOnEnvironment, jobs[0].BlockedReason)
+	// The queue came from webhooks so there is no need to poll
+	assert.Len(t, innerClient.Calls, 0)
+}
+
+func TestSnapshotIsServedFromCacheUntilRefreshed(t *testing.T) {
+	stateProvider := state.NewInMemoryStateProvider()
+	innerClient := testutils.ClientMock{
+		RecordGetWorkQueueLength: true,
+		QueueLength:              2,
+		Runners:                  []*github.Runner{fakeRunner("foo-0", "online", true)},
+	}
+	client := NewClient(&innerClient, StateName, Namespace, GitOwnerRepo, GithubHost, time.Hour, time.Hour, 0, stateProvider)
+	innerClient.On(GetQueuedJobs).Return(2, nil)
+
+	snapshot, err := client.GetSnapshot()
+	assert.Nil(t, err)
+	assert.False(t, snapshot.Loaded)
+	assert.True(t, snapshot.Stale)
+	assert.Equal(t, ErrRunnersNotListed, snapshot.RunnersErr)
+	assert.Len(t, innerClient.Calls, 0)
+
+	assert.Nil(t, client.Refresh(context.TODO()))
+	snapshot, err = client.GetSnapshot()
+	assert.Nil(t, err)
+	assert.True(t, snapshot.Loaded)
+	assert.False(t, snapshot.Stale)
+	assert.Len(t, snapshot.Jobs, 2)
+	assert.Len(t, snapshot.Runners, 1)
+	assert.Nil(t, snapshot.RunnersErr)
+	assert.False(t, snapshot.RetrievalTime.IsZero())
+
+	// Once it expires the last value is still served, but marked as stale
+	s, _ := client.GetState()
+	s.LastRequest = s.LastRequest.Add(-2 * time.Hour)
+	client.SaveState(s)
+	snapshot, _ = client.GetSnapshot()
+	assert.True(t, snapshot.Loaded)
+	assert.True(t, snapshot.Stale)
+	assert.Len(t, snapshot.Jobs, 2)
+	assert.Len(t, innerClient.Calls, 1)
+}
+
+func TestRunnersWithTheSameNameInDifferentNamespacesHaveSeparateState(t *testing.T) {
+	stateProvider := state.NewInMemoryStateProvider()
+	first := testutils.ClientMock{QueueLength: 1}
+	second := testutils.ClientMock{QueueLength: 2}
+	a := NewClient(&first, StateName, "a", "first/repo", GithubHost, time.Hour, time.Hour, 0, stateProvider)
+	b := NewClient(&second, StateName, "b", "second/repo", GithubHost, time.Hour, time.Hour, 0, stateProvider)
+	first.On(GetQueuedJobs).Return(1, nil)
+	second.On(GetQueuedJobs).Return(2, nil)
+
+	_, _, err := a.GetQueuedJobs(context.TODO())
+	assert.Nil(t, err)
+	_, _, err = b.GetQueuedJobs(context.TODO())
+	assert.Nil(t, err)
+
+	s, _ := a.GetState()
+	assert.Len(t, s.LastValue, 1)
+	s, _ = b.GetState()
+	assert.Len(t, s.LastValue, 2)
+	assert.NotEqual(t, a.StateKey(), b.StateKey())
+}
@@ -0,0 +1,118 @@
+package gitclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/state"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/klog/v2"
+)
+
+var counterConditionalRequests *prometheus.CounterVec
+
+func init() {
+	counterConditionalRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "github_conditional_requests",
+		Help: "Number of conditional requests made to Github, responses which were not modified do not cost credits",
+	}, []string{"not_modified"})
+}
+
+// conditionalTransport stores the ETag and Last-Modified headers of GET responses along with their bodies
+// and revalidates them on subsequent requests. Github does not charge credits for 304 responses.
+type conditionalTransport struct {
+	base  http.RoundTripper
+	cache state.IStateProvider
+	// Responses vary by credentials so they are only shared between clients using the same ones
+	credentialsKey string
+}
+
+func newConditionalTransport(base http.RoundTripper, cache state.IStateProvider, credentialsKey string) http.RoundTripper {
+	if cache == nil {
+		return base
+	}
+	return &conditionalTransport{base: base, cache: cache, credentialsKey: credentialsKey}
+}
+
+func (t *conditionalTransport) key(r *http.Request) string {
+	hash := sha256.Sum256([]byte(t.credentialsKey + " " + r.URL.String()))
+	return state.SharedKey(state.KindResponse, hex.EncodeToString(hash[:]))
+}
+
+func (t *conditionalTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method != http.MethodGet || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return t.base.RoundTrip(r)
+	}
+	key := t.key(r)
+	cached, err := t.cache.GetCachedResponse(key)
+	if err != nil {
+		klog.Warningf("Error reading cached response for %s: %s", r.URL.String(), err.Error())
+		cached = nil
+	}
+	if cached != nil {
+		r = r.Clone(r.Context())
+		if cached.ETag != "" {
+			r.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			r.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+	if cached != nil {
+		counterConditionalRequests.WithLabelValues(strconv.FormatBool(resp.StatusCode == http.StatusNotModified)).Inc()
+	}
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return fromCache(resp, cached), nil
+	}
+	if resp.StatusCode != http.StatusOK || (resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "") {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	err = t.cache.SetCachedResponse(key, &state.CachedResponse{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ContentType:  resp.Header.Get("Content-Type"),
+		Link:         resp.Header.Get("Link"),
+		Body:         body,
+		StoredAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		// Probably too big for the cache, we'll just make an unconditional request next time
+		klog.V(5).Infof("Error caching response for %s: %s", r.URL.String(), err.Error())
+	}
+	return resp, nil
+}
+
+// fromCache turns a 304 in to the 200 that it stands for, keeping the rate limit headers from the 304
+func fromCache(notModified *http.Response, cached *state.CachedResponse) *http.Response {
+	notModified.Body.Close()
+	resp := *notModified
+	resp.StatusCode = http.StatusOK
+	resp.Status = "200 OK"
+	resp.Header = notModified.Header.Clone()
+	if cached.ContentType != "" {
+		resp.Header.Set("Content-Type", cached.ContentType)
+	}
+	if cached.Link != "" {
+		resp.Header.Set("Link", cached.Link)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(cached.Body))
+	resp.ContentLength = int64(len(cached.Body))
+	return &resp
+}
@@ -0,0 +1,48 @@
+package gitclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevalidatesCachedResponsesWithEtags(t *testing.T) {
+	requests, notModified := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		if r.Header.Get("If-None-Match") == `"abc"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Link", `<https://api.github.com/foo?page=2>; rel="next"`)
+		w.Write([]byte(`{"total_count":1}`))
+	}))
+	defer server.Close()
+	stateProvider := state.NewInMemoryStateProvider()
+	client := &http.Client{Transport: newConditionalTransport(http.DefaultTransport, stateProvider, "creds")}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL + "/repos/foo/bar/actions/runs")
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, `{"total_count":1}`, string(body))
+		assert.Equal(t, `<https://api.github.com/foo?page=2>; rel="next"`, resp.Header.Get("Link"))
+		assert.Equal(t, "4999", resp.Header.Get("X-RateLimit-Remaining"))
+	}
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, 2, notModified)
+
+	// Different credentials may see different data so they don't share responses
+	other := &http.Client{Transport: newConditionalTransport(http.DefaultTransport, stateProvider, "other")}
+	_, err := other.Get(server.URL + "/repos/foo/bar/actions/runs")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, notModified)
+}
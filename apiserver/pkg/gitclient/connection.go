@@ -0,0 +1,73 @@
+package gitclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	"github.com/google/go-github/v33/github"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Transports are shared between clients so that connections to Github get reused
+var transports = map[runnerv1alpha1.GithubConnection]*http.Transport{}
+var transportsMutex = sync.Mutex{}
+
+func getTransport(conn *runnerv1alpha1.GithubConnection) (http.RoundTripper, error) {
+	if conn == nil || (conn.Proxy == "" && conn.CaBundle == "") {
+		return http.DefaultTransport, nil
+	}
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	if t, found := transports[*conn]; found {
+		return t, nil
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if conn.Proxy != "" {
+		proxyFunc := (&httpproxy.Config{
+			HTTPProxy:  conn.Proxy,
+			HTTPSProxy: conn.Proxy,
+			NoProxy:    conn.NoProxy,
+		}).ProxyFunc()
+		t.Proxy = func(r *http.Request) (*url.URL, error) {
+			return proxyFunc(r.URL)
+		}
+	}
+	if conn.CaBundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(conn.CaBundle)) {
+			return nil, errors.New("no certificates could be parsed from the Github CA bundle")
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	transports[*conn] = t
+	return t, nil
+}
+
+func getHttpClient(conn *runnerv1alpha1.GithubConnection) (*http.Client, error) {
+	t, err := getTransport(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// newGithubClient targets github.com unless a base URL for a Github Enterprise Server has been set
+func newGithubClient(conn *runnerv1alpha1.GithubConnection, httpClient *http.Client) (*github.Client, error) {
+	if conn == nil || conn.BaseUrl == "" {
+		return github.NewClient(httpClient), nil
+	}
+	uploadUrl := conn.UploadUrl
+	if uploadUrl == "" {
+		// go-github appends api/uploads/ to the server's URL
+		uploadUrl = conn.ServerUrl() + "/"
+	}
+	return github.NewEnterpriseClient(conn.BaseUrl, uploadUrl, httpClient)
+}
@@ -4,29 +4,37 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"sort"
+	"net/http"
 	"strings"
+	"time"
 
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/state"
 	utils "github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
 	"github.com/google/go-github/v33/github"
 	"golang.org/x/oauth2"
-	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/klog/v2"
 )
 
 type IStatelessClient interface {
-	GetQueuedJobs(ctx context.Context) ([]*github.WorkflowRun, error)
+	GetQueuedJobs(ctx context.Context) ([]*utils.WorkflowJob, error)
+	GetWorkflowIDForRun(ctx context.Context, repository string, runID int64) (int64, error)
 	GetRemainingCreditsForToken(ctx context.Context) (string, string, int, error)
 	//TODO: Rename to GetWorkflowInfo
 	GetWorkflowData(ctx context.Context) (*map[int64]utils.WorkflowInfo, error)
+	GetRunners(ctx context.Context) ([]*github.Runner, error)
 }
 type GithubClient struct {
 	Owner      string
 	Repository string
-	client     *github.Client
-	token      string
+	// Organization is set instead of Repository when jobs are counted across an organization
+	Organization *runnerv1alpha1.Organization
+	client       *github.Client
+	tokens       []string
+	app          *GithubAppCredentials
 }
 
 type result struct {
@@ -34,18 +42,45 @@ type result struct {
 	Labels map[string]int
 }
 
-func NewGitHubClient(token string, owner string, repository string) GithubClient {
-	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: token},
-	)
-	tc := oauth2.NewClient(ctx, ts)
-	client := github.NewClient(tc)
+// NewGitHubClient creates a client authenticated with one or more PAT tokens. Each request is made with the healthiest
+// token in the shared pool. If cache is set then GET requests are made conditional on the cached response having changed.
+func NewGitHubClient(tokens []string, owner string, repository string, conn *runnerv1alpha1.GithubConnection, cache state.IStateProvider) (GithubClient, error) {
+	transport, err := getTransport(conn)
+	if err != nil {
+		return GithubClient{}, err
+	}
+	credentialsKey, _ := tokenizeToken(strings.Join(tokens, " "))
+	httpClient := &http.Client{Transport: newTokenPoolTransport(newConditionalTransport(transport, cache, credentialsKey), sharedTokenPool, tokens)}
+	client, err := newGithubClient(conn, httpClient)
+	if err != nil {
+		return GithubClient{}, err
+	}
 	return GithubClient{
 		client:     client,
 		Owner:      owner,
 		Repository: repository,
+		tokens:     tokens,
+	}, nil
+}
+
+func NewGitHubAppClient(app GithubAppCredentials, owner string, repository string, conn *runnerv1alpha1.GithubConnection, cache state.IStateProvider) (GithubClient, error) {
+	transport, err := getTransport(conn)
+	if err != nil {
+		return GithubClient{}, err
+	}
+	httpClient := &http.Client{Transport: newConditionalTransport(transport, cache, "app_"+app.key())}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	tc := oauth2.NewClient(ctx, GetInstallationTokenSource(app, conn))
+	client, err := newGithubClient(conn, tc)
+	if err != nil {
+		return GithubClient{}, err
 	}
+	return GithubClient{
+		client:     client,
+		Owner:      owner,
+		Repository: repository,
+		app:        &app,
+	}, nil
 }
 
 // func (c *GithubClient) getQueueLengthByStatus(status string, ctx context.Context, cResults chan result) {
@@ -67,7 +102,7 @@ func NewGitHubClient(token string, owner string, repository string) GithubClient
 // 	}
 // }
 
-func (c *GithubClient) GetQueuedJobs(ctx context.Context) ([]*github.WorkflowRun, error) {
+func (c *GithubClient) GetQueuedJobs(ctx context.Context) ([]*utils.WorkflowJob, error) {
 	// This wastes credits - just getting the top 100 should work pretty much all of the time
 	// statuses := []string{
 	// 	"queued",
@@ -93,7 +128,55 @@ func (c *GithubClient) GetQueuedJobs(ctx context.Context) ([]*github.WorkflowRun
 	// 	}
 	// 	lock.Unlock()
 	// }
-	runs, _, err := c.client.Actions.ListRepositoryWorkflowRuns(ctx, c.Owner, c.Repository, &github.ListWorkflowRunsOptions{
+	repos, err := c.getRepositories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []*utils.WorkflowJob{}
+	for _, repo := range repos {
+		repoJobs, err := c.getQueuedJobsForRepo(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, repoJobs...)
+	}
+	return jobs, nil
+}
+
+// getRepositories returns the repos to poll, for organizations this is every repo that the credentials can see which the
+// organization's filters include
+func (c *GithubClient) getRepositories(ctx context.Context) ([]string, error) {
+	if c.Organization == nil {
+		return []string{c.Repository}, nil
+	}
+	var names []string
+	opts := &github.RepositoryListByOrgOptions{
+		Type: "all",
+		ListOptions: github.ListOptions{
+			PerPage: 100,
+		},
+	}
+	for {
+		repos, resp, err := c.client.Repositories.ListByOrg(ctx, c.Owner, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error listing repos in %s. %s", c.Owner, err.Error())
+		}
+		for _, r := range repos {
+			if r.GetArchived() || r.GetDisabled() || !c.Organization.Includes(r.GetName(), r.Topics) {
+				continue
+			}
+			names = append(names, r.GetName())
+		}
+		if resp == nil || resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return names, nil
+}
+
+func (c *GithubClient) getQueuedJobsForRepo(ctx context.Context, repo string) ([]*utils.WorkflowJob, error) {
+	runs, _, err := c.client.Actions.ListRepositoryWorkflowRuns(ctx, c.Owner, repo, &github.ListWorkflowRunsOptions{
 		ListOptions: github.ListOptions{
 			PerPage: 100,
 		},
@@ -101,20 +184,124 @@ func (c *GithubClient) GetQueuedJobs(ctx context.Context) ([]*github.WorkflowRun
 	if err != nil {
 		return nil, err
 	}
-	jobs := filterJobsByStatus(runs.WorkflowRuns)
+	// A single run can contain many jobs (e.g. a matrix) so expand each active run in to its jobs
+	jobs := []*utils.WorkflowJob{}
+	for _, r := range filterRunsByStatus(runs.WorkflowRuns) {
+		runJobs, err := c.getJobsForRun(ctx, repo, r)
+		if err != nil {
+			return nil, err
+		}
+		active := filterJobsByStatus(runJobs)
+		for _, j := range active {
+			j.BlockedReason = blockedReason(r, j.WorkflowJob)
+		}
+		if reason := blockedReason(r, nil); len(active) == 0 && reason != "" {
+			// Jobs aren't created until the run is approved or leaves the concurrency group, stand in for them so that
+			// the run can still be seen
+			active = append(active, &utils.WorkflowJob{
+				WorkflowJob:   &github.WorkflowJob{RunID: r.ID, Status: r.Status, StartedAt: r.CreatedAt},
+				WorkflowID:    r.WorkflowID,
+				BlockedReason: reason,
+				QueuedAt:      queuedAt(r, nil),
+			})
+			if c.Organization != nil {
+				active[0].Repository = repo
+			}
+		}
+		jobs = append(jobs, active...)
+	}
 	return jobs, nil
 }
 
-func filterJobsByStatus(jobs []*github.WorkflowRun) []*github.WorkflowRun {
+func (c *GithubClient) getJobsForRun(ctx context.Context, repo string, run *github.WorkflowRun) ([]*utils.WorkflowJob, error) {
+	var jobs []*utils.WorkflowJob
+	opts := &github.ListWorkflowJobsOptions{
+		Filter: "latest",
+		ListOptions: github.ListOptions{
+			PerPage: 100,
+		},
+	}
+	for {
+		page, resp, err := c.client.Actions.ListWorkflowJobs(ctx, c.Owner, repo, *run.ID, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, j := range page.Jobs {
+			job := &utils.WorkflowJob{WorkflowJob: j, WorkflowID: run.WorkflowID, QueuedAt: queuedAt(run, j)}
+			if c.Organization != nil {
+				job.Repository = repo
+			}
+			jobs = append(jobs, job)
+		}
+		if resp == nil || resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return jobs, nil
+}
+
+func (c *GithubClient) GetWorkflowIDForRun(ctx context.Context, repository string, runID int64) (int64, error) {
+	run, _, err := c.client.Actions.GetWorkflowRunByID(ctx, c.Owner, repository, runID)
+	if err != nil {
+		return 0, err
+	}
+	return run.GetWorkflowID(), nil
+}
+
+func filterRunsByStatus(runs []*github.WorkflowRun) []*github.WorkflowRun {
 	filtered := []*github.WorkflowRun{}
 	statuses := map[string]bool{
 		"queued":      true,
 		"waiting":     true,
 		"requested":   true,
 		"in_progress": true,
+		// Blocked by a concurrency group
+		"pending": true,
+		// Waiting for a maintainer to approve a run from a first time contributor's fork
+		"action_required": true,
+	}
+	for _, r := range runs {
+		// Runs waiting for approval are reported as completed with a conclusion of action_required
+		if statuses[r.GetStatus()] || r.GetConclusion() == "action_required" {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
+
+// blockedReason returns why a job (or a run when job is nil) is waiting on something other than a runner, or "" if a
+// runner could pick it up
+func blockedReason(run *github.WorkflowRun, job *github.WorkflowJob) string {
+	switch {
+	case run.GetStatus() == "action_required" || run.GetConclusion() == "action_required":
+		return utils.BlockedOnForkApproval
+	case job.GetStatus() == "waiting" || (job == nil && run.GetStatus() == "waiting"):
+		// Waiting for a reviewer to approve a deployment to a protected environment
+		return utils.BlockedOnEnvironment
+	case job.GetStatus() == "pending" || run.GetStatus() == "pending":
+		return utils.BlockedOnConcurrency
 	}
+	return ""
+}
+
+// queuedAt returns when a job (or a run when job is nil) started waiting for a runner. Jobs can't be queued before
+// their run was created so the later of the two is used, this also handles re-runs which keep the run's created time.
+func queuedAt(run *github.WorkflowRun, job *github.WorkflowJob) *time.Time {
+	var t *time.Time
+	if run.CreatedAt != nil {
+		t = &run.CreatedAt.Time
+	}
+	if job != nil && job.StartedAt != nil && (t == nil || job.StartedAt.After(*t)) {
+		t = &job.StartedAt.Time
+	}
+	return t
+}
+
+func filterJobsByStatus(jobs []*utils.WorkflowJob) []*utils.WorkflowJob {
+	filtered := []*utils.WorkflowJob{}
 	for _, j := range jobs {
-		if statuses[*j.Status] {
+		if j.Status != nil && *j.Status != "completed" {
 			filtered = append(filtered, j)
 		}
 	}
@@ -137,7 +324,13 @@ func tokenizeToken(token string) (string, string) {
 }
 
 func (c *GithubClient) GetRemainingCreditsForToken(ctx context.Context) (string, string, int, error) {
-	key, name := tokenizeToken(c.token)
+	if c.app == nil {
+		// The pool already knows the credits of every token from the headers of previous responses
+		return sharedTokenPool.healthiest(c.tokens)
+	}
+	// Installation tokens are short lived so identify the installation rather than the token
+	key := fmt.Sprintf("app_%s", c.app.key())
+	name := key
 	limits, _, err := c.client.RateLimits(ctx)
 	if err != nil {
 		return key, name, 0, err
@@ -145,58 +338,57 @@ func (c *GithubClient) GetRemainingCreditsForToken(ctx context.Context) (string,
 	return key, name, limits.Core.Remaining, nil
 }
 
-type workflow struct {
-	Name string `json:"name"`
-	Jobs map[string]struct {
-		RunsOn []string `json:"runs-on"`
-	} `json:"jobs"`
-}
-
-func (c *GithubClient) getLabels(ctx context.Context, path string) ([]string, error) {
-	reader, _, err := c.client.Repositories.DownloadContents(ctx, c.Owner, c.Repository, path, &github.RepositoryContentGetOptions{})
+func (c *GithubClient) getLabels(ctx context.Context, repo string, path string) (map[string][]string, []string, error) {
+	reader, _, err := c.client.Repositories.DownloadContents(ctx, c.Owner, repo, path, &github.RepositoryContentGetOptions{})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return c.processWorkflow(reader)
+	return c.processWorkflow(reader, func(p string) ([]byte, error) {
+		r, _, err := c.client.Repositories.DownloadContents(ctx, c.Owner, repo, p, &github.RepositoryContentGetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	})
 }
-func (c *GithubClient) processWorkflow(reader io.ReadCloser) ([]string, error) {
+
+// processWorkflow returns the runs-on labels of each job in the workflow along with every label used by the workflow
+func (c *GithubClient) processWorkflow(reader io.ReadCloser, resolve func(path string) ([]byte, error)) (map[string][]string, []string, error) {
+	defer reader.Close()
 	data, err := ioutil.ReadAll(reader)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	wf := workflow{}
-	err = yaml.Unmarshal(data, &wf)
+	jobs, err := parseWorkflow(data, resolve)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	var runsOn []string
-	for _, j := range wf.Jobs {
-		if j.RunsOn != nil {
-			for _, l := range j.RunsOn {
-				if !utils.ContainsStr(runsOn, l) {
-					runsOn = append(runsOn, l)
-				}
-			}
-		}
-	}
-	sort.Strings(runsOn)
-	return runsOn, nil
+	return jobs, allLabels(jobs), nil
 }
 func (c *GithubClient) GetWorkflowData(ctx context.Context) (*map[int64]utils.WorkflowInfo, error) {
 	results := make(map[int64]utils.WorkflowInfo)
-	wfs, _, err := c.client.Actions.ListWorkflows(ctx, c.Owner, c.Repository, &github.ListOptions{})
+	repos, err := c.getRepositories(ctx)
 	if err != nil {
 		return nil, err
 	}
-	for _, w := range wfs.Workflows {
-		labels, err := c.getLabels(ctx, *w.Path)
+	// Workflow IDs are unique across Github so the workflows of every repo in an organization can share a map
+	for _, repo := range repos {
+		wfs, _, err := c.client.Actions.ListWorkflows(ctx, c.Owner, repo, &github.ListOptions{})
 		if err != nil {
-			klog.Warningf("Failed to get workflow info for %s in %s/%s: %s", *w.Path, c.Owner, c.Repository, err.Error())
+			return nil, err
 		}
-		results[*w.ID] = utils.WorkflowInfo{
-			ID:     *w.ID,
-			Name:   *w.Name,
-			Labels: labels,
+		for _, w := range wfs.Workflows {
+			jobs, labels, err := c.getLabels(ctx, repo, *w.Path)
+			if err != nil {
+				klog.Warningf("Failed to get workflow info for %s in %s/%s: %s", *w.Path, c.Owner, repo, err.Error())
+			}
+			results[*w.ID] = utils.WorkflowInfo{
+				ID:     *w.ID,
+				Name:   *w.Name,
+				Labels: labels,
+				Jobs:   jobs,
+			}
 		}
 	}
 
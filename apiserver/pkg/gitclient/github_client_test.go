@@ -3,10 +3,25 @@ package gitclient
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	"github.com/google/go-github/v33/github"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,8 +30,9 @@ func TestAPIAccess(t *testing.T) {
 	if token == "" {
 		t.Skip("Skipping TestAPIAccess because GITHUB_TOKEN environment variable was not set")
 	}
-	client := NewGitHubClient(token, "devjoes", "test")
-	_, err := client.GetQueuedJobs(context.Background())
+	client, err := NewGitHubClient([]string{token}, "devjoes", "test", nil, nil)
+	assert.Nil(t, err)
+	_, err = client.GetQueuedJobs(context.Background())
 	assert.Nil(t, err)
 }
 
@@ -38,9 +54,10 @@ jobs:
 
 	client := GithubClient{}
 	reader := ioutil.NopCloser(bytes.NewReader([]byte(wfYaml)))
-	labels, err := client.processWorkflow(reader)
+	jobs, labels, err := client.processWorkflow(reader, nil)
 	assert.Nil(t, err)
 	assert.Empty(t, labels)
+	assert.Equal(t, map[string][]string{"build": {}}, jobs)
 }
 
 func TestLabelsExtraction(t *testing.T) {
@@ -59,7 +76,188 @@ jobs:
 
 	client := GithubClient{}
 	reader := ioutil.NopCloser(bytes.NewReader([]byte(wfYaml)))
-	labels, err := client.processWorkflow(reader)
+	jobs, labels, err := client.processWorkflow(reader, nil)
 	assert.Nil(t, err)
 	assert.Equal(t, []string{"bar", "baz", "foo"}, labels)
+	assert.Equal(t, []string{"foo", "baz"}, jobs["deploy"])
+}
+
+func TestFiltersRunsAndJobsByStatus(t *testing.T) {
+	statuses := []string{"queued", "waiting", "requested", "in_progress", "completed"}
+	var runs []*github.WorkflowRun
+	var jobs []*utils.WorkflowJob
+	for i := range statuses {
+		status := statuses[i]
+		runs = append(runs, &github.WorkflowRun{Status: &status})
+		jobs = append(jobs, &utils.WorkflowJob{WorkflowJob: &github.WorkflowJob{Status: &status}})
+	}
+	assert.Len(t, filterRunsByStatus(runs), 4)
+	filtered := filterJobsByStatus(jobs)
+	assert.Len(t, filtered, 4)
+	for _, j := range filtered {
+		assert.NotEqual(t, "completed", *j.Status)
+	}
+}
+
+func TestAppJwtIsSignedWithPrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	now := time.Unix(1600000000, 0)
+	jwt, err := createAppJwt(123, key, now)
+	assert.Nil(t, err)
+	parts := strings.Split(jwt, ".")
+	assert.Len(t, parts, 3)
+
+	claims := map[string]interface{}{}
+	claimsJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(claimsJson, &claims))
+	assert.Equal(t, "123", claims["iss"])
+	assert.Equal(t, float64(now.Add(-appJwtClockSkew).Unix()), claims["iat"])
+	assert.Equal(t, float64(now.Add(appJwtLifetime).Unix()), claims["exp"])
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	assert.Nil(t, err)
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	assert.Nil(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature))
+}
+
+func TestInstallationTokenSourcesAreSharedByInstallation(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ts1 := GetInstallationTokenSource(GithubAppCredentials{AppID: 1, InstallationID: 2, PrivateKey: key}, nil)
+	ts2 := GetInstallationTokenSource(GithubAppCredentials{AppID: 1, InstallationID: 2, PrivateKey: key}, nil)
+	ts3 := GetInstallationTokenSource(GithubAppCredentials{AppID: 1, InstallationID: 3, PrivateKey: key}, nil)
+	assert.True(t, ts1 == ts2)
+	assert.False(t, ts1 == ts3)
+
+	rotated := GetInstallationTokenSource(GithubAppCredentials{AppID: 1, InstallationID: 2, PrivateKey: otherKey}, nil)
+	assert.False(t, ts1 == rotated)
+
+	// Clients are built from the connection so installations on the same server with other settings don't share
+	ghes := &runnerv1alpha1.GithubConnection{BaseUrl: "https://github.example.com/api/v3/"}
+	proxied := &runnerv1alpha1.GithubConnection{BaseUrl: "https://github.example.com/api/v3/", Proxy: "http://proxy:3128"}
+	ts4 := GetInstallationTokenSource(GithubAppCredentials{AppID: 1, InstallationID: 4, PrivateKey: key}, ghes)
+	assert.True(t, ts4 == GetInstallationTokenSource(GithubAppCredentials{AppID: 1, InstallationID: 4, PrivateKey: key}, &runnerv1alpha1.GithubConnection{BaseUrl: ghes.BaseUrl}))
+	assert.False(t, ts4 == GetInstallationTokenSource(GithubAppCredentials{AppID: 1, InstallationID: 4, PrivateKey: key}, proxied))
+}
+
+func TestTargetsGithubEnterpriseServer(t *testing.T) {
+	client, err := NewGitHubClient([]string{"token"}, "owner", "repo", &runnerv1alpha1.GithubConnection{
+		BaseUrl: "https://github.example.com/api/v3/",
+		Proxy:   "http://proxy.example.com:3128",
+		NoProxy: "internal.example.com",
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://github.example.com/api/v3/", client.client.BaseURL.String())
+	assert.Equal(t, "https://github.example.com/api/uploads/", client.client.UploadURL.String())
+
+	transport, err := getTransport(&runnerv1alpha1.GithubConnection{Proxy: "http://proxy.example.com:3128", NoProxy: "internal.example.com"})
+	assert.Nil(t, err)
+	proxy := transport.(*http.Transport).Proxy
+	proxyUrl, _ := proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: "github.example.com"}})
+	assert.Equal(t, "proxy.example.com:3128", proxyUrl.Host)
+	proxyUrl, _ = proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: "internal.example.com"}})
+	assert.Nil(t, proxyUrl)
+
+	client, err = NewGitHubClient([]string{"token"}, "owner", "repo", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://api.github.com/", client.client.BaseURL.String())
+}
+
+func TestRejectsInvalidCaBundle(t *testing.T) {
+	_, err := NewGitHubClient([]string{"token"}, "owner", "repo", &runnerv1alpha1.GithubConnection{CaBundle: "not a certificate"}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestMarksJobsBlockedOnSomethingOtherThanARunner(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/repos/owner/repo/actions/runs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"total_count":5,"workflow_runs":[
+			{"id":1,"workflow_id":10,"status":"queued"},
+			{"id":2,"workflow_id":10,"status":"waiting"},
+			{"id":3,"workflow_id":10,"status":"pending"},
+			{"id":4,"workflow_id":10,"status":"completed","conclusion":"action_required"},
+			{"id":5,"workflow_id":10,"status":"completed","conclusion":"success"}]}`))
+	})
+	mux.HandleFunc("/api/v3/repos/owner/repo/actions/runs/1/jobs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"total_count":1,"jobs":[{"id":100,"run_id":1,"status":"queued"}]}`))
+	})
+	mux.HandleFunc("/api/v3/repos/owner/repo/actions/runs/2/jobs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"total_count":2,"jobs":[{"id":200,"run_id":2,"status":"completed"},{"id":201,"run_id":2,"status":"waiting"}]}`))
+	})
+	for _, run := range []int{3, 4} {
+		mux.HandleFunc(fmt.Sprintf("/api/v3/repos/owner/repo/actions/runs/%d/jobs", run), func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"total_count":0,"jobs":[]}`))
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client, err := NewGitHubClient([]string{"token"}, "owner", "repo", &runnerv1alpha1.GithubConnection{BaseUrl: server.URL + "/api/v3/"}, nil)
+	assert.Nil(t, err)
+	jobs, err := client.GetQueuedJobs(context.Background())
+	assert.Nil(t, err)
+	reasons := map[int64]string{}
+	for _, j := range jobs {
+		reasons[j.GetRunID()] = j.BlockedReason
+	}
+	assert.Equal(t, map[int64]string{
+		1: "",
+		2: utils.BlockedOnEnvironment,
+		3: utils.BlockedOnConcurrency,
+		4: utils.BlockedOnForkApproval,
+	}, reasons)
+	runnable, blocked := utils.SplitBlocked(jobs)
+	assert.Len(t, runnable, 1)
+	assert.Len(t, blocked, 3)
+}
+
+func TestCountsJobsAcrossOrganization(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/orgs/org/repos", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"name":"a","topics":["ci"]},
+			{"name":"b","topics":["ci"]},
+			{"name":"c","topics":["ci"],"archived":true},
+			{"name":"d","topics":["docs"]},
+			{"name":"excluded","topics":["ci"]}]`))
+	})
+	for _, repo := range []string{"a", "b"} {
+		repo := repo
+		mux.HandleFunc(fmt.Sprintf("/api/v3/repos/org/%s/actions/runs", repo), func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"total_count":2,"workflow_runs":[{"id":1,"workflow_id":10,"status":"queued"},{"id":2,"workflow_id":10,"status":"completed"}]}`))
+		})
+		mux.HandleFunc(fmt.Sprintf("/api/v3/repos/org/%s/actions/runs/1/jobs", repo), func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"total_count":1,"jobs":[{"id":100,"run_id":1,"status":"queued"}]}`))
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client, err := NewGitHubClient([]string{"token"}, "org", "", &runnerv1alpha1.GithubConnection{BaseUrl: server.URL + "/api/v3/"}, nil)
+	assert.Nil(t, err)
+	client.Organization = &runnerv1alpha1.Organization{
+		ExcludeRepos: []string{"Excluded"},
+		Topics:       []string{"ci"},
+	}
+	jobs, err := client.GetQueuedJobs(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 2)
+	repos := []string{}
+	for _, j := range jobs {
+		repos = append(repos, j.Repository)
+	}
+	assert.ElementsMatch(t, []string{"a", "b"}, repos)
+}
+
+func TestQueuedAtIsTheLaterOfRunAndJob(t *testing.T) {
+	created := time.Date(2021, 5, 3, 9, 0, 0, 0, time.UTC)
+	run := &github.WorkflowRun{CreatedAt: &github.Timestamp{Time: created}}
+	assert.Equal(t, created, *queuedAt(run, nil))
+	assert.Equal(t, created, *queuedAt(run, &github.WorkflowJob{StartedAt: &github.Timestamp{Time: created.Add(-time.Minute)}}))
+	// Re-runs keep the run's created time
+	rerun := created.Add(time.Hour)
+	assert.Equal(t, rerun, *queuedAt(run, &github.WorkflowJob{StartedAt: &github.Timestamp{Time: rerun}}))
+	assert.Nil(t, queuedAt(&github.WorkflowRun{}, &github.WorkflowJob{}))
 }
@@ -0,0 +1,148 @@
+package gitclient
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/state"
+	utils "github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	"github.com/google/go-github/v33/github"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/klog/v2"
+)
+
+var runnerStatuses = []string{utils.RunnerOffline, utils.RunnerIdle, utils.RunnerBusy}
+
+var guageRunnerStatus *prometheus.GaugeVec
+
+// instrumented are the runners which have a github_runner_status series, by namespace/name of the ScaledActionRunner,
+// so that the series of runners which are deregistered can be deleted
+var instrumented = map[string]map[string]bool{}
+var instrumentedMutex = &sync.Mutex{}
+
+func init() {
+	guageRunnerStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "github_runner_status",
+		Help: "1 for the status that Github reports for each runner in a ScaledActionRunner's StatefulSet, 0 otherwise",
+	}, []string{"name", "namespace", "runner", "status"})
+}
+
+// GetRunners lists the self-hosted runners registered with the repo, or the organization
+func (c *GithubClient) GetRunners(ctx context.Context) ([]*github.Runner, error) {
+	var runners []*github.Runner
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		var page *github.Runners
+		var resp *github.Response
+		var err error
+		if c.Organization != nil {
+			page, resp, err = c.client.Actions.ListOrganizationRunners(ctx, c.Owner, opts)
+		} else {
+			page, resp, err = c.client.Actions.ListRunners(ctx, c.Owner, c.Repository, opts)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error listing runners for %s. %s", c.Owner, err.Error())
+		}
+		runners = append(runners, page.Runners...)
+		if resp == nil || resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return runners, nil
+}
+
+// GetRunners returns the runners which belong to this client's StatefulSet. The inventory is cached for the same
+// window as the queue.
+func (c *Client) GetRunners(ctx context.Context) ([]utils.RunnerStatus, error) {
+	s, err := c.GetState()
+	if err != nil {
+		return nil, err
+	}
+	if s.Runners != nil && time.Now().UTC().Before(s.LastRunnerRequest.Add(c.cacheWindow)) {
+		return s.Runners, nil
+	}
+	registered, err := c.innerClient.GetRunners(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s, err = c.UpdateState(func(s *state.ClientState) error {
+		s.Runners = runnersForStatefulSet(c.namespace, c.name, registered)
+		s.LastRunnerRequest = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	instrumentRunners(c.namespace, c.name, s.Runners)
+	return s.Runners, nil
+}
+
+// runnersForStatefulSet picks out the runners named after the StatefulSet's pods (RUNNER_NAME is the pod name) and
+// orders them by ordinal. Runners registered with a namespace label for a different namespace are left out, otherwise
+// organization runners with the same name in two namespaces would be counted by both.
+func runnersForStatefulSet(namespace string, name string, registered []*github.Runner) []utils.RunnerStatus {
+	podName := regexp.MustCompile(fmt.Sprintf(`^%s-(\d+)$`, regexp.QuoteMeta(name)))
+	runners := []utils.RunnerStatus{}
+	for _, r := range registered {
+		match := podName.FindStringSubmatch(r.GetName())
+		if match == nil || !inNamespace(r, namespace) {
+			continue
+		}
+		ordinal, _ := strconv.Atoi(match[1])
+		runners = append(runners, utils.RunnerStatus{
+			Name:    r.GetName(),
+			Ordinal: ordinal,
+			Online:  r.GetStatus() == "online",
+			Busy:    r.GetBusy(),
+		})
+	}
+	sort.Slice(runners, func(i, j int) bool { return runners[i].Ordinal < runners[j].Ordinal })
+	return runners
+}
+
+// inNamespace is true unless the runner was registered with the namespace label of another namespace, runners which
+// were registered without one can't be told apart so they are matched on their name alone
+func inNamespace(r *github.Runner, namespace string) bool {
+	for _, l := range r.Labels {
+		if strings.HasPrefix(l.GetName(), runnerv1alpha1.RunnerNamespaceLabelPrefix) {
+			return l.GetName() == runnerv1alpha1.RunnerNamespaceLabelPrefix+namespace
+		}
+	}
+	return true
+}
+
+// instrumentRunners sets the status of each runner and deletes the series of runners which are no longer registered
+func instrumentRunners(namespace string, name string, runners []utils.RunnerStatus) {
+	key := fmt.Sprintf("%s/%s", namespace, name)
+	current := map[string]bool{}
+	for _, r := range runners {
+		current[r.Name] = true
+		for _, status := range runnerStatuses {
+			value := 0.0
+			if r.Status() == status {
+				value = 1
+			}
+			guageRunnerStatus.WithLabelValues(name, namespace, r.Name, status).Set(value)
+		}
+	}
+	instrumentedMutex.Lock()
+	for runner := range instrumented[key] {
+		if !current[runner] {
+			for _, status := range runnerStatuses {
+				guageRunnerStatus.DeleteLabelValues(name, namespace, runner, status)
+			}
+		}
+	}
+	instrumented[key] = current
+	instrumentedMutex.Unlock()
+	klog.V(10).Infof("Runners for %s: %v", key, runners)
+}
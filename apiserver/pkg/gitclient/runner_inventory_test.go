@@ -0,0 +1,107 @@
+package gitclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devjoes/github-runner-autoscaler/apiserver/internal/testutils"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/state"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	"github.com/google/go-github/v33/github"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeRunner(name string, status string, busy bool) *github.Runner {
+	return &github.Runner{Name: &name, Status: &status, Busy: &busy}
+}
+
+func TestMapsRunnersToStatefulSetPods(t *testing.T) {
+	runners := runnersForStatefulSet("ns", "foo", []*github.Runner{
+		fakeRunner("foo-10", "online", true),
+		fakeRunner("foo-2", "online", false),
+		fakeRunner("foo-bar-1", "online", true),
+		fakeRunner("foo-0", "offline", false),
+		fakeRunner("laptop", "online", true),
+	})
+	assert.Equal(t, []utils.RunnerStatus{
+		{Name: "foo-0", Ordinal: 0},
+		{Name: "foo-2", Ordinal: 2, Online: true},
+		{Name: "foo-10", Ordinal: 10, Online: true, Busy: true},
+	}, runners)
+	assert.Equal(t, utils.RunnerOffline, runners[0].Status())
+	assert.Equal(t, utils.RunnerIdle, runners[1].Status())
+	assert.Equal(t, utils.RunnerBusy, runners[2].Status())
+	assert.Equal(t, 1, utils.CountBusy(runners))
+}
+
+func TestOnlyMapsRunnersRegisteredInTheSameNamespace(t *testing.T) {
+	inNs := func(r *github.Runner, ns string) *github.Runner {
+		label := runnerv1alpha1.RunnerNamespaceLabelPrefix + ns
+		r.Labels = []*github.RunnerLabels{{Name: github.String("self-hosted")}, {Name: &label}}
+		return r
+	}
+	runners := runnersForStatefulSet("ns", "foo", []*github.Runner{
+		inNs(fakeRunner("foo-0", "online", true), "ns"),
+		inNs(fakeRunner("foo-0", "online", false), "other"),
+		fakeRunner("foo-1", "online", false),
+	})
+	assert.Equal(t, []utils.RunnerStatus{
+		{Name: "foo-0", Ordinal: 0, Online: true, Busy: true},
+		{Name: "foo-1", Ordinal: 1, Online: true},
+	}, runners)
+}
+
+func TestDeletesStatusOfDeregisteredRunners(t *testing.T) {
+	instrumentRunners("ns", "deregistered", []utils.RunnerStatus{{Name: "deregistered-0"}, {Name: "deregistered-1", Online: true}})
+	assert.Equal(t, 1.0, testutil.ToFloat64(guageRunnerStatus.WithLabelValues("deregistered", "ns", "deregistered-1", utils.RunnerIdle)))
+	instrumentRunners("ns", "deregistered", []utils.RunnerStatus{{Name: "deregistered-0"}})
+	assert.False(t, guageRunnerStatus.DeleteLabelValues("deregistered", "ns", "deregistered-1", utils.RunnerIdle))
+	assert.True(t, guageRunnerStatus.DeleteLabelValues("deregistered", "ns", "deregistered-0", utils.RunnerOffline))
+}
+
+func TestCachesRunners(t *testing.T) {
+	stateProvider := state.NewInMemoryStateProvider()
+	innerClient := testutils.ClientMock{Runners: []*github.Runner{fakeRunner(StateName+"-0", "online", true)}}
+	client := NewClient(&innerClient, StateName, Namespace, GitOwnerRepo, GithubHost, time.Hour, time.Hour, time.Hour, stateProvider)
+
+	runners, err := client.GetRunners(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, runners, 1)
+	innerClient.Runners = nil
+	runners, _ = client.GetRunners(context.TODO())
+	assert.Len(t, runners, 1)
+
+	s, _ := client.GetState()
+	s.LastRunnerRequest = time.Time{}
+	client.SaveState(s)
+	runners, _ = client.GetRunners(context.TODO())
+	assert.Len(t, runners, 0)
+
+	innerClient.ErrorOnGetRunners = true
+	s.LastRunnerRequest = time.Time{}
+	client.SaveState(s)
+	_, err = client.GetRunners(context.TODO())
+	assert.NotNil(t, err)
+}
+
+func TestListsOrganizationRunners(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/orgs/org/actions/runners", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"total_count":2,"runners":[{"id":1,"name":"foo-0","status":"online","busy":true},{"id":2,"name":"foo-1","status":"offline","busy":false}]}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client, err := NewGitHubClient([]string{"token"}, "org", "", &runnerv1alpha1.GithubConnection{BaseUrl: server.URL + "/api/v3/"}, nil)
+	assert.Nil(t, err)
+	client.Organization = &runnerv1alpha1.Organization{}
+	runners, err := client.GetRunners(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, runners, 2)
+	assert.True(t, runners[0].GetBusy())
+}
@@ -0,0 +1,181 @@
+package gitclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/state"
+	utils "github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// repoLeaseTTL is how long a replica can poll a repo for before another replica gives up waiting and polls it too
+	repoLeaseTTL = 15 * time.Second
+	// repoLeaseWait is how often a replica waiting on another replica's poll checks whether it has finished
+	repoLeaseWait = 250 * time.Millisecond
+)
+
+// Polls of the same repo by this process are collapsed in to one, leaseHolder identifies this process to other replicas
+var (
+	repoPolls   = &flights{calls: map[string]*flight{}}
+	leaseHolder = newLeaseHolder()
+)
+
+var counterRepoPolls *prometheus.CounterVec
+
+func init() {
+	counterRepoPolls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "workflow_repo_polls",
+		Help: "Number of times a workflow's expired jobs were refreshed, source is github if this replica polled Github, shared if another workflow or replica already had and waited if it waited for another replica to",
+	}, []string{"name", "namespace", "source"})
+}
+
+func newLeaseHolder() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s_%s", hostname, rand.String(5))
+}
+
+// sharedRepo is the name that entries shared by every workflow counting jobs in the repo are stored under, the same
+// owner/repo on another Github server is a different repo
+func (c *Client) sharedRepo() string {
+	return fmt.Sprintf("%s/%s", c.githubHost, c.gitOwnerRepo)
+}
+
+func repoJobsKey(repo string) string {
+	return state.SharedKey(state.KindJobs, repo)
+}
+
+func repoLeaseKey(repo string) string {
+	return state.SharedKey(state.KindLease, repo)
+}
+
+// getRepoJobs returns the jobs in the repo to replace the expired jobs in s. Every workflow counting jobs in the same
+// repo shares one list so if another workflow (or replica) polled the repo recently enough then its jobs are used,
+// otherwise only one caller in this process polls Github and other replicas wait for whoever holds the repo's lease.
+func (c *Client) getRepoJobs(ctx context.Context, s *state.ClientState) ([]*utils.WorkflowJob, time.Time, error) {
+	shared, err := c.stateProvider.GetRepoJobs(repoJobsKey(c.sharedRepo()))
+	if err != nil {
+		klog.Warningf("Error getting the shared jobs for %s. %s", c.gitOwnerRepo, err.Error())
+	} else if c.canUse(s, shared) {
+		counterRepoPolls.WithLabelValues(c.name, c.namespace, "shared").Inc()
+		return shared.Jobs, shared.RetrievedAt, nil
+	}
+	shared, err = repoPolls.do(c.sharedRepo(), func() (*state.RepoJobs, error) {
+		return c.pollRepo(ctx)
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return shared.Jobs, shared.RetrievedAt, nil
+}
+
+// canUse returns true if the shared jobs are newer than s, weren't polled before a webhook changed s and are still
+// within s's cache window
+func (c *Client) canUse(s *state.ClientState, shared *state.RepoJobs) bool {
+	if shared == nil || !shared.RetrievedAt.After(s.LastRequest) || shared.RetrievedAt.Before(s.LastWebhook) {
+		return false
+	}
+	candidate := *s
+	candidate.LastValue, candidate.LastRequest, candidate.Status = shared.Jobs, shared.RetrievedAt, state.Valid
+	return !c.expired(&candidate)
+}
+
+// pollRepo polls Github for the repo's jobs and shares them, unless another replica holds the lease in which case it
+// waits for that replica's jobs. If the lease can't be checked, or expires without any jobs being shared, then it polls
+// Github anyway rather than stopping scaling.
+func (c *Client) pollRepo(ctx context.Context) (*state.RepoJobs, error) {
+	key, leaseKey := repoJobsKey(c.sharedRepo()), repoLeaseKey(c.sharedRepo())
+	started := time.Now().UTC()
+	acquired, err := c.stateProvider.AcquireLease(leaseKey, leaseHolder, repoLeaseTTL)
+	if err != nil {
+		klog.Warningf("Error acquiring the lease on %s, polling anyway. %s", c.gitOwnerRepo, err.Error())
+	}
+	if err == nil && !acquired {
+		if shared := c.waitForRepoJobs(ctx, started); shared != nil {
+			counterRepoPolls.WithLabelValues(c.name, c.namespace, "waited").Inc()
+			return shared, nil
+		}
+		klog.Warningf("Gave up waiting for another replica to poll %s", c.gitOwnerRepo)
+	}
+	if acquired {
+		defer func() {
+			if err := c.stateProvider.ReleaseLease(leaseKey, leaseHolder); err != nil {
+				klog.Warningf("Error releasing the lease on %s. %s", c.gitOwnerRepo, err.Error())
+			}
+		}()
+	}
+
+	jobs, err := c.innerClient.GetQueuedJobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counterRepoPolls.WithLabelValues(c.name, c.namespace, "github").Inc()
+	shared := &state.RepoJobs{Jobs: jobs, RetrievedAt: time.Now().UTC()}
+	if err := c.stateProvider.SetRepoJobs(key, shared); err != nil {
+		klog.Warningf("Error sharing the jobs for %s. %s", c.gitOwnerRepo, err.Error())
+	}
+	return shared, nil
+}
+
+// waitForRepoJobs waits for jobs polled after since to be shared, it returns nil if the lease expires first
+func (c *Client) waitForRepoJobs(ctx context.Context, since time.Time) *state.RepoJobs {
+	ticker := time.NewTicker(repoLeaseWait)
+	defer ticker.Stop()
+	timeout := time.After(repoLeaseTTL)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timeout:
+			return nil
+		case <-ticker.C:
+			shared, err := c.stateProvider.GetRepoJobs(repoJobsKey(c.sharedRepo()))
+			if err != nil {
+				klog.Warningf("Error getting the shared jobs for %s. %s", c.gitOwnerRepo, err.Error())
+				continue
+			}
+			if shared != nil && !shared.RetrievedAt.Before(since) {
+				return shared
+			}
+		}
+	}
+}
+
+// flight is a poll which is in progress, jobs and err are set before done is closed
+type flight struct {
+	done chan struct{}
+	jobs *state.RepoJobs
+	err  error
+}
+
+// flights collapses concurrent calls with the same key in to one
+type flights struct {
+	mutex sync.Mutex
+	calls map[string]*flight
+}
+
+func (f *flights) do(key string, fn func() (*state.RepoJobs, error)) (*state.RepoJobs, error) {
+	f.mutex.Lock()
+	if call, found := f.calls[key]; found {
+		f.mutex.Unlock()
+		<-call.done
+		return call.jobs, call.err
+	}
+	call := &flight{done: make(chan struct{})}
+	f.calls[key] = call
+	f.mutex.Unlock()
+
+	call.jobs, call.err = fn()
+	f.mutex.Lock()
+	delete(f.calls, key)
+	f.mutex.Unlock()
+	close(call.done)
+	return call.jobs, call.err
+}
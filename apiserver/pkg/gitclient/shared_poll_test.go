@@ -0,0 +1,97 @@
+package gitclient
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devjoes/github-runner-autoscaler/apiserver/internal/testutils"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkflowsInTheSameRepoShareJobs(t *testing.T) {
+	stateProvider := state.NewInMemoryStateProvider()
+	first := testutils.ClientMock{RecordGetWorkQueueLength: true, QueueLength: 3}
+	second := testutils.ClientMock{RecordGetWorkQueueLength: true, QueueLength: 5}
+	first.On(GetQueuedJobs).Return(3, nil)
+	second.On(GetQueuedJobs).Return(5, nil)
+	a := NewClient(&first, "a", Namespace, GitOwnerRepo, GithubHost, time.Hour, time.Hour, 0, stateProvider)
+	b := NewClient(&second, "b", Namespace, GitOwnerRepo, GithubHost, time.Hour, time.Hour, 0, stateProvider)
+
+	jobs, _, err := a.GetQueuedJobs(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 3)
+	jobs, retrievalTime, err := b.GetQueuedJobs(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 3)
+	assert.Len(t, first.Calls, 1)
+	assert.Len(t, second.Calls, 0)
+	shared, _ := stateProvider.GetRepoJobs(repoJobsKey(GithubHost + "/" + GitOwnerRepo))
+	assert.Equal(t, shared.RetrievedAt, *retrievalTime)
+
+	// Jobs polled before a webhook changed the workflow aren't used
+	s, _ := b.GetState()
+	s.Status, s.LastWebhook = state.Unset, time.Now().UTC()
+	b.SaveState(s)
+	jobs, _, _ = b.GetQueuedJobs(context.TODO())
+	assert.Len(t, jobs, 5)
+	assert.Len(t, second.Calls, 1)
+}
+
+func TestReposOnOtherServersDontShareJobs(t *testing.T) {
+	stateProvider := state.NewInMemoryStateProvider()
+	first := testutils.ClientMock{RecordGetWorkQueueLength: true, QueueLength: 3}
+	second := testutils.ClientMock{RecordGetWorkQueueLength: true, QueueLength: 5}
+	first.On(GetQueuedJobs).Return(3, nil)
+	second.On(GetQueuedJobs).Return(5, nil)
+	a := NewClient(&first, "a", Namespace, GitOwnerRepo, GithubHost, time.Hour, time.Hour, 0, stateProvider)
+	b := NewClient(&second, "b", Namespace, GitOwnerRepo, "github.example.com", time.Hour, time.Hour, 0, stateProvider)
+
+	jobs, _, err := a.GetQueuedJobs(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 3)
+	jobs, _, err = b.GetQueuedJobs(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 5)
+	assert.Len(t, second.Calls, 1)
+}
+func TestConcurrentPollsOfARepoAreCollapsed(t *testing.T) {
+	innerClient := testutils.ClientMock{RecordGetWorkQueueLength: true, QueueLength: 2, Delay: 100 * time.Millisecond}
+	innerClient.On(GetQueuedJobs).Return(2, nil)
+	client := NewClient(&innerClient, StateName, Namespace, "collapsed/repo", GithubHost, time.Hour, time.Hour, 0, state.NewInMemoryStateProvider())
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jobs, _, err := client.GetQueuedJobs(context.TODO())
+			assert.Nil(t, err)
+			assert.Len(t, jobs, 2)
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, innerClient.Calls, 1)
+}
+
+func TestWaitsForTheReplicaHoldingTheLease(t *testing.T) {
+	stateProvider := state.NewInMemoryStateProvider()
+	innerClient := testutils.ClientMock{RecordGetWorkQueueLength: true, QueueLength: 2}
+	client := NewClient(&innerClient, StateName, Namespace, "leased/repo", GithubHost, time.Hour, time.Hour, 0, stateProvider)
+	acquired, _ := stateProvider.AcquireLease(repoLeaseKey("github.com/leased/repo"), "other-replica", time.Minute)
+	assert.True(t, acquired)
+	go func() {
+		time.Sleep(2 * repoLeaseWait)
+		stateProvider.SetRepoJobs(repoJobsKey("github.com/leased/repo"), &state.RepoJobs{Jobs: testutils.FakeQueueData(4), RetrievedAt: time.Now().UTC()})
+		stateProvider.ReleaseLease(repoLeaseKey("github.com/leased/repo"), "other-replica")
+	}()
+
+	jobs, _, err := client.GetQueuedJobs(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 4)
+	assert.Len(t, innerClient.Calls, 0)
+	acquired, _ = stateProvider.AcquireLease(repoLeaseKey("github.com/leased/repo"), leaseHolder, time.Minute)
+	assert.True(t, acquired)
+}
@@ -0,0 +1,224 @@
+package gitclient
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Github doesn't tell us the limit of a token until we've used it, assume it is full so that it gets tried
+	defaultRateLimit = 5000
+	// Github recommends waiting at least a minute after a secondary rate limit which has no Retry-After
+	minSecondaryBackoff = time.Minute
+	maxSecondaryBackoff = 15 * time.Minute
+)
+
+var guageTokenExhausted *prometheus.GaugeVec
+
+func init() {
+	guageTokenExhausted = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "github_token_exhausted",
+		Help: "1 while a token has been pulled from the pool until its rate limit resets",
+	}, []string{"token_id", "token_name"})
+}
+
+type tokenHealth struct {
+	token     string
+	key       string
+	name      string
+	remaining int
+	reset     time.Time
+	// Set when Github asks us to back off because of a secondary rate limit
+	blockedUntil time.Time
+	backoff      time.Duration
+}
+
+func (t *tokenHealth) availableAt(now time.Time) time.Time {
+	available := t.blockedUntil
+	if t.remaining <= 0 && t.reset.After(available) {
+		available = t.reset
+	}
+	if available.Before(now) {
+		return now
+	}
+	return available
+}
+
+// TokenPool tracks the remaining credits and reset time of every PAT token it has seen. Tokens are shared by every
+// client in the process, so runners which share tokens draw from the same picture of their rate limits.
+type TokenPool struct {
+	tokens map[string]*tokenHealth
+	mutex  sync.Mutex
+	now    func() time.Time
+}
+
+var sharedTokenPool = NewTokenPool()
+
+func NewTokenPool() *TokenPool {
+	return &TokenPool{tokens: map[string]*tokenHealth{}, now: time.Now}
+}
+
+func (p *TokenPool) get(token string) *tokenHealth {
+	key, name := tokenizeToken(token)
+	if t, found := p.tokens[key]; found {
+		return t
+	}
+	t := &tokenHealth{token: token, key: key, name: name, remaining: defaultRateLimit}
+	p.tokens[key] = t
+	return t
+}
+
+// pick returns the token with the most remaining credits, ignoring those which are exhausted or backing off
+func (p *TokenPool) pick(tokens []string) (*tokenHealth, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no Github tokens configured")
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := p.now()
+	var best *tokenHealth
+	var soonest time.Time
+	for _, token := range tokens {
+		t := p.get(token)
+		if available := t.availableAt(now); available.After(now) {
+			if soonest.IsZero() || available.Before(soonest) {
+				soonest = available
+			}
+			continue
+		}
+		if t.remaining <= 0 {
+			// The reset has passed
+			t.remaining = defaultRateLimit
+		}
+		if best == nil || t.remaining > best.remaining {
+			best = t
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("all %d Github tokens are rate limited until %s", len(tokens), soonest.UTC().Format(time.RFC3339))
+	}
+	return best, nil
+}
+
+// update records the rate limit headers of a response and returns true if the token was rate limited
+func (p *TokenPool) update(t *tokenHealth, resp *http.Response) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := p.now()
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		t.remaining = remaining
+		guageGithubCredits.WithLabelValues(t.key, t.name).Set(float64(remaining))
+	}
+	if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		t.reset = time.Unix(reset, 0)
+	}
+
+	limited := false
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests {
+		if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			limited = true
+			p.backOff(t, now, time.Duration(retryAfter)*time.Second)
+		} else if t.remaining <= 0 && resp.Header.Get("X-RateLimit-Remaining") != "" {
+			limited = true
+			klog.Warningf("Github token %s is exhausted until %s", t.name, t.reset.UTC().Format(time.RFC3339))
+		} else if isSecondaryRateLimit(resp) {
+			limited = true
+			p.backOff(t, now, 0)
+		}
+	} else if resp.StatusCode < http.StatusBadRequest {
+		t.backoff = 0
+	}
+	exhausted := 0.0
+	if t.availableAt(now).After(now) {
+		exhausted = 1
+	}
+	guageTokenExhausted.WithLabelValues(t.key, t.name).Set(exhausted)
+	return limited
+}
+
+// backOff blocks a token for at least retryAfter, doubling the wait each time it is hit in succession
+func (p *TokenPool) backOff(t *tokenHealth, now time.Time, retryAfter time.Duration) {
+	if t.backoff == 0 {
+		t.backoff = minSecondaryBackoff
+	} else if t.backoff < maxSecondaryBackoff {
+		t.backoff *= 2
+		if t.backoff > maxSecondaryBackoff {
+			t.backoff = maxSecondaryBackoff
+		}
+	}
+	wait := t.backoff
+	if retryAfter > wait {
+		wait = retryAfter
+	}
+	t.blockedUntil = now.Add(wait)
+	klog.Warningf("Github token %s hit a secondary rate limit, backing off until %s", t.name, t.blockedUntil.UTC().Format(time.RFC3339))
+}
+
+func isSecondaryRateLimit(resp *http.Response) bool {
+	if resp.Body == nil {
+		return false
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(string(body)), "secondary rate limit")
+}
+
+// healthiest returns the state of the token that the next request would use without making a request
+func (p *TokenPool) healthiest(tokens []string) (string, string, int, error) {
+	t, err := p.pick(tokens)
+	if err != nil {
+		return "", "", 0, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return t.key, t.name, t.remaining, nil
+}
+
+// tokenPoolTransport authenticates each request with the healthiest token in the pool. Rate limited GET requests are
+// retried with the next healthiest token, if there is one.
+type tokenPoolTransport struct {
+	base   http.RoundTripper
+	pool   *TokenPool
+	tokens []string
+}
+
+func newTokenPoolTransport(base http.RoundTripper, pool *TokenPool, tokens []string) http.RoundTripper {
+	return &tokenPoolTransport{base: base, pool: pool, tokens: tokens}
+}
+
+func (t *tokenPoolTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := t.pool.pick(t.tokens)
+		if err != nil {
+			return nil, err
+		}
+		req := r.Clone(r.Context())
+		req.Header.Set("Authorization", "Bearer "+token.token)
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return resp, err
+		}
+		if !t.pool.update(token, resp) || r.Method != http.MethodGet || attempt >= len(t.tokens)-1 {
+			return resp, nil
+		}
+		if _, err := t.pool.pick(t.tokens); err != nil {
+			// Nothing else to try, let the caller see the rate limit
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
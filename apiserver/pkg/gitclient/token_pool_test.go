@@ -0,0 +1,139 @@
+package gitclient
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutesRequestsThroughHealthiestToken(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Unix()
+	remaining := map[string]int{"Bearer a": 10, "Bearer b": 100}
+	used := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		used[auth]++
+		remaining[auth]--
+		w.Header().Set("X-RateLimit-Remaining", fmt.Sprint(remaining[auth]))
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprint(reset))
+		if remaining[auth] < 0 {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	pool := NewTokenPool()
+	client := &http.Client{Transport: newTokenPoolTransport(http.DefaultTransport, pool, []string{"a", "b"})}
+
+	// Both are unknown to start with so a is tried first, after that b has more credits
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(server.URL)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, 1, used["Bearer a"])
+	assert.Equal(t, 4, used["Bearer b"])
+
+	remaining["Bearer b"] = 0
+	resp, err := client.Get(server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, used["Bearer a"])
+	assert.Equal(t, 5, used["Bearer b"])
+
+	// b is exhausted until it resets so it isn't tried again
+	for i := 0; i < 3; i++ {
+		client.Get(server.URL)
+	}
+	assert.Equal(t, 5, used["Bearer a"])
+	assert.Equal(t, 5, used["Bearer b"])
+
+	pool.now = func() time.Time { return time.Unix(reset+1, 0) }
+	remaining["Bearer b"] = 100
+	client.Get(server.URL)
+	assert.Equal(t, 6, used["Bearer b"])
+}
+
+func TestFailsWhenAllTokensAreExhausted(t *testing.T) {
+	reset := time.Now().Add(time.Hour)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprint(reset.Unix()))
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: newTokenPoolTransport(http.DefaultTransport, NewTokenPool(), []string{"a", "b"})}
+
+	resp, err := client.Get(server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, err = client.Get(server.URL)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "all 2 Github tokens are rate limited")
+}
+
+func TestBacksOffAfterSecondaryRateLimit(t *testing.T) {
+	limited := true
+	used := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		used[r.Header.Get("Authorization")]++
+		if limited {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message":"You have exceeded a secondary rate limit."}`))
+		}
+	}))
+	defer server.Close()
+	now := time.Now()
+	pool := NewTokenPool()
+	pool.now = func() time.Time { return now }
+	client := &http.Client{Transport: newTokenPoolTransport(http.DefaultTransport, pool, []string{"a"})}
+
+	resp, err := client.Get(server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, err = client.Get(server.URL)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, used["Bearer a"])
+
+	// Retry-After is honoured even though it is longer than the initial backoff
+	now = now.Add(time.Minute + time.Second)
+	_, err = client.Get(server.URL)
+	assert.NotNil(t, err)
+
+	// Repeated secondary limits back off for longer each time, until it exceeds Retry-After
+	now = now.Add(time.Minute)
+	client.Get(server.URL)
+	now = now.Add(2*time.Minute + time.Second)
+	client.Get(server.URL)
+	assert.Equal(t, 3, used["Bearer a"])
+	assert.Equal(t, 4*time.Minute, pool.get("a").backoff)
+	now = now.Add(2*time.Minute + time.Second)
+	_, err = client.Get(server.URL)
+	assert.NotNil(t, err)
+	now = now.Add(2 * time.Minute)
+	limited = false
+	resp, err = client.Get(server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, time.Duration(0), pool.get("a").backoff)
+}
+
+func TestDetectsSecondaryRateLimitWithoutRetryAfter(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header:     http.Header{"X-Ratelimit-Remaining": []string{"4000"}},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"message":"You have exceeded a secondary rate limit. Please wait a few minutes."}`)),
+	}
+	pool := NewTokenPool()
+	token := pool.get("a")
+	assert.True(t, pool.update(token, resp))
+	assert.Equal(t, minSecondaryBackoff, token.backoff)
+	_, err := pool.pick([]string{"a"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,416 @@
+package gitclient
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	utils "github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
+)
+
+// Github allows reusable workflows to be nested 4 deep
+const maxWorkflowDepth = 4
+
+var rxExpression = regexp.MustCompile(`\$\{\{\s*(.*?)\s*\}\}`)
+var rxContextPath = regexp.MustCompile(`^(matrix|inputs)((\.[A-Za-z0-9_-]+)+)$`)
+
+// workflowDefinition is the subset of a workflow file that affects which runners its jobs run on. Nodes are kept
+// rather than decoded so that the order of matrix keys, which Github uses to name jobs, is preserved.
+type workflowDefinition struct {
+	On   yaml.Node `yaml:"on"`
+	Jobs yaml.Node `yaml:"jobs"`
+}
+
+type jobDefinition struct {
+	Name     string               `yaml:"name"`
+	RunsOn   yaml.Node            `yaml:"runs-on"`
+	Uses     string               `yaml:"uses"`
+	With     map[string]yaml.Node `yaml:"with"`
+	Strategy struct {
+		Matrix yaml.Node `yaml:"matrix"`
+	} `yaml:"strategy"`
+}
+
+// combination is one job from a matrix, keys are in the order that they were defined
+type combination struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (c *combination) set(key string, value interface{}) {
+	if _, found := c.values[key]; !found {
+		c.keys = append(c.keys, key)
+	}
+	c.values[key] = value
+}
+
+// workflowParser resolves the runs-on of every job in a workflow. Local reusable workflows are fetched with resolve.
+type workflowParser struct {
+	resolve func(path string) ([]byte, error)
+	jobs    map[string][]string
+}
+
+// parseWorkflow returns the labels that each job in the workflow runs on keyed by the name that Github gives the job
+func parseWorkflow(data []byte, resolve func(path string) ([]byte, error)) (map[string][]string, error) {
+	p := workflowParser{resolve: resolve, jobs: map[string][]string{}}
+	if err := p.parse(data, "", map[string]interface{}{}, []string{}); err != nil {
+		return nil, err
+	}
+	return p.jobs, nil
+}
+
+func (p *workflowParser) parse(data []byte, prefix string, inputs map[string]interface{}, callers []string) error {
+	wf := workflowDefinition{}
+	if err := yaml.Unmarshal(data, &wf); err != nil {
+		return err
+	}
+	for k, v := range getInputDefaults(&wf.On) {
+		if _, found := inputs[k]; !found {
+			inputs[k] = v
+		}
+	}
+	if wf.Jobs.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(wf.Jobs.Content); i += 2 {
+		key := wf.Jobs.Content[i].Value
+		job := jobDefinition{}
+		if err := wf.Jobs.Content[i+1].Decode(&job); err != nil {
+			return fmt.Errorf("could not parse job %s. %s", key, err.Error())
+		}
+		if err := p.parseJob(key, &job, prefix, inputs, callers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *workflowParser) parseJob(key string, job *jobDefinition, prefix string, inputs map[string]interface{}, callers []string) error {
+	combinations, ok := expandMatrix(&job.Strategy.Matrix)
+	if !ok {
+		klog.V(5).Infof("Matrix of job %s is dynamic, its runs-on can't be resolved", key)
+		combinations = []combination{{values: map[string]interface{}{}}}
+	}
+	for _, c := range combinations {
+		context := map[string]interface{}{"matrix": c.values, "inputs": inputs}
+		name := prefix + jobName(key, job.Name, &c, context)
+		if job.Uses != "" {
+			if err := p.parseReusable(name, job, context, callers); err != nil {
+				return err
+			}
+			continue
+		}
+		labels, resolved := getRunsOn(&job.RunsOn, context)
+		if !resolved {
+			klog.V(5).Infof("runs-on of job %s contains expressions which can't be resolved", name)
+		}
+		if _, found := p.jobs[name]; !found {
+			p.jobs[name] = []string{}
+		}
+		p.jobs[name] = utils.AppendIfMissing(p.jobs[name], labels...)
+	}
+	return nil
+}
+
+func (p *workflowParser) parseReusable(name string, job *jobDefinition, context map[string]interface{}, callers []string) error {
+	if !strings.HasPrefix(job.Uses, "./") {
+		klog.V(5).Infof("Job %s uses %s which isn't in this repo, its runs-on can't be resolved", name, job.Uses)
+		return nil
+	}
+	path := strings.TrimPrefix(job.Uses, "./")
+	if len(callers) >= maxWorkflowDepth || utils.ContainsStr(callers, path) {
+		return fmt.Errorf("reusable workflow %s is nested too deeply or calls itself", path)
+	}
+	data, err := p.resolve(path)
+	if err != nil {
+		return fmt.Errorf("could not get reusable workflow %s. %s", path, err.Error())
+	}
+	inputs := map[string]interface{}{}
+	for k, n := range job.With {
+		var v interface{}
+		if err = n.Decode(&v); err != nil {
+			return err
+		}
+		if s, isString := v.(string); isString {
+			if resolved, ok := evaluate(s, context); ok {
+				v = resolved
+			} else {
+				continue
+			}
+		}
+		inputs[k] = v
+	}
+	return p.parse(data, name+" / ", inputs, append(callers, path))
+}
+
+func getInputDefaults(on *yaml.Node) map[string]interface{} {
+	defaults := map[string]interface{}{}
+	trigger := struct {
+		WorkflowCall struct {
+			Inputs map[string]struct {
+				Default interface{} `yaml:"default"`
+			} `yaml:"inputs"`
+		} `yaml:"workflow_call"`
+	}{}
+	if on.Kind != yaml.MappingNode || on.Decode(&trigger) != nil {
+		return defaults
+	}
+	for k, v := range trigger.WorkflowCall.Inputs {
+		if v.Default != nil {
+			defaults[k] = v.Default
+		}
+	}
+	return defaults
+}
+
+// expandMatrix returns every combination in the matrix after applying exclude and include. False is returned if the
+// matrix is created by an expression.
+func expandMatrix(matrix *yaml.Node) ([]combination, bool) {
+	combinations := []combination{{values: map[string]interface{}{}}}
+	if matrix.Kind == 0 {
+		return combinations, true
+	}
+	if matrix.Kind != yaml.MappingNode {
+		return nil, false
+	}
+	var include, exclude []yaml.Node
+	original := map[string]bool{}
+	for i := 0; i+1 < len(matrix.Content); i += 2 {
+		key, value := matrix.Content[i].Value, matrix.Content[i+1]
+		if value.Kind != yaml.SequenceNode {
+			return nil, false
+		}
+		switch key {
+		case "include":
+			include = nodes(value)
+		case "exclude":
+			exclude = nodes(value)
+		default:
+			var values []interface{}
+			if err := value.Decode(&values); err != nil {
+				return nil, false
+			}
+			original[key] = true
+			product := []combination{}
+			for _, c := range combinations {
+				for _, v := range values {
+					n := combination{keys: append([]string{}, c.keys...), values: copyValues(c.values)}
+					n.set(key, v)
+					product = append(product, n)
+				}
+			}
+			combinations = product
+		}
+	}
+	if len(original) == 0 {
+		// A matrix of only includes
+		combinations = []combination{}
+	}
+
+	for _, n := range exclude {
+		e := combination{values: map[string]interface{}{}}
+		if !decodeOrdered(&n, &e) {
+			return nil, false
+		}
+		filtered := []combination{}
+		for _, c := range combinations {
+			if !matches(&c, &e, nil) {
+				filtered = append(filtered, c)
+			}
+		}
+		combinations = filtered
+	}
+
+	expanded := len(combinations)
+	for _, n := range include {
+		inc := combination{values: map[string]interface{}{}}
+		if !decodeOrdered(&n, &inc) {
+			return nil, false
+		}
+		// Includes extend every combination that they don't conflict with, original values are never overwritten
+		added := false
+		for i := 0; i < expanded; i++ {
+			if !matches(&combinations[i], &inc, original) {
+				continue
+			}
+			for _, k := range inc.keys {
+				if !original[k] {
+					combinations[i].set(k, inc.values[k])
+				}
+			}
+			added = true
+		}
+		if !added {
+			combinations = append(combinations, inc)
+		}
+	}
+	return combinations, true
+}
+
+func nodes(seq *yaml.Node) []yaml.Node {
+	var ns []yaml.Node
+	for _, n := range seq.Content {
+		ns = append(ns, *n)
+	}
+	return ns
+}
+
+func decodeOrdered(n *yaml.Node, c *combination) bool {
+	if n.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		var v interface{}
+		if err := n.Content[i+1].Decode(&v); err != nil {
+			return false
+		}
+		c.set(n.Content[i].Value, v)
+	}
+	return true
+}
+
+// matches returns true if every value in other (limited to the keys in only if it is set) is the same in c
+func matches(c *combination, other *combination, only map[string]bool) bool {
+	for k, v := range other.values {
+		if only != nil && !only[k] {
+			continue
+		}
+		if !reflect.DeepEqual(c.values[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+func copyValues(values map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		copied[k] = v
+	}
+	return copied
+}
+
+// jobName returns the name that Github shows for a job. Matrix values are appended unless the name already uses them.
+func jobName(key string, name string, c *combination, context map[string]interface{}) string {
+	if name == "" {
+		name = key
+	} else if rxExpression.MatchString(name) {
+		if evaluated, ok := evaluate(name, context); ok {
+			return fmt.Sprint(evaluated)
+		}
+		return key
+	}
+	if len(c.keys) == 0 {
+		return name
+	}
+	values := make([]string, len(c.keys))
+	for i, k := range c.keys {
+		values[i] = fmt.Sprint(c.values[k])
+	}
+	return fmt.Sprintf("%s (%s)", name, strings.Join(values, ", "))
+}
+
+// getRunsOn handles runs-on as a string, a list of strings or an object with a group and labels. False is returned if
+// any of the labels could not be resolved.
+func getRunsOn(runsOn *yaml.Node, context map[string]interface{}) ([]string, bool) {
+	switch runsOn.Kind {
+	case yaml.ScalarNode:
+		return labelsFromValue(runsOn.Value, context)
+	case yaml.SequenceNode:
+		labels := []string{}
+		resolved := true
+		for _, n := range runsOn.Content {
+			l, ok := getRunsOn(n, context)
+			labels = utils.AppendIfMissing(labels, l...)
+			resolved = resolved && ok
+		}
+		return labels, resolved
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(runsOn.Content); i += 2 {
+			// Runner groups aren't labels so only the labels can be matched
+			if runsOn.Content[i].Value == "labels" {
+				return getRunsOn(runsOn.Content[i+1], context)
+			}
+		}
+		return []string{}, true
+	default:
+		return []string{}, true
+	}
+}
+
+func labelsFromValue(s string, context map[string]interface{}) ([]string, bool) {
+	v, ok := evaluate(s, context)
+	if !ok {
+		return []string{}, false
+	}
+	return toLabels(v), true
+}
+
+// toLabels converts the value of an expression, which may be a list or a group and labels object, in to labels
+func toLabels(v interface{}) []string {
+	labels := []string{}
+	switch val := v.(type) {
+	case []interface{}:
+		for _, l := range val {
+			labels = utils.AppendIfMissing(labels, toLabels(l)...)
+		}
+	case map[string]interface{}:
+		if l, found := val["labels"]; found {
+			labels = toLabels(l)
+		}
+	case nil:
+	default:
+		labels = append(labels, fmt.Sprint(val))
+	}
+	return labels
+}
+
+// evaluate replaces ${{ matrix.x }} and ${{ inputs.x }} expressions. A string made of a single expression evaluates to
+// the value itself, which may be a list. Any other expression can't be evaluated and false is returned.
+func evaluate(s string, context map[string]interface{}) (interface{}, bool) {
+	if m := rxExpression.FindStringSubmatch(s); m != nil && m[0] == strings.TrimSpace(s) {
+		return lookup(m[1], context)
+	}
+	resolved := true
+	result := rxExpression.ReplaceAllStringFunc(s, func(expr string) string {
+		v, ok := lookup(rxExpression.FindStringSubmatch(expr)[1], context)
+		if !ok {
+			resolved = false
+			return expr
+		}
+		return fmt.Sprint(v)
+	})
+	return result, resolved
+}
+
+func lookup(expr string, context map[string]interface{}) (interface{}, bool) {
+	m := rxContextPath.FindStringSubmatch(expr)
+	if m == nil {
+		return nil, false
+	}
+	var current interface{} = context[m[1]]
+	for _, p := range strings.Split(strings.TrimPrefix(m[2], "."), ".") {
+		values, isMap := current.(map[string]interface{})
+		if !isMap {
+			return nil, false
+		}
+		if current, isMap = values[p]; !isMap {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// allLabels returns every label that any job runs on
+func allLabels(jobs map[string][]string) []string {
+	labels := []string{}
+	for _, l := range jobs {
+		labels = utils.AppendIfMissing(labels, l...)
+	}
+	sort.Strings(labels)
+	return labels
+}
@@ -0,0 +1,136 @@
+package gitclient
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsesRunsOnForms(t *testing.T) {
+	jobs, err := parseWorkflow([]byte(`
+on: push
+jobs:
+  scalar:
+    runs-on: ubuntu-latest
+  list:
+    runs-on: [self-hosted, linux]
+  group:
+    runs-on:
+      group: my-group
+      labels: [self-hosted, gpu]
+  groupOnly:
+    runs-on:
+      group: my-group
+  named:
+    name: Named job
+    runs-on: self-hosted`), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{
+		"scalar":    {"ubuntu-latest"},
+		"list":      {"self-hosted", "linux"},
+		"group":     {"self-hosted", "gpu"},
+		"groupOnly": {},
+		"Named job": {"self-hosted"},
+	}, jobs)
+}
+
+func TestExpandsMatrixExpressions(t *testing.T) {
+	jobs, err := parseWorkflow([]byte(`
+jobs:
+  test:
+    strategy:
+      matrix:
+        os: [linux, windows]
+        node: [12, 14]
+        exclude:
+          - os: windows
+            node: 12
+        include:
+          - os: linux
+            arch: arm64
+          - os: macos
+            node: 16
+    runs-on: [self-hosted, "${{ matrix.os }}", "${{ matrix.arch }}"]
+  listExpression:
+    strategy:
+      matrix:
+        runner: [[self-hosted, big], [self-hosted, small]]
+    name: build ${{ matrix.runner[0] }}
+    runs-on: ${{ matrix.runner }}
+  dynamic:
+    strategy:
+      matrix: ${{ fromJSON(needs.setup.outputs.matrix) }}
+    runs-on: ${{ matrix.os }}`), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"self-hosted", "linux", "arm64"}, jobs["test (linux, 12, arm64)"])
+	assert.Equal(t, []string{"self-hosted", "linux", "arm64"}, jobs["test (linux, 14, arm64)"])
+	assert.Equal(t, []string{"self-hosted", "windows"}, jobs["test (windows, 14)"])
+	assert.Equal(t, []string{"self-hosted", "macos"}, jobs["test (macos, 16)"])
+	assert.NotContains(t, jobs, "test (windows, 12)")
+	// The name can't be evaluated so the key is used instead
+	assert.ElementsMatch(t, []string{"self-hosted", "big", "small"}, jobs["listExpression"])
+	assert.Equal(t, []string{}, jobs["dynamic"])
+}
+
+func TestResolvesLocalReusableWorkflows(t *testing.T) {
+	files := map[string]string{
+		".github/workflows/build.yml": `
+on:
+  workflow_call:
+    inputs:
+      runner:
+        type: string
+        default: default-runner
+      size:
+        type: string
+        default: small
+jobs:
+  compile:
+    runs-on: [self-hosted, "${{ inputs.runner }}", "${{ inputs.size }}"]
+  nested:
+    uses: ./.github/workflows/nested.yml`,
+		".github/workflows/nested.yml": `
+on: workflow_call
+jobs:
+  inner:
+    runs-on: nested-runner`,
+	}
+	resolve := func(path string) ([]byte, error) {
+		if f, found := files[path]; found {
+			return []byte(f), nil
+		}
+		return nil, errors.New("not found")
+	}
+	jobs, err := parseWorkflow([]byte(`
+jobs:
+  call:
+    strategy:
+      matrix:
+        runner: [a, b]
+    uses: ./.github/workflows/build.yml
+    with:
+      runner: ${{ matrix.runner }}
+  remote:
+    uses: octo-org/other/.github/workflows/build.yml@main`), resolve)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{
+		"call (a) / compile":        {"self-hosted", "a", "small"},
+		"call (b) / compile":        {"self-hosted", "b", "small"},
+		"call (a) / nested / inner": {"nested-runner"},
+		"call (b) / nested / inner": {"nested-runner"},
+	}, jobs)
+
+	_, err = parseWorkflow([]byte(`
+jobs:
+  missing:
+    uses: ./.github/workflows/missing.yml`), resolve)
+	assert.NotNil(t, err)
+
+	files[".github/workflows/loop.yml"] = `
+jobs:
+  again:
+    uses: ./.github/workflows/loop.yml`
+	_, err = parseWorkflow([]byte(files[".github/workflows/loop.yml"]), resolve)
+	assert.NotNil(t, err)
+}
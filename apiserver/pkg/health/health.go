@@ -8,12 +8,18 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// Pinger checks that the cache can be written to, it is the Host so that probes reuse its connections
+type Pinger interface {
+	Ping() error
+}
+
 type Health struct {
-	conf config.Config
+	conf  config.Config
+	cache Pinger
 }
 
-func NewHealth(conf config.Config) Health {
-	return Health{conf: conf}
+func NewHealth(conf config.Config, cache Pinger) Health {
+	return Health{conf: conf, cache: cache}
 }
 
 func (h *Health) Livez() http.HandlerFunc {
@@ -32,6 +38,13 @@ func (h *Health) Readyz() http.HandlerFunc {
 				return
 			}
 		}
+		if len(h.conf.Redis.Addrs) > 0 && h.cache != nil {
+			if err := h.cache.Ping(); err != nil {
+				klog.Errorf("Readiness probe failed with: %s", err.Error())
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+		}
 		w.WriteHeader(http.StatusOK)
 	}
 }
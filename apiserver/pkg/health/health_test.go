@@ -1,24 +1,26 @@
 package health
 
 import (
+	"errors"
 	"net"
 	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/config"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/state"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestLive(t *testing.T) {
-	h := NewHealth(config.Config{MemcachedServers: ""})
+	h := NewHealth(config.Config{MemcachedServers: ""}, nil)
 	w := httptest.NewRecorder()
 	h.Livez().ServeHTTP(w, nil)
 	assert.Equal(t, 200, w.Code)
 }
 
 func TestReadyNoCache(t *testing.T) {
-	h := NewHealth(config.Config{MemcachedServers: ""})
+	h := NewHealth(config.Config{MemcachedServers: ""}, nil)
 	w := httptest.NewRecorder()
 
 	for i := 0; i < 10; i++ {
@@ -28,7 +30,7 @@ func TestReadyNoCache(t *testing.T) {
 }
 
 func TestReadyFailure(t *testing.T) {
-	h := NewHealth(config.Config{MemcachedServers: "127.0.0.1:1234"})
+	h := NewHealth(config.Config{MemcachedServers: "127.0.0.1:1234"}, nil)
 	w := httptest.NewRecorder()
 	for i := 0; i < 10; i++ {
 		h.Readyz().ServeHTTP(w, nil)
@@ -42,7 +44,7 @@ func TestReadySuccess(t *testing.T) {
 		t.Skip("Skipping test - no memcached running on 127.0.0.1:11211")
 		return
 	}
-	h := NewHealth(config.Config{MemcachedServers: "127.0.0.1:11211"})
+	h := NewHealth(config.Config{MemcachedServers: "127.0.0.1:11211"}, nil)
 	w := httptest.NewRecorder()
 	for i := 0; i < 10; i++ {
 		h.Readyz().ServeHTTP(w, nil)
@@ -56,10 +58,40 @@ func TestReadyPartialFailure(t *testing.T) {
 		t.Skip("Skipping test - no memcached running on 127.0.0.1:11211")
 		return
 	}
-	h := NewHealth(config.Config{MemcachedServers: "127.0.0.1:4321,127.0.0.1:11211,127.0.0.1:12345,127.0.0.1:1234"})
+	h := NewHealth(config.Config{MemcachedServers: "127.0.0.1:4321,127.0.0.1:11211,127.0.0.1:12345,127.0.0.1:1234"}, nil)
 	w := httptest.NewRecorder()
 	for i := 0; i < 10; i++ {
 		h.Readyz().ServeHTTP(w, nil)
 		assert.Equal(t, 200, w.Code)
 	}
 }
+
+type fakePinger struct {
+	err   error
+	pings int
+}
+
+func (p *fakePinger) Ping() error {
+	p.pings++
+	return p.err
+}
+
+func TestReadyRedisFailure(t *testing.T) {
+	cache := &fakePinger{err: errors.New("connection refused")}
+	h := NewHealth(config.Config{Redis: state.RedisOptions{Addrs: []string{"127.0.0.1:1234"}, Mode: state.RedisStandalone}}, cache)
+	w := httptest.NewRecorder()
+	h.Readyz().ServeHTTP(w, nil)
+	assert.NotEqual(t, 200, w.Code)
+}
+
+func TestReadyRedisSuccess(t *testing.T) {
+	cache := &fakePinger{}
+	h := NewHealth(config.Config{Redis: state.RedisOptions{Addrs: []string{"127.0.0.1:6379"}, Mode: state.RedisStandalone}}, cache)
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		h.Readyz().ServeHTTP(w, nil)
+		assert.Equal(t, 200, w.Code)
+	}
+	// The host's provider is pinged rather than connecting again
+	assert.Equal(t, 10, cache.pings)
+}
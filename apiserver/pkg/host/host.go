@@ -4,21 +4,104 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/budget"
 	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/config"
 	client "github.com/devjoes/github-runner-autoscaler/apiserver/pkg/gitclient"
 	labeling "github.com/devjoes/github-runner-autoscaler/apiserver/pkg/labeling"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/scaling"
 	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/state"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	"github.com/google/go-github/v33/github"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 )
 
+var (
+	guageBlockedJobs *prometheus.GaugeVec
+	guageStaleRuns   *prometheus.GaugeVec
+	guageDemand      *prometheus.GaugeVec
+	guageForecast    *prometheus.GaugeVec
+	guageWaitTime    *prometheus.GaugeVec
+	guageThrottled   *prometheus.GaugeVec
+	guageStale       *prometheus.GaugeVec
+	guageQueueAge    *prometheus.GaugeVec
+	histogramRefresh *prometheus.HistogramVec
+)
+
+func init() {
+	guageBlockedJobs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "workflow_blocked_jobs",
+		Help: "Number of pending jobs which are waiting on something other than a runner and are not scaled for",
+	}, []string{"name", "namespace", "reason"})
+	guageStaleRuns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "workflow_stale_runs",
+		Help: "Number of runs which have been queued or in progress for longer than the max age and are not scaled for",
+	}, []string{"name", "namespace", "status"})
+	guageDemand = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "workflow_demand",
+		Help: "Number of queued jobs plus busy runners that are scaled for",
+	}, []string{"name", "namespace"})
+	guageForecast = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "workflow_demand_forecast",
+		Help: "Highest demand forecast within the lookahead by predictive scaling",
+	}, []string{"name", "namespace"})
+	guageWaitTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "workflow_queue_wait_seconds",
+		Help: "How long queued jobs have been waiting for a runner, stat is oldest, p50 or p95",
+	}, []string{"name", "namespace", "stat"})
+	guageThrottled = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "workflow_throttled_runners",
+		Help: "Number of runners which were wanted but are held back by the budget",
+	}, []string{"name", "namespace"})
+	guageStale = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "workflow_queue_stale",
+		Help: "1 if the last metric was served from an expired cache whilst it was refreshed in the background, 0 if it wasn't",
+	}, []string{"name", "namespace"})
+	guageQueueAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "workflow_queue_age_seconds",
+		Help: "How long ago the jobs that the last metric was served from were retrieved from Github",
+	}, []string{"name", "namespace"})
+	histogramRefresh = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "workflow_refresh_seconds",
+		Help: "How long background refreshes from Github take, result is success or error",
+	}, []string{"name", "namespace", "result"})
+}
+
 type Host struct {
 	config        config.Config
 	stateProvider state.IStateProvider
+
+	budgetMutex *sync.Mutex
+	// claims are what every workflow wanted as of claimsLoaded, they are shared between API server replicas through the
+	// state provider so they are only reloaded every claimsRefresh
+	claims       []budget.Claim
+	claimsLoaded time.Time
+	// throttled is what was last saved in each workflow's status
+	throttled map[string]int32
+
+	watchMutex *sync.Mutex
+	watchers   map[chan types.NamespacedName]struct{}
+
+	refreshMutex *sync.Mutex
+	// refreshing are the workflows which are being refreshed in the background, by namespace/name
+	refreshing map[string]*refresh
 }
 
+const (
+	claimsRefresh = 15 * time.Second
+	// Workflows which haven't been queried for this long are assumed to only want their min runners
+	claimExpiry = 5 * time.Minute
+	// The refresher waits for up to this fraction of its interval again between checks
+	refreshJitter = 0.5
+)
+
 func (h *Host) GetAllMetricNames(namespace string) ([]string, error) {
 	wfs := h.config.GetAllWorkflows()
 	metrics := make([]string, len(wfs))
@@ -32,44 +115,489 @@ func (h *Host) GetAllMetricNames(namespace string) ([]string, error) {
 
 const MetricErrNotFound string = "metric not found"
 
-//TODO: Wrap all of these returned vars up in ot a struct
-func (h *Host) QueryMetric(key string, selector labels.Selector) (int, *time.Time, map[string][]string, *config.GithubWorkflowConfig, bool, error) {
-	wf, err := h.config.GetWorkflow(key)
+const statusUpdateInterval = time.Hour
+
+// Metric is the demand for a workflow's runners along with where it came from
+type Metric struct {
+	Demand scaling.Demand
+	// RetrievalTime is when the jobs were last polled from Github
+	RetrievalTime time.Time
+	// Stale is true when the cache had expired and the metric was served whilst it is refreshed in the background
+	Stale         bool
+	MatchedLabels map[string][]string
+	Workflow      *config.GithubWorkflowConfig
+	KeepAlive     int32
+}
+
+// QueryMetric returns the metric of the ScaledActionRunner name in namespace, runners in other namespaces with the same
+// name aren't found
+func (h *Host) QueryMetric(namespace string, name string, selector labels.Selector) (*Metric, error) {
+	wf, err := h.config.GetWorkflow(namespace, name)
 	if err != nil {
-		return 0, nil, nil, nil, false, err
+		return nil, err
 	}
 	if wf == nil {
-		return 0, nil, nil, nil, false, errors.New(MetricErrNotFound)
+		return nil, errors.New(MetricErrNotFound)
+	}
+	client, err := h.getClient(wf)
+	if err != nil {
+		return nil, err
 	}
-	client := h.getClient(wf)
 	ctx := context.Background()
-	jobs, retrievalTime, err := client.GetQueuedJobs(ctx)
+	snapshot, err := h.getSnapshot(ctx, client, wf)
 	if err != nil {
-		return 0, nil, nil, wf, false, err
+		return nil, err
 	}
 	wfInfo, err := client.GetWorkflowInfo(ctx)
 	if err != nil {
-		return 0, nil, nil, wf, false, err
+		return nil, err
+	}
+	runners := snapshot.Runners
+	if snapshot.RunnersErr != nil {
+		runners = nil
+	}
+	keepAlive, err := h.keepAlive(ctx, client, wf, runners, snapshot.RunnersErr == nil)
+	if err != nil {
+		return nil, err
+	}
+	jobs, stale := utils.SplitStale(snapshot.Jobs, time.Now(), wf.MaxPendingAge, wf.MaxInProgressAge)
+	recordStaleRuns(wf, stale)
+	runnable, blocked := utils.SplitBlocked(jobs)
+	recordBlockedJobs(blocked, wf, wfInfo, selector)
+	filteredJobs, matchedLabels := labeling.FilterBySelector(runnable, wf, wfInfo, selector)
+	now := time.Now()
+	recordStaleness(wf, snapshot, now)
+	d := demand(filteredJobs, runners, snapshot.RunnersErr)
+	d.OldestWait = recordWaitTimes(wf, filteredJobs, now)
+	d.Forecast = h.predict(wf, d, now)
+
+	return &Metric{
+		Demand:        d,
+		RetrievalTime: snapshot.RetrievalTime,
+		Stale:         snapshot.Stale,
+		MatchedLabels: matchedLabels,
+		Workflow:      wf,
+		KeepAlive:     keepAlive,
+	}, nil
+}
+
+// getSnapshot returns the cached jobs and runners for wf. If the background refresher is running and the cache has
+// expired then a refresh is started and the cached snapshot is returned straight away marked as stale, it only waits
+// for Github if nothing has been loaded yet. Otherwise Github is queried if the cache has expired.
+func (h *Host) getSnapshot(ctx context.Context, c *client.Client, wf *config.GithubWorkflowConfig) (*client.Snapshot, error) {
+	if h.config.RefreshInterval <= 0 {
+		jobs, retrievalTime, err := c.GetQueuedJobs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		runners, runnersErr := c.GetRunners(ctx)
+		if runnersErr != nil {
+			klog.Warningf("Error listing runners for %s/%s, counting in progress jobs instead. %s", wf.Namespace, wf.Name, runnersErr.Error())
+		}
+		return &client.Snapshot{Jobs: jobs, RetrievalTime: *retrievalTime, Runners: runners, RunnersErr: runnersErr, Loaded: true}, nil
+	}
+	snapshot, err := c.GetSnapshot()
+	if err != nil || !snapshot.Stale {
+		return snapshot, err
+	}
+	r := h.refresh(wf, c)
+	if snapshot.Loaded {
+		return snapshot, nil
+	}
+	<-r.done
+	if r.err != nil {
+		return nil, r.err
+	}
+	return c.GetSnapshot()
+}
+
+// refresh is a background refresh of a workflow, err is set before done is closed
+type refresh struct {
+	done chan struct{}
+	err  error
+}
+
+// RunRefresher refreshes the workflows whose cache has expired every interval until ctx is done, so that metrics
+// requests don't have to wait for Github. The interval is jittered so that API server replicas sharing a cache don't
+// all poll Github at the same moment.
+func (h *Host) RunRefresher(ctx context.Context, interval time.Duration) {
+	klog.Infof("Refreshing workflows in the background every %s", interval.String())
+	wait.JitterUntil(h.refreshExpired, interval, refreshJitter, true, ctx.Done())
+}
+
+func (h *Host) refreshExpired() {
+	for _, wf := range h.config.GetAllWorkflows() {
+		wf := wf
+		c, err := h.getClient(&wf)
+		if err != nil {
+			klog.Errorf("Error refreshing %s/%s. %s", wf.Namespace, wf.Name, err.Error())
+			continue
+		}
+		snapshot, err := c.GetSnapshot()
+		if err != nil {
+			klog.Errorf("Error getting the cached state of %s/%s. %s", wf.Namespace, wf.Name, err.Error())
+			continue
+		}
+		if snapshot.Stale {
+			h.refresh(&wf, c)
+		}
+	}
+}
+
+// refresh starts refreshing wf in the background unless it is already being refreshed, either way it returns the
+// refresh that is running
+func (h *Host) refresh(wf *config.GithubWorkflowConfig, c *client.Client) *refresh {
+	h.refreshMutex.Lock()
+	defer h.refreshMutex.Unlock()
+	if r, found := h.refreshing[wf.Key()]; found {
+		return r
+	}
+	r := &refresh{done: make(chan struct{})}
+	h.refreshing[wf.Key()] = r
+	go func() {
+		start := time.Now()
+		r.err = c.Refresh(context.Background())
+		result := "success"
+		if r.err != nil {
+			result = "error"
+			klog.Warningf("Error refreshing %s/%s. %s", wf.Namespace, wf.Name, r.err.Error())
+		}
+		histogramRefresh.WithLabelValues(wf.Name, wf.Namespace, result).Observe(time.Since(start).Seconds())
+		h.refreshMutex.Lock()
+		delete(h.refreshing, wf.Key())
+		h.refreshMutex.Unlock()
+		close(r.done)
+		if r.err == nil {
+			h.notify(types.NamespacedName{Namespace: wf.Namespace, Name: wf.Name})
+		}
+	}()
+	return r
+}
+
+// recordStaleness records how old the jobs being served for wf are and whether they are being refreshed
+func recordStaleness(wf *config.GithubWorkflowConfig, snapshot *client.Snapshot, now time.Time) {
+	stale := 0.0
+	if snapshot.Stale {
+		stale = 1
+		klog.V(5).Infof("Serving %s/%s from a stale cache retrieved at %s whilst it is refreshed", wf.Namespace, wf.Name, snapshot.RetrievalTime.String())
+	}
+	guageStale.WithLabelValues(wf.Name, wf.Namespace).Set(stale)
+	if !snapshot.RetrievalTime.IsZero() {
+		guageQueueAge.WithLabelValues(wf.Name, wf.Namespace).Set(now.Sub(snapshot.RetrievalTime).Seconds())
+	}
+}
+
+// Allocate records how many runners wf wants and returns how many it can have under the budget. If the budget can't be
+// worked out then wf gets what it wants rather than stopping runners from scaling.
+func (h *Host) Allocate(wf *config.GithubWorkflowConfig, wanted int32) int32 {
+	if h.config.Budget == nil {
+		return wanted
+	}
+	now := time.Now().UTC()
+	_, err := state.UpdateState(h.stateProvider, state.Key(wf.Namespace, state.KindState, wf.Name), func(s *state.ClientState) error {
+		s.Wanted, s.WantedAt = wanted, now
+		return nil
+	})
+	if err != nil {
+		klog.Warningf("Error saving state for %s/%s. %s", wf.Namespace, wf.Name, err.Error())
+	}
+
+	claim := claimFor(wf, wanted)
+	claims := []budget.Claim{claim}
+	for _, c := range h.getClaims(now) {
+		if c.Key() != claim.Key() {
+			claims = append(claims, c)
+		}
+	}
+	a := budget.Allocate(h.config.Budget, claims)[claim.Key()]
+	guageThrottled.WithLabelValues(wf.Name, wf.Namespace).Set(float64(a.Throttled))
+	h.saveThrottled(wf, a)
+	return a.Runners
+}
+
+func claimFor(wf *config.GithubWorkflowConfig, wanted int32) budget.Claim {
+	return budget.Claim{
+		Name:      wf.Name,
+		Namespace: wf.Namespace,
+		Priority:  wf.Priority,
+		Min:       wf.Scaling.MinWorkers,
+		Wanted:    wanted,
+		MilliCpu:  wf.MilliCpu,
+		Memory:    wf.Memory,
+	}
+}
+
+func (h *Host) getClaims(now time.Time) []budget.Claim {
+	h.budgetMutex.Lock()
+	defer h.budgetMutex.Unlock()
+	if now.Sub(h.claimsLoaded) < claimsRefresh {
+		return h.claims
+	}
+	claims := []budget.Claim{}
+	for _, wf := range h.config.GetAllWorkflows() {
+		s, err := h.stateProvider.GetState(state.Key(wf.Namespace, state.KindState, wf.Name))
+		if err != nil {
+			klog.Warningf("Error getting state for %s/%s, assuming that it only wants its min runners. %s", wf.Namespace, wf.Name, err.Error())
+			s = state.NewClientState(wf.Name)
+		}
+		wanted := int32(0)
+		if now.Sub(s.WantedAt) < claimExpiry {
+			wanted = s.Wanted
+		}
+		claims = append(claims, claimFor(&wf, wanted))
+	}
+	h.claims, h.claimsLoaded = claims, now
+	return claims
+}
+
+// saveThrottled records how many runners are being held back in the ScaledActionRunner's status when it changes
+func (h *Host) saveThrottled(wf *config.GithubWorkflowConfig, a budget.Allocation) {
+	key := wf.Key()
+	h.budgetMutex.Lock()
+	saved, found := h.throttled[key]
+	if !found {
+		saved = wf.Throttled
+	}
+	h.throttled[key] = a.Throttled
+	h.budgetMutex.Unlock()
+	if saved == a.Throttled {
+		return
+	}
+	if a.Throttled > 0 {
+		klog.Infof("%s wants %d more runners than the %s budget allows", key, a.Throttled, a.ThrottledBy)
+	}
+	if err := h.config.SaveThrottled(context.Background(), wf, a.Throttled, a.ThrottledBy); err != nil {
+		klog.Warningf("Error saving throttled runners for %s. %s", key, err.Error())
+		h.budgetMutex.Lock()
+		h.throttled[key] = saved
+		h.budgetMutex.Unlock()
+	}
+}
+
+// recordWaitTimes records how long the queued jobs matching the selector have been waiting for and returns the oldest
+func recordWaitTimes(wf *config.GithubWorkflowConfig, jobs []*utils.WorkflowJob, now time.Time) time.Duration {
+	waits := utils.GetWaitTimes(jobs, now)
+	guageWaitTime.WithLabelValues(wf.Name, wf.Namespace, "oldest").Set(waits.Oldest.Seconds())
+	guageWaitTime.WithLabelValues(wf.Name, wf.Namespace, "p50").Set(waits.P50.Seconds())
+	guageWaitTime.WithLabelValues(wf.Name, wf.Namespace, "p95").Set(waits.P95.Seconds())
+	return waits.Oldest
+}
+
+// predict records the demand in the workflow's queue history and returns the forecast. Errors are only logged as
+// predictive scaling is just an optimization.
+func (h *Host) predict(wf *config.GithubWorkflowConfig, d scaling.Demand, now time.Time) float64 {
+	guageDemand.WithLabelValues(wf.Name, wf.Namespace).Set(float64(d.Total()))
+	if wf.Scaling.Predictive == nil {
+		return 0
+	}
+	key := state.Key(wf.Namespace, state.KindHistory, wf.Name)
+	history, err := h.stateProvider.GetQueueHistory(key)
+	if err != nil {
+		klog.Warningf("Error getting queue history for %s/%s, not predicting demand. %s", wf.Namespace, wf.Name, err.Error())
+		return 0
+	}
+	if history == nil {
+		history = &utils.QueueHistory{}
+	}
+	history.Record(now, d.Total(), wf.Scaling.Predictive.HistoryRetention())
+	if err := h.stateProvider.SetQueueHistory(key, history); err != nil {
+		klog.Warningf("Error saving queue history for %s/%s. %s", wf.Namespace, wf.Name, err.Error())
+	}
+	forecast := wf.Scaling.Forecast(history, now)
+	guageForecast.WithLabelValues(wf.Name, wf.Namespace).Set(forecast)
+	return forecast
+}
+
+// demand is what the number of runners is worked out from: the pending jobs and the runners that are already busy.
+// Runners which are online and idle will pick up pending jobs so they aren't added on. If Github won't list the runners, e.g. because
+// the credentials don't have admin access, then in progress jobs are counted instead.
+func demand(jobs []*utils.WorkflowJob, runners []utils.RunnerStatus, runnersErr error) scaling.Demand {
+	d := scaling.Demand{}
+	for _, j := range jobs {
+		if j.GetStatus() == "in_progress" {
+			d.Busy++
+		} else {
+			d.Queued++
+		}
+	}
+	if runnersErr == nil {
+		d.Busy = int32(utils.CountBusy(runners))
+	}
+	return d
+}
+
+// keepAlive records when each runner was last online and returns the number of replicas needed to bring up the runners
+// which have been offline for so long that Github will soon remove them. Last seen times are written to the
+// ScaledActionRunner's status every statusUpdateInterval so that they survive the cache being lost.
+func (h *Host) keepAlive(ctx context.Context, c *client.Client, wf *config.GithubWorkflowConfig, runners []utils.RunnerStatus, haveRunners bool) (int32, error) {
+	now := time.Now().UTC()
+	var replicas int32
+	// Other replicas may be keeping the same runners alive so the keep alive window is recomputed from the latest state
+	s, err := c.UpdateState(func(s *state.ClientState) error {
+		if s.RunnersLastSeen == nil {
+			s.RunnersLastSeen = map[int]time.Time{}
+		}
+		for ordinal, seen := range wf.RunnersLastSeen {
+			if seen.After(s.RunnersLastSeen[ordinal]) {
+				s.RunnersLastSeen[ordinal] = seen
+			}
+		}
+		for _, r := range runners {
+			if r.Online {
+				s.RunnersLastSeen[r.Ordinal] = now
+			}
+		}
+		if !haveRunners && s.KeepAliveSince != nil && now.After(s.KeepAliveSince.Add(wf.Scaling.ForceScaleUpWindow)) {
+			// Without the runner inventory we can't see the runners come online, so assume they did once the window is over
+			for ordinal := range s.RunnersLastSeen {
+				if now.Sub(s.RunnersLastSeen[ordinal]) > wf.Scaling.ForceScaleUpFrequency {
+					s.RunnersLastSeen[ordinal] = now
+				}
+			}
+		}
+		var since *time.Time
+		replicas, since = wf.Scaling.KeepAlive(s.RunnersLastSeen, s.KeepAliveSince, now)
+		klog.V(10).Infof("KeepAlive: ForceScaleUpWindow:%s ForceScaleUpFrequency:%s replicas: %d since: %v", wf.Scaling.ForceScaleUpWindow.String(), wf.Scaling.ForceScaleUpFrequency.String(), replicas, since)
+		s.KeepAliveSince = since
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for ordinal, seen := range s.RunnersLastSeen {
+		if seen.Sub(wf.RunnersLastSeen[ordinal]) > statusUpdateInterval {
+			if err := h.config.SaveRunnersLastSeen(ctx, wf, s.RunnersLastSeen); err != nil {
+				klog.Warningf("Error saving when runners were last seen. %s", err.Error())
+			}
+			break
+		}
+	}
+	return replicas, nil
+}
+
+// recordBlockedJobs counts the jobs matching the selector which are blocked on approvals, concurrency groups etc
+func recordBlockedJobs(blocked []*utils.WorkflowJob, wf *config.GithubWorkflowConfig, wfInfo map[int64]utils.WorkflowInfo, selector labels.Selector) map[string]int {
+	counts := map[string]int{}
+	for _, r := range utils.BlockedReasons {
+		counts[r] = 0
+	}
+	filtered, _ := labeling.FilterBySelector(blocked, wf, wfInfo, selector)
+	for _, j := range filtered {
+		counts[j.BlockedReason]++
+	}
+	for r, c := range counts {
+		guageBlockedJobs.WithLabelValues(wf.Name, wf.Namespace, r).Set(float64(c))
+	}
+	return counts
+}
+
+// recordStaleRuns counts the runs which have at least one stale job, stale runs are often left behind by Github
+// glitches or runners dying so their IDs are logged to help track them down
+func recordStaleRuns(wf *config.GithubWorkflowConfig, stale []*utils.WorkflowJob) map[string][]int64 {
+	runs := map[string][]int64{"pending": {}, "in_progress": {}}
+	seen := map[int64]bool{}
+	for _, j := range stale {
+		if seen[j.GetRunID()] {
+			continue
+		}
+		seen[j.GetRunID()] = true
+		status := "pending"
+		if j.GetStatus() == "in_progress" {
+			status = "in_progress"
+		}
+		runs[status] = append(runs[status], j.GetRunID())
+	}
+	for status, ids := range runs {
+		guageStaleRuns.WithLabelValues(wf.Name, wf.Namespace, status).Set(float64(len(ids)))
+		if len(ids) > 0 {
+			klog.Warningf("Ignoring %d %s runs in %s/%s (%s) which are older than the max age: %v", len(ids), status, wf.Namespace, wf.Name, wf.GitOwnerRepo(), ids)
+		}
+	}
+	return runs
+}
+
+func (h *Host) getClient(wf *config.GithubWorkflowConfig) (*client.Client, error) {
+	var githubClient client.GithubClient
+	var err error
+	if wf.GithubApp != nil {
+		githubClient, err = client.NewGitHubAppClient(*wf.GithubApp, wf.Owner, wf.Repository, wf.Github, h.stateProvider)
+	} else {
+		githubClient, err = client.NewGitHubClient(wf.Tokens, wf.Owner, wf.Repository, wf.Github, h.stateProvider)
 	}
-	clientState, err := client.GetState()
 	if err != nil {
-		return 0, nil, nil, wf, false, err
+		return nil, fmt.Errorf("error creating Github client for %s. %s", wf.GitOwnerRepo(), err.Error())
 	}
-	forceScaleNow, nextForceScale := wf.Scaling.CalculateForcedScale(clientState.NextForcedScale)
-	klog.V(10).Infof("CalculateForcedScale: ForceScaleUpWindow:%s ForceScaleUpFrequency:%s forceScaleNow: %v nextForceScale: %s", wf.Scaling.ForceScaleUpWindow.String(), wf.Scaling.ForceScaleUpFrequency.String(), forceScaleNow, nextForceScale.String())
-	if clientState.NextForcedScale == nil || nextForceScale != *clientState.NextForcedScale {
-		clientState.NextForcedScale = &nextForceScale
-		client.SaveState(clientState)
+	githubClient.Organization = wf.Organization
+	c := client.NewClient(&githubClient, wf.Name, wf.Namespace, wf.GitOwnerRepo(), wf.Github.Host(), h.config.CacheWindow, h.config.CacheWindowWhenEmpty, h.config.WebhookReconcileWindow, h.stateProvider)
+	return &c, nil
+}
+
+// HandleWorkflowJob applies a job from a workflow_job webhook to every workflow that counts jobs in the job's repository
+func (h *Host) HandleWorkflowJob(ctx context.Context, repo *github.Repository, job *github.WorkflowJob) (int, error) {
+	return h.forEachClient(repo, func(c *client.Client) error {
+		return c.ApplyJobEvent(ctx, repo.GetName(), job)
+	})
+}
+
+// HandleWorkflowRun applies a run from a workflow_run webhook to every workflow that counts jobs in the run's repository
+func (h *Host) HandleWorkflowRun(ctx context.Context, repo *github.Repository, run *github.WorkflowRun) (int, error) {
+	return h.forEachClient(repo, func(c *client.Client) error {
+		return c.ApplyRunEvent(ctx, run)
+	})
+}
+
+// Ping returns an error if the state provider can't be written to, it reuses the provider's connections so that
+// readiness probes don't open new ones
+func (h *Host) Ping() error {
+	if pinger, ok := h.stateProvider.(state.Pinger); ok {
+		return pinger.Ping()
 	}
-	filteredJobs, matchedLabels := labeling.FilterBySelector(jobs, wf, wfInfo, selector)
+	return nil
+}
 
-	return len(filteredJobs), retrievalTime, matchedLabels, wf, forceScaleNow, err
+// Watch returns a channel which receives the namespace and name of a workflow whenever a webhook changes its jobs, so
+// that scaling from zero doesn't have to wait to be polled. Call the returned func to stop watching.
+func (h *Host) Watch() (<-chan types.NamespacedName, func()) {
+	ch := make(chan types.NamespacedName, 16)
+	h.watchMutex.Lock()
+	h.watchers[ch] = struct{}{}
+	h.watchMutex.Unlock()
+	return ch, func() {
+		h.watchMutex.Lock()
+		delete(h.watchers, ch)
+		h.watchMutex.Unlock()
+	}
 }
 
-func (h *Host) getClient(wf *config.GithubWorkflowConfig) client.Client {
-	githubClient := client.NewGitHubClient(wf.Token, wf.Owner, wf.Repository)
-	gitOwnerRepo := fmt.Sprintf("%s/%s", wf.Owner, wf.Repository)
-	return client.NewClient(&githubClient, wf.Name, gitOwnerRepo, h.config.CacheWindow, h.config.CacheWindowWhenEmpty, h.stateProvider)
+// notify tells every watcher that name has changed, watchers which are behind miss out rather than blocking webhooks
+func (h *Host) notify(name types.NamespacedName) {
+	h.watchMutex.Lock()
+	defer h.watchMutex.Unlock()
+	for ch := range h.watchers {
+		select {
+		case ch <- name:
+		default:
+		}
+	}
+}
+
+func (h *Host) forEachClient(repo *github.Repository, f func(c *client.Client) error) (int, error) {
+	matched := 0
+	for _, wf := range h.config.GetAllWorkflows() {
+		if !wf.Matches(repo.GetOwner().GetLogin(), repo.GetName(), repo.Topics) {
+			continue
+		}
+		c, err := h.getClient(&wf)
+		if err != nil {
+			return matched, err
+		}
+		if err = f(c); err != nil {
+			return matched, fmt.Errorf("error updating %s/%s. %s", wf.Namespace, wf.Name, err.Error())
+		}
+		h.notify(types.NamespacedName{Namespace: wf.Namespace, Name: wf.Name})
+		matched++
+	}
+	return matched, nil
 }
 
 func NewHost(conf config.Config, params ...interface{}) (*Host, error) {
@@ -92,21 +620,49 @@ func NewHost(conf config.Config, params ...interface{}) (*Host, error) {
 		if err != nil {
 			return nil, err
 		}
+	} else if len(conf.Redis.Addrs) > 0 {
+		attempts := 0
+		for stateProvider == nil && attempts < 120 {
+			stateProvider, err = state.NewRedisStateProvider(conf.Redis)
+			attempts++
+			if err != nil {
+				stateProvider = nil
+				klog.Warningf("Attempt %d - Error connecting to redis: %s", attempts, err.Error())
+				time.Sleep(time.Second)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		stateProvider = state.NewInMemoryStateProvider()
 	}
+	if len(conf.MemcachedServers) > 0 || len(conf.Redis.Addrs) > 0 {
+		// Entries written by earlier versions are kept in memcached/redis between restarts
+		stateProvider = state.NewMigratingStateProvider(stateProvider)
+	}
 	h := Host{
 		config:        conf,
 		stateProvider: stateProvider,
+		budgetMutex:   &sync.Mutex{},
+		throttled:     map[string]int32{},
+		watchMutex:    &sync.Mutex{},
+		watchers:      map[chan types.NamespacedName]struct{}{},
+		refreshMutex:  &sync.Mutex{},
+		refreshing:    map[string]*refresh{},
 	}
 	err = h.config.InitWorkflows()
 	if err != nil {
 		return &h, err
 	}
 	for _, wf := range h.config.GetAllWorkflows() {
-		c := h.getClient(&wf)
+		c, err := h.getClient(&wf)
+		if err != nil {
+			klog.Errorf("Error whilst initializing %s/%s: %s", wf.Namespace, wf.Name, err.Error())
+			continue
+		}
 		jobs, retrievalTime, err := c.GetQueuedJobs(context.Background())
-		name := fmt.Sprintf("%s/%s (%s/%s) @%s", wf.Namespace, wf.Name, wf.Owner, wf.Repository, retrievalTime.String())
+		name := fmt.Sprintf("%s/%s (%s) @%s", wf.Namespace, wf.Name, wf.GitOwnerRepo(), retrievalTime.String())
 		if err != nil {
 			klog.Errorf("Error whilst getting jobs for %s: %s", name, err.Error())
 		}
@@ -1,5 +1,21 @@
 package host
 
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devjoes/github-runner-autoscaler/apiserver/internal/testutils"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/config"
+	client "github.com/devjoes/github-runner-autoscaler/apiserver/pkg/gitclient"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/state"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	"github.com/google/go-github/v33/github"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+)
+
 const (
 	testClientCount = 5
 )
@@ -79,3 +95,55 @@ const (
 // 	assert.Nil(t, err)
 // 	assert.Equal(t, 1, metric)
 // }
+
+func TestNotifiesWatchers(t *testing.T) {
+	h := Host{watchMutex: &sync.Mutex{}, watchers: map[chan types.NamespacedName]struct{}{}}
+	changes, stop := h.Watch()
+	name := types.NamespacedName{Namespace: "ns", Name: "wf"}
+	h.notify(name)
+	assert.Equal(t, name, <-changes)
+	stop()
+	h.notify(name)
+	assert.Len(t, changes, 0)
+	assert.Len(t, h.watchers, 0)
+}
+
+func TestLabelsMetricsWithNamespace(t *testing.T) {
+	a := &config.GithubWorkflowConfig{Name: "runner", Namespace: "a"}
+	b := &config.GithubWorkflowConfig{Name: "runner", Namespace: "b"}
+	stale := []*utils.WorkflowJob{{WorkflowJob: &github.WorkflowJob{RunID: github.Int64(1), Status: github.String("queued")}}}
+	recordStaleRuns(a, stale)
+	recordStaleRuns(b, nil)
+	assert.Equal(t, 1.0, testutil.ToFloat64(guageStaleRuns.WithLabelValues("runner", "a", "pending")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(guageStaleRuns.WithLabelValues("runner", "b", "pending")))
+}
+
+func TestRefreshesEachWorkflowOnceAtATime(t *testing.T) {
+	h := Host{
+		watchMutex:   &sync.Mutex{},
+		watchers:     map[chan types.NamespacedName]struct{}{},
+		refreshMutex: &sync.Mutex{},
+		refreshing:   map[string]*refresh{},
+	}
+	changes, stop := h.Watch()
+	defer stop()
+	innerClient := testutils.ClientMock{QueueLength: 3, Delay: 100 * time.Millisecond}
+	c := client.NewClient(&innerClient, "wf", "default", "owner/repo", "github.com", time.Hour, time.Hour, 0, state.NewInMemoryStateProvider())
+	wf := config.GithubWorkflowConfig{Name: "wf"}
+
+	r := h.refresh(&wf, &c)
+	assert.Same(t, r, h.refresh(&wf, &c))
+	<-r.done
+	assert.Nil(t, r.err)
+	assert.Equal(t, types.NamespacedName{Name: "wf"}, <-changes)
+	snapshot, _ := c.GetSnapshot()
+	assert.Len(t, snapshot.Jobs, 3)
+	assert.False(t, snapshot.Stale)
+
+	h.refreshMutex.Lock()
+	assert.Len(t, h.refreshing, 0)
+	h.refreshMutex.Unlock()
+	next := h.refresh(&wf, &c)
+	assert.NotSame(t, r, next)
+	<-next.done
+}
@@ -0,0 +1,125 @@
+package k8sprovider
+
+import (
+	"context"
+	"time"
+
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/host"
+	pb "github.com/kedacore/keda/v2/pkg/scalers/externalscaler"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// MetricsSelectorKey is the key in the trigger's metadata of the selector which filters the jobs, the same as the
+// selector at the end of the custom metrics URL
+const MetricsSelectorKey = "metricsSelector"
+
+var scaledObjects = schema.GroupResource{Group: "keda.sh", Resource: "scaledobjects"}
+
+// ExternalScaler serves the same metric as the metrics APIs to KEDA over gRPC so that KEDA doesn't need to trust the
+// API server's certificate and can be told as soon as a webhook makes a ScaledObject active
+type ExternalScaler struct {
+	pb.UnimplementedExternalScalerServer
+	value    func(ref *pb.ScaledObjectRef) (int64, error)
+	watch    func() (<-chan types.NamespacedName, func())
+	interval time.Duration
+}
+
+// NewExternalScaler returns a scaler which gets metrics from orchestrator, StreamIsActive checks every interval as
+// well as whenever a webhook changes a workflow
+func NewExternalScaler(orchestrator *host.Host, interval time.Duration) *ExternalScaler {
+	p := &workflowQueueProvider{orchestrator: orchestrator}
+	return &ExternalScaler{
+		value: func(ref *pb.ScaledObjectRef) (int64, error) {
+			return p.externalScalerValue(ref)
+		},
+		watch:    orchestrator.Watch,
+		interval: interval,
+	}
+}
+
+func (p *workflowQueueProvider) externalScalerValue(ref *pb.ScaledObjectRef) (int64, error) {
+	selector := labels.Everything()
+	if s := ref.ScalerMetadata[MetricsSelectorKey]; s != "" && s != "*" {
+		var err error
+		selector, err = labels.Parse(s)
+		if err != nil {
+			return 0, status.Errorf(codes.InvalidArgument, "invalid %s '%s'. %s", MetricsSelectorKey, s, err.Error())
+		}
+	}
+	info := provider.CustomMetricInfo{GroupResource: scaledObjects, Namespaced: true, Metric: ref.Name}
+	value, _, _, _, err := p.valueFor(info, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, selector)
+	if err != nil {
+		if errors.IsNotFound(err) || err.Error() == host.MetricErrNotFound {
+			return 0, status.Errorf(codes.NotFound, "%s/%s not found", ref.Namespace, ref.Name)
+		}
+		return 0, status.Errorf(codes.Unavailable, "error getting metric for %s/%s. %s", ref.Namespace, ref.Name, err.Error())
+	}
+	return value.Value(), nil
+}
+
+func (s *ExternalScaler) IsActive(ctx context.Context, ref *pb.ScaledObjectRef) (*pb.IsActiveResponse, error) {
+	klog.V(5).Infof("IsActive %s/%s", ref.Namespace, ref.Name)
+	value, err := s.value(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.IsActiveResponse{Result: value > 0}, nil
+}
+
+// StreamIsActive sends whether the ScaledObject is active whenever it changes until KEDA disconnects
+func (s *ExternalScaler) StreamIsActive(ref *pb.ScaledObjectRef, stream pb.ExternalScaler_StreamIsActiveServer) error {
+	klog.V(5).Infof("StreamIsActive %s/%s", ref.Namespace, ref.Name)
+	changes, stop := s.watch()
+	defer stop()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	var sent *bool
+	for check := true; ; {
+		if check {
+			value, err := s.value(ref)
+			if err != nil {
+				// KEDA falls back to polling GetMetrics so errors are only logged rather than ending the stream
+				klog.Warningf("Error checking if %s/%s is active. %s", ref.Namespace, ref.Name, err.Error())
+			} else if active := value > 0; sent == nil || *sent != active {
+				if err := stream.Send(&pb.IsActiveResponse{Result: active}); err != nil {
+					return err
+				}
+				sent = &active
+			}
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+			check = true
+		case name := <-changes:
+			check = name.Namespace == ref.Namespace && name.Name == ref.Name
+		}
+	}
+}
+
+func (s *ExternalScaler) GetMetricSpec(ctx context.Context, ref *pb.ScaledObjectRef) (*pb.GetMetricSpecResponse, error) {
+	klog.V(5).Infof("GetMetricSpec %s/%s", ref.Namespace, ref.Name)
+	// The metric is already the number of runners so each runner takes 1
+	return &pb.GetMetricSpecResponse{MetricSpecs: []*pb.MetricSpec{{MetricName: ref.Name, TargetSize: 1}}}, nil
+}
+
+func (s *ExternalScaler) GetMetrics(ctx context.Context, req *pb.GetMetricsRequest) (*pb.GetMetricsResponse, error) {
+	ref := req.ScaledObjectRef
+	if ref == nil {
+		return nil, status.Error(codes.InvalidArgument, "scaledObjectRef is required")
+	}
+	klog.V(5).Infof("GetMetrics %s/%s %s", ref.Namespace, ref.Name, req.MetricName)
+	value, err := s.value(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetMetricsResponse{MetricValues: []*pb.MetricValue{{MetricName: req.MetricName, MetricValue: value}}}, nil
+}
@@ -0,0 +1,90 @@
+package k8sprovider
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/kedacore/keda/v2/pkg/scalers/externalscaler"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type fakeStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent chan bool
+}
+
+func (s *fakeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeStream) Send(r *pb.IsActiveResponse) error {
+	s.sent <- r.Result
+	return nil
+}
+
+func newTestScaler(values map[string]int64, changes chan types.NamespacedName) (*ExternalScaler, *sync.Mutex) {
+	mutex := &sync.Mutex{}
+	return &ExternalScaler{
+		value: func(ref *pb.ScaledObjectRef) (int64, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return values[ref.Name], nil
+		},
+		watch: func() (<-chan types.NamespacedName, func()) {
+			return changes, func() {}
+		},
+		interval: time.Hour,
+	}, mutex
+}
+
+func TestExternalScalerReturnsMetric(t *testing.T) {
+	s, _ := newTestScaler(map[string]int64{"wf": 3}, nil)
+	ref := &pb.ScaledObjectRef{Name: "wf", Namespace: "ns"}
+	active, err := s.IsActive(context.Background(), ref)
+	assert.Nil(t, err)
+	assert.True(t, active.Result)
+	spec, _ := s.GetMetricSpec(context.Background(), ref)
+	assert.Equal(t, []*pb.MetricSpec{{MetricName: "wf", TargetSize: 1}}, spec.MetricSpecs)
+	metrics, err := s.GetMetrics(context.Background(), &pb.GetMetricsRequest{ScaledObjectRef: ref, MetricName: "wf"})
+	assert.Nil(t, err)
+	assert.Equal(t, []*pb.MetricValue{{MetricName: "wf", MetricValue: 3}}, metrics.MetricValues)
+	_, err = s.GetMetrics(context.Background(), &pb.GetMetricsRequest{MetricName: "wf"})
+	assert.NotNil(t, err)
+}
+
+func TestStreamIsActivePushesChanges(t *testing.T) {
+	values := map[string]int64{"wf": 0}
+	changes := make(chan types.NamespacedName)
+	s, mutex := newTestScaler(values, changes)
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &fakeStream{ctx: ctx, sent: make(chan bool, 10)}
+	done := make(chan error)
+	go func() {
+		done <- s.StreamIsActive(&pb.ScaledObjectRef{Name: "wf", Namespace: "ns"}, stream)
+	}()
+	assert.False(t, <-stream.sent)
+
+	// Changes to other workflows, including ones with the same name in another namespace, and changes which don't affect
+	// whether it is active aren't sent
+	wf := types.NamespacedName{Namespace: "ns", Name: "wf"}
+	changes <- types.NamespacedName{Namespace: "ns", Name: "other"}
+	changes <- wf
+	mutex.Lock()
+	values["wf"] = 2
+	mutex.Unlock()
+	changes <- types.NamespacedName{Namespace: "other", Name: "wf"}
+	// Once the next change is received the previous one has been handled
+	changes <- types.NamespacedName{Namespace: "ns", Name: "other"}
+	assert.Len(t, stream.sent, 0)
+	changes <- wf
+	assert.True(t, <-stream.sent)
+	assert.Len(t, stream.sent, 0)
+
+	cancel()
+	assert.Nil(t, <-done)
+}
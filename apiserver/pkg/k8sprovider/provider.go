@@ -32,7 +32,8 @@ type workflowQueueProvider struct {
 	orchestrator *host.Host
 }
 
-func NewProvider(orchestrator *host.Host) provider.CustomMetricsProvider {
+// NewProvider returns a provider which serves the same metrics as both custom and external metrics
+func NewProvider(orchestrator *host.Host) provider.MetricsProvider {
 	klog.V(5).Infof("NewProvider")
 	provider := &workflowQueueProvider{
 		orchestrator: orchestrator,
@@ -60,29 +61,55 @@ func (p *workflowQueueProvider) valueFor(info provider.CustomMetricInfo, name ty
 			klog.Warningf("Invalid selector '%s' in %s. %s", info.Metric, name.String(), err.Error())
 		}
 	}
-	total, retrievalTime, lbls, wf, forceScale, err := p.orchestrator.QueryMetric(name.Name, metricSelector)
+	metric, err := p.orchestrator.QueryMetric(name.Namespace, name.Name, metricSelector)
 	if err != nil && err.Error() == host.MetricErrNotFound {
 		return resource.Quantity{}, time.Time{}, nil, nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
 	}
-
-	promLabels, allLabels := labeling.GetLabelsForOutput(lbls)
-
 	if err != nil {
-		return resource.Quantity{}, time.Time{}, wf, nil, err
+		return resource.Quantity{}, time.Time{}, nil, nil, err
 	}
-	scaledTotal := int(wf.Scaling.GetOutput(int32(total)))
+
+	promLabels, allLabels := labeling.GetLabelsForOutput(metric.MatchedLabels)
+	wf, keepAlive := metric.Workflow, metric.KeepAlive
+	total := metric.Demand.Total()
+	now := time.Now()
+	scaledTotal := int(wf.Scaling.GetOutputForDemandAt(metric.Demand, now))
+	recordActiveWindow(wf, now)
 	promLabels = append([]string{name.String(), metricSelector.String()}, promLabels...)
 
-	if forceScale {
-		promLabels[0] = "ForciblyScaledUp_" + promLabels[0]
-		scaledTotal = int(wf.Scaling.MaxWorkers)
+	if scaledTotal < int(keepAlive) {
+		// Bring up runners which haven't been online for a while so that Github doesn't remove them
+		promLabels[0] = "KeptAlive_" + promLabels[0]
+		scaledTotal = int(keepAlive)
+		if _, max := wf.Scaling.Bounds(now); scaledTotal > int(max) {
+			// Windows which freeze runners win over keeping them alive
+			scaledTotal = int(max)
+		}
+	}
+	if allowed := int(p.orchestrator.Allocate(wf, int32(scaledTotal))); allowed < scaledTotal {
+		// The budget in ScaledActionRunnerCore has run out
+		promLabels[0] = "Throttled_" + promLabels[0]
+		scaledTotal = allowed
 	}
 
 	//TODO: Get the labels out of QueryMetric, maybe move all this instrumentation stuff in to one place
 
 	guageFilteredQueueLength.WithLabelValues(promLabels...).Set(float64(total))
 	guageFilteredScaledQueueLength.WithLabelValues(promLabels...).Set(float64(scaledTotal))
-	return *resource.NewQuantity(int64(scaledTotal), resource.DecimalSI), *retrievalTime, wf, allLabels, nil
+	// The timestamp is when the jobs were retrieved so that clients can tell how stale the metric is
+	return *resource.NewQuantity(int64(scaledTotal), resource.DecimalSI), metric.RetrievalTime, wf, allLabels, nil
+}
+
+// recordActiveWindow sets the window guage to 1 for the active window and 0 for the rest
+func recordActiveWindow(wf *config.GithubWorkflowConfig, now time.Time) {
+	active := wf.Scaling.ActiveWindow(now)
+	for _, w := range wf.Scaling.Windows {
+		value := 0.0
+		if active != nil && active.Name == w.Name {
+			value = 1
+		}
+		guageActiveWindow.WithLabelValues(wf.Name, wf.Namespace, w.Name).Set(value)
+	}
 }
 
 func (p *workflowQueueProvider) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
@@ -149,8 +176,55 @@ func (p *workflowQueueProvider) ListAllMetrics() []provider.CustomMetricInfo {
 	return metrics
 }
 
+// GetExternalMetric returns the metric of the ScaledActionRunner named info.Metric in namespace, metricSelector filters
+// the jobs in the same way as the selector in the custom metric's name does
+func (p *workflowQueueProvider) GetExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	if metricSelector == nil {
+		// Otherwise valueFor would parse the metric name as a selector
+		metricSelector = labels.Everything()
+	}
+	klog.V(5).Infof("GetExternalMetric %s %s %s", namespace, info.Metric, metricSelector.String())
+	name := types.NamespacedName{Namespace: namespace, Name: info.Metric}
+	customInfo := provider.CustomMetricInfo{GroupResource: external_metrics.Resource("ScaledActionRunner"), Namespaced: true, Metric: info.Metric}
+	value, tm, _, lbls, err := p.valueFor(customInfo, name, metricSelector)
+	if err != nil {
+		if errors.IsNotFound(err) || err.Error() == host.MetricErrNotFound {
+			klog.Warningf("External metric not found with %s %s", name, metricSelector.String())
+			return nil, errors.NewNotFound(external_metrics.Resource("GithubWorkflowConfig"), name.Name)
+		}
+		klog.Warningf("Error getting external metric with %s %s. %s", name, metricSelector.String(), err.Error())
+		return nil, errors.NewBadRequest("Error getting metric")
+	}
+	return &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{{
+			MetricName:   info.Metric,
+			MetricLabels: lbls,
+			Timestamp:    v1.Time{Time: tm},
+			Value:        value,
+		}},
+	}, nil
+}
+
+func (p *workflowQueueProvider) ListAllExternalMetrics() []provider.ExternalMetricInfo {
+	klog.V(5).Info("ListAllExternalMetrics")
+	names, err := p.orchestrator.GetAllMetricNames("")
+	if err != nil {
+		klog.Errorf("Error listing all external metrics. %s", err)
+	}
+	seen := map[string]struct{}{}
+	metrics := []provider.ExternalMetricInfo{}
+	for _, name := range names {
+		if _, found := seen[name]; !found {
+			seen[name] = struct{}{}
+			metrics = append(metrics, provider.ExternalMetricInfo{Metric: name})
+		}
+	}
+	return metrics
+}
+
 var guageFilteredQueueLength *prometheus.GaugeVec
 var guageFilteredScaledQueueLength *prometheus.GaugeVec
+var guageActiveWindow *prometheus.GaugeVec
 
 func init() {
 	labelNames := append([]string{"name", "selector"}, labeling.JobLabelsForPrometheus...)
@@ -162,5 +236,8 @@ func init() {
 		Name: "workflow_queue_length_filtered_scaled",
 		Help: "The scaled up/down number of queued jobs filtered by labels",
 	}, labelNames)
-
+	guageActiveWindow = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "workflow_scaling_window_active",
+		Help: "1 if the scheduled window is overriding min/max runners, 0 if it isn't",
+	}, []string{"name", "namespace", "window"})
 }
@@ -8,7 +8,6 @@ import (
 
 	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/config"
 	utils "github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
-	"github.com/google/go-github/v33/github"
 	"k8s.io/apimachinery/pkg/labels"
 )
 
@@ -73,21 +72,27 @@ func sanitizeLabelValue(val string) string {
 	return rxEdges.ReplaceAllString(rx.ReplaceAllString(val, "_"), "")
 }
 
-func getLabels(r *github.WorkflowRun, wf *config.GithubWorkflowConfig, wfInfo map[int64]utils.WorkflowInfo) labels.Set {
+func getLabels(j *utils.WorkflowJob, wf *config.GithubWorkflowConfig, wfInfo map[int64]utils.WorkflowInfo) labels.Set {
+	repo := wf.Repository
+	if j.Repository != "" {
+		// Jobs counted across an organization each come from their own repo
+		repo = j.Repository
+	}
 	var lbls labels.Set = map[string]string{
-		WfIdLabel:        fmt.Sprintf("%d", *r.WorkflowID),
+		WfIdLabel:        fmt.Sprintf("%d", *j.WorkflowID),
 		CrNameLabel:      sanitizeLabelValue(wf.Name),
 		CrNamespaceLabel: sanitizeLabelValue(wf.Namespace),
-		CrRepoLabel:      sanitizeLabelValue(wf.Repository),
+		CrRepoLabel:      sanitizeLabelValue(repo),
 		CrOwnerLabel:     sanitizeLabelValue(wf.Owner),
 	}
 	lbls[WfNameLabel] = "unknown"
-	info, found := wfInfo[*r.WorkflowID]
+	info, found := wfInfo[*j.WorkflowID]
 	if found {
 		lbls[WfNameLabel] = sanitizeLabelValue(info.Name)
 		allRunsOn := strings.Builder{}
-		sort.Strings(info.Labels)
-		for i, rl := range info.Labels {
+		runsOn := append([]string{}, info.LabelsForJob(j.GetName())...)
+		sort.Strings(runsOn)
+		for i, rl := range runsOn {
 			if i > 0 {
 				allRunsOn.WriteString(".")
 			}
@@ -99,18 +104,18 @@ func getLabels(r *github.WorkflowRun, wf *config.GithubWorkflowConfig, wfInfo ma
 	return lbls
 }
 
-func FilterBySelector(runs []*github.WorkflowRun, wf *config.GithubWorkflowConfig, wfInfo map[int64]utils.WorkflowInfo, selector labels.Selector) ([]*github.WorkflowRun, map[string][]string) {
-	filtered := []*github.WorkflowRun{}
+func FilterBySelector(jobs []*utils.WorkflowJob, wf *config.GithubWorkflowConfig, wfInfo map[int64]utils.WorkflowInfo, selector labels.Selector) ([]*utils.WorkflowJob, map[string][]string) {
+	filtered := []*utils.WorkflowJob{}
 	matchedLabels := map[string][]string{}
-	for _, r := range runs {
-		lbls := getLabels(r, wf, wfInfo)
+	for _, j := range jobs {
+		lbls := getLabels(j, wf, wfInfo)
 		if selector.Matches(lbls) {
 			for l, v := range lbls {
 				if !utils.ContainsStr(matchedLabels[l], v) {
 					matchedLabels[l] = append(matchedLabels[l], v)
 				}
 			}
-			filtered = append(filtered, r)
+			filtered = append(filtered, j)
 		}
 	}
 
@@ -65,15 +65,15 @@ func TestFilterBySelectorMatchesSelector(t *testing.T) {
 	assert.Len(t, lbls["wf_runs_on_bar.8"], 1)
 }
 
-func getTestData() ([]*github.WorkflowRun, *config.GithubWorkflowConfig, map[int64]utils.WorkflowInfo) {
-	jobs := []*github.WorkflowRun{}
+func getTestData() ([]*utils.WorkflowJob, *config.GithubWorkflowConfig, map[int64]utils.WorkflowInfo) {
+	jobs := []*utils.WorkflowJob{}
 	wfInfo := make(map[int64]utils.WorkflowInfo)
 	for i := int64(0); i < 80; i++ {
 		id := i
 		wfId := id % 10
-		jobs = append(jobs, &github.WorkflowRun{
-			ID:         &id,
-			WorkflowID: &wfId,
+		jobs = append(jobs, &utils.WorkflowJob{
+			WorkflowJob: &github.WorkflowJob{ID: &id},
+			WorkflowID:  &wfId,
 		})
 		wfInfo[wfId] = utils.WorkflowInfo{
 			ID:     wfId,
@@ -88,3 +88,35 @@ func getTestData() ([]*github.WorkflowRun, *config.GithubWorkflowConfig, map[int
 	}
 	return jobs, &wf, wfInfo
 }
+
+func TestUsesRunsOnOfEachJob(t *testing.T) {
+	wfId := int64(1)
+	info := map[int64]utils.WorkflowInfo{wfId: {
+		ID:     wfId,
+		Name:   "wf",
+		Labels: []string{"gpu", "linux", "windows"},
+		Jobs: map[string][]string{
+			"test (linux, 12)":   {"linux"},
+			"test (windows, 12)": {"windows"},
+			"train":              {"linux", "gpu"},
+		},
+	}}
+	job := func(id int64, name string) *utils.WorkflowJob {
+		return &utils.WorkflowJob{WorkflowJob: &github.WorkflowJob{ID: &id, Name: &name}, WorkflowID: &wfId}
+	}
+	jobs := []*utils.WorkflowJob{job(1, "test (linux, 12)"), job(2, "test (12, windows)"), job(3, "train"), job(4, "unknown")}
+	wf := config.GithubWorkflowConfig{Name: testName, Namespace: testNamespace, Owner: testOwner}
+
+	selector, _ := labels.Parse("wf_runs_on_gpu")
+	matched, _ := FilterBySelector(jobs, &wf, info, selector)
+	assert.Len(t, matched, 2)
+	assert.Equal(t, int64(3), matched[0].GetID())
+	assert.Equal(t, int64(4), matched[1].GetID())
+
+	selector, _ = labels.Parse("wf_runs_on_windows")
+	matched, _ = FilterBySelector(jobs, &wf, info, selector)
+	assert.Len(t, matched, 2)
+	// Matrix values in a different order fall back to every variation of the job
+	assert.Equal(t, int64(2), matched[0].GetID())
+	assert.Equal(t, int64(4), matched[1].GetID())
+}
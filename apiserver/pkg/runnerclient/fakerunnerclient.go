@@ -12,22 +12,25 @@ import (
 type FakeRunnersV1Alpha1Client struct {
 	Runners *[]runnerv1alpha1.ScaledActionRunner
 	Watch   *watch.Interface
+	// StatusPatches are the patches applied to each runner's status, keyed by namespace/name
+	StatusPatches map[string][]byte
 }
 
 func NewFakeRunnersV1Alpha1Client(runners []runnerv1alpha1.ScaledActionRunner) (*FakeRunnersV1Alpha1Client, *watch.FakeWatcher) {
 	fw := watch.NewFakeWithChanSize(2, false)
 	var w watch.Interface = fw
-	return &FakeRunnersV1Alpha1Client{Runners: &runners, Watch: &w}, fw
+	return &FakeRunnersV1Alpha1Client{Runners: &runners, Watch: &w, StatusPatches: map[string][]byte{}}, fw
 }
 
 func (c *FakeRunnersV1Alpha1Client) ScaledActionRunners(namespace string) IScaledActionRunnerClient {
-	return &fakeScaledActionRunnerClient{ns: namespace, runners: c.Runners, watch: c.Watch}
+	return &fakeScaledActionRunnerClient{ns: namespace, runners: c.Runners, watch: c.Watch, statusPatches: c.StatusPatches}
 }
 
 type fakeScaledActionRunnerClient struct {
-	ns      string
-	runners *[]runnerv1alpha1.ScaledActionRunner
-	watch   *watch.Interface
+	ns            string
+	runners       *[]runnerv1alpha1.ScaledActionRunner
+	watch         *watch.Interface
+	statusPatches map[string][]byte
 }
 
 func (c *fakeScaledActionRunnerClient) List(ctx context.Context, opts metav1.ListOptions) (*runnerv1alpha1.ScaledActionRunnerList, error) {
@@ -51,6 +54,10 @@ func (c *fakeScaledActionRunnerClient) Get(ctx context.Context, name string, opt
 func (c *fakeScaledActionRunnerClient) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
 	return *c.watch, nil
 }
+func (c *fakeScaledActionRunnerClient) PatchStatus(ctx context.Context, name string, patch []byte) error {
+	c.statusPatches[c.ns+"/"+name] = patch
+	return nil
+}
 func (c *fakeScaledActionRunnerClient) GetNs() string {
 	return c.ns
 }
@@ -8,6 +8,7 @@ import (
 
 	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
@@ -46,6 +47,7 @@ type IScaledActionRunnerClient interface {
 	List(ctx context.Context, opts metav1.ListOptions) (*runnerv1alpha1.ScaledActionRunnerList, error)
 	Get(ctx context.Context, name string, options metav1.GetOptions) (*runnerv1alpha1.ScaledActionRunner, error)
 	Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+	PatchStatus(ctx context.Context, name string, patch []byte) error
 	GetNs() string
 }
 
@@ -102,6 +104,19 @@ func (c *scaledActionRunnerClient) Watch(ctx context.Context, opts metav1.ListOp
 		Watch(ctx)
 }
 
+// PatchStatus applies a JSON merge patch to the status of a ScaledActionRunner
+func (c *scaledActionRunnerClient) PatchStatus(ctx context.Context, name string, patch []byte) error {
+	return c.restClient.
+		Patch(types.MergePatchType).
+		Namespace(c.ns).
+		Resource(scaledactionrunners).
+		Name(name).
+		SubResource("status").
+		Body(patch).
+		Do(ctx).
+		Error()
+}
+
 func (c *scaledActionRunnerClient) GetNs() string {
 	return c.ns
 }
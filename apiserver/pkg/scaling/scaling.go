@@ -1,12 +1,14 @@
 package scaling
 
 import (
+	"fmt"
 	"math"
-	"math/rand"
 	"strconv"
 	"time"
 
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
 	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	"github.com/devjoes/github-runner-autoscaler/operator/schedule"
 	"k8s.io/klog/v2"
 )
 
@@ -17,10 +19,78 @@ type Scaling struct {
 	Linear                bool          `json:"linear"`
 	ForceScaleUpWindow    time.Duration `json:"forceScaleUpWindow"`
 	ForceScaleUpFrequency time.Duration `json:"forceScaleUpFrequency"`
+	// Strategy overrides Linear and ScaleFactor when it is set
+	Strategy IStrategy `json:"-"`
+	// Windows override MinWorkers and MaxWorkers on a schedule, the first active window wins
+	Windows []Window `json:"-"`
+	// Predictive is nil unless predictive scaling is enabled
+	Predictive *Predictive `json:"predictive,omitempty"`
+	// MaxWait is the wait time SLO, 0 disables it
+	MaxWait time.Duration `json:"maxWait"`
 }
 
-func NewScaling(crd *runnerv1alpha1.ScaledActionRunner) Scaling {
+type Predictive struct {
+	Lookahead time.Duration `json:"lookahead"`
+	Weeks     int           `json:"weeks"`
+}
+
+// HistoryRetention is how much queue history is needed to make a forecast
+func (p *Predictive) HistoryRetention() time.Duration {
+	return time.Duration(p.Weeks)*week + p.Lookahead + utils.HistoryBucket
+}
+
+// Window is a parsed ScheduledWindow
+type Window struct {
+	Name       string
+	Schedule   *schedule.Schedule
+	Duration   time.Duration
+	Location   *time.Location
+	MinWorkers int32
+	MaxWorkers int32
+}
+
+func newWindows(spec *runnerv1alpha1.ScaledActionRunnerSpec) ([]Window, error) {
+	windows := []Window{}
+	for _, w := range spec.Windows {
+		sched, err := schedule.Parse(w.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule for window %s. %s", w.Name, err.Error())
+		}
+		loc, err := w.Location()
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone for window %s. %s", w.Name, err.Error())
+		}
+		min, max := w.Bounds(spec)
+		windows = append(windows, Window{Name: w.Name, Schedule: sched, Duration: w.Duration.Duration, Location: loc, MinWorkers: min, MaxWorkers: max})
+	}
+	return windows, nil
+}
+
+func NewScaling(crd *runnerv1alpha1.ScaledActionRunner) (Scaling, error) {
 	sf, _ := strconv.ParseFloat(*crd.Spec.ScaleFactor, 64)
+	var strategy IStrategy
+	if crd.Spec.Scaling != nil && crd.Spec.Scaling.Strategy != nil {
+		var err error
+		strategy, err = NewStrategy(crd.Spec.Scaling.Strategy)
+		if err != nil {
+			return Scaling{}, fmt.Errorf("invalid scaling strategy. %s", err.Error())
+		}
+	}
+	var predictive *Predictive
+	if crd.Spec.Scaling != nil && crd.Spec.Scaling.Predictive != nil {
+		if err := crd.Spec.Scaling.Predictive.Validate(); err != nil {
+			return Scaling{}, fmt.Errorf("invalid predictive scaling. %s", err.Error())
+		}
+		predictive = &Predictive{Lookahead: crd.Spec.Scaling.Predictive.GetLookahead(), Weeks: crd.Spec.Scaling.Predictive.GetWeeks()}
+	}
+	var maxWait time.Duration
+	if crd.Spec.Scaling != nil && crd.Spec.Scaling.MaxWait != nil {
+		maxWait = crd.Spec.Scaling.MaxWait.Duration
+	}
+	windows, err := newWindows(&crd.Spec)
+	if err != nil {
+		return Scaling{}, err
+	}
 
 	forceScaleUpWindow := time.Duration(20) * time.Minute
 	forceScaleUpFrequency := time.Duration(20*24) * time.Hour
@@ -37,7 +107,11 @@ func NewScaling(crd *runnerv1alpha1.ScaledActionRunner) Scaling {
 		ForceScaleUpFrequency: forceScaleUpFrequency,
 		ScaleFactor:           sf,
 		Linear:                sf == 0,
-	}
+		Strategy:              strategy,
+		Windows:               windows,
+		Predictive:            predictive,
+		MaxWait:               maxWait,
+	}, nil
 }
 
 func logistic(c float64, a float64, k float64, x float64) float64 {
@@ -47,18 +121,111 @@ func logistic(c float64, a float64, k float64, x float64) float64 {
 	return c / (1 + a*math.Pow(b, x))
 }
 
+func (s *Scaling) strategy() IStrategy {
+	if s.Strategy != nil {
+		return s.Strategy
+	}
+	if s.Linear {
+		return linearStrategy{}
+	}
+	return logisticStrategy{factor: s.ScaleFactor}
+}
+
 func (s *Scaling) GetOutput(queueLength int32) int32 {
+	return s.GetOutputForDemand(Demand{Queued: queueLength})
+}
+
+// ActiveWindow returns the first window which is active at now or nil if there isn't one
+func (s *Scaling) ActiveWindow(now time.Time) *Window {
+	for i, w := range s.Windows {
+		if w.Schedule.Active(now, w.Duration, w.Location) {
+			return &s.Windows[i]
+		}
+	}
+	return nil
+}
+
+// Bounds returns MinWorkers and MaxWorkers unless they are overridden by a window which is active at now
+func (s *Scaling) Bounds(now time.Time) (int32, int32) {
+	if w := s.ActiveWindow(now); w != nil {
+		return w.MinWorkers, w.MaxWorkers
+	}
+	return s.MinWorkers, s.MaxWorkers
+}
+
+// GetOutputForDemand returns the number of runners that the strategy wants, kept between MinWorkers and MaxWorkers
+// or the bounds of the active window
+func (s *Scaling) GetOutputForDemand(demand Demand) int32 {
+	return s.GetOutputForDemandAt(demand, time.Now())
+}
+
+// GetOutputForDemandAt is GetOutputForDemand with the windows evaluated at now
+func (s *Scaling) GetOutputForDemandAt(demand Demand, now time.Time) int32 {
+	bounded := *s
+	bounded.MinWorkers, bounded.MaxWorkers = s.Bounds(now)
+	result := bounded.getOutput(demand)
+	if demand.Forecast > float64(demand.Total()) {
+		// Scale for the forecast as if it had already turned up, the busy runners are still busy
+		queued := int32(math.Ceil(demand.Forecast)) - demand.Busy
+		if predicted := bounded.getOutput(Demand{Queued: queued, Busy: demand.Busy}); predicted > result {
+			klog.V(10).Infof("Scaling: pre-scaling to %d for a forecast of %f", predicted, demand.Forecast)
+			result = predicted
+		}
+	}
+	if s.MaxWait > 0 && demand.Queued > 0 && demand.OldestWait > s.MaxWait && result < bounded.MaxWorkers {
+		// The SLO is being breached so ask for a runner for every job and more the longer that jobs are waiting
+		breach := float64(demand.OldestWait) / float64(s.MaxWait)
+		wanted := int32(math.Ceil(math.Max(float64(result), float64(demand.Total())) * breach))
+		if wanted <= result {
+			wanted = result + 1
+		}
+		if wanted > bounded.MaxWorkers {
+			wanted = bounded.MaxWorkers
+		}
+		klog.V(10).Infof("Scaling: oldest job has waited %s which is over %s, scaling from %d to %d", demand.OldestWait.String(), s.MaxWait.String(), result, wanted)
+		result = wanted
+	}
+	return result
+}
+
+const week = 7 * 24 * time.Hour
+
+// Forecast averages the demand at the same weekday and time of day over the previous weeks and returns the highest
+// average within the lookahead. Buckets which weren't recorded, e.g. because the API server was down, are left out of
+// the average.
+func (s *Scaling) Forecast(history *utils.QueueHistory, now time.Time) float64 {
+	if s.Predictive == nil || history == nil {
+		return 0
+	}
+	forecast := 0.0
+	for t := now; !t.After(now.Add(s.Predictive.Lookahead)); t = t.Add(utils.HistoryBucket) {
+		total, count := 0, 0
+		for w := 1; w <= s.Predictive.Weeks; w++ {
+			if d, found := history.At(t.Add(-time.Duration(w) * week)); found {
+				total += int(d)
+				count++
+			}
+		}
+		if count > 0 && float64(total)/float64(count) > forecast {
+			forecast = float64(total) / float64(count)
+		}
+	}
+	return forecast
+}
+
+func (s *Scaling) getOutput(demand Demand) int32 {
 	var result float64
 	fMinWorkers := float64(s.MinWorkers)
 	fMaxWorkers := float64(s.MaxWorkers)
-	fQueueLength := float64(queueLength)
+	queueLength := demand.Total()
 
 	result = fMinWorkers
 	if queueLength > 0 {
-		if s.Linear {
-			result = fQueueLength
-		} else {
-			result = logistic(float64(s.MaxWorkers), float64(s.MaxWorkers), s.ScaleFactor, float64(queueLength))
+		var err error
+		result, err = s.strategy().Runners(demand, s)
+		if err != nil {
+			klog.Warningf("Error scaling for %d queued jobs and %d busy runners, using maxWorkers. %s", demand.Queued, demand.Busy, err.Error())
+			result = fMaxWorkers
 		}
 
 		if result > fMaxWorkers {
@@ -67,32 +234,45 @@ func (s *Scaling) GetOutput(queueLength int32) int32 {
 		if result < fMinWorkers {
 			result = fMinWorkers
 		}
-		if result == 0 && queueLength > 0 {
+		if result == 0 && queueLength > 0 && fMaxWorkers > 0 {
 			result = 1
 		}
 	}
-	klog.V(10).Infof("Scaling: queueLength=%d s.Linear=%t, s.MinWorkers=%d, s.MaxWorkers=%d, s.ScaleFactor=%f.  RESULT=%d (%f)", queueLength, s.Linear, s.MinWorkers, s.MaxWorkers, s.ScaleFactor, math.Round(result), result)
+	klog.V(10).Infof("Scaling: queueLength=%d busy=%d strategy=%T, s.MinWorkers=%d, s.MaxWorkers=%d, s.ScaleFactor=%f.  RESULT=%d (%f)", queueLength, demand.Busy, s.strategy(), s.MinWorkers, s.MaxWorkers, s.ScaleFactor, math.Round(result), result)
 	return int32(math.Round(result))
 }
 
-func (s *Scaling) CalculateForcedScale(nextForcedScale *time.Time) (bool, time.Time) {
+// KeepAlive returns the number of replicas needed to bring up runners which haven't been online for
+// ForceScaleUpFrequency, Github removes runners which have been offline for 30 days. Only the highest ordinal which is
+// due matters as the StatefulSet brings up every ordinal below it. Ordinals which have never been seen are assumed to
+// have just been registered. If the runners don't come online within ForceScaleUpWindow then it backs off for the same
+// amount of time before trying again. since is when the current attempt started, or will start when backing off.
+func (s *Scaling) KeepAlive(lastSeen map[int]time.Time, since *time.Time, now time.Time) (int32, *time.Time) {
 	if s.ForceScaleUpWindow == 0 {
-		return false, *nextForcedScale
+		return 0, nil
 	}
-	rndSecs := rand.Intn(60 * 60 * 24)
-	if nextForcedScale == nil {
-		// If there is no next forced scale window then set it to some random time in the next 24 hours
-		return false, time.Now().UTC().Add(time.Second * time.Duration(rndSecs))
+	due := -1
+	for ordinal := 0; ordinal < int(s.MaxWorkers); ordinal++ {
+		seen, found := lastSeen[ordinal]
+		if !found {
+			lastSeen[ordinal] = now
+		} else if now.Sub(seen) > s.ForceScaleUpFrequency {
+			due = ordinal
+		}
 	}
-
-	endOfForcedScaleWindow := nextForcedScale.Add(s.ForceScaleUpWindow)
-	if endOfForcedScaleWindow.Before(time.Now().UTC()) {
-		// If the forced scale window has ended then set a new one
-		return false, time.Now().UTC().Add(s.ForceScaleUpFrequency + time.Duration(rndSecs))
-	} else if nextForcedScale.Before(time.Now().UTC()) {
-		// If we are in the forced scale window then scale up
-		return true, *nextForcedScale
+	if due < 0 {
+		return 0, nil
 	}
-
-	return false, *nextForcedScale
+	if since == nil {
+		since = &now
+	}
+	if now.Before(*since) {
+		return 0, since
+	}
+	if now.After(since.Add(s.ForceScaleUpWindow)) {
+		klog.Warningf("Runners up to ordinal %d did not come online within %s, backing off", due, s.ForceScaleUpWindow.String())
+		next := now.Add(s.ForceScaleUpWindow)
+		return 0, &next
+	}
+	return int32(due + 1), since
 }
@@ -4,8 +4,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
 	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
 	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func getScaling() Scaling {
@@ -18,7 +20,8 @@ func getScaling() Scaling {
 		},
 	}
 
-	return NewScaling(&crd)
+	s, _ := NewScaling(&crd)
+	return s
 }
 
 func TestMinWorkersWhenNoWork(t *testing.T) {
@@ -68,59 +71,134 @@ func TestLogistic(t *testing.T) {
 	testRangeAgainstOutputs(t, 100, 1, []int{1, 3, 7, 17, 35, 60, 80, 92, 97, 99, 100})
 }
 
-func TestCalculateForcedScale_ShouldReturnNextForceScale_IfNil(t *testing.T) {
+func TestKeepAliveBringsUpRunnersWhichHaveNotBeenSeen(t *testing.T) {
 	s := Scaling{
+		MaxWorkers:            4,
 		ForceScaleUpWindow:    time.Duration(20) * time.Minute,
 		ForceScaleUpFrequency: time.Duration(20*24) * time.Hour,
 	}
-	scaleNow, nextForcedScale := s.CalculateForcedScale(nil)
-	assert.False(t, scaleNow)
-	assert.NotNil(t, nextForcedScale)
-	assert.True(t, nextForcedScale.After(time.Now().UTC()))
-	assert.True(t, nextForcedScale.Before(time.Now().UTC().Add(time.Hour*time.Duration(24))))
+	now := time.Now().UTC()
+	lastSeen := map[int]time.Time{
+		0: now.Add(-time.Hour),
+		1: now.Add(-21 * 24 * time.Hour),
+		2: now.Add(-time.Minute),
+	}
+	replicas, since := s.KeepAlive(lastSeen, nil, now)
+	assert.Equal(t, int32(2), replicas)
+	assert.Equal(t, now, *since)
+	// Ordinal 3 has never been seen so it is tracked from now
+	assert.Equal(t, now, lastSeen[3])
+
+	replicas, since = s.KeepAlive(lastSeen, since, now.Add(10*time.Minute))
+	assert.Equal(t, int32(2), replicas)
+	assert.Equal(t, now, *since)
+
+	lastSeen[1] = now.Add(11 * time.Minute)
+	replicas, since = s.KeepAlive(lastSeen, since, now.Add(11*time.Minute))
+	assert.Equal(t, int32(0), replicas)
+	assert.Nil(t, since)
 }
 
-func TestCalculateForcedScale_ShouldReturnNextForceScale_IfBeforeScaleWindow(t *testing.T) {
+func TestKeepAliveBacksOffIfRunnersDoNotComeOnline(t *testing.T) {
 	s := Scaling{
+		MaxWorkers:            2,
 		ForceScaleUpWindow:    time.Duration(20) * time.Minute,
 		ForceScaleUpFrequency: time.Duration(20*24) * time.Hour,
 	}
-	yesterday := time.Now().UTC().Add(time.Hour * time.Duration(-24))
-	scaleNow, nextForcedScale := s.CalculateForcedScale(&yesterday)
-	assert.False(t, scaleNow)
-	assert.NotNil(t, nextForcedScale)
-	assert.True(t, nextForcedScale.After(time.Now().UTC().Add(s.ForceScaleUpFrequency)))
+	now := time.Now().UTC()
+	lastSeen := map[int]time.Time{0: now, 1: now.Add(-21 * 24 * time.Hour)}
+	replicas, since := s.KeepAlive(lastSeen, nil, now)
+	assert.Equal(t, int32(2), replicas)
+
+	later := now.Add(21 * time.Minute)
+	replicas, since = s.KeepAlive(lastSeen, since, later)
+	assert.Equal(t, int32(0), replicas)
+	assert.Equal(t, later.Add(s.ForceScaleUpWindow), *since)
+	replicas, since = s.KeepAlive(lastSeen, since, later.Add(time.Minute))
+	assert.Equal(t, int32(0), replicas)
+	replicas, _ = s.KeepAlive(lastSeen, since, later.Add(s.ForceScaleUpWindow+time.Minute))
+	assert.Equal(t, int32(2), replicas)
 }
 
-func TestCalculateForcedScale_ShouldReturnTrueScaleNow_IfInScalingWindow(t *testing.T) {
+func TestKeepAliveDoesNothingIfDisabled(t *testing.T) {
 	s := Scaling{
-		ForceScaleUpWindow:    time.Duration(20) * time.Minute,
+		MaxWorkers:            2,
+		ForceScaleUpWindow:    time.Duration(0),
 		ForceScaleUpFrequency: time.Duration(20*24) * time.Hour,
 	}
-	fiveMinsAgo := time.Now().UTC().Add(time.Minute * time.Duration(-5))
-	scaleNow, nextForcedScale := s.CalculateForcedScale(&fiveMinsAgo)
-	assert.True(t, scaleNow)
-	assert.Equal(t, fiveMinsAgo, nextForcedScale)
+	now := time.Now().UTC()
+	replicas, since := s.KeepAlive(map[int]time.Time{0: now.Add(-30 * 24 * time.Hour)}, nil, now)
+	assert.Equal(t, int32(0), replicas)
+	assert.Nil(t, since)
 }
 
-func TestCalculateForcedScale_ShouldDoNothing_IfScalingWindowIsInFuture(t *testing.T) {
-	s := Scaling{
-		ForceScaleUpWindow:    time.Duration(20) * time.Minute,
-		ForceScaleUpFrequency: time.Duration(20*24) * time.Hour,
+func TestWindowsOverrideBounds(t *testing.T) {
+	one := "1"
+	zero, three := int32(0), int32(3)
+	crd := runnerv1alpha1.ScaledActionRunner{
+		Spec: runnerv1alpha1.ScaledActionRunnerSpec{
+			MaxRunners:  10,
+			MinRunners:  1,
+			ScaleFactor: &one,
+			Windows: []runnerv1alpha1.ScheduledWindow{
+				{Name: "freeze", Schedule: "0 2 * * 0", Duration: metav1.Duration{Duration: 2 * time.Hour}, MaxRunners: &zero},
+				{Name: "office-hours", Schedule: "0 9 * * 1-5", Duration: metav1.Duration{Duration: 8 * time.Hour}, Timezone: "America/New_York", MinRunners: &three},
+			},
+		},
 	}
-	hourInFuture := time.Now().UTC().Add(time.Hour)
-	scaleNow, nextForcedScale := s.CalculateForcedScale(&hourInFuture)
-	assert.False(t, scaleNow)
-	assert.Equal(t, hourInFuture, nextForcedScale)
+	s, err := NewScaling(&crd)
+	assert.Nil(t, err)
+	s.Linear = true
+
+	// Monday 10:00 in New York
+	monday := time.Date(2021, 5, 3, 14, 0, 0, 0, time.UTC)
+	assert.Equal(t, "office-hours", s.ActiveWindow(monday).Name)
+	assert.Equal(t, int32(3), s.GetOutputForDemandAt(Demand{}, monday))
+	assert.Equal(t, int32(5), s.GetOutputForDemandAt(Demand{Queued: 5}, monday))
+
+	// Sunday 03:00 UTC
+	sunday := time.Date(2021, 5, 2, 3, 0, 0, 0, time.UTC)
+	assert.Equal(t, "freeze", s.ActiveWindow(sunday).Name)
+	assert.Equal(t, int32(0), s.GetOutputForDemandAt(Demand{Queued: 5}, sunday))
+
+	// Sunday 06:00 UTC
+	assert.Nil(t, s.ActiveWindow(sunday.Add(3*time.Hour)))
+	assert.Equal(t, int32(1), s.GetOutputForDemandAt(Demand{}, sunday.Add(3*time.Hour)))
 }
 
-func TestCalculateForcedScale_ShouldDoNothing_IfScalingIsDisabled(t *testing.T) {
-	s := Scaling{
-		ForceScaleUpWindow:    time.Duration(0),
-		ForceScaleUpFrequency: time.Duration(20*24) * time.Hour,
+func TestPreScalesForForecast(t *testing.T) {
+	s := getScaling()
+	s.Linear = true
+	s.Predictive = &Predictive{Lookahead: 30 * time.Minute, Weeks: 2}
+	now := time.Date(2021, 5, 17, 8, 50, 0, 0, time.UTC)
+
+	history := utils.QueueHistory{}
+	for w := 2; w >= 1; w-- {
+		weekAgo := now.Add(-time.Duration(w) * week)
+		history.Record(weekAgo, 0, s.Predictive.HistoryRetention())
+		// A push storm at 9:00 on the previous Mondays
+		history.Record(weekAgo.Add(10*time.Minute), int32(4*w), s.Predictive.HistoryRetention())
 	}
-	now := time.Now().UTC()
-	scaleNow, nextForcedScale := s.CalculateForcedScale(&now)
-	assert.False(t, scaleNow)
-	assert.Equal(t, now, nextForcedScale)
+
+	forecast := s.Forecast(&history, now)
+	assert.Equal(t, 6.0, forecast)
+	assert.Equal(t, int32(6), s.GetOutputForDemandAt(Demand{Queued: 1, Forecast: forecast}, now))
+	assert.Equal(t, int32(8), s.GetOutputForDemandAt(Demand{Queued: 8, Forecast: forecast}, now))
+
+	// Nothing is forecast outside of the lookahead
+	assert.Equal(t, 0.0, s.Forecast(&history, now.Add(-time.Hour)))
+}
+
+func TestScalesUpWhileMaxWaitIsBreached(t *testing.T) {
+	s := getScaling()
+	s.ScaleFactor = 0.1
+	s.MaxWait = 5 * time.Minute
+	now := time.Now()
+
+	within := s.GetOutputForDemandAt(Demand{Queued: 4, Busy: 2, OldestWait: 4 * time.Minute}, now)
+	breached := s.GetOutputForDemandAt(Demand{Queued: 4, Busy: 2, OldestWait: 6 * time.Minute}, now)
+	assert.Less(t, within, int32(6))
+	assert.Equal(t, int32(8), breached)
+	assert.Equal(t, int32(10), s.GetOutputForDemandAt(Demand{Queued: 4, Busy: 2, OldestWait: 15 * time.Minute}, now))
+	assert.Equal(t, int32(10), s.GetOutputForDemandAt(Demand{Queued: 40, Busy: 2, OldestWait: time.Hour}, now))
 }
@@ -0,0 +1,109 @@
+package scaling
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	"github.com/devjoes/github-runner-autoscaler/operator/expression"
+)
+
+// Demand is what the number of runners is worked out from
+type Demand struct {
+	// Queued is the number of jobs waiting for a runner
+	Queued int32
+	// Busy is the number of runners which are running a job
+	Busy int32
+	// Forecast is the highest total demand expected within the lookahead, it is 0 unless predictive scaling is enabled
+	Forecast float64
+	// OldestWait is how long the oldest queued job has been waiting for a runner
+	OldestWait time.Duration
+}
+
+func (d Demand) Total() int32 {
+	return d.Queued + d.Busy
+}
+
+// IStrategy works out how many runners are wanted for the demand, the result is kept between MinWorkers and MaxWorkers
+// by Scaling
+type IStrategy interface {
+	Runners(d Demand, s *Scaling) (float64, error)
+}
+
+// NewStrategy validates and builds the strategy configured on a ScaledActionRunner
+func NewStrategy(spec *v1alpha1.ScalingStrategy) (IStrategy, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	factor, _ := strconv.ParseFloat(spec.Factor, 64)
+	switch spec.Type {
+	case v1alpha1.StrategyLogistic:
+		return logisticStrategy{factor: factor}, nil
+	case v1alpha1.StrategyStep:
+		return stepStrategy{steps: spec.Steps}, nil
+	case v1alpha1.StrategyExponential:
+		return exponentialStrategy{base: factor}, nil
+	case v1alpha1.StrategyExpression:
+		expr, err := expression.Parse(spec.Expression, v1alpha1.ScalingExpressionVars)
+		if err != nil {
+			return nil, err
+		}
+		return expressionStrategy{expr: expr}, nil
+	}
+	return linearStrategy{}, nil
+}
+
+// linearStrategy asks for a runner per job
+type linearStrategy struct{}
+
+func (linearStrategy) Runners(d Demand, s *Scaling) (float64, error) {
+	return float64(d.Total()), nil
+}
+
+// logisticStrategy scales up eagerly and levels off as it approaches MaxWorkers
+type logisticStrategy struct {
+	factor float64
+}
+
+func (l logisticStrategy) Runners(d Demand, s *Scaling) (float64, error) {
+	return logistic(float64(s.MaxWorkers), float64(s.MaxWorkers), l.factor, float64(d.Total())), nil
+}
+
+// stepStrategy uses the runners of the highest step whose queued is no more than the demand
+type stepStrategy struct {
+	steps []v1alpha1.ScalingStep
+}
+
+func (st stepStrategy) Runners(d Demand, s *Scaling) (float64, error) {
+	runners := int32(0)
+	for _, step := range st.steps {
+		if step.Queued > d.Total() {
+			break
+		}
+		runners = step.Runners
+	}
+	return float64(runners), nil
+}
+
+// exponentialStrategy grows by base^demand - 1 e.g. a base of 2 gives 1, 3, 7, 15...
+type exponentialStrategy struct {
+	base float64
+}
+
+func (e exponentialStrategy) Runners(d Demand, s *Scaling) (float64, error) {
+	return math.Pow(e.base, float64(d.Total())) - 1, nil
+}
+
+type expressionStrategy struct {
+	expr *expression.Expression
+}
+
+func (e expressionStrategy) Runners(d Demand, s *Scaling) (float64, error) {
+	return e.expr.Evaluate(map[string]float64{
+		"queued": float64(d.Queued),
+		"busy":   float64(d.Busy),
+		"min":    float64(s.MinWorkers),
+		"max":    float64(s.MaxWorkers),
+	})
+}
@@ -0,0 +1,92 @@
+package scaling
+
+import (
+	"testing"
+
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+)
+
+func scalingWithStrategy(t *testing.T, strategy runnerv1alpha1.ScalingStrategy) Scaling {
+	zero := "0"
+	s, err := NewScaling(&runnerv1alpha1.ScaledActionRunner{
+		Spec: runnerv1alpha1.ScaledActionRunnerSpec{
+			MinRunners:  1,
+			MaxRunners:  20,
+			ScaleFactor: &zero,
+			Scaling:     &runnerv1alpha1.Scaling{Strategy: &strategy},
+		},
+	})
+	assert.Nil(t, err)
+	return s
+}
+
+func TestStepStrategy(t *testing.T) {
+	s := scalingWithStrategy(t, runnerv1alpha1.ScalingStrategy{
+		Type:  runnerv1alpha1.StrategyStep,
+		Steps: []runnerv1alpha1.ScalingStep{{Queued: 1, Runners: 2}, {Queued: 5, Runners: 8}, {Queued: 10, Runners: 50}},
+	})
+	for queued, expected := range map[int32]int32{0: 1, 1: 2, 4: 2, 5: 8, 9: 8, 10: 20} {
+		assert.Equal(t, expected, s.GetOutput(queued), "%d queued", queued)
+	}
+}
+
+func TestExponentialStrategy(t *testing.T) {
+	s := scalingWithStrategy(t, runnerv1alpha1.ScalingStrategy{Type: runnerv1alpha1.StrategyExponential, Factor: "2"})
+	for queued, expected := range map[int32]int32{1: 1, 2: 3, 3: 7, 4: 15, 5: 20} {
+		assert.Equal(t, expected, s.GetOutput(queued), "%d queued", queued)
+	}
+}
+
+func TestExpressionStrategy(t *testing.T) {
+	s := scalingWithStrategy(t, runnerv1alpha1.ScalingStrategy{Type: runnerv1alpha1.StrategyExpression, Expression: "ceil(queued*1.5)+busy"})
+	assert.Equal(t, int32(1), s.GetOutputForDemand(Demand{}))
+	assert.Equal(t, int32(2), s.GetOutputForDemand(Demand{Queued: 1}))
+	assert.Equal(t, int32(7), s.GetOutputForDemand(Demand{Queued: 3, Busy: 2}))
+	assert.Equal(t, int32(20), s.GetOutputForDemand(Demand{Queued: 30, Busy: 2}))
+
+	s = scalingWithStrategy(t, runnerv1alpha1.ScalingStrategy{Type: runnerv1alpha1.StrategyExpression, Expression: "queued / (busy - 1)"})
+	// Errors scale up rather than risk starving the queue
+	assert.Equal(t, int32(20), s.GetOutputForDemand(Demand{Queued: 3, Busy: 1}))
+}
+
+func TestLegacyScaleFactorIsUsedWithoutAStrategy(t *testing.T) {
+	linear := scalingWithStrategy(t, runnerv1alpha1.ScalingStrategy{Type: runnerv1alpha1.StrategyLinear})
+	legacy := linear
+	legacy.Strategy = nil
+	for i := int32(0); i < 25; i++ {
+		assert.Equal(t, legacy.GetOutput(i), linear.GetOutput(i))
+	}
+	logistic := scalingWithStrategy(t, runnerv1alpha1.ScalingStrategy{Type: runnerv1alpha1.StrategyLogistic, Factor: "0.5"})
+	legacy.Linear = false
+	legacy.ScaleFactor = 0.5
+	for i := int32(0); i < 25; i++ {
+		assert.Equal(t, legacy.GetOutput(i), logistic.GetOutput(i))
+	}
+}
+
+func TestRejectsInvalidStrategies(t *testing.T) {
+	zero := "0"
+	for message, strategy := range map[string]runnerv1alpha1.ScalingStrategy{
+		"unknown type 'quadratic'":                      {Type: "quadratic"},
+		"factor '' is not a number":                     {Type: runnerv1alpha1.StrategyLogistic},
+		"factor must be greater than 1":                 {Type: runnerv1alpha1.StrategyExponential, Factor: "1"},
+		"at least one step must be specified":           {Type: runnerv1alpha1.StrategyStep},
+		"steps must be in ascending order of queued":    {Type: runnerv1alpha1.StrategyStep, Steps: []runnerv1alpha1.ScalingStep{{Queued: 5}, {Queued: 5}}},
+		"steps can only be set for the step strategy":   {Type: runnerv1alpha1.StrategyLinear, Steps: []runnerv1alpha1.ScalingStep{{Queued: 5}}},
+		"unknown variable 'pending'":                    {Type: runnerv1alpha1.StrategyExpression, Expression: "pending * 2"},
+		"expression can only be set for the expression": {Type: runnerv1alpha1.StrategyLinear, Expression: "queued"},
+	} {
+		strategy := strategy
+		_, err := NewScaling(&runnerv1alpha1.ScaledActionRunner{
+			Spec: runnerv1alpha1.ScaledActionRunnerSpec{
+				ScaleFactor: &zero,
+				Scaling:     &runnerv1alpha1.Scaling{Strategy: &strategy},
+			},
+		})
+		if assert.NotNil(t, err, message) {
+			assert.Contains(t, err.Error(), "invalid scaling strategy")
+			assert.Contains(t, err.Error(), message)
+		}
+	}
+}
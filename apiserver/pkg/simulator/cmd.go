@@ -0,0 +1,107 @@
+package simulator
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Run is the simulate subcommand, it reads the ScaledActionRunner and queue named in args and writes the result to out
+func Run(args []string, out io.Writer) error {
+	defaults := DefaultOptions()
+	opts := Options{}
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	runnerPath := flags.String("runner", "", "ScaledActionRunner manifest (YAML or JSON)")
+	queuePath := flags.String("queue", "", "Queue to replay, CSV of time,queued[,busy] or a JSON array of {time, queued, busy}. Times are RFC3339 or seconds")
+	format := flags.String("format", "", "Format of the queue, csv or json. Defaults to the queue's file extension")
+	output := flags.String("output", "table", "Output format, table, csv or json")
+	scaleFactor := flags.String("scale-factor", "", "Overrides the ScaledActionRunner's scaleFactor")
+	flags.DurationVar(&opts.CacheWindow, "cache-window", defaults.CacheWindow, "How long the API server caches the queue for")
+	flags.DurationVar(&opts.StartupDelay, "startup-delay", defaults.StartupDelay, "How long a runner takes to come online")
+	flags.DurationVar(&opts.HpaSyncPeriod, "hpa-sync-period", defaults.HpaSyncPeriod, "The HPA's sync period")
+	flags.DurationVar(&opts.Tail, "tail", defaults.Tail, "How long to carry on after the last sample")
+	flags.DurationVar(&opts.LastSeen, "last-seen", defaults.LastSeen, "How long before the first sample every runner was last online, for keep alive scaling")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *runnerPath == "" || *queuePath == "" {
+		return errors.New("--runner and --queue are required")
+	}
+
+	runnerFile, err := os.Open(*runnerPath)
+	if err != nil {
+		return err
+	}
+	defer runnerFile.Close()
+	crd, err := ReadRunner(runnerFile)
+	if err != nil {
+		return err
+	}
+	if *scaleFactor != "" {
+		if _, err := strconv.ParseFloat(*scaleFactor, 64); err != nil {
+			return fmt.Errorf("Could not parse %s as a float64", *scaleFactor)
+		}
+		crd.Spec.ScaleFactor = scaleFactor
+	}
+
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(*queuePath)), ".")
+	}
+	queueFile, err := os.Open(*queuePath)
+	if err != nil {
+		return err
+	}
+	defer queueFile.Close()
+	samples, err := ReadSamples(queueFile, *format)
+	if err != nil {
+		return fmt.Errorf("could not read queue. %s", err.Error())
+	}
+
+	result, err := Simulate(crd, samples, opts)
+	if err != nil {
+		return err
+	}
+	return Write(out, result, *output)
+}
+
+// Write writes the result as a table, CSV or JSON. The table lists the points followed by a summary, CSV only has the
+// points.
+func Write(out io.Writer, result *Result, output string) error {
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	case "csv":
+		w := csv.NewWriter(out)
+		w.Write([]string{"time", "demand", "metric", "replicas", "ready", "waiting", "keptAlive"})
+		for _, p := range result.Points {
+			w.Write([]string{p.Time.Format(time.RFC3339), fmt.Sprint(p.Demand), fmt.Sprint(p.Metric), fmt.Sprint(p.Replicas), fmt.Sprint(p.Ready), fmt.Sprint(p.Waiting), fmt.Sprint(p.KeptAlive)})
+		}
+		w.Flush()
+		return w.Error()
+	case "table":
+		fmt.Fprintf(out, "%-25s %8s %8s %8s %8s %8s %10s\n", "TIME", "DEMAND", "METRIC", "REPLICAS", "READY", "WAITING", "KEPTALIVE")
+		for _, p := range result.Points {
+			fmt.Fprintf(out, "%-25s %8d %8d %8d %8d %8d %10d\n", p.Time.Format(time.RFC3339), p.Demand, p.Metric, p.Replicas, p.Ready, p.Waiting, p.KeptAlive)
+		}
+		fmt.Fprintln(out)
+		fmt.Fprintf(out, "Runner minutes:      %.1f\n", result.RunnerMinutes)
+		fmt.Fprintf(out, "Peak replicas:       %d\n", result.PeakReplicas)
+		fmt.Fprintf(out, "Waiting job minutes: %.1f\n", result.WaitingJobMinutes)
+		fmt.Fprintf(out, "Peak waiting:        %d\n", result.PeakWaiting)
+		fmt.Fprintf(out, "Mean wait:           %s\n", result.MeanWait.String())
+		fmt.Fprintf(out, "Longest wait:        %s\n", result.LongestWait.String())
+		return nil
+	default:
+		return fmt.Errorf("unknown output '%s', expected table, csv or json", output)
+	}
+}
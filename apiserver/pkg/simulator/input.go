@@ -0,0 +1,131 @@
+package simulator
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Sample is the queue at a point in time, it lasts until the next sample
+type Sample struct {
+	Time time.Time
+	// Queued is the number of jobs waiting for a runner
+	Queued int32
+	// Busy is the number of jobs running, it is optional as recorded queues often only have the queue length
+	Busy int32
+}
+
+// parseTime accepts RFC3339 or a number of seconds. Seconds are from the epoch so use RFC3339 when windows or
+// predictive scaling matter.
+func parseTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, 0).UTC().Add(time.Duration(seconds * float64(time.Second))), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' is not RFC3339 or a number of seconds", value)
+	}
+	return t, nil
+}
+
+// ReadSamples reads a queue from CSV (time,queued[,busy] with an optional header) or JSON (an array of
+// {"time", "queued", "busy"}) and returns it in order of time
+func ReadSamples(r io.Reader, format string) ([]Sample, error) {
+	var samples []Sample
+	var err error
+	switch format {
+	case "csv":
+		samples, err = readCsv(r)
+	case "json":
+		samples, err = readJson(r)
+	default:
+		return nil, fmt.Errorf("unknown format '%s', expected csv or json", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("the queue doesn't contain any samples")
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	return samples, nil
+}
+
+func readCsv(r io.Reader) ([]Sample, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	samples := []Sample{}
+	for i, record := range records {
+		if len(record) < 2 {
+			return nil, fmt.Errorf("line %d should be time,queued[,busy]", i+1)
+		}
+		if i == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "time") {
+			continue
+		}
+		t, err := parseTime(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d. %s", i+1, err.Error())
+		}
+		s := Sample{Time: t}
+		counts := []*int32{&s.Queued, &s.Busy}
+		for j := 1; j < len(record) && j <= len(counts); j++ {
+			n, err := strconv.Atoi(strings.TrimSpace(record[j]))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("line %d. '%s' is not a count", i+1, record[j])
+			}
+			*counts[j-1] = int32(n)
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+func readJson(r io.Reader) ([]Sample, error) {
+	var raw []struct {
+		Time   interface{} `json:"time"`
+		Queued int32       `json:"queued"`
+		Busy   int32       `json:"busy"`
+	}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	samples := []Sample{}
+	for i, s := range raw {
+		t, err := parseTime(fmt.Sprint(s.Time))
+		if err != nil {
+			return nil, fmt.Errorf("sample %d. %s", i, err.Error())
+		}
+		if s.Queued < 0 || s.Busy < 0 {
+			return nil, fmt.Errorf("sample %d can't be negative", i)
+		}
+		samples = append(samples, Sample{Time: t, Queued: s.Queued, Busy: s.Busy})
+	}
+	return samples, nil
+}
+
+// ReadRunner reads a ScaledActionRunner manifest in YAML or JSON
+func ReadRunner(r io.Reader) (*runnerv1alpha1.ScaledActionRunner, error) {
+	crd := runnerv1alpha1.ScaledActionRunner{}
+	if err := yaml.NewYAMLOrJSONDecoder(r, 4096).Decode(&crd); err != nil {
+		return nil, fmt.Errorf("could not read ScaledActionRunner. %s", err.Error())
+	}
+	if crd.Spec.MaxRunners <= 0 {
+		return nil, errors.New("maxRunners must be specified")
+	}
+	return &crd, nil
+}
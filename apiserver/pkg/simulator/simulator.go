@@ -0,0 +1,458 @@
+// Package simulator replays a queue through the scaling of a ScaledActionRunner offline. It emulates the API server's
+// cache and keep alive scaling, KEDA's polling and cooldown, the HPA's tolerance, stabilization windows and scaling
+// policies and the time that runners take to come online, so that scaling settings can be tried out against a recorded
+// or synthetic queue before they are deployed.
+package simulator
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/scaling"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+)
+
+const (
+	// KEDA's defaults for a ScaledObject
+	defaultPollingInterval = 30 * time.Second
+	defaultCooldownPeriod  = 300 * time.Second
+	// hpaTolerance is the HPA's default --horizontal-pod-autoscaler-tolerance
+	hpaTolerance = 0.1
+	step         = time.Second
+)
+
+type Options struct {
+	// CacheWindow is how long the API server caches the queue for
+	CacheWindow time.Duration
+	// StartupDelay is how long a runner takes to come online after it is scheduled
+	StartupDelay time.Duration
+	// HpaSyncPeriod is the HPA's --horizontal-pod-autoscaler-sync-period
+	HpaSyncPeriod time.Duration
+	// Tail is how long to carry on after the last sample, so that scaling down is included
+	Tail time.Duration
+	// LastSeen is how long before the first sample every runner was last online, keep alive scaling brings up the
+	// runners which haven't been online for forceScaleUpFrequency
+	LastSeen time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		CacheWindow:   time.Minute,
+		StartupDelay:  time.Minute,
+		HpaSyncPeriod: 15 * time.Second,
+		Tail:          10 * time.Minute,
+	}
+}
+
+// Point is the state of the simulation when something changed
+type Point struct {
+	Time time.Time `json:"time"`
+	// Demand is the number of jobs which need a runner, queued or busy
+	Demand int32 `json:"demand"`
+	// Metric is the value returned by the API server
+	Metric   int32 `json:"metric"`
+	Replicas int32 `json:"replicas"`
+	Ready    int32 `json:"ready"`
+	// Waiting is the number of jobs waiting for a runner
+	Waiting int32 `json:"waiting"`
+	// KeptAlive is the number of replicas that keep alive scaling wants, the metric is raised to it
+	KeptAlive int32 `json:"keptAlive"`
+}
+
+type Result struct {
+	Points        []Point `json:"points"`
+	RunnerMinutes float64 `json:"runnerMinutes"`
+	PeakReplicas  int32   `json:"peakReplicas"`
+	// WaitingJobMinutes is the total time that jobs spent waiting for a runner
+	WaitingJobMinutes float64 `json:"waitingJobMinutes"`
+	PeakWaiting       int32   `json:"peakWaiting"`
+	// MeanWait is estimated from WaitingJobMinutes and the number of jobs that arrived (Little's law)
+	MeanWait time.Duration `json:"meanWait"`
+	// LongestWait is the longest time that there was always at least one job waiting, no job waited for longer
+	LongestWait time.Duration `json:"longestWait"`
+}
+
+type scaleEvent struct {
+	time   time.Time
+	change int32
+}
+
+type recommendation struct {
+	time     time.Time
+	replicas int32
+}
+
+type simulation struct {
+	crd     *runnerv1alpha1.ScaledActionRunner
+	scale   scaling.Scaling
+	opts    Options
+	min     int32
+	max     int32
+	history *utils.QueueHistory
+
+	// started is when each runner was scheduled, indexed by ordinal
+	started []time.Time
+	// lastSeen is when each runner was last online as seen by the API server, indexed by ordinal
+	lastSeen        map[int]time.Time
+	keepAliveSince  *time.Time
+	keptAlive       int32
+	fetchedAt       time.Time
+	cached          scaling.Demand
+	waitingSince    *time.Time
+	lastActive      time.Time
+	recommendations []recommendation
+	events          []scaleEvent
+}
+
+// Simulate replays samples through crd's scaling and returns the replicas over time along with estimates of the cost
+// and wait times
+func Simulate(crd *runnerv1alpha1.ScaledActionRunner, samples []Sample, opts Options) (*Result, error) {
+	if len(samples) == 0 {
+		return nil, errors.New("the queue doesn't contain any samples")
+	}
+	if crd.Spec.ScaleFactor == nil {
+		point8 := "0.8"
+		crd.Spec.ScaleFactor = &point8
+	}
+	scale, err := scaling.NewScaling(crd)
+	if err != nil {
+		return nil, err
+	}
+	if opts.HpaSyncPeriod <= 0 {
+		opts.HpaSyncPeriod = DefaultOptions().HpaSyncPeriod
+	}
+	min, max := crd.Spec.ReplicaBounds()
+	s := simulation{crd: crd, scale: scale, opts: opts, min: min, max: max}
+	if scale.Predictive != nil {
+		s.history = &utils.QueueHistory{}
+	}
+	return s.run(samples), nil
+}
+
+// pollingInterval returns KEDA's default when pollingInterval isn't positive as the simulation polls every multiple of it
+func (s *simulation) pollingInterval() time.Duration {
+	if s.crd.Spec.Scaling != nil && s.crd.Spec.Scaling.PollingInterval != nil && *s.crd.Spec.Scaling.PollingInterval > 0 {
+		return time.Duration(*s.crd.Spec.Scaling.PollingInterval) * time.Second
+	}
+	return defaultPollingInterval
+}
+
+func (s *simulation) cooldownPeriod() time.Duration {
+	if s.crd.Spec.Scaling != nil && s.crd.Spec.Scaling.CooldownPeriod != nil {
+		return time.Duration(*s.crd.Spec.Scaling.CooldownPeriod) * time.Second
+	}
+	return defaultCooldownPeriod
+}
+
+func (s *simulation) run(samples []Sample) *Result {
+	result := Result{Points: []Point{}}
+	start := samples[0].Time
+	end := samples[len(samples)-1].Time.Add(s.opts.Tail)
+	polling, cooldown := s.pollingInterval(), s.cooldownPeriod()
+	s.resize(start, s.min)
+	s.lastActive = start
+	s.lastSeen = map[int]time.Time{}
+	for ordinal := 0; ordinal < int(s.crd.Spec.MaxRunners); ordinal++ {
+		s.lastSeen[ordinal] = start.Add(-s.opts.LastSeen)
+	}
+	s.fetchedAt = start.Add(-s.opts.CacheWindow)
+
+	var arrivals, previous int32
+	var metric int32
+	next := 0
+	for t := start; !t.After(end); t = t.Add(step) {
+		for next < len(samples) && !samples[next].Time.After(t) {
+			next++
+		}
+		demand := samples[next-1].Queued + samples[next-1].Busy
+		if t.After(samples[len(samples)-1].Time) {
+			// The queue drains after the last sample
+			demand = 0
+		}
+		if demand > previous {
+			arrivals += demand - previous
+		}
+		previous = demand
+
+		ready := s.ready(t)
+		busy := demand
+		if busy > ready {
+			busy = ready
+		}
+		waiting := demand - busy
+		if waiting > 0 && s.waitingSince == nil {
+			since := t
+			s.waitingSince = &since
+		} else if waiting == 0 {
+			s.waitingSince = nil
+		}
+
+		// The HPA goes first so that after KEDA activates it waits for its next sync
+		elapsed := t.Sub(start)
+		if elapsed%s.opts.HpaSyncPeriod == 0 {
+			metric = s.metric(t, waiting, busy)
+			s.hpa(t, metric)
+		}
+		if elapsed%polling == 0 {
+			metric = s.metric(t, waiting, busy)
+			s.keda(t, metric, cooldown)
+		}
+
+		replicas := int32(len(s.started))
+		result.RunnerMinutes += float64(replicas) * step.Minutes()
+		result.WaitingJobMinutes += float64(waiting) * step.Minutes()
+		if replicas > result.PeakReplicas {
+			result.PeakReplicas = replicas
+		}
+		if waiting > result.PeakWaiting {
+			result.PeakWaiting = waiting
+		}
+		if s.waitingSince != nil && t.Sub(*s.waitingSince)+step > result.LongestWait {
+			result.LongestWait = t.Sub(*s.waitingSince) + step
+		}
+
+		p := Point{Time: t, Demand: demand, Metric: metric, Replicas: replicas, Ready: s.ready(t), Waiting: waiting, KeptAlive: s.keptAlive}
+		if len(result.Points) == 0 || !samePoint(result.Points[len(result.Points)-1], p) {
+			result.Points = append(result.Points, p)
+		}
+	}
+	if arrivals > 0 {
+		result.MeanWait = time.Duration(result.WaitingJobMinutes / float64(arrivals) * float64(time.Minute)).Round(time.Second)
+	}
+	return &result
+}
+
+func samePoint(a Point, b Point) bool {
+	return a.Demand == b.Demand && a.Metric == b.Metric && a.Replicas == b.Replicas && a.Ready == b.Ready && a.Waiting == b.Waiting &&
+		a.KeptAlive == b.KeptAlive
+}
+
+// metric is what the API server would return, the queue and runners are only fetched from Github once per cache window
+func (s *simulation) metric(t time.Time, waiting int32, busy int32) int32 {
+	if t.Sub(s.fetchedAt) >= s.opts.CacheWindow {
+		s.fetchedAt = t
+		for ordinal, started := range s.started {
+			if t.Sub(started) >= s.opts.StartupDelay {
+				s.lastSeen[ordinal] = t
+			}
+		}
+		s.cached = scaling.Demand{Queued: waiting, Busy: busy}
+		if s.waitingSince != nil {
+			s.cached.OldestWait = t.Sub(*s.waitingSince)
+		}
+		if s.history != nil {
+			s.history.Record(t, s.cached.Total(), s.scale.Predictive.HistoryRetention())
+			s.cached.Forecast = s.scale.Forecast(s.history, t)
+		}
+	}
+	output := s.scale.GetOutputForDemandAt(s.cached, t)
+	s.keptAlive, s.keepAliveSince = s.scale.KeepAlive(s.lastSeen, s.keepAliveSince, t)
+	if output < s.keptAlive {
+		// The same as the API server, windows which freeze runners win over keeping them alive
+		_, max := s.scale.Bounds(t)
+		output = minInt32(s.keptAlive, max)
+	}
+	return output
+}
+
+// keda activates the ScaledObject when the metric is above 0 and scales to minReplicas once it has been inactive for
+// the cooldown period
+func (s *simulation) keda(t time.Time, metric int32, cooldown time.Duration) {
+	replicas := int32(len(s.started))
+	if metric > 0 {
+		s.lastActive = t
+		if replicas == 0 {
+			s.resize(t, maxInt32(1, s.min))
+		}
+		return
+	}
+	if replicas > 0 && s.min == 0 && t.Sub(s.lastActive) >= cooldown {
+		s.resize(t, 0)
+	}
+}
+
+// hpa follows the HPA's algorithm for an AverageValue target of 1, it does nothing while KEDA has scaled to zero
+func (s *simulation) hpa(t time.Time, metric int32) {
+	current := int32(len(s.started))
+	if current == 0 {
+		return
+	}
+	desired := current
+	if ratio := float64(metric) / float64(current); math.Abs(ratio-1) > hpaTolerance {
+		desired = metric
+	}
+	desired = s.stabilize(t, current, desired)
+	desired = s.limitRate(t, current, desired)
+	desired = minInt32(maxInt32(desired, maxInt32(1, s.min)), s.max)
+	if desired != current {
+		// Policy periods can't be longer than 30 minutes
+		for len(s.events) > 0 && t.Sub(s.events[0].time) > 30*time.Minute {
+			s.events = s.events[1:]
+		}
+		s.events = append(s.events, scaleEvent{time: t, change: desired - current})
+		s.resize(t, desired)
+	}
+}
+
+func (s *simulation) behavior() (up autoscalingv2beta2.HPAScalingRules, down autoscalingv2beta2.HPAScalingRules) {
+	up, down = defaultScaleUp(), defaultScaleDown()
+	if s.crd.Spec.Scaling == nil || s.crd.Spec.Scaling.Behavior == nil {
+		return up, down
+	}
+	return mergeRules(s.crd.Spec.Scaling.Behavior.ScaleUp, up), mergeRules(s.crd.Spec.Scaling.Behavior.ScaleDown, down)
+}
+
+// stabilize uses the lowest recommendation within the scale up window and the highest within the scale down window
+func (s *simulation) stabilize(t time.Time, current int32, desired int32) int32 {
+	up, down := s.behavior()
+	upWindow := time.Duration(*up.StabilizationWindowSeconds) * time.Second
+	downWindow := time.Duration(*down.StabilizationWindowSeconds) * time.Second
+	upRecommendation, downRecommendation := desired, desired
+	kept := []recommendation{}
+	for _, r := range s.recommendations {
+		age := t.Sub(r.time)
+		if age < upWindow {
+			upRecommendation = minInt32(upRecommendation, r.replicas)
+		}
+		if age < downWindow {
+			downRecommendation = maxInt32(downRecommendation, r.replicas)
+		}
+		if age < upWindow || age < downWindow {
+			kept = append(kept, r)
+		}
+	}
+	s.recommendations = append(kept, recommendation{time: t, replicas: desired})
+	result := current
+	if result < upRecommendation {
+		result = upRecommendation
+	}
+	if result > downRecommendation {
+		result = downRecommendation
+	}
+	return result
+}
+
+// limitRate applies the scaling policies to the replicas at the start of each policy's period
+func (s *simulation) limitRate(t time.Time, current int32, desired int32) int32 {
+	up, down := s.behavior()
+	if desired > current {
+		return minInt32(desired, maxInt32(current, s.limit(t, current, up, true)))
+	}
+	if desired < current {
+		return maxInt32(desired, minInt32(current, s.limit(t, current, down, false)))
+	}
+	return desired
+}
+
+func (s *simulation) limit(t time.Time, current int32, rules autoscalingv2beta2.HPAScalingRules, up bool) int32 {
+	if rules.SelectPolicy != nil && *rules.SelectPolicy == autoscalingv2beta2.DisabledPolicySelect {
+		return current
+	}
+	most := rules.SelectPolicy == nil || *rules.SelectPolicy == autoscalingv2beta2.MaxPolicySelect
+	var result int32
+	for i, p := range rules.Policies {
+		var changed int32
+		for _, e := range s.events {
+			if t.Sub(e.time) < time.Duration(p.PeriodSeconds)*time.Second && (e.change > 0) == up {
+				changed += e.change
+			}
+		}
+		periodStart := current - changed
+		var l int32
+		switch {
+		case up && p.Type == autoscalingv2beta2.PodsScalingPolicy:
+			l = periodStart + p.Value
+		case up:
+			l = int32(math.Ceil(float64(periodStart) * (1 + float64(p.Value)/100)))
+		case p.Type == autoscalingv2beta2.PodsScalingPolicy:
+			l = periodStart - p.Value
+		default:
+			l = int32(float64(periodStart) * (1 - float64(p.Value)/100))
+		}
+		// Scaling up the most allowed is the highest limit, scaling down it is the lowest
+		if i == 0 || (most == up && l > result) || (most != up && l < result) {
+			result = l
+		}
+	}
+	return result
+}
+
+func defaultScaleUp() autoscalingv2beta2.HPAScalingRules {
+	window := int32(0)
+	selectPolicy := autoscalingv2beta2.MaxPolicySelect
+	return autoscalingv2beta2.HPAScalingRules{
+		StabilizationWindowSeconds: &window,
+		SelectPolicy:               &selectPolicy,
+		Policies: []autoscalingv2beta2.HPAScalingPolicy{
+			{Type: autoscalingv2beta2.PodsScalingPolicy, Value: 4, PeriodSeconds: 15},
+			{Type: autoscalingv2beta2.PercentScalingPolicy, Value: 100, PeriodSeconds: 15},
+		},
+	}
+}
+
+func defaultScaleDown() autoscalingv2beta2.HPAScalingRules {
+	window := int32(300)
+	selectPolicy := autoscalingv2beta2.MaxPolicySelect
+	return autoscalingv2beta2.HPAScalingRules{
+		StabilizationWindowSeconds: &window,
+		SelectPolicy:               &selectPolicy,
+		Policies: []autoscalingv2beta2.HPAScalingPolicy{
+			{Type: autoscalingv2beta2.PercentScalingPolicy, Value: 100, PeriodSeconds: 15},
+		},
+	}
+}
+
+// mergeRules fills in anything that isn't set with the HPA's defaults
+func mergeRules(rules *autoscalingv2beta2.HPAScalingRules, defaults autoscalingv2beta2.HPAScalingRules) autoscalingv2beta2.HPAScalingRules {
+	if rules == nil {
+		return defaults
+	}
+	result := *rules
+	if result.StabilizationWindowSeconds == nil {
+		result.StabilizationWindowSeconds = defaults.StabilizationWindowSeconds
+	}
+	if result.SelectPolicy == nil {
+		result.SelectPolicy = defaults.SelectPolicy
+	}
+	if len(result.Policies) == 0 {
+		result.Policies = defaults.Policies
+	}
+	return result
+}
+
+// resize adds or removes runners from the end like a StatefulSet does
+func (s *simulation) resize(t time.Time, replicas int32) {
+	if replicas < int32(len(s.started)) {
+		s.started = s.started[:replicas]
+	}
+	for int32(len(s.started)) < replicas {
+		s.started = append(s.started, t)
+	}
+}
+
+func (s *simulation) ready(t time.Time) int32 {
+	var ready int32
+	for _, started := range s.started {
+		if t.Sub(started) >= s.opts.StartupDelay {
+			ready++
+		}
+	}
+	return ready
+}
+
+func minInt32(a int32, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt32(a int32, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,125 @@
+package simulator
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const runnerYaml = `
+apiVersion: runner.devjoes.com/v1alpha1
+kind: ScaledActionRunner
+metadata:
+  name: test
+  namespace: ns
+spec:
+  minRunners: 0
+  maxRunners: 10
+  scaleFactor: "0"
+  scaling:
+    pollingInterval: 10
+    cooldownPeriod: 60
+`
+
+func TestReadsCsvAndJsonQueues(t *testing.T) {
+	samples, err := ReadSamples(strings.NewReader("time,queued,busy\n60,2\n0,1,1\n"), "csv")
+	assert.Nil(t, err)
+	assert.Equal(t, []Sample{
+		{Time: time.Unix(0, 0).UTC(), Queued: 1, Busy: 1},
+		{Time: time.Unix(60, 0).UTC(), Queued: 2},
+	}, samples)
+
+	samples, err = ReadSamples(strings.NewReader(`[{"time":"2021-05-03T09:00:00Z","queued":3},{"time":30,"busy":2}]`), "json")
+	assert.Nil(t, err)
+	assert.Equal(t, []Sample{
+		{Time: time.Unix(30, 0).UTC(), Busy: 2},
+		{Time: time.Date(2021, 5, 3, 9, 0, 0, 0, time.UTC), Queued: 3},
+	}, samples)
+
+	_, err = ReadSamples(strings.NewReader("0,-1\n"), "csv")
+	assert.NotNil(t, err)
+	_, err = ReadSamples(strings.NewReader("0,1\n"), "xml")
+	assert.NotNil(t, err)
+}
+
+func TestSimulatesScalingUpAndDown(t *testing.T) {
+	crd, err := ReadRunner(strings.NewReader(runnerYaml))
+	assert.Nil(t, err)
+	samples, _ := ReadSamples(strings.NewReader("0,4\n300,0\n"), "csv")
+	opts := Options{CacheWindow: 30 * time.Second, StartupDelay: time.Minute, HpaSyncPeriod: 15 * time.Second, Tail: 10 * time.Minute}
+	result, err := Simulate(crd, samples, opts)
+	assert.Nil(t, err)
+
+	at := func(seconds int64) Point {
+		var found Point
+		for _, p := range result.Points {
+			if p.Time.Unix() <= seconds {
+				found = p
+			}
+		}
+		return found
+	}
+	// KEDA activates with 1 replica and then the HPA scales to the metric
+	assert.Equal(t, int32(1), at(0).Replicas)
+	assert.Equal(t, int32(4), at(15).Replicas)
+	// Nothing is ready until the runners have started
+	assert.Equal(t, int32(4), at(59).Waiting)
+	assert.Equal(t, int32(0), at(75).Waiting)
+	// KEDA scales to zero once the metric has been 0 for the cooldown period
+	assert.Equal(t, int32(4), at(340).Replicas)
+	assert.Equal(t, int32(0), at(360).Replicas)
+
+	assert.Equal(t, int32(4), result.PeakReplicas)
+	assert.Equal(t, int32(4), result.PeakWaiting)
+	assert.Equal(t, 75*time.Second, result.LongestWait)
+	assert.True(t, result.RunnerMinutes > 20 && result.RunnerMinutes < 45, result.RunnerMinutes)
+	assert.True(t, result.MeanWait > 30*time.Second && result.MeanWait < 75*time.Second, result.MeanWait)
+}
+
+func TestSimulatesKeepAlive(t *testing.T) {
+	crd, _ := ReadRunner(strings.NewReader(runnerYaml + `  forceScaleUpFrequency: 24h
+  forceScaleUpWindow: 10m
+`))
+	samples, _ := ReadSamples(strings.NewReader("0,0\n600,0\n"), "csv")
+	opts := Options{CacheWindow: 30 * time.Second, StartupDelay: time.Minute, HpaSyncPeriod: 15 * time.Second, LastSeen: 48 * time.Hour}
+	result, err := Simulate(crd, samples, opts)
+	assert.Nil(t, err)
+	// Every runner is due so they are all brought up until they have been online
+	assert.Equal(t, int32(10), result.Points[0].KeptAlive)
+	assert.Equal(t, int32(10), result.PeakReplicas)
+	last := result.Points[len(result.Points)-1]
+	assert.Equal(t, int32(0), last.KeptAlive)
+	assert.Equal(t, int32(0), last.Replicas)
+
+	opts.LastSeen = 0
+	result, _ = Simulate(crd, samples, opts)
+	assert.Equal(t, int32(0), result.PeakReplicas)
+}
+
+func TestUsesDefaultPollingIntervalWhenItIsZero(t *testing.T) {
+	crd, err := ReadRunner(strings.NewReader(strings.Replace(runnerYaml, "pollingInterval: 10", "pollingInterval: 0", 1)))
+	assert.Nil(t, err)
+	samples, _ := ReadSamples(strings.NewReader("0,4\n300,0\n"), "csv")
+	opts := Options{CacheWindow: 30 * time.Second, StartupDelay: time.Minute, HpaSyncPeriod: 15 * time.Second}
+	result, err := Simulate(crd, samples, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(4), result.PeakReplicas)
+}
+
+func TestWritesResult(t *testing.T) {
+	crd, _ := ReadRunner(strings.NewReader(runnerYaml))
+	samples, _ := ReadSamples(strings.NewReader("0,1\n"), "csv")
+	result, err := Simulate(crd, samples, DefaultOptions())
+	assert.Nil(t, err)
+
+	out := bytes.Buffer{}
+	assert.Nil(t, Write(&out, result, "csv"))
+	assert.True(t, strings.HasPrefix(out.String(), "time,demand,metric,replicas,ready,waiting,keptAlive\n1970-01-01T00:00:00Z,1,1,1,0,1,0\n"), out.String())
+	out.Reset()
+	assert.Nil(t, Write(&out, result, "table"))
+	assert.Contains(t, out.String(), "Runner minutes:")
+	assert.NotNil(t, Write(&out, result, "yaml"))
+}
@@ -3,7 +3,7 @@ package state
 import (
 	"time"
 
-	"github.com/google/go-github/v33/github"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
 )
 
 type Status int8
@@ -21,10 +21,37 @@ func NewClientState(name string) *ClientState {
 	}
 }
 
+// CachedResponse is a Github API response which can be revalidated with a conditional request
+type CachedResponse struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	ContentType  string    `json:"contentType,omitempty"`
+	Link         string    `json:"link,omitempty"`
+	Body         []byte    `json:"body"`
+	StoredAt     time.Time `json:"storedAt"`
+}
+
+// RepoJobs are the active jobs polled from a repo, they are shared by every workflow that counts jobs in the repo
+type RepoJobs struct {
+	Jobs        []*utils.WorkflowJob `json:"jobs"`
+	RetrievedAt time.Time            `json:"retrievedAt"`
+}
+
 type ClientState struct {
-	Name            string
-	LastValue       []*github.WorkflowRun
-	LastRequest     time.Time
-	Status          Status
-	NextForcedScale *time.Time
+	Name        string
+	LastValue   []*utils.WorkflowJob
+	LastRequest time.Time
+	Status      Status
+	// RunnersLastSeen is when each ordinal was last online
+	RunnersLastSeen map[int]time.Time
+	// KeepAliveSince is when runners started being kept alive, or will start again if it is backing off
+	KeepAliveSince *time.Time
+	// LastWebhook is when LastValue was last updated by a webhook rather than by polling
+	LastWebhook time.Time
+	// Runners registered by the StatefulSet's pods, as of LastRunnerRequest
+	Runners           []utils.RunnerStatus
+	LastRunnerRequest time.Time
+	// Wanted is how many runners were wanted at WantedAt before the budget was applied
+	Wanted   int32
+	WantedAt time.Time
 }
@@ -0,0 +1,66 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SchemaVersion is part of every key so that when the format of something that is stored changes it is written to a
+// new key, rather than replicas running different versions reading each other's entries
+const SchemaVersion = 2
+
+// Kinds of entry, they are part of every key
+const (
+	KindState     = "state"
+	KindHistory   = "history"
+	KindWorkflows = "workflows"
+	KindJobs      = "jobs"
+	KindLease     = "lease"
+	KindResponse  = "response"
+)
+
+// legacyGithubHost is the only Github server that versions before keys were namespaced and versioned used
+const legacyGithubHost = "github.com"
+
+// SharedNamespace is the namespace of entries which are shared by every namespace, e.g. the jobs polled from a repo.
+// It isn't a valid Kubernetes namespace so it can't clash with one.
+const SharedNamespace = "_shared"
+
+// Key returns the key of name e.g. "default:state:v2:my-runner", names are only unique within a namespace and kind
+func Key(namespace string, kind string, name string) string {
+	return fmt.Sprintf("%s:%s:v%d:%s", namespace, kind, SchemaVersion, name)
+}
+
+// SharedKey returns the key of name in SharedNamespace
+func SharedKey(kind string, name string) string {
+	return Key(SharedNamespace, kind, name)
+}
+
+// parseKey splits a key returned by Key, ok is false if it isn't one
+func parseKey(key string) (namespace string, kind string, name string, ok bool) {
+	parts := strings.SplitN(key, ":", 4)
+	if len(parts) != 4 || parts[2] != fmt.Sprintf("v%d", SchemaVersion) {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[3], true
+}
+
+// legacyKey returns the key that the entry was stored under before keys were namespaced and versioned, or "" if it
+// isn't migrated. Queue history isn't migrated as the legacy entry may belong to a runner with the same name in another
+// namespace.
+func legacyKey(key string) string {
+	_, kind, name, ok := parseKey(key)
+	if !ok {
+		return ""
+	}
+	switch kind {
+	case KindState:
+		return name
+	case KindWorkflows:
+		// Shared entries are named after the Github server too, earlier versions only spoke to github.com
+		if strings.HasPrefix(name, legacyGithubHost+"/") {
+			return strings.TrimPrefix(name, legacyGithubHost+"/")
+		}
+	}
+	return ""
+}
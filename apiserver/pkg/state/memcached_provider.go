@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"time"
 
 	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
 	"github.com/memcachier/mc/v3"
@@ -14,6 +16,10 @@ import (
 const (
 	stateCacheTime  = 60 * 60
 	wfInfoCacheTime = 5 * 60
+	// Memcached treats anything over 30 days as a timestamp, the history is rewritten far more often than this
+	queueHistoryCacheTime = 30 * 24 * 60 * 60
+	// Shared jobs are only reused within a cache window, this just stops repos which are no longer polled hanging around
+	repoJobsCacheTime = 60 * 60
 )
 
 type MemcachedStateProvider struct {
@@ -66,6 +72,39 @@ func (p *MemcachedStateProvider) SetState(key string, state *ClientState) error
 	return err
 }
 
+// GetStateVersion returns the state with its CAS token as the version
+func (p *MemcachedStateProvider) GetStateVersion(key string) (*ClientState, uint64, error) {
+	val, _, cas, err := p.cache.Get(key)
+	if err == nil {
+		var state ClientState
+		err = json.Unmarshal([]byte(val), &state)
+		if err == nil {
+			return &state, cas, nil
+		}
+	}
+	if errors.Is(err, mc.ErrNotFound) {
+		return NewClientState(key), 0, nil
+	}
+	return nil, 0, fmt.Errorf("memcache server unreachable. aborting to avoid potential rate limitting. %s", err.Error())
+}
+
+// CompareAndSetState sets the state with the CAS token from GetStateVersion, or adds it if it didn't exist
+func (p *MemcachedStateProvider) CompareAndSetState(key string, state *ClientState, version uint64) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		_, err = p.cache.Add(key, string(data), 0, stateCacheTime)
+	} else {
+		_, err = p.cache.Set(key, string(data), 0, stateCacheTime, version)
+	}
+	if errors.Is(err, mc.ErrKeyExists) || errors.Is(err, mc.ErrNotFound) || errors.Is(err, mc.ErrValueNotStored) {
+		return ErrConflict
+	}
+	return err
+}
+
 func (p *MemcachedStateProvider) GetWorkflowInfo(key string) (*map[int64]utils.WorkflowInfo, error) {
 	val, _, _, err := p.cache.Get(key)
 	if err == nil {
@@ -81,6 +120,30 @@ func (p *MemcachedStateProvider) GetWorkflowInfo(key string) (*map[int64]utils.W
 	return nil, err
 }
 
+func (p *MemcachedStateProvider) GetCachedResponse(key string) (*CachedResponse, error) {
+	val, _, _, err := p.cache.Get(key)
+	if err == nil {
+		var resp CachedResponse
+		err = json.Unmarshal([]byte(val), &resp)
+		if err == nil {
+			return &resp, nil
+		}
+	}
+	if errors.Is(err, mc.ErrNotFound) {
+		return nil, nil
+	}
+	return nil, err
+}
+
+func (p *MemcachedStateProvider) SetCachedResponse(key string, resp *CachedResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = p.cache.Set(key, string(data), 0, uint32(cachedResponseLifetime.Seconds()), 0)
+	return err
+}
+
 func (p *MemcachedStateProvider) SetWorkflowInfo(key string, wfInfo *map[int64]utils.WorkflowInfo) error {
 	data, err := json.Marshal(wfInfo)
 	if err != nil {
@@ -89,3 +152,82 @@ func (p *MemcachedStateProvider) SetWorkflowInfo(key string, wfInfo *map[int64]u
 	_, err = p.cache.Set(key, string(data), 0, wfInfoCacheTime, 0)
 	return err
 }
+
+func (p *MemcachedStateProvider) GetQueueHistory(key string) (*utils.QueueHistory, error) {
+	val, _, _, err := p.cache.Get(key)
+	if err == nil {
+		var history utils.QueueHistory
+		err = json.Unmarshal([]byte(val), &history)
+		if err == nil {
+			return &history, nil
+		}
+	}
+	if errors.Is(err, mc.ErrNotFound) {
+		return nil, nil
+	}
+	return nil, err
+}
+
+func (p *MemcachedStateProvider) SetQueueHistory(key string, history *utils.QueueHistory) error {
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	_, err = p.cache.Set(key, string(data), 0, queueHistoryCacheTime, 0)
+	return err
+}
+
+func (p *MemcachedStateProvider) GetRepoJobs(key string) (*RepoJobs, error) {
+	val, _, _, err := p.cache.Get(key)
+	if err == nil {
+		var jobs RepoJobs
+		err = json.Unmarshal([]byte(val), &jobs)
+		if err == nil {
+			return &jobs, nil
+		}
+	}
+	if errors.Is(err, mc.ErrNotFound) {
+		return nil, nil
+	}
+	return nil, err
+}
+
+func (p *MemcachedStateProvider) SetRepoJobs(key string, jobs *RepoJobs) error {
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		return err
+	}
+	_, err = p.cache.Set(key, string(data), 0, repoJobsCacheTime, 0)
+	return err
+}
+
+// AcquireLease adds key with holder as its value, Add fails if another holder has already added it. Memcached expires
+// the lease after ttl (rounded up to a second) if the holder dies without releasing it.
+func (p *MemcachedStateProvider) AcquireLease(key string, holder string, ttl time.Duration) (bool, error) {
+	_, err := p.cache.Add(key, holder, 0, uint32(math.Ceil(ttl.Seconds())))
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, mc.ErrKeyExists) || errors.Is(err, mc.ErrValueNotStored) {
+		val, _, _, getErr := p.cache.Get(key)
+		return getErr == nil && val == holder, nil
+	}
+	return false, err
+}
+
+// ReleaseLease deletes the lease if holder still holds it, the CAS stops it deleting a lease that expired and was
+// acquired by another holder in the meantime
+func (p *MemcachedStateProvider) ReleaseLease(key string, holder string) error {
+	val, _, cas, err := p.cache.Get(key)
+	if errors.Is(err, mc.ErrNotFound) {
+		return nil
+	}
+	if err != nil || val != holder {
+		return err
+	}
+	err = p.cache.DelCAS(key, cas)
+	if errors.Is(err, mc.ErrNotFound) || errors.Is(err, mc.ErrKeyExists) {
+		return nil
+	}
+	return err
+}
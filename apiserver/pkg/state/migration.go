@@ -0,0 +1,99 @@
+package state
+
+import (
+	"errors"
+
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/klog/v2"
+)
+
+var counterMigrations *prometheus.CounterVec
+
+func init() {
+	counterMigrations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "workflow_state_migrations",
+		Help: "Number of entries copied from the keys used before keys were namespaced and versioned, by kind",
+	}, []string{"kind"})
+}
+
+// MigratingStateProvider copies entries from their legacy keys the first time that their new key is read and isn't
+// found. Legacy entries are left to expire so that replicas which haven't been upgraded yet can carry on using them.
+type MigratingStateProvider struct {
+	IStateProvider
+}
+
+func NewMigratingStateProvider(p IStateProvider) *MigratingStateProvider {
+	return &MigratingStateProvider{IStateProvider: p}
+}
+
+// Ping pings the wrapped provider if it is a Pinger
+func (p *MigratingStateProvider) Ping() error {
+	if pinger, ok := p.IStateProvider.(Pinger); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
+
+func (p *MigratingStateProvider) GetState(key string) (*ClientState, error) {
+	s, _, err := p.GetStateVersion(key)
+	return s, err
+}
+
+// GetStateVersion migrates the state with CompareAndSetState so that a state saved by another replica in the meantime
+// isn't overwritten
+func (p *MigratingStateProvider) GetStateVersion(key string) (*ClientState, uint64, error) {
+	s, version, err := p.IStateProvider.GetStateVersion(key)
+	legacy := legacyKey(key)
+	if err != nil || version != 0 || legacy == "" {
+		return s, version, err
+	}
+	old, oldVersion, err := p.IStateProvider.GetStateVersion(legacy)
+	if err != nil || oldVersion == 0 {
+		if err != nil {
+			klog.Warningf("Error reading %s to migrate it to %s. %s", legacy, key, err.Error())
+		}
+		return s, version, nil
+	}
+	err = p.IStateProvider.CompareAndSetState(key, migrateState(old, s), 0)
+	if err != nil && !errors.Is(err, ErrConflict) {
+		klog.Warningf("Error migrating %s to %s. %s", legacy, key, err.Error())
+		return s, version, nil
+	}
+	if err == nil {
+		counterMigrations.WithLabelValues(KindState).Inc()
+	}
+	return p.IStateProvider.GetStateVersion(key)
+}
+
+// migrateState returns the parts of old which can be trusted. Runners with the same name in different namespaces
+// shared the legacy key, so the jobs and runners may belong to another namespace's runners and are polled again instead.
+func migrateState(old *ClientState, s *ClientState) *ClientState {
+	s.RunnersLastSeen = old.RunnersLastSeen
+	s.KeepAliveSince = old.KeepAliveSince
+	s.Wanted, s.WantedAt = old.Wanted, old.WantedAt
+	return s
+}
+
+func (p *MigratingStateProvider) GetWorkflowInfo(key string) (*map[int64]utils.WorkflowInfo, error) {
+	wfInfo, err := p.IStateProvider.GetWorkflowInfo(key)
+	if err != nil || wfInfo != nil || legacyKey(key) == "" {
+		return wfInfo, err
+	}
+	wfInfo, err = p.IStateProvider.GetWorkflowInfo(legacyKey(key))
+	if err != nil || wfInfo == nil {
+		return nil, nil
+	}
+	p.migrated(KindWorkflows, key, p.IStateProvider.SetWorkflowInfo(key, wfInfo))
+	return wfInfo, nil
+}
+
+// migrated records the migration of key, errors saving it are only logged as the legacy entry can be read again
+func (p *MigratingStateProvider) migrated(kind string, key string, err error) {
+	if err != nil {
+		klog.Warningf("Error migrating %s to %s. %s", legacyKey(key), key, err.Error())
+		return
+	}
+	counterMigrations.WithLabelValues(kind).Inc()
+}
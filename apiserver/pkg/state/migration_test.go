@@ -0,0 +1,75 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeysIncludeNamespaceKindAndVersion(t *testing.T) {
+	assert.Equal(t, "default:state:v2:runner", Key("default", KindState, "runner"))
+	assert.Equal(t, "_shared:jobs:v2:owner/repo", SharedKey(KindJobs, "owner/repo"))
+	assert.NotEqual(t, Key("a", KindState, "runner"), Key("b", KindState, "runner"))
+
+	assert.Equal(t, "runner", legacyKey(Key("default", KindState, "runner")))
+	assert.Equal(t, "", legacyKey(Key("default", KindHistory, "runner")))
+	assert.Equal(t, "owner/repo", legacyKey(SharedKey(KindWorkflows, "github.com/owner/repo")))
+	assert.Equal(t, "", legacyKey(SharedKey(KindWorkflows, "github.example.com/owner/repo")))
+	assert.Equal(t, "", legacyKey(SharedKey(KindJobs, "github.com/owner/repo")))
+	assert.Equal(t, "", legacyKey(SharedKey(KindLease, "owner/repo")))
+	assert.Equal(t, "", legacyKey("runner"))
+	assert.Equal(t, "", legacyKey("default:state:v1:runner"))
+}
+
+func TestMigratesStateFromLegacyKey(t *testing.T) {
+	inner := NewInMemoryStateProvider()
+	now := time.Now()
+	inner.SetState("runner", &ClientState{
+		Name:            "runner",
+		Status:          Valid,
+		LastValue:       []*utils.WorkflowJob{{}},
+		RunnersLastSeen: map[int]time.Time{0: now},
+		KeepAliveSince:  &now,
+		Wanted:          3,
+		WantedAt:        now,
+	})
+	p := NewMigratingStateProvider(inner)
+	key := Key("default", KindState, "runner")
+
+	s, version, err := p.GetStateVersion(key)
+	assert.Nil(t, err)
+	assert.NotZero(t, version)
+	assert.Equal(t, int32(3), s.Wanted)
+	assert.Equal(t, now, s.RunnersLastSeen[0])
+	// The jobs may have belonged to a runner with the same name in another namespace
+	assert.Equal(t, Unset, s.Status)
+	assert.Len(t, s.LastValue, 0)
+
+	// Once migrated the new key is used
+	s.Wanted = 4
+	assert.Nil(t, p.SetState(key, s))
+	s, _ = p.GetState(key)
+	assert.Equal(t, int32(4), s.Wanted)
+	old, _ := inner.GetState("runner")
+	assert.Equal(t, int32(3), old.Wanted)
+}
+
+func TestMigratesSharedEntriesFromLegacyKeys(t *testing.T) {
+	inner := NewInMemoryStateProvider()
+	inner.SetWorkflowInfo("owner/repo", &map[int64]utils.WorkflowInfo{1: {ID: 1, Name: "build"}})
+	inner.SetQueueHistory("runner_history", &utils.QueueHistory{Samples: []utils.DemandSample{{Start: 1, Demand: 2}}})
+	p := NewMigratingStateProvider(inner)
+
+	wfInfo, err := p.GetWorkflowInfo(SharedKey(KindWorkflows, "github.com/owner/repo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "build", (*wfInfo)[1].Name)
+	wfInfo, _ = inner.GetWorkflowInfo(SharedKey(KindWorkflows, "github.com/owner/repo"))
+	assert.NotNil(t, wfInfo)
+
+	// History isn't migrated as runner_history may be from a runner in another namespace
+	history, err := p.GetQueueHistory(Key("default", KindHistory, "runner"))
+	assert.Nil(t, err)
+	assert.Nil(t, history)
+}
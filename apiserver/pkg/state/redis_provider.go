@@ -0,0 +1,378 @@
+package state
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	"github.com/go-redis/redis/v8"
+	"k8s.io/apimachinery/pkg/util/rand"
+)
+
+const (
+	RedisStandalone = "standalone"
+	RedisSentinel   = "sentinel"
+	RedisCluster    = "cluster"
+
+	redisTimeout = 5 * time.Second
+	// redisMaxRetries is how many redirects and retries are attempted before giving up, slots only move during
+	// resharding and failovers
+	redisMaxRetries = 5
+)
+
+// RedisOptions are how to connect to Redis, Addrs are the Redis servers, the sentinels or the cluster nodes depending
+// on Mode. The sentinels have their own user, password and TLS settings as they are often configured separately to
+// the servers they monitor.
+type RedisOptions struct {
+	Addrs            []string `json:"addrs"`
+	Mode             string   `json:"mode"`
+	MasterName       string   `json:"masterName"`
+	Username         string   `json:"username"`
+	Password         string   `json:"-"`
+	TLS              bool     `json:"tls"`
+	CaFile           string   `json:"caFile"`
+	SentinelUsername string   `json:"sentinelUsername"`
+	SentinelPassword string   `json:"-"`
+	SentinelTLS      bool     `json:"sentinelTls"`
+	SentinelCaFile   string   `json:"sentinelCaFile"`
+}
+
+// Validate returns an error if the mode is unknown, sentinel mode is missing the master's name or the sentinel
+// settings are used outside of sentinel mode
+func (o RedisOptions) Validate() error {
+	switch o.Mode {
+	case RedisStandalone, RedisCluster:
+		if o.SentinelUsername != "" || o.SentinelPassword != "" || o.SentinelTLS || o.SentinelCaFile != "" {
+			return errors.New("the sentinel user, password and TLS settings can only be used in sentinel mode")
+		}
+	case RedisSentinel:
+		if o.MasterName == "" {
+			return errors.New("the master name is required in sentinel mode")
+		}
+	default:
+		return fmt.Errorf("unknown mode '%s', expected %s, %s or %s", o.Mode, RedisStandalone, RedisSentinel, RedisCluster)
+	}
+	if len(o.Addrs) == 0 {
+		return errors.New("at least one address is required")
+	}
+	if o.CaFile != "" && !o.TLS {
+		return errors.New("a CA file can only be used with TLS")
+	}
+	if o.SentinelCaFile != "" && !o.SentinelTLS {
+		return errors.New("a sentinel CA file can only be used with sentinel TLS")
+	}
+	return nil
+}
+
+// ClientState is stored as a hash so that its version can be compared and incremented by a script
+const (
+	stateVersionField = "v"
+	stateDataField    = "d"
+)
+
+var (
+	// compareAndSetScript saves ARGV[2] if the state is still at version ARGV[1], a missing version is 0
+	compareAndSetScript = redis.NewScript(`
+if (redis.call('HGET', KEYS[1], 'v') or '0') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'd', ARGV[2])
+redis.call('HINCRBY', KEYS[1], 'v', 1)
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return 1`)
+	setStateScript = redis.NewScript(`
+redis.call('HSET', KEYS[1], 'd', ARGV[1])
+redis.call('HINCRBY', KEYS[1], 'v', 1)
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+return 1`)
+	// releaseLeaseScript deletes the lease if it is still held by ARGV[1]
+	releaseLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`)
+)
+
+// RedisStateProvider stores state in a standalone Redis server, the master monitored by Redis Sentinel or a Redis
+// Cluster. go-redis finds the master, follows it when it fails over and sends keys to the cluster node which owns them.
+type RedisStateProvider struct {
+	client redis.UniversalClient
+}
+
+func NewRedisStateProvider(opts RedisOptions) (*RedisStateProvider, error) {
+	if opts.Password == "" && os.Getenv("REDIS_PASSWORD") != "" {
+		opts.Password = os.Getenv("REDIS_PASSWORD")
+	}
+	if opts.Mode == RedisSentinel && opts.SentinelPassword == "" && os.Getenv("REDIS_SENTINEL_PASSWORD") != "" {
+		opts.SentinelPassword = os.Getenv("REDIS_SENTINEL_PASSWORD")
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	client, err := newRedisClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	p := &RedisStateProvider{client: client}
+	if err = p.Ping(); err != nil {
+		p.Close()
+		return nil, fmt.Errorf("Could not connect to redis with '%s' '%s' '%s': %s", strings.Join(opts.Addrs, ","), opts.Mode, opts.Username, err.Error())
+	}
+	return p, nil
+}
+
+func newRedisClient(opts RedisOptions) (redis.UniversalClient, error) {
+	tlsConfig, err := redisTLSConfig(opts.TLS, opts.CaFile)
+	if err != nil {
+		return nil, err
+	}
+	switch opts.Mode {
+	case RedisSentinel:
+		sentinelTLSConfig, err := redisTLSConfig(opts.SentinelTLS, opts.SentinelCaFile)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       opts.MasterName,
+			SentinelAddrs:    opts.Addrs,
+			SentinelUsername: opts.SentinelUsername,
+			SentinelPassword: opts.SentinelPassword,
+			Username:         opts.Username,
+			Password:         opts.Password,
+			Dialer:           redisDialer(opts.Addrs, sentinelTLSConfig, tlsConfig),
+			MaxRetries:       redisMaxRetries,
+			DialTimeout:      redisTimeout,
+			ReadTimeout:      redisTimeout,
+			WriteTimeout:     redisTimeout,
+		}), nil
+	case RedisCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        opts.Addrs,
+			Username:     opts.Username,
+			Password:     opts.Password,
+			TLSConfig:    tlsConfig,
+			MaxRedirects: redisMaxRetries,
+			DialTimeout:  redisTimeout,
+			ReadTimeout:  redisTimeout,
+			WriteTimeout: redisTimeout,
+		}), nil
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:         opts.Addrs[0],
+			Username:     opts.Username,
+			Password:     opts.Password,
+			TLSConfig:    tlsConfig,
+			MaxRetries:   redisMaxRetries,
+			DialTimeout:  redisTimeout,
+			ReadTimeout:  redisTimeout,
+			WriteTimeout: redisTimeout,
+		}), nil
+	}
+}
+
+// redisTLSConfig returns nil without TLS, otherwise the CA bundle in caFile is trusted or the system's CAs if it is
+// unset
+func redisTLSConfig(useTLS bool, caFile string) (*tls.Config, error) {
+	if !useTLS {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read the redis CA file. %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// redisDialer connects to the sentinels with sentinelTLS and to everything else, i.e. the master, with tlsConfig.
+// go-redis uses the same dialer for both so sentinels are told apart by their address, sentinels which are only
+// discovered from the others are dialled like the master.
+func redisDialer(sentinels []string, sentinelTLS *tls.Config, tlsConfig *tls.Config) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		config := tlsConfig
+		for _, sentinel := range sentinels {
+			if sentinel == addr {
+				config = sentinelTLS
+				break
+			}
+		}
+		dialer := &net.Dialer{Timeout: redisTimeout, KeepAlive: 5 * time.Minute}
+		if config == nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return tls.DialWithDialer(dialer, network, addr, config)
+	}
+}
+
+// Ping returns an error if Redis can't be written to
+func (p *RedisStateProvider) Ping() error {
+	// Like memcached the key is dynamic so that in cluster mode it tests whichever node owns it
+	key := fmt.Sprintf("test_%s", rand.String(5))
+	return p.client.Set(context.Background(), key, "ok", time.Second).Err()
+}
+
+// Close closes the connections to Redis
+func (p *RedisStateProvider) Close() error {
+	return p.client.Close()
+}
+
+// get unmarshals key in to value, it returns false if the key doesn't exist
+func (p *RedisStateProvider) get(key string, value interface{}) (bool, error) {
+	data, err := p.client.Get(context.Background(), key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+// set marshals value and saves it, it expires after ttl seconds
+func (p *RedisStateProvider) set(key string, value interface{}, ttl int) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return p.client.Set(context.Background(), key, data, time.Duration(ttl)*time.Second).Err()
+}
+
+func (p *RedisStateProvider) GetState(key string) (*ClientState, error) {
+	s, _, err := p.GetStateVersion(key)
+	return s, err
+}
+
+func (p *RedisStateProvider) SetState(key string, state *ClientState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return setStateScript.Run(context.Background(), p.client, []string{key}, data, stateCacheTime).Err()
+}
+
+// GetStateVersion returns the state along with the version that is incremented every time it is saved
+func (p *RedisStateProvider) GetStateVersion(key string) (*ClientState, uint64, error) {
+	values, err := p.client.HMGet(context.Background(), key, stateVersionField, stateDataField).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("redis server unreachable. aborting to avoid potential rate limitting. %s", err.Error())
+	}
+	if len(values) != 2 || values[1] == nil {
+		return NewClientState(key), 0, nil
+	}
+	version, err := strconv.ParseUint(fmt.Sprint(values[0]), 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	var state ClientState
+	if err = json.Unmarshal([]byte(fmt.Sprint(values[1])), &state); err != nil {
+		return nil, 0, err
+	}
+	return &state, version, nil
+}
+
+// CompareAndSetState saves the state in a script so that the version can't change between checking and saving it
+func (p *RedisStateProvider) CompareAndSetState(key string, state *ClientState, version uint64) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	saved, err := compareAndSetScript.Run(context.Background(), p.client, []string{key}, strconv.FormatUint(version, 10), data, stateCacheTime).Int()
+	if err != nil {
+		return err
+	}
+	if saved == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (p *RedisStateProvider) GetWorkflowInfo(key string) (*map[int64]utils.WorkflowInfo, error) {
+	var wfInfo map[int64]utils.WorkflowInfo
+	found, err := p.get(key, &wfInfo)
+	if !found || err != nil {
+		return nil, err
+	}
+	return &wfInfo, nil
+}
+
+func (p *RedisStateProvider) SetWorkflowInfo(key string, wfInfo *map[int64]utils.WorkflowInfo) error {
+	return p.set(key, wfInfo, wfInfoCacheTime)
+}
+
+func (p *RedisStateProvider) GetCachedResponse(key string) (*CachedResponse, error) {
+	var resp CachedResponse
+	found, err := p.get(key, &resp)
+	if !found || err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (p *RedisStateProvider) SetCachedResponse(key string, resp *CachedResponse) error {
+	return p.set(key, resp, int(cachedResponseLifetime.Seconds()))
+}
+
+func (p *RedisStateProvider) GetQueueHistory(key string) (*utils.QueueHistory, error) {
+	var history utils.QueueHistory
+	found, err := p.get(key, &history)
+	if !found || err != nil {
+		return nil, err
+	}
+	return &history, nil
+}
+
+func (p *RedisStateProvider) SetQueueHistory(key string, history *utils.QueueHistory) error {
+	return p.set(key, history, queueHistoryCacheTime)
+}
+
+func (p *RedisStateProvider) GetRepoJobs(key string) (*RepoJobs, error) {
+	var jobs RepoJobs
+	found, err := p.get(key, &jobs)
+	if !found || err != nil {
+		return nil, err
+	}
+	return &jobs, nil
+}
+
+func (p *RedisStateProvider) SetRepoJobs(key string, jobs *RepoJobs) error {
+	return p.set(key, jobs, repoJobsCacheTime)
+}
+
+// AcquireLease sets key to holder if it isn't set already, Redis expires the lease after ttl if the holder dies
+// without releasing it
+func (p *RedisStateProvider) AcquireLease(key string, holder string, ttl time.Duration) (bool, error) {
+	ctx := context.Background()
+	acquired, err := p.client.SetNX(ctx, key, holder, ttl).Result()
+	if acquired || err != nil {
+		return acquired, err
+	}
+	current, err := p.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		// It expired in the meantime, it is left for the next attempt rather than racing for it
+		return false, nil
+	}
+	return current == holder, err
+}
+
+// ReleaseLease deletes the lease in a script so that a lease which expired and was acquired by another holder in the
+// meantime isn't deleted
+func (p *RedisStateProvider) ReleaseLease(key string, holder string) error {
+	return releaseLeaseScript.Run(context.Background(), p.client, []string{key}, holder).Err()
+}
@@ -0,0 +1,268 @@
+package state
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatesRedisOptions(t *testing.T) {
+	assert.Nil(t, RedisOptions{Addrs: []string{"redis:6379"}, Mode: RedisStandalone}.Validate())
+	assert.NotNil(t, RedisOptions{Addrs: []string{"redis:6379"}, Mode: "replicated"}.Validate())
+	assert.NotNil(t, RedisOptions{Addrs: []string{"sentinel:26379"}, Mode: RedisSentinel}.Validate())
+	assert.NotNil(t, RedisOptions{Mode: RedisCluster}.Validate())
+	assert.NotNil(t, RedisOptions{Addrs: []string{"redis:6379"}, Mode: RedisStandalone, CaFile: "ca.crt"}.Validate())
+	assert.Nil(t, RedisOptions{Addrs: []string{"sentinel:26379"}, Mode: RedisSentinel, MasterName: "primary", SentinelTLS: true, SentinelCaFile: "ca.crt"}.Validate())
+	assert.NotNil(t, RedisOptions{Addrs: []string{"sentinel:26379"}, Mode: RedisSentinel, MasterName: "primary", SentinelCaFile: "ca.crt"}.Validate())
+	assert.NotNil(t, RedisOptions{Addrs: []string{"redis:6379"}, Mode: RedisStandalone, SentinelUsername: "sentinel"}.Validate())
+}
+
+func testRedisProviderStateAndLeases(t *testing.T, server *miniredis.Miniredis, p *RedisStateProvider) {
+	key := "test_redis_state"
+	s, version, err := p.GetStateVersion(key)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), version)
+	assert.Nil(t, p.CompareAndSetState(key, s, version))
+	assert.Equal(t, ErrConflict, p.CompareAndSetState(key, s, version))
+	assert.Nil(t, p.SetState(key, &ClientState{Wanted: 2}))
+	s, version, _ = p.GetStateVersion(key)
+	assert.Equal(t, uint64(2), version)
+	assert.Equal(t, int32(2), s.Wanted)
+	assert.Equal(t, time.Duration(stateCacheTime)*time.Second, server.TTL(key))
+
+	history := utils.QueueHistory{}
+	assert.Nil(t, p.SetQueueHistory("test_redis_history", &history))
+	found, err := p.GetQueueHistory("test_redis_history")
+	assert.Nil(t, err)
+	assert.NotNil(t, found)
+	missing, err := p.GetRepoJobs("test_redis_missing")
+	assert.Nil(t, err)
+	assert.Nil(t, missing)
+
+	leaseKey := "test_redis_lease"
+	acquired, err := p.AcquireLease(leaseKey, "a", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, acquired)
+	acquired, _ = p.AcquireLease(leaseKey, "b", time.Minute)
+	assert.False(t, acquired)
+	acquired, _ = p.AcquireLease(leaseKey, "a", time.Minute)
+	assert.True(t, acquired)
+	assert.Nil(t, p.ReleaseLease(leaseKey, "b"))
+	acquired, _ = p.AcquireLease(leaseKey, "b", time.Minute)
+	assert.False(t, acquired)
+	assert.Nil(t, p.ReleaseLease(leaseKey, "a"))
+	acquired, _ = p.AcquireLease(leaseKey, "b", time.Minute)
+	assert.True(t, acquired)
+	// Leases held by holders which have died expire
+	server.FastForward(2 * time.Minute)
+	acquired, _ = p.AcquireLease(leaseKey, "a", time.Minute)
+	assert.True(t, acquired)
+}
+
+func TestRedisStandalone(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer server.Close()
+	server.RequireUserAuth("scaler", "secret")
+
+	_, err = NewRedisStateProvider(RedisOptions{Addrs: []string{server.Addr()}, Mode: RedisStandalone, Username: "scaler", Password: "wrong"})
+	assert.NotNil(t, err)
+	p, err := NewRedisStateProvider(RedisOptions{Addrs: []string{server.Addr()}, Mode: RedisStandalone, Username: "scaler", Password: "secret"})
+	assert.Nil(t, err)
+	defer p.Close()
+	testRedisProviderStateAndLeases(t, server, p)
+	assert.Nil(t, NewMigratingStateProvider(p).Ping())
+
+	server.Close()
+	assert.NotNil(t, p.Ping())
+	assert.NotNil(t, NewMigratingStateProvider(p).Ping())
+}
+
+func TestRedisCluster(t *testing.T) {
+	// miniredis is a cluster with a single node which owns every slot
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer server.Close()
+	p, err := NewRedisStateProvider(RedisOptions{Addrs: []string{server.Addr()}, Mode: RedisCluster})
+	assert.Nil(t, err)
+	defer p.Close()
+	testRedisProviderStateAndLeases(t, server, p)
+}
+
+// fakeSentinel answers the commands that go-redis sends to sentinels, it only knows of one master
+type fakeSentinel struct {
+	listener   net.Listener
+	master     string
+	password   string
+	mutex      sync.Mutex
+	authed     []string
+	masterAsks int
+}
+
+func newFakeSentinel(t *testing.T, master string, password string) *fakeSentinel {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &fakeSentinel{listener: listener, master: master, password: password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSentinel) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		cmd, err := readRespCommand(r)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(cmd[0])
+		switch {
+		case name == "AUTH":
+			s.mutex.Lock()
+			s.authed = append(s.authed, strings.Join(cmd[1:], " "))
+			s.mutex.Unlock()
+			if cmd[len(cmd)-1] != s.password {
+				fmt.Fprint(conn, "-WRONGPASS invalid username-password pair\r\n")
+				continue
+			}
+			authed = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authed:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case name == "SENTINEL" && strings.EqualFold(cmd[1], "get-master-addr-by-name"):
+			s.mutex.Lock()
+			s.masterAsks++
+			s.mutex.Unlock()
+			host, port, _ := net.SplitHostPort(s.master)
+			fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+		case name == "SENTINEL":
+			fmt.Fprint(conn, "*0\r\n")
+		case name == "PING":
+			fmt.Fprint(conn, "+PONG\r\n")
+		default:
+			// PSUBSCRIBE for failovers is left hanging, there aren't any
+		}
+	}
+}
+
+func (s *fakeSentinel) auths() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.authed...)
+}
+
+func readRespCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	cmd := make([]string, count)
+	for i := range cmd {
+		if _, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		cmd[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return cmd, nil
+}
+
+// writeTestCert writes a self signed certificate for 127.0.0.1 and returns its TLS config and the path of the CA file
+func writeTestCert(t *testing.T) (*tls.Config, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	cert, err := tls.X509KeyPair(certPem, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	assert.Nil(t, err)
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	assert.Nil(t, ioutil.WriteFile(caFile, certPem, 0600))
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, caFile
+}
+
+func TestRedisSentinelHasItsOwnAuthAndTLS(t *testing.T) {
+	tlsConfig, caFile := writeTestCert(t)
+	server, err := miniredis.RunTLS(tlsConfig)
+	assert.Nil(t, err)
+	defer server.Close()
+	server.RequireUserAuth("scaler", "secret")
+	sentinel := newFakeSentinel(t, server.Addr(), "sentinel-secret")
+	defer sentinel.listener.Close()
+
+	// The master uses TLS and ACLs whilst the sentinel is plain text with a password
+	p, err := NewRedisStateProvider(RedisOptions{
+		Addrs:            []string{sentinel.listener.Addr().String()},
+		Mode:             RedisSentinel,
+		MasterName:       "primary",
+		Username:         "scaler",
+		Password:         "secret",
+		TLS:              true,
+		CaFile:           caFile,
+		SentinelPassword: "sentinel-secret",
+	})
+	assert.Nil(t, err)
+	defer p.Close()
+	testRedisProviderStateAndLeases(t, server, p)
+	assert.Contains(t, sentinel.auths(), "sentinel-secret")
+	assert.NotContains(t, sentinel.auths(), "scaler secret")
+	sentinel.mutex.Lock()
+	assert.Greater(t, sentinel.masterAsks, 0)
+	sentinel.mutex.Unlock()
+
+	_, err = NewRedisStateProvider(RedisOptions{
+		Addrs:      []string{sentinel.listener.Addr().String()},
+		Mode:       RedisSentinel,
+		MasterName: "primary",
+		Username:   "scaler",
+		Password:   "secret",
+		TLS:        true,
+		CaFile:     caFile,
+	})
+	assert.NotNil(t, err)
+}
@@ -1,39 +1,152 @@
 package state
 
 import (
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/devjoes/github-runner-autoscaler/apiserver/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/klog/v2"
 )
 
 type IStateProvider interface {
 	GetState(key string) (*ClientState, error)
 	SetState(key string, state *ClientState) error
+	// GetStateVersion returns the state along with its version, the version is 0 if the state hasn't been saved
+	GetStateVersion(key string) (*ClientState, uint64, error)
+	// CompareAndSetState saves the state if it is still at version, otherwise it returns ErrConflict
+	CompareAndSetState(key string, state *ClientState, version uint64) error
 	GetWorkflowInfo(key string) (*map[int64]utils.WorkflowInfo, error)
 	SetWorkflowInfo(key string, wfInfo *map[int64]utils.WorkflowInfo) error
+	GetCachedResponse(key string) (*CachedResponse, error)
+	SetCachedResponse(key string, resp *CachedResponse) error
+	GetQueueHistory(key string) (*utils.QueueHistory, error)
+	SetQueueHistory(key string, history *utils.QueueHistory) error
+	GetRepoJobs(key string) (*RepoJobs, error)
+	SetRepoJobs(key string, jobs *RepoJobs) error
+	// AcquireLease returns true if holder now holds the lease on key, leases expire after ttl unless released first
+	AcquireLease(key string, holder string, ttl time.Duration) (bool, error)
+	ReleaseLease(key string, holder string) error
+}
+
+// Pinger is implemented by state providers which can check that they can still be written to
+type Pinger interface {
+	Ping() error
+}
+
+// Cached responses are only useful whilst the resource is still being polled
+const cachedResponseLifetime = time.Hour
+
+// maxConflictRetries is how many times UpdateState retries after the state was changed by someone else
+const maxConflictRetries = 5
+
+// ErrConflict is returned by CompareAndSetState when the state has changed since it was read
+var ErrConflict = errors.New("state was changed by someone else")
+
+var counterConflicts *prometheus.CounterVec
+
+func init() {
+	counterConflicts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "workflow_state_conflicts",
+		Help: "Number of times a workflow's state was changed by another request or replica whilst it was being updated",
+	}, []string{"name", "namespace"})
+}
+
+// UpdateState applies update to the latest state of key and saves it. If the state is changed in the meantime, e.g.
+// by another API server replica, then update is applied again to the new state.
+func UpdateState(p IStateProvider, key string, update func(s *ClientState) error) (*ClientState, error) {
+	for attempt := 0; ; attempt++ {
+		s, version, err := p.GetStateVersion(key)
+		if err != nil {
+			return nil, err
+		}
+		if err = update(s); err != nil {
+			return nil, err
+		}
+		err = p.CompareAndSetState(key, s, version)
+		if err == nil {
+			return s, nil
+		}
+		if !errors.Is(err, ErrConflict) {
+			return nil, err
+		}
+		if namespace, _, name, ok := parseKey(key); ok {
+			counterConflicts.WithLabelValues(name, namespace).Inc()
+		} else {
+			counterConflicts.WithLabelValues(key, "").Inc()
+		}
+		if attempt >= maxConflictRetries {
+			return nil, err
+		}
+		klog.V(5).Infof("State of %s was changed whilst it was being updated, retrying", key)
+	}
 }
 
 type InMemoryStateProvider struct {
 	ClientStateData      map[string]ClientState
 	clientStateDataMutex *sync.RWMutex
+	// versions of ClientStateData, they are guarded by clientStateDataMutex too
+	versions             map[string]uint64
 	WorkflowInfo         map[string]map[int64]utils.WorkflowInfo
 	workflowInfoMutex    *sync.RWMutex
+	CachedResponses      map[string]CachedResponse
+	cachedResponsesMutex *sync.RWMutex
+	lastPurge            time.Time
+	QueueHistory         map[string]utils.QueueHistory
+	queueHistoryMutex    *sync.RWMutex
+	RepoJobs             map[string]RepoJobs
+	repoJobsMutex        *sync.RWMutex
+	leases               map[string]lease
+	leasesMutex          *sync.Mutex
+}
+
+type lease struct {
+	holder  string
+	expires time.Time
 }
 
 func (p *InMemoryStateProvider) GetState(key string) (*ClientState, error) {
+	s, _, err := p.GetStateVersion(key)
+	return s, err
+}
+
+func (p *InMemoryStateProvider) SetState(key string, state *ClientState) error {
+	p.clientStateDataMutex.Lock()
+	defer p.clientStateDataMutex.Unlock()
+	p.ClientStateData[key] = *state
+	p.versions[key]++
+	return nil
+}
+
+func (p *InMemoryStateProvider) GetStateVersion(key string) (*ClientState, uint64, error) {
 	p.clientStateDataMutex.RLock()
 	defer p.clientStateDataMutex.RUnlock()
 	s, found := p.ClientStateData[key]
 	if !found {
-		return NewClientState(key), nil
+		return NewClientState(key), 0, nil
 	}
-	return &s, nil
+	if s.RunnersLastSeen != nil {
+		// The map is updated in place so copy it to stop callers changing the saved state
+		seen := make(map[int]time.Time, len(s.RunnersLastSeen))
+		for ordinal, t := range s.RunnersLastSeen {
+			seen[ordinal] = t
+		}
+		s.RunnersLastSeen = seen
+	}
+	return &s, p.versions[key], nil
 }
 
-func (p *InMemoryStateProvider) SetState(key string, state *ClientState) error {
+func (p *InMemoryStateProvider) CompareAndSetState(key string, state *ClientState, version uint64) error {
 	p.clientStateDataMutex.Lock()
 	defer p.clientStateDataMutex.Unlock()
+	_, found := p.ClientStateData[key]
+	if (found && p.versions[key] != version) || (!found && version != 0) {
+		return ErrConflict
+	}
 	p.ClientStateData[key] = *state
+	p.versions[key]++
 	return nil
 }
 
@@ -54,6 +167,89 @@ func (p *InMemoryStateProvider) SetWorkflowInfo(key string, state *map[int64]uti
 	return nil
 }
 
+func (p *InMemoryStateProvider) GetCachedResponse(key string) (*CachedResponse, error) {
+	p.cachedResponsesMutex.RLock()
+	defer p.cachedResponsesMutex.RUnlock()
+	r, found := p.CachedResponses[key]
+	if !found {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+func (p *InMemoryStateProvider) SetCachedResponse(key string, resp *CachedResponse) error {
+	p.cachedResponsesMutex.Lock()
+	defer p.cachedResponsesMutex.Unlock()
+	now := time.Now().UTC()
+	if now.Sub(p.lastPurge) > time.Minute {
+		// Lots of URLs (e.g. the jobs for each run) are only requested for a short time so remove them once they expire
+		for k, r := range p.CachedResponses {
+			if now.Sub(r.StoredAt) > cachedResponseLifetime {
+				delete(p.CachedResponses, k)
+			}
+		}
+		p.lastPurge = now
+	}
+	p.CachedResponses[key] = *resp
+	return nil
+}
+
+func (p *InMemoryStateProvider) GetQueueHistory(key string) (*utils.QueueHistory, error) {
+	p.queueHistoryMutex.RLock()
+	defer p.queueHistoryMutex.RUnlock()
+	h, found := p.QueueHistory[key]
+	if !found {
+		return nil, nil
+	}
+	// Samples are appended to so copy them to stop callers sharing the backing array
+	h.Samples = append([]utils.DemandSample{}, h.Samples...)
+	return &h, nil
+}
+
+func (p *InMemoryStateProvider) SetQueueHistory(key string, history *utils.QueueHistory) error {
+	p.queueHistoryMutex.Lock()
+	defer p.queueHistoryMutex.Unlock()
+	p.QueueHistory[key] = *history
+	return nil
+}
+
+func (p *InMemoryStateProvider) GetRepoJobs(key string) (*RepoJobs, error) {
+	p.repoJobsMutex.RLock()
+	defer p.repoJobsMutex.RUnlock()
+	j, found := p.RepoJobs[key]
+	if !found {
+		return nil, nil
+	}
+	return &j, nil
+}
+
+func (p *InMemoryStateProvider) SetRepoJobs(key string, jobs *RepoJobs) error {
+	p.repoJobsMutex.Lock()
+	defer p.repoJobsMutex.Unlock()
+	p.RepoJobs[key] = *jobs
+	return nil
+}
+
+func (p *InMemoryStateProvider) AcquireLease(key string, holder string, ttl time.Duration) (bool, error) {
+	p.leasesMutex.Lock()
+	defer p.leasesMutex.Unlock()
+	now := time.Now()
+	if l, found := p.leases[key]; found && l.holder != holder && now.Before(l.expires) {
+		return false, nil
+	}
+	p.leases[key] = lease{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (p *InMemoryStateProvider) ReleaseLease(key string, holder string) error {
+	p.leasesMutex.Lock()
+	defer p.leasesMutex.Unlock()
+	if l, found := p.leases[key]; found && l.holder == holder {
+		delete(p.leases, key)
+	}
+	return nil
+}
+
 func NewInMemoryStateProvider() *InMemoryStateProvider {
 	return NewInMemoryStateProviderWithData(make(map[string]ClientState))
 }
@@ -62,7 +258,16 @@ func NewInMemoryStateProviderWithData(data map[string]ClientState) *InMemoryStat
 	return &InMemoryStateProvider{
 		clientStateDataMutex: &sync.RWMutex{},
 		workflowInfoMutex:    &sync.RWMutex{},
+		cachedResponsesMutex: &sync.RWMutex{},
+		queueHistoryMutex:    &sync.RWMutex{},
+		repoJobsMutex:        &sync.RWMutex{},
+		leasesMutex:          &sync.Mutex{},
 		ClientStateData:      data,
+		versions:             make(map[string]uint64),
 		WorkflowInfo:         make(map[string]map[int64]utils.WorkflowInfo),
+		CachedResponses:      make(map[string]CachedResponse),
+		QueueHistory:         make(map[string]utils.QueueHistory),
+		RepoJobs:             make(map[string]RepoJobs),
+		leases:               make(map[string]lease),
 	}
 }
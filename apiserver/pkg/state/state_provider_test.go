@@ -0,0 +1,80 @@
+package state
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareAndSetStateRejectsStaleVersions(t *testing.T) {
+	p := NewInMemoryStateProvider()
+	s, version, err := p.GetStateVersion("wf")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), version)
+	assert.Nil(t, p.CompareAndSetState("wf", s, version))
+	assert.Equal(t, ErrConflict, p.CompareAndSetState("wf", s, version))
+
+	_, version, _ = p.GetStateVersion("wf")
+	p.SetState("wf", &ClientState{Wanted: 1})
+	assert.Equal(t, ErrConflict, p.CompareAndSetState("wf", s, version))
+}
+
+func TestUpdateStateRetriesOnConflict(t *testing.T) {
+	p := NewInMemoryStateProvider()
+	now := time.Now().UTC()
+	attempts := 0
+	s, err := UpdateState(p, "wf", func(s *ClientState) error {
+		attempts++
+		if attempts == 1 {
+			// Another replica saves the state in the meantime
+			p.SetState("wf", &ClientState{KeepAliveSince: &now, RunnersLastSeen: map[int]time.Time{0: now}})
+		}
+		s.Wanted = 3
+		if s.RunnersLastSeen == nil {
+			s.RunnersLastSeen = map[int]time.Time{}
+		}
+		s.RunnersLastSeen[1] = now
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, int32(3), s.Wanted)
+
+	saved, _ := p.GetState("wf")
+	assert.Equal(t, int32(3), saved.Wanted)
+	assert.Equal(t, &now, saved.KeepAliveSince)
+	assert.Len(t, saved.RunnersLastSeen, 2)
+
+	bang := errors.New("bang")
+	_, err = UpdateState(p, "wf", func(s *ClientState) error {
+		s.Wanted = 5
+		return bang
+	})
+	assert.Equal(t, bang, err)
+	saved, _ = p.GetState("wf")
+	assert.Equal(t, int32(3), saved.Wanted)
+
+	_, err = UpdateState(p, "wf", func(s *ClientState) error {
+		return p.SetState("wf", s)
+	})
+	assert.Equal(t, ErrConflict, err)
+}
+
+func TestCountsConflictsByWorkflow(t *testing.T) {
+	p := NewInMemoryStateProvider()
+	key := Key("ns", KindState, "wf")
+	before := testutil.ToFloat64(counterConflicts.WithLabelValues("wf", "ns"))
+	attempts := 0
+	_, err := UpdateState(p, key, func(s *ClientState) error {
+		attempts++
+		if attempts == 1 {
+			p.SetState(key, &ClientState{})
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, before+1, testutil.ToFloat64(counterConflicts.WithLabelValues("wf", "ns")))
+}
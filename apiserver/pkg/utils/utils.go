@@ -1,5 +1,15 @@
 package utils
 
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v33/github"
+)
+
 func ContainsStr(arr []string, i string) bool {
 	for _, x := range arr {
 		if x == i {
@@ -9,8 +19,327 @@ func ContainsStr(arr []string, i string) bool {
 	return false
 }
 
+// AppendIfMissing appends each value which isn't already in arr
+func AppendIfMissing(arr []string, values ...string) []string {
+	for _, v := range values {
+		if !ContainsStr(arr, v) {
+			arr = append(arr, v)
+		}
+	}
+	return arr
+}
+
 type WorkflowInfo struct {
 	ID     int64    `json:"id,omitempty"`
 	Name   string   `json:"name,omitempty"`
 	Labels []string `json:"labels,omitempty"` //TODO: Rename to RunsOn
+	// Jobs maps the name that Github gives each job to the labels in its runs-on
+	Jobs map[string][]string `json:"jobs,omitempty"`
+}
+
+// LabelsForJob returns the labels that a job runs on. If the job isn't known by name, e.g. because matrix values were
+// named in a different order, then every variation of the job is used and failing that every label in the workflow.
+func (w *WorkflowInfo) LabelsForJob(name string) []string {
+	if labels, found := w.Jobs[name]; found {
+		return labels
+	}
+	base := name
+	if i := strings.Index(name, " ("); i > 0 {
+		base = name[:i]
+	}
+	var labels []string
+	for n, l := range w.Jobs {
+		if n == base || strings.HasPrefix(n, base+" (") {
+			labels = AppendIfMissing(labels, l...)
+		}
+	}
+	if labels == nil {
+		return w.Labels
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// Reasons that a pending job can't be picked up by a runner yet
+const (
+	BlockedOnEnvironment  = "environment"
+	BlockedOnConcurrency  = "concurrency"
+	BlockedOnForkApproval = "fork_approval"
+)
+
+var BlockedReasons = []string{BlockedOnEnvironment, BlockedOnConcurrency, BlockedOnForkApproval}
+
+// WorkflowJob is a job from an active workflow run along with the ID of the workflow that it belongs to
+type WorkflowJob struct {
+	*github.WorkflowJob
+	WorkflowID *int64 `json:"workflow_id,omitempty"`
+	// Repository that the job belongs to, only set for organizations
+	Repository string `json:"repository,omitempty"`
+	// BlockedReason is set when the job is waiting on something other than a runner
+	BlockedReason string `json:"blocked_reason,omitempty"`
+	// QueuedAt is when the job started waiting for a runner
+	QueuedAt *time.Time `json:"queued_at,omitempty"`
+}
+
+// JobSummary is the compact form that jobs are cached in. A whole github.WorkflowJob includes every step and several
+// URLs, which made the jobs cached for busy repos approach memcached's 1MB item limit. Times are in seconds since the
+// epoch.
+type JobSummary struct {
+	ID            int64  `json:"i,omitempty"`
+	RunID         int64  `json:"r,omitempty"`
+	Name          string `json:"n,omitempty"`
+	Status        string `json:"s,omitempty"`
+	StartedAt     int64  `json:"t,omitempty"`
+	QueuedAt      int64  `json:"q,omitempty"`
+	WorkflowID    int64  `json:"w,omitempty"`
+	Repository    string `json:"p,omitempty"`
+	BlockedReason string `json:"b,omitempty"`
+}
+
+// Summary returns the fields of the job which are cached
+func (j *WorkflowJob) Summary() JobSummary {
+	s := JobSummary{
+		ID:            j.GetID(),
+		RunID:         j.GetRunID(),
+		Name:          j.GetName(),
+		Status:        j.GetStatus(),
+		Repository:    j.Repository,
+		BlockedReason: j.BlockedReason,
+	}
+	if j.WorkflowJob != nil && j.StartedAt != nil {
+		s.StartedAt = j.StartedAt.Unix()
+	}
+	if j.QueuedAt != nil {
+		s.QueuedAt = j.QueuedAt.Unix()
+	}
+	if j.WorkflowID != nil {
+		s.WorkflowID = *j.WorkflowID
+	}
+	return s
+}
+
+// Job returns the job that s summarizes
+func (s JobSummary) Job() *WorkflowJob {
+	j := &WorkflowJob{
+		WorkflowJob:   &github.WorkflowJob{},
+		Repository:    s.Repository,
+		BlockedReason: s.BlockedReason,
+	}
+	if s.ID != 0 {
+		j.ID = &s.ID
+	}
+	if s.RunID != 0 {
+		j.RunID = &s.RunID
+	}
+	if s.Name != "" {
+		j.Name = &s.Name
+	}
+	if s.Status != "" {
+		j.Status = &s.Status
+	}
+	if s.StartedAt != 0 {
+		j.StartedAt = &github.Timestamp{Time: time.Unix(s.StartedAt, 0).UTC()}
+	}
+	if s.QueuedAt != 0 {
+		queuedAt := time.Unix(s.QueuedAt, 0).UTC()
+		j.QueuedAt = &queuedAt
+	}
+	if s.WorkflowID != 0 {
+		j.WorkflowID = &s.WorkflowID
+	}
+	return j
+}
+
+// MarshalJSON stores the job as a JobSummary
+func (j WorkflowJob) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.Summary())
+}
+
+// legacyWorkflowJob is how jobs were stored before JobSummary, it doesn't have WorkflowJob's JSON methods
+type legacyWorkflowJob struct {
+	*github.WorkflowJob
+	WorkflowID    *int64     `json:"workflow_id,omitempty"`
+	Repository    string     `json:"repository,omitempty"`
+	BlockedReason string     `json:"blocked_reason,omitempty"`
+	QueuedAt      *time.Time `json:"queued_at,omitempty"`
+}
+
+// UnmarshalJSON reads a JobSummary, or a whole github.WorkflowJob for jobs which were stored before JobSummary
+func (j *WorkflowJob) UnmarshalJSON(data []byte) error {
+	var s JobSummary
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s != (JobSummary{}) {
+		*j = *s.Job()
+		return nil
+	}
+	// Every summary has a run ID, so this is either a legacy job or an empty one
+	var legacy legacyWorkflowJob
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	*j = WorkflowJob(legacy)
+	if j.WorkflowJob == nil {
+		j.WorkflowJob = &github.WorkflowJob{}
+	}
+	return nil
+}
+
+// GetQueuedAt returns QueuedAt or StartedAt for jobs cached before QueuedAt was recorded
+func (j *WorkflowJob) GetQueuedAt() *time.Time {
+	if j.QueuedAt != nil {
+		return j.QueuedAt
+	}
+	if j.StartedAt != nil {
+		return &j.StartedAt.Time
+	}
+	return nil
+}
+
+// WaitTimes are how long the pending jobs have been waiting for a runner
+type WaitTimes struct {
+	Oldest time.Duration
+	P50    time.Duration
+	P95    time.Duration
+}
+
+// GetWaitTimes works out how long the jobs which aren't in progress have been waiting for, the percentiles use the
+// nearest rank
+func GetWaitTimes(jobs []*WorkflowJob, now time.Time) WaitTimes {
+	waits := []time.Duration{}
+	for _, j := range jobs {
+		queuedAt := j.GetQueuedAt()
+		if j.GetStatus() == "in_progress" || queuedAt == nil {
+			continue
+		}
+		wait := now.Sub(*queuedAt)
+		if wait < 0 {
+			wait = 0
+		}
+		waits = append(waits, wait)
+	}
+	if len(waits) == 0 {
+		return WaitTimes{}
+	}
+	sort.Slice(waits, func(a, b int) bool { return waits[a] < waits[b] })
+	percentile := func(p float64) time.Duration {
+		rank := int(math.Ceil(p*float64(len(waits)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		return waits[rank]
+	}
+	return WaitTimes{Oldest: waits[len(waits)-1], P50: percentile(0.5), P95: percentile(0.95)}
+}
+
+// SplitBlocked separates the jobs which a runner could pick up from those which are waiting on something else
+func SplitBlocked(jobs []*WorkflowJob) ([]*WorkflowJob, []*WorkflowJob) {
+	runnable, blocked := []*WorkflowJob{}, []*WorkflowJob{}
+	for _, j := range jobs {
+		if j.BlockedReason == "" {
+			runnable = append(runnable, j)
+		} else {
+			blocked = append(blocked, j)
+		}
+	}
+	return runnable, blocked
+}
+
+const (
+	RunnerOffline = "offline"
+	RunnerIdle    = "idle"
+	RunnerBusy    = "busy"
+)
+
+// RunnerStatus is what Github reports for a self-hosted runner registered by one of a StatefulSet's pods
+type RunnerStatus struct {
+	Name    string `json:"name"`
+	Ordinal int    `json:"ordinal"`
+	Online  bool   `json:"online"`
+	Busy    bool   `json:"busy"`
+}
+
+func (r RunnerStatus) Status() string {
+	switch {
+	case r.Busy:
+		return RunnerBusy
+	case r.Online:
+		return RunnerIdle
+	}
+	return RunnerOffline
+}
+
+// CountBusy returns the number of runners which are running a job
+func CountBusy(runners []RunnerStatus) int {
+	busy := 0
+	for _, r := range runners {
+		if r.Busy {
+			busy++
+		}
+	}
+	return busy
+}
+
+// SplitStale separates the jobs which have been queued for longer than maxPendingAge, or in progress for longer than
+// maxInProgressAge, from the rest. A max age of 0 means that jobs never go stale.
+func SplitStale(jobs []*WorkflowJob, now time.Time, maxPendingAge time.Duration, maxInProgressAge time.Duration) ([]*WorkflowJob, []*WorkflowJob) {
+	fresh, stale := []*WorkflowJob{}, []*WorkflowJob{}
+	for _, j := range jobs {
+		maxAge := maxPendingAge
+		if j.GetStatus() == "in_progress" {
+			maxAge = maxInProgressAge
+		}
+		if maxAge > 0 && j.StartedAt != nil && now.Sub(j.StartedAt.Time) > maxAge {
+			stale = append(stale, j)
+		} else {
+			fresh = append(fresh, j)
+		}
+	}
+	return fresh, stale
+}
+
+// HistoryBucket is how much time each sample in a QueueHistory covers
+const HistoryBucket = 15 * time.Minute
+
+// QueueHistory is a rolling time series of demand (queued jobs plus busy runners) in order of time
+type QueueHistory struct {
+	Samples []DemandSample `json:"samples"`
+}
+
+// DemandSample is the highest demand seen in the HistoryBucket starting at Start
+type DemandSample struct {
+	// Start is in seconds since the epoch to keep the history small
+	Start  int64 `json:"t"`
+	Demand int32 `json:"d"`
+}
+
+// Record adds demand to the sample for now and drops samples which are older than retention
+func (h *QueueHistory) Record(now time.Time, demand int32, retention time.Duration) {
+	start := now.Truncate(HistoryBucket).Unix()
+	last := len(h.Samples) - 1
+	switch {
+	case last >= 0 && h.Samples[last].Start == start:
+		if demand > h.Samples[last].Demand {
+			h.Samples[last].Demand = demand
+		}
+	case last >= 0 && h.Samples[last].Start > start:
+		// The clock went backwards, keep the history in order by ignoring it
+		return
+	default:
+		h.Samples = append(h.Samples, DemandSample{Start: start, Demand: demand})
+	}
+	oldest := now.Add(-retention).Unix()
+	drop := sort.Search(len(h.Samples), func(i int) bool { return h.Samples[i].Start >= oldest })
+	h.Samples = h.Samples[drop:]
+}
+
+// At returns the demand recorded in the bucket containing t, found is false if nothing was recorded then
+func (h *QueueHistory) At(t time.Time) (int32, bool) {
+	start := t.Truncate(HistoryBucket).Unix()
+	i := sort.Search(len(h.Samples), func(i int) bool { return h.Samples[i].Start >= start })
+	if i < len(h.Samples) && h.Samples[i].Start == start {
+		return h.Samples[i].Demand, true
+	}
+	return 0, false
 }
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v33/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitsStaleJobs(t *testing.T) {
+	now := time.Now()
+	job := func(id int64, status string, age time.Duration) *WorkflowJob {
+		j := &WorkflowJob{WorkflowJob: &github.WorkflowJob{ID: &id, Status: &status}}
+		if age > 0 {
+			j.StartedAt = &github.Timestamp{Time: now.Add(-age)}
+		}
+		return j
+	}
+	jobs := []*WorkflowJob{
+		job(1, "queued", time.Minute),
+		job(2, "queued", 2*time.Hour),
+		job(3, "in_progress", 2*time.Hour),
+		job(4, "in_progress", 7*time.Hour),
+		job(5, "queued", 0),
+	}
+	ids := func(jobs []*WorkflowJob) []int64 {
+		ids := []int64{}
+		for _, j := range jobs {
+			ids = append(ids, j.GetID())
+		}
+		return ids
+	}
+
+	fresh, stale := SplitStale(jobs, now, time.Hour, 6*time.Hour)
+	assert.Equal(t, []int64{1, 3, 5}, ids(fresh))
+	assert.Equal(t, []int64{2, 4}, ids(stale))
+
+	fresh, stale = SplitStale(jobs, now, 0, 0)
+	assert.Len(t, fresh, 5)
+	assert.Len(t, stale, 0)
+}
+
+func TestRecordsQueueHistory(t *testing.T) {
+	start := time.Date(2021, 5, 3, 9, 0, 0, 0, time.UTC)
+	h := QueueHistory{}
+	h.Record(start, 2, time.Hour)
+	h.Record(start.Add(5*time.Minute), 5, time.Hour)
+	h.Record(start.Add(10*time.Minute), 1, time.Hour)
+	h.Record(start.Add(20*time.Minute), 3, time.Hour)
+
+	d, found := h.At(start.Add(14 * time.Minute))
+	assert.True(t, found)
+	assert.Equal(t, int32(5), d)
+	d, found = h.At(start.Add(15 * time.Minute))
+	assert.True(t, found)
+	assert.Equal(t, int32(3), d)
+	_, found = h.At(start.Add(30 * time.Minute))
+	assert.False(t, found)
+
+	h.Record(start.Add(80*time.Minute), 0, time.Hour)
+	assert.Len(t, h.Samples, 1)
+	_, found = h.At(start)
+	assert.False(t, found)
+}
+
+func TestGetsWaitTimesOfQueuedJobs(t *testing.T) {
+	now := time.Now()
+	jobs := []*WorkflowJob{}
+	for i := 1; i <= 20; i++ {
+		queuedAt := now.Add(-time.Duration(i) * time.Minute)
+		jobs = append(jobs, &WorkflowJob{WorkflowJob: &github.WorkflowJob{Status: github.String("queued")}, QueuedAt: &queuedAt})
+	}
+	longAgo := now.Add(-time.Hour)
+	jobs = append(jobs,
+		&WorkflowJob{WorkflowJob: &github.WorkflowJob{Status: github.String("in_progress"), StartedAt: &github.Timestamp{Time: longAgo}}},
+		&WorkflowJob{WorkflowJob: &github.WorkflowJob{Status: github.String("queued")}})
+
+	waits := GetWaitTimes(jobs, now)
+	assert.Equal(t, 20*time.Minute, waits.Oldest)
+	assert.Equal(t, 10*time.Minute, waits.P50)
+	assert.Equal(t, 19*time.Minute, waits.P95)
+	assert.Equal(t, WaitTimes{}, GetWaitTimes([]*WorkflowJob{}, now))
+}
+
+func TestStoresJobsAsSummaries(t *testing.T) {
+	id, runID, workflowID := int64(1), int64(2), int64(3)
+	name, status := "build", "queued"
+	queuedAt := time.Unix(1600000000, 0).UTC()
+	job := WorkflowJob{
+		WorkflowJob: &github.WorkflowJob{ID: &id, RunID: &runID, Name: &name, Status: &status,
+			StartedAt: &github.Timestamp{Time: queuedAt}, HTMLURL: github.String("https://github.com/foo/bar/runs/1"),
+			Steps: []*github.TaskStep{{Name: github.String("checkout")}}},
+		WorkflowID:    &workflowID,
+		Repository:    "foo/bar",
+		BlockedReason: BlockedOnEnvironment,
+		QueuedAt:      &queuedAt,
+	}
+	data, err := json.Marshal([]*WorkflowJob{&job})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "checkout")
+
+	var jobs []*WorkflowJob
+	assert.Nil(t, json.Unmarshal(data, &jobs))
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, id, jobs[0].GetID())
+	assert.Equal(t, runID, jobs[0].GetRunID())
+	assert.Equal(t, name, jobs[0].GetName())
+	assert.Equal(t, status, jobs[0].GetStatus())
+	assert.Equal(t, queuedAt, jobs[0].StartedAt.Time)
+	assert.Equal(t, queuedAt, *jobs[0].QueuedAt)
+	assert.Equal(t, workflowID, *jobs[0].WorkflowID)
+	assert.Equal(t, "foo/bar", jobs[0].Repository)
+	assert.Equal(t, BlockedOnEnvironment, jobs[0].BlockedReason)
+	assert.Nil(t, jobs[0].HTMLURL)
+}
+
+func TestReadsJobsStoredBeforeSummaries(t *testing.T) {
+	legacy := `[{"id":1,"run_id":2,"name":"build","status":"queued","started_at":"2020-09-13T12:26:40Z","workflow_id":3,"repository":"foo/bar","queued_at":"2020-09-13T12:26:40Z"},{}]`
+	var jobs []*WorkflowJob
+	assert.Nil(t, json.Unmarshal([]byte(legacy), &jobs))
+	assert.Len(t, jobs, 2)
+	assert.Equal(t, int64(1), jobs[0].GetID())
+	assert.Equal(t, int64(2), jobs[0].GetRunID())
+	assert.Equal(t, "queued", jobs[0].GetStatus())
+	assert.Equal(t, int64(1600000000), jobs[0].GetQueuedAt().Unix())
+	assert.Equal(t, int64(3), *jobs[0].WorkflowID)
+	assert.Equal(t, "foo/bar", jobs[0].Repository)
+	assert.NotNil(t, jobs[1].WorkflowJob)
+}
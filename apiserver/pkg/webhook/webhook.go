@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/google/go-github/v33/github"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/klog/v2"
+)
+
+const (
+	signatureHeader       = "X-Hub-Signature"
+	signatureSha256Header = "X-Hub-Signature-256"
+	maxPayloadBytes       = 25 * 1024 * 1024
+)
+
+var counterWebhookEvents *prometheus.CounterVec
+
+func init() {
+	counterWebhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "workflow_webhook_events",
+		Help: "Github webhook events received",
+	}, []string{"event", "action", "owner", "repository", "errored"})
+}
+
+// IEventHandler applies webhook events to the state of every workflow that counts jobs in a repository and returns how
+// many were updated
+type IEventHandler interface {
+	HandleWorkflowJob(ctx context.Context, repo *github.Repository, job *github.WorkflowJob) (int, error)
+	HandleWorkflowRun(ctx context.Context, repo *github.Repository, run *github.WorkflowRun) (int, error)
+}
+
+type Webhook struct {
+	secret  []byte
+	handler IEventHandler
+}
+
+// go-github v33 doesn't know about workflow_job events and omits workflow_run from WorkflowRunEvent
+type workflowJobEvent struct {
+	Action      string              `json:"action"`
+	WorkflowJob *github.WorkflowJob `json:"workflow_job"`
+	Repo        *github.Repository  `json:"repository"`
+}
+
+type workflowRunEvent struct {
+	Action      string              `json:"action"`
+	WorkflowRun *github.WorkflowRun `json:"workflow_run"`
+	Repo        *github.Repository  `json:"repository"`
+}
+
+func NewWebhook(secret string, handler IEventHandler) Webhook {
+	return Webhook{secret: []byte(secret), handler: handler}
+}
+
+func (wh *Webhook) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		payload, err := wh.validatePayload(r)
+		if err != nil {
+			klog.Warningf("Rejected webhook %s: %s", r.Header.Get("X-Github-Delivery"), err.Error())
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		event := github.WebHookType(r)
+		action, owner, repository, err := wh.handleEvent(r.Context(), event, payload)
+		counterWebhookEvents.WithLabelValues(event, action, owner, repository, fmt.Sprintf("%t", err != nil)).Inc()
+		if err != nil {
+			klog.Errorf("Error whilst processing %s webhook for %s/%s: %s", event, owner, repository, err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// validatePayload checks the HMAC signature of the request and returns the JSON payload
+func (wh *Webhook) validatePayload(r *http.Request) ([]byte, error) {
+	if len(wh.secret) == 0 {
+		return nil, errors.New("no webhook secret configured")
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxPayloadBytes))
+	if err != nil {
+		return nil, err
+	}
+	signature := r.Header.Get(signatureSha256Header)
+	if signature == "" {
+		signature = r.Header.Get(signatureHeader)
+	}
+	if signature == "" {
+		return nil, errors.New("request is not signed")
+	}
+	if err = github.ValidateSignature(signature, body, wh.secret); err != nil {
+		return nil, err
+	}
+	switch ct := r.Header.Get("Content-Type"); ct {
+	case "application/json":
+		return body, nil
+	case "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		return []byte(form.Get("payload")), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Type %q", ct)
+	}
+}
+
+func (wh *Webhook) handleEvent(ctx context.Context, event string, payload []byte) (string, string, string, error) {
+	switch event {
+	case "workflow_job":
+		e := workflowJobEvent{}
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return "", "", "", err
+		}
+		owner, repository := e.Repo.GetOwner().GetLogin(), e.Repo.GetName()
+		if e.WorkflowJob == nil || e.Repo == nil {
+			return e.Action, owner, repository, errors.New("workflow_job or repository missing from payload")
+		}
+		matched, err := wh.handler.HandleWorkflowJob(ctx, e.Repo, e.WorkflowJob)
+		klog.V(5).Infof("workflow_job %d %s in %s/%s updated %d workflows", e.WorkflowJob.GetID(), e.Action, owner, repository, matched)
+		return e.Action, owner, repository, err
+	case "workflow_run":
+		e := workflowRunEvent{}
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return "", "", "", err
+		}
+		owner, repository := e.Repo.GetOwner().GetLogin(), e.Repo.GetName()
+		if e.WorkflowRun == nil || e.Repo == nil {
+			return e.Action, owner, repository, errors.New("workflow_run or repository missing from payload")
+		}
+		matched, err := wh.handler.HandleWorkflowRun(ctx, e.Repo, e.WorkflowRun)
+		klog.V(5).Infof("workflow_run %d %s in %s/%s updated %d workflows", e.WorkflowRun.GetID(), e.Action, owner, repository, matched)
+		return e.Action, owner, repository, err
+	default:
+		// e.g. ping
+		return "", "", "", nil
+	}
+}
@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-github/v33/github"
+	"github.com/stretchr/testify/assert"
+)
+
+const secret = "s3cr3t"
+
+type fakeHandler struct {
+	owner      string
+	repository string
+	jobs       []*github.WorkflowJob
+	runs       []*github.WorkflowRun
+}
+
+func (h *fakeHandler) HandleWorkflowJob(ctx context.Context, repo *github.Repository, job *github.WorkflowJob) (int, error) {
+	h.owner, h.repository = repo.GetOwner().GetLogin(), repo.GetName()
+	h.jobs = append(h.jobs, job)
+	return 1, nil
+}
+
+func (h *fakeHandler) HandleWorkflowRun(ctx context.Context, repo *github.Repository, run *github.WorkflowRun) (int, error) {
+	h.owner, h.repository = repo.GetOwner().GetLogin(), repo.GetName()
+	h.runs = append(h.runs, run)
+	return 1, nil
+}
+
+func send(wh Webhook, event string, body string, key string) *httptest.ResponseRecorder {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(body))
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Github-Event", event)
+	req.Header.Set(signatureSha256Header, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	wh.Handler()(w, req)
+	return w
+}
+
+const jobPayload = `{"action":"queued","workflow_job":{"id":1,"run_id":2,"status":"queued"},"repository":{"name":"repo","owner":{"login":"owner"}}}`
+
+func TestRejectsInvalidSignatures(t *testing.T) {
+	handler := &fakeHandler{}
+	w := send(NewWebhook(secret, handler), "workflow_job", jobPayload, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Len(t, handler.jobs, 0)
+
+	w = send(NewWebhook("", handler), "workflow_job", jobPayload, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Len(t, handler.jobs, 0)
+}
+
+func TestDispatchesWorkflowJobs(t *testing.T) {
+	handler := &fakeHandler{}
+	w := send(NewWebhook(secret, handler), "workflow_job", jobPayload, secret)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, handler.jobs, 1)
+	assert.Equal(t, int64(2), handler.jobs[0].GetRunID())
+	assert.Equal(t, "owner", handler.owner)
+	assert.Equal(t, "repo", handler.repository)
+}
+
+func TestDispatchesWorkflowRuns(t *testing.T) {
+	handler := &fakeHandler{}
+	payload := `{"action":"completed","workflow_run":{"id":2,"workflow_id":3,"status":"completed"},"repository":{"name":"repo","owner":{"login":"owner"}}}`
+	w := send(NewWebhook(secret, handler), "workflow_run", payload, secret)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, handler.runs, 1)
+	assert.Equal(t, int64(3), handler.runs[0].GetWorkflowID())
+}
+
+func TestIgnoresOtherEvents(t *testing.T) {
+	handler := &fakeHandler{}
+	w := send(NewWebhook(secret, handler), "ping", `{"zen":"Keep it logically awesome."}`, secret)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, handler.jobs, 0)
+	assert.Len(t, handler.runs, 0)
+}
@@ -18,10 +18,16 @@ package v1alpha1
 
 import (
 	"context"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/devjoes/github-runner-autoscaler/operator/expression"
+	"github.com/devjoes/github-runner-autoscaler/operator/schedule"
 	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -39,18 +45,112 @@ type ScaledActionRunnerSpec struct {
 	// Important: Run "make" to regenerate code after modifying this file
 
 	// Foo is an example field of ScaledActionRunner. Edit ScaledActionRunner_types.go to remove/update
-	MaxRunners            int32            `json:"maxRunners"`
-	MinRunners            int32            `json:"minRunners,omitempty"`
-	RunnerSecrets         []string         `json:"runnerSecrets"`
-	GithubTokenSecret     string           `json:"githubTokenSecret"`
-	Owner                 string           `json:"owner"`
-	Repo                  string           `json:"repo"`
-	Scaling               *Scaling         `json:"scaling,omitempty"`
-	ScaleFactor           *string          `json:"scaleFactor,omitempty"`
-	MetricsSelector       *string          `json:"metricsSelector,omitempty"`
-	Runner                *Runner          `json:"runner,omitempty"`
-	ForceScaleUpWindow    *metav1.Duration `json:"forceScaleUpWindow,omitempty"`
-	ForceScaleUpFrequency *metav1.Duration `json:"forceScaleUpFrequency,omitempty"`
+	MaxRunners            int32             `json:"maxRunners"`
+	MinRunners            int32             `json:"minRunners,omitempty"`
+	RunnerSecrets         []string          `json:"runnerSecrets"`
+	GithubTokenSecret     string            `json:"githubTokenSecret,omitempty"`
+	GithubAppSecret       string            `json:"githubAppSecret,omitempty"`
+	Owner                 string            `json:"owner"`
+	Repo                  string            `json:"repo,omitempty"`
+	Organization          *Organization     `json:"organization,omitempty"`
+	Scaling               *Scaling          `json:"scaling,omitempty"`
+	ScaleFactor           *string           `json:"scaleFactor,omitempty"`
+	MetricsSelector       *string           `json:"metricsSelector,omitempty"`
+	Runner                *Runner           `json:"runner,omitempty"`
+	ForceScaleUpWindow    *metav1.Duration  `json:"forceScaleUpWindow,omitempty"`
+	ForceScaleUpFrequency *metav1.Duration  `json:"forceScaleUpFrequency,omitempty"`
+	Github                *GithubConnection `json:"github,omitempty"`
+	// MaxPendingAge is how long a job can be queued for before it is assumed to be stuck and is no longer counted
+	MaxPendingAge *metav1.Duration `json:"maxPendingAge,omitempty"`
+	// MaxInProgressAge is how long a job can be in progress for before it is assumed that its runner died
+	MaxInProgressAge *metav1.Duration `json:"maxInProgressAge,omitempty"`
+	// Windows override minRunners and maxRunners on a schedule, the first active window wins
+	Windows []ScheduledWindow `json:"windows,omitempty"`
+	// Priority decides which runners get capacity first when a budget in ScaledActionRunnerCore runs out, higher first
+	Priority int32 `json:"priority,omitempty"`
+}
+
+// ScheduledWindow overrides minRunners and/or maxRunners for a period of time after its schedule fires e.g. warm runners
+// during office hours or a freeze during maintenance
+type ScheduledWindow struct {
+	Name string `json:"name"`
+	// Schedule is a 5 field cron expression for when the window starts e.g. "0 9 * * 1-5"
+	Schedule string `json:"schedule"`
+	// Duration is how long the window lasts for after it starts, at most 31 days
+	Duration metav1.Duration `json:"duration"`
+	// Timezone that the schedule is in e.g. Europe/London, defaults to UTC
+	Timezone string `json:"timezone,omitempty"`
+	// MinRunners overrides minRunners while the window is active
+	MinRunners *int32 `json:"minRunners,omitempty"`
+	// MaxRunners overrides maxRunners while the window is active, it can't be more than maxRunners
+	MaxRunners *int32 `json:"maxRunners,omitempty"`
+}
+
+// Location returns the time zone that the window's schedule is in
+func (w *ScheduledWindow) Location() (*time.Location, error) {
+	if w.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(w.Timezone)
+}
+
+// Bounds returns the min and max runners while the window is active
+func (w *ScheduledWindow) Bounds(spec *ScaledActionRunnerSpec) (int32, int32) {
+	min, max := spec.MinRunners, spec.MaxRunners
+	if w.MinRunners != nil {
+		min = *w.MinRunners
+	}
+	if w.MaxRunners != nil {
+		max = *w.MaxRunners
+	}
+	if min > max {
+		min = max
+	}
+	return min, max
+}
+
+func (w *ScheduledWindow) validate(spec *ScaledActionRunnerSpec) error {
+	if w.Name == "" {
+		return errors.New("name must be specified")
+	}
+	if _, err := schedule.Parse(w.Schedule); err != nil {
+		return err
+	}
+	if w.Duration.Duration <= 0 || w.Duration.Duration > schedule.MaxDuration {
+		return fmt.Errorf("duration must be greater than 0 and no more than %s", schedule.MaxDuration.String())
+	}
+	if _, err := w.Location(); err != nil {
+		return fmt.Errorf("unknown timezone '%s'", w.Timezone)
+	}
+	if w.MinRunners == nil && w.MaxRunners == nil {
+		return errors.New("at least one of minRunners or maxRunners must be specified")
+	}
+	if (w.MinRunners != nil && *w.MinRunners < 0) || (w.MaxRunners != nil && *w.MaxRunners < 0) {
+		return errors.New("minRunners and maxRunners can't be negative")
+	}
+	if w.MaxRunners != nil && *w.MaxRunners > spec.MaxRunners {
+		return errors.New("maxRunners can't be more than the runner's maxRunners as there are no more runners registered")
+	}
+	if w.MinRunners != nil && *w.MinRunners > spec.MaxRunners {
+		return errors.New("minRunners can't be more than the runner's maxRunners as there are no more runners registered")
+	}
+	if w.MinRunners != nil && w.MaxRunners != nil && *w.MinRunners > *w.MaxRunners {
+		return errors.New("minRunners can't be more than maxRunners")
+	}
+	return nil
+}
+
+// ReplicaBounds returns the widest min and max runners across minRunners, maxRunners and every window so that the
+// ScaledObject doesn't stop a window from taking effect
+func (s *ScaledActionRunnerSpec) ReplicaBounds() (int32, int32) {
+	min, max := s.MinRunners, s.MaxRunners
+	for i := range s.Windows {
+		wMin, _ := s.Windows[i].Bounds(s)
+		if wMin < min {
+			min = wMin
+		}
+	}
+	return min, max
 }
 
 type Runner struct {
@@ -68,17 +168,314 @@ type Runner struct {
 	Patch                   string                                     `json:"patch,omitempty"`
 }
 
+// GithubConnection describes how to reach Github. Unset fields fall back to the values in ScaledActionRunnerCore and then to github.com
+type GithubConnection struct {
+	// BaseUrl of the Github API e.g. https://github.example.com/api/v3/
+	BaseUrl   string `json:"baseUrl,omitempty"`
+	UploadUrl string `json:"uploadUrl,omitempty"`
+	Proxy     string `json:"proxy,omitempty"`
+	NoProxy   string `json:"noProxy,omitempty"`
+	// CaBundle is PEM encoded and is trusted in addition to the system CAs
+	CaBundle string `json:"caBundle,omitempty"`
+}
+
+// Organization scopes runners to an organization rather than a single repo. Jobs are counted across every repo in the
+// organization that the credentials can see, optionally narrowed down by name or topic.
+type Organization struct {
+	// RunnerGroup that runners are registered in, the organization's default group is used if unset
+	RunnerGroup string `json:"runnerGroup,omitempty"`
+	// Repos to include, every repo is included if unset
+	Repos []string `json:"repos,omitempty"`
+	// ExcludeRepos are never included
+	ExcludeRepos []string `json:"excludeRepos,omitempty"`
+	// Topics that a repo must have at least one of to be included
+	Topics []string `json:"topics,omitempty"`
+}
+
 type Scaling struct {
 	Behavior        *autoscalingv2beta2.HorizontalPodAutoscalerBehavior `json:"behavior,omitempty"`
 	PollingInterval *int32                                              `json:"pollingInterval,omitempty"`
 	CooldownPeriod  *int32                                              `json:"cooldownPeriod,omitempty"`
+	// Strategy works out how many runners are needed, if it is unset then scaleFactor picks linear or logistic
+	Strategy *ScalingStrategy `json:"strategy,omitempty"`
+	// Predictive pre-scales for the demand seen at the same time on the same weekday in previous weeks
+	Predictive *PredictiveScaling `json:"predictive,omitempty"`
+	// MaxWait is the longest that a job should wait for a runner, while the oldest queued job has waited for longer
+	// than this more runners are asked for
+	MaxWait *metav1.Duration `json:"maxWait,omitempty"`
+}
+
+const (
+	DefaultPredictiveLookahead = 15 * time.Minute
+	MaxPredictiveLookahead     = 24 * time.Hour
+	DefaultPredictiveWeeks     = 4
+	MaxPredictiveWeeks         = 8
+)
+
+// PredictiveScaling forecasts demand by averaging the demand at the same weekday and time of day over previous weeks.
+// Runners are scaled for the highest forecast within the lookahead if it is more than the current demand.
+type PredictiveScaling struct {
+	// Lookahead is how far ahead to scale for, it should cover how long runners take to come online. Defaults to 15m
+	Lookahead *metav1.Duration `json:"lookahead,omitempty"`
+	// Weeks of history to average, defaults to 4 and can be at most 8
+	Weeks int32 `json:"weeks,omitempty"`
 }
 
+// GetLookahead returns Lookahead or the default if it isn't set
+func (p *PredictiveScaling) GetLookahead() time.Duration {
+	if p.Lookahead == nil {
+		return DefaultPredictiveLookahead
+	}
+	return p.Lookahead.Duration
+}
+
+// GetWeeks returns Weeks or the default if it isn't set
+func (p *PredictiveScaling) GetWeeks() int {
+	if p.Weeks == 0 {
+		return DefaultPredictiveWeeks
+	}
+	return int(p.Weeks)
+}
+
+// Validate returns an error explaining what is wrong with the predictive settings
+func (p *PredictiveScaling) Validate() error {
+	if l := p.GetLookahead(); l <= 0 || l > MaxPredictiveLookahead {
+		return fmt.Errorf("lookahead must be greater than 0 and no more than %s", MaxPredictiveLookahead.String())
+	}
+	if p.Weeks < 0 || p.Weeks > MaxPredictiveWeeks {
+		return fmt.Errorf("weeks must be between 1 and %d", MaxPredictiveWeeks)
+	}
+	return nil
+}
+
+const (
+	StrategyLinear      = "linear"
+	StrategyLogistic    = "logistic"
+	StrategyStep        = "step"
+	StrategyExponential = "exponential"
+	StrategyExpression  = "expression"
+)
+
+// ScalingExpressionVars are the variables that an expression strategy can use
+var ScalingExpressionVars = []string{"queued", "busy", "min", "max"}
+
+// ScalingStrategy works out the number of runners from the number of queued jobs and busy runners. The result is always
+// kept between minRunners and maxRunners.
+type ScalingStrategy struct {
+	// Type is one of linear, logistic, step, exponential or expression
+	Type string `json:"type"`
+	// Factor is how steep the logistic curve is or the base of the exponential curve e.g. "2"
+	Factor string `json:"factor,omitempty"`
+	// Steps are used by the step strategy, the step with the highest queued which is no more than the demand is used
+	Steps []ScalingStep `json:"steps,omitempty"`
+	// Expression is used by the expression strategy e.g. ceil(queued*1.5)+busy
+	Expression string `json:"expression,omitempty"`
+}
+
+type ScalingStep struct {
+	Queued  int32 `json:"queued"`
+	Runners int32 `json:"runners"`
+}
+
+// Validate returns an error explaining what is wrong with the strategy
+func (s *ScalingStrategy) Validate() error {
+	if s.Type != StrategyLogistic && s.Type != StrategyExponential && s.Factor != "" {
+		return fmt.Errorf("factor can only be set for the %s and %s strategies", StrategyLogistic, StrategyExponential)
+	}
+	if s.Type != StrategyStep && len(s.Steps) > 0 {
+		return fmt.Errorf("steps can only be set for the %s strategy", StrategyStep)
+	}
+	if s.Type != StrategyExpression && s.Expression != "" {
+		return fmt.Errorf("expression can only be set for the %s strategy", StrategyExpression)
+	}
+	switch s.Type {
+	case StrategyLinear:
+	case StrategyLogistic, StrategyExponential:
+		factor, err := strconv.ParseFloat(s.Factor, 64)
+		if err != nil {
+			return fmt.Errorf("factor '%s' is not a number", s.Factor)
+		}
+		if s.Type == StrategyLogistic && factor <= 0 {
+			return errors.New("factor must be greater than 0 for the logistic strategy")
+		}
+		if s.Type == StrategyExponential && factor <= 1 {
+			return errors.New("factor must be greater than 1 for the exponential strategy")
+		}
+	case StrategyStep:
+		if len(s.Steps) == 0 {
+			return errors.New("at least one step must be specified for the step strategy")
+		}
+		for i, step := range s.Steps {
+			if step.Queued < 0 || step.Runners < 0 {
+				return fmt.Errorf("step %d can't be negative", i)
+			}
+			if i > 0 && step.Queued <= s.Steps[i-1].Queued {
+				return fmt.Errorf("steps must be in ascending order of queued, step %d is not", i)
+			}
+		}
+	case StrategyExpression:
+		if _, err := expression.Parse(s.Expression, ScalingExpressionVars); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown type '%s', expected one of %s, %s, %s, %s or %s", s.Type, StrategyLinear, StrategyLogistic, StrategyStep, StrategyExponential, StrategyExpression)
+	}
+	return nil
+}
+
+// Requested by each runner unless Runner.Requests is set
+var (
+	DefaultRunnerCpu    = resource.MustParse("200m")
+	DefaultRunnerMemory = resource.MustParse("200Mi")
+)
+
 const (
 	DefaultWorkVolumeSize = "5Gi"
 	DefaultImage          = "myoung34/github-runner:latest"
+	DefaultGithubHost     = "github.com"
 )
 
+// RunnerNamespaceLabelPrefix followed by the StatefulSet's namespace is added to the labels of runners when they are
+// registered so that organization runners with the same name in different namespaces can be told apart
+const RunnerNamespaceLabelPrefix = "k8s-namespace-"
+
+// Keys expected in the secret referenced by GithubAppSecret
+const (
+	GithubAppIdKey             = "app-id"
+	GithubAppInstallationIdKey = "installation-id"
+	GithubAppPrivateKeyKey     = "private-key"
+)
+
+// GithubCredentialsSecret returns the name of the secret that is used to authenticate with Github
+func (s *ScaledActionRunnerSpec) GithubCredentialsSecret() string {
+	if s.GithubAppSecret != "" {
+		return s.GithubAppSecret
+	}
+	return s.GithubTokenSecret
+}
+
+// IsOrganization returns true when runners are shared by every repo in the owner's organization
+func (s *ScaledActionRunnerSpec) IsOrganization() bool {
+	return s.Organization != nil
+}
+
+// Includes returns true if jobs in the repo should be counted
+func (o *Organization) Includes(repo string, topics []string) bool {
+	if o == nil {
+		return true
+	}
+	for _, r := range o.ExcludeRepos {
+		if strings.EqualFold(r, repo) {
+			return false
+		}
+	}
+	if len(o.Repos) > 0 {
+		found := false
+		for _, r := range o.Repos {
+			if strings.EqualFold(r, repo) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(o.Topics) == 0 {
+		return true
+	}
+	for _, want := range o.Topics {
+		for _, t := range topics {
+			if strings.EqualFold(want, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithDefaults returns a copy of g where any unset fields are taken from defaults
+func (g *GithubConnection) WithDefaults(defaults *GithubConnection) *GithubConnection {
+	if g == nil && defaults == nil {
+		return nil
+	}
+	merged := GithubConnection{}
+	if defaults != nil {
+		merged = *defaults
+	}
+	if g == nil {
+		return &merged
+	}
+	if g.BaseUrl != "" {
+		merged.BaseUrl = g.BaseUrl
+		merged.UploadUrl = g.UploadUrl
+	}
+	if g.UploadUrl != "" {
+		merged.UploadUrl = g.UploadUrl
+	}
+	if g.Proxy != "" {
+		merged.Proxy = g.Proxy
+	}
+	if g.NoProxy != "" {
+		merged.NoProxy = g.NoProxy
+	}
+	if g.CaBundle != "" {
+		merged.CaBundle = g.CaBundle
+	}
+	return &merged
+}
+
+// IsEnterprise returns true when a Github Enterprise Server is being used rather than github.com
+func (g *GithubConnection) IsEnterprise() bool {
+	return g != nil && g.BaseUrl != "" && g.Host() != DefaultGithubHost
+}
+
+// Host returns the host name of the Github server e.g. github.com or github.example.com
+func (g *GithubConnection) Host() string {
+	if g == nil || g.BaseUrl == "" {
+		return DefaultGithubHost
+	}
+	u, err := url.Parse(g.BaseUrl)
+	if err != nil || u.Hostname() == "" {
+		return DefaultGithubHost
+	}
+	if u.Hostname() == "api."+DefaultGithubHost {
+		return DefaultGithubHost
+	}
+	return u.Host
+}
+
+// ServerUrl returns the URL that runners are registered against e.g. https://github.com
+func (g *GithubConnection) ServerUrl() string {
+	scheme := "https"
+	if g != nil && g.BaseUrl != "" {
+		if u, err := url.Parse(g.BaseUrl); err == nil && u.Scheme != "" {
+			scheme = u.Scheme
+		}
+	}
+	return fmt.Sprintf("%s://%s", scheme, g.Host())
+}
+
+func (g *GithubConnection) validate() error {
+	if g == nil {
+		return nil
+	}
+	for _, u := range []string{g.BaseUrl, g.UploadUrl, g.Proxy} {
+		if u == "" {
+			continue
+		}
+		if _, err := url.Parse(u); err != nil {
+			return fmt.Errorf("Could not parse %s as a URL. %s", u, err.Error())
+		}
+	}
+	if g.CaBundle != "" {
+		if block, _ := pem.Decode([]byte(g.CaBundle)); block == nil {
+			return errors.New("github.caBundle does not contain any PEM encoded certificates")
+		}
+	}
+	return nil
+}
+
 func Validate(ctx context.Context, sr *ScaledActionRunner, c client.Client, apiServerNs string) error {
 	s := corev1.Secret{}
 	checkSecret := func(ctx context.Context, c client.Client, name string, namespace string) error {
@@ -87,17 +484,73 @@ func Validate(ctx context.Context, sr *ScaledActionRunner, c client.Client, apiS
 		}
 		return nil
 	}
-	if err := checkSecret(ctx, c, sr.Spec.GithubTokenSecret, sr.ObjectMeta.Namespace); err != nil {
-		if err := checkSecret(ctx, c, sr.Spec.GithubTokenSecret, apiServerNs); err != nil {
+	if sr.Spec.GithubTokenSecret == "" && sr.Spec.GithubAppSecret == "" {
+		return errors.New("One of githubTokenSecret or githubAppSecret must be specified")
+	}
+	if sr.Spec.GithubTokenSecret != "" && sr.Spec.GithubAppSecret != "" {
+		return errors.New("Only one of githubTokenSecret or githubAppSecret can be specified")
+	}
+	if sr.Spec.Owner == "" {
+		return errors.New("owner must be specified")
+	}
+	if sr.Spec.IsOrganization() && sr.Spec.Repo != "" {
+		return errors.New("Only one of repo or organization can be specified")
+	}
+	if !sr.Spec.IsOrganization() && sr.Spec.Repo == "" {
+		return errors.New("One of repo or organization must be specified")
+	}
+	if sr.Spec.MaxPendingAge != nil && sr.Spec.MaxPendingAge.Duration < 0 {
+		return errors.New("maxPendingAge can't be negative")
+	}
+	if sr.Spec.MaxInProgressAge != nil && sr.Spec.MaxInProgressAge.Duration < 0 {
+		return errors.New("maxInProgressAge can't be negative")
+	}
+	names := map[string]bool{}
+	for i := range sr.Spec.Windows {
+		w := &sr.Spec.Windows[i]
+		if err := w.validate(&sr.Spec); err != nil {
+			return fmt.Errorf("Invalid window %d. %s", i, err.Error())
+		}
+		if names[w.Name] {
+			return fmt.Errorf("Window name %s is used more than once", w.Name)
+		}
+		names[w.Name] = true
+	}
+	credsSecret := sr.Spec.GithubCredentialsSecret()
+	if err := checkSecret(ctx, c, credsSecret, sr.ObjectMeta.Namespace); err != nil {
+		if err := checkSecret(ctx, c, credsSecret, apiServerNs); err != nil {
 			return err
 		}
 	}
+	if sr.Spec.GithubAppSecret != "" {
+		for _, k := range []string{GithubAppIdKey, GithubAppInstallationIdKey, GithubAppPrivateKeyKey} {
+			if _, found := s.Data[k]; !found {
+				return fmt.Errorf("Secret %s does not contain the key %s", credsSecret, k)
+			}
+		}
+	}
 
 	for _, name := range sr.Spec.RunnerSecrets {
 		if err := checkSecret(ctx, c, name, sr.ObjectMeta.Namespace); err != nil {
 			return err
 		}
 	}
+	if err := sr.Spec.Github.validate(); err != nil {
+		return err
+	}
+	if sr.Spec.Scaling != nil && sr.Spec.Scaling.Strategy != nil {
+		if err := sr.Spec.Scaling.Strategy.Validate(); err != nil {
+			return fmt.Errorf("Invalid scaling strategy. %s", err.Error())
+		}
+	}
+	if sr.Spec.Scaling != nil && sr.Spec.Scaling.MaxWait != nil && sr.Spec.Scaling.MaxWait.Duration <= 0 {
+		return errors.New("scaling.maxWait must be greater than 0")
+	}
+	if sr.Spec.Scaling != nil && sr.Spec.Scaling.Predictive != nil {
+		if err := sr.Spec.Scaling.Predictive.Validate(); err != nil {
+			return fmt.Errorf("Invalid predictive scaling. %s", err.Error())
+		}
+	}
 	_, err := strconv.ParseFloat(*sr.Spec.ScaleFactor, 64)
 	if err != nil {
 		return fmt.Errorf("Could not parse %s as a float64", *sr.Spec.ScaleFactor)
@@ -121,8 +574,8 @@ func Setup(sr *ScaledActionRunner, crNamespace string) {
 	}
 	if spec.Runner.Requests == nil {
 		spec.Runner.Requests = &map[corev1.ResourceName]resource.Quantity{
-			corev1.ResourceCPU:    resource.MustParse("200m"),
-			corev1.ResourceMemory: resource.MustParse("200Mi"),
+			corev1.ResourceCPU:    DefaultRunnerCpu.DeepCopy(),
+			corev1.ResourceMemory: DefaultRunnerMemory.DeepCopy(),
 		}
 	}
 	if spec.Runner.Limits == nil {
@@ -168,6 +621,13 @@ type ScaledActionRunnerStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 	ReferencedSecrets map[string]string `json:"referencedSecrets,omitempty"`
+	// RunnersLastSeen is when each runner was last online, runners which have been offline for too long are briefly
+	// brought up so that Github doesn't remove them
+	RunnersLastSeen map[string]metav1.Time `json:"runnersLastSeen,omitempty"`
+	// Throttled is how many of the runners that were wanted are being held back by a budget
+	Throttled int32 `json:"throttled,omitempty"`
+	// ThrottledBy is the budget that is holding runners back, either cluster or namespace
+	ThrottledBy string `json:"throttledBy,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -17,8 +17,11 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -52,8 +55,203 @@ type ScaledActionRunnerCoreSpec struct {
 	CacheWindowWhenEmpty time.Duration `json:"cacheWindowWhenEmpty,omitempty"`
 	ResyncInterval       time.Duration `json:"resyncInterval,omitempty"`
 	Namespaces           []string      `json:"namespaces,omitempty"`
+	// Github connection settings used by every ScaledActionRunner unless overridden
+	Github *GithubConnection `json:"github,omitempty"`
+	// WebhookSecret is the name of a secret in ApiServerNamespace containing the Github webhook secret under the key "webhook-secret"
+	WebhookSecret string `json:"webhookSecret,omitempty"`
+	// Budget caps the runners of every ScaledActionRunner, the capacity is shared out by priority and then fairly
+	Budget *RunnerBudget `json:"budget,omitempty"`
+	// MetricsApis are the metrics APIs that the API server serves, custom (custom.metrics.k8s.io) and/or external
+	// (external.metrics.k8s.io). Defaults to custom, use external alongside prometheus-adapter. Only custom is
+	// registered as an APIService, external's belongs to KEDA and is only read from the API server's URL.
+	MetricsApis []string `json:"metricsApis,omitempty"`
+	// ScalerTrigger is the KEDA trigger used by ScaledObjects, metrics-api (the default) reads the metrics API over
+	// HTTPS, external and external-push use the API server's gRPC external scaler. external-push scales from zero as
+	// soon as a webhook is received.
+	ScalerTrigger string `json:"scalerTrigger,omitempty"`
+	// Redis is used as the API server's cache instead of memcached when it is set
+	Redis *RedisCache `json:"redis,omitempty"`
 }
 
+// RedisCache configures Redis as the API server's cache
+type RedisCache struct {
+	// Addrs are the Redis servers, sentinels or cluster nodes to use. If unset then a Redis server is created as the
+	// managed cache.
+	Addrs []string `json:"addrs,omitempty"`
+	// Mode is how to connect to Addrs, standalone (the default), sentinel or cluster
+	Mode string `json:"mode,omitempty"`
+	// MasterName is the name of the master monitored by the sentinels in sentinel mode
+	MasterName string `json:"masterName,omitempty"`
+	// User is the ACL user to authenticate as, the default user is used if unset
+	User string `json:"user,omitempty"`
+	// CredsSecret is the name of a secret in ApiServerNamespace containing the password under the key "redis-password".
+	// If unset then a password is generated for the managed cache, or no password is used with Addrs.
+	CredsSecret string `json:"credsSecret,omitempty"`
+	// TLS connects to Addrs with TLS, it isn't supported by the managed cache
+	TLS bool `json:"tls,omitempty"`
+	// CaSecret is the name of a secret in ApiServerNamespace containing the CA bundle to verify Redis with under the
+	// key "ca.crt"
+	CaSecret string `json:"caSecret,omitempty"`
+	// SentinelUser is the ACL user to authenticate with the sentinels as in sentinel mode
+	SentinelUser string `json:"sentinelUser,omitempty"`
+	// SentinelCredsSecret is the name of a secret in ApiServerNamespace containing the sentinels' password under the key
+	// "redis-sentinel-password", the sentinels aren't authenticated if unset
+	SentinelCredsSecret string `json:"sentinelCredsSecret,omitempty"`
+	// SentinelTLS connects to the sentinels with TLS in sentinel mode
+	SentinelTLS bool `json:"sentinelTls,omitempty"`
+	// SentinelCaSecret is the name of a secret in ApiServerNamespace containing the CA bundle to verify the sentinels
+	// with under the key "ca.crt"
+	SentinelCaSecret string `json:"sentinelCaSecret,omitempty"`
+	// Image is the image of the managed cache
+	Image string `json:"image,omitempty"`
+	// Storage is the size of the volume the managed cache persists its data to, it only keeps it in memory if unset
+	Storage *resource.Quantity `json:"storage,omitempty"`
+}
+
+const (
+	RedisStandalone        = "standalone"
+	RedisSentinel          = "sentinel"
+	RedisCluster           = "cluster"
+	RedisPort              = 6379
+	RedisSecretKey         = "redis-password"
+	RedisSentinelSecretKey = "redis-sentinel-password"
+	RedisCaKey             = "ca.crt"
+)
+
+// Managed returns true if the operator creates the Redis server
+func (r *RedisCache) Managed() bool {
+	return len(r.Addrs) == 0
+}
+
+// Validate returns an error if the mode is unknown, the master name is missing in sentinel mode or the managed cache
+// is asked for something it doesn't support
+func (r *RedisCache) Validate() error {
+	switch r.Mode {
+	case RedisStandalone, RedisCluster:
+	case RedisSentinel:
+		if r.MasterName == "" {
+			return errors.New("masterName is required in sentinel mode")
+		}
+	default:
+		return fmt.Errorf("unknown mode '%s', expected %s, %s or %s", r.Mode, RedisStandalone, RedisSentinel, RedisCluster)
+	}
+	if r.Managed() && (r.Mode != RedisStandalone || r.TLS) {
+		return errors.New("the managed cache is a standalone server without TLS, set addrs to use anything else")
+	}
+	if r.CaSecret != "" && !r.TLS {
+		return errors.New("caSecret can only be used with tls")
+	}
+	if r.Mode != RedisSentinel && (r.SentinelUser != "" || r.SentinelCredsSecret != "" || r.SentinelTLS || r.SentinelCaSecret != "") {
+		return errors.New("sentinelUser, sentinelCredsSecret, sentinelTls and sentinelCaSecret can only be used in sentinel mode")
+	}
+	if r.SentinelCaSecret != "" && !r.SentinelTLS {
+		return errors.New("sentinelCaSecret can only be used with sentinelTls")
+	}
+	return nil
+}
+
+const (
+	TriggerMetricsApi   = "metrics-api"
+	TriggerExternal     = "external"
+	TriggerExternalPush = "external-push"
+	ExternalScalerPort  = 6000
+)
+
+// UsesExternalScaler returns true if ScaledObjects use the API server's gRPC external scaler
+func (s *ScaledActionRunnerCoreSpec) UsesExternalScaler() bool {
+	return s.ScalerTrigger == TriggerExternal || s.ScalerTrigger == TriggerExternalPush
+}
+
+// ValidateScalerTrigger returns an error if trigger isn't metrics-api, external or external-push
+func ValidateScalerTrigger(trigger string) error {
+	switch trigger {
+	case TriggerMetricsApi, TriggerExternal, TriggerExternalPush:
+		return nil
+	}
+	return fmt.Errorf("unknown scalerTrigger '%s', expected %s, %s or %s", trigger, TriggerMetricsApi, TriggerExternal, TriggerExternalPush)
+}
+
+const (
+	MetricsApiCustom   = "custom"
+	MetricsApiExternal = "external"
+)
+
+// MetricsApiGroups are the API groups of each metrics API
+var MetricsApiGroups = map[string]string{
+	MetricsApiCustom:   "custom.metrics.k8s.io",
+	MetricsApiExternal: "external.metrics.k8s.io",
+}
+
+// ValidateMetricsApis returns an error if apis is empty or contains anything other than custom and external
+func ValidateMetricsApis(apis []string) error {
+	if len(apis) == 0 {
+		return errors.New("at least one metrics API must be served")
+	}
+	for _, api := range apis {
+		if _, found := MetricsApiGroups[api]; !found {
+			return fmt.Errorf("unknown metrics API '%s', expected %s or %s", api, MetricsApiCustom, MetricsApiExternal)
+		}
+	}
+	return nil
+}
+
+// ServesMetricsApi returns true if api is in MetricsApis
+func (s *ScaledActionRunnerCoreSpec) ServesMetricsApi(api string) bool {
+	for _, a := range s.MetricsApis {
+		if a == api {
+			return true
+		}
+	}
+	return false
+}
+
+// RunnerBudget caps the total runners, CPU and memory requested by runners across the cluster and in each namespace
+type RunnerBudget struct {
+	Cluster *BudgetLimits `json:"cluster,omitempty"`
+	// Namespaces caps the runners in individual namespaces, keyed by namespace
+	Namespaces map[string]BudgetLimits `json:"namespaces,omitempty"`
+}
+
+// BudgetLimits are caps on the sum of every runner, limits which aren't set aren't enforced
+type BudgetLimits struct {
+	MaxRunners *int32 `json:"maxRunners,omitempty"`
+	// Cpu is the most CPU that runners can request in total
+	Cpu *resource.Quantity `json:"cpu,omitempty"`
+	// Memory is the most memory that runners can request in total
+	Memory *resource.Quantity `json:"memory,omitempty"`
+}
+
+// Validate returns an error explaining what is wrong with the budget
+func (b *RunnerBudget) Validate() error {
+	check := func(scope string, l *BudgetLimits) error {
+		if l == nil {
+			return nil
+		}
+		if l.MaxRunners != nil && *l.MaxRunners < 0 {
+			return fmt.Errorf("%s maxRunners can't be negative", scope)
+		}
+		if (l.Cpu != nil && l.Cpu.Sign() < 0) || (l.Memory != nil && l.Memory.Sign() < 0) {
+			return fmt.Errorf("%s cpu and memory can't be negative", scope)
+		}
+		return nil
+	}
+	if err := check("cluster", b.Cluster); err != nil {
+		return err
+	}
+	for ns, l := range b.Namespaces {
+		l := l
+		if err := check("namespace "+ns, &l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	WebhookSecretKey = "webhook-secret"
+	WebhookPort      = 8443
+)
+
 // ScaledActionRunnerCoreStatus defines the observed state of ScaledActionRunnerCore
 type ScaledActionRunnerCoreStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
@@ -107,6 +305,18 @@ func (a *ScaledActionRunnerCore) Setup() {
 	if a.Spec.MemcachedImage == "" {
 		a.Spec.MemcachedImage = "docker.io/bitnami/memcached:1.6.9-debian-10-r86"
 	}
+	if a.Spec.ScalerTrigger == "" {
+		a.Spec.ScalerTrigger = TriggerMetricsApi
+	}
+	if len(a.Spec.MetricsApis) == 0 {
+		a.Spec.MetricsApis = []string{MetricsApiCustom}
+	}
+	if a.Spec.Redis != nil && a.Spec.Redis.Mode == "" {
+		a.Spec.Redis.Mode = RedisStandalone
+	}
+	if a.Spec.Redis != nil && a.Spec.Redis.Image == "" {
+		a.Spec.Redis.Image = "docker.io/library/redis:6.2.6"
+	}
 	if a.Spec.MemcachedAuth && a.Spec.MemcachedUser == nil {
 		user := "user"
 		a.Spec.MemcachedUser = &user
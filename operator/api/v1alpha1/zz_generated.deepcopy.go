@@ -28,6 +28,126 @@ import (
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BudgetLimits) DeepCopyInto(out *BudgetLimits) {
+	*out = *in
+	if in.MaxRunners != nil {
+		in, out := &in.MaxRunners, &out.MaxRunners
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Cpu != nil {
+		in, out := &in.Cpu, &out.Cpu
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.Memory != nil {
+		in, out := &in.Memory, &out.Memory
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BudgetLimits.
+func (in *BudgetLimits) DeepCopy() *BudgetLimits {
+	if in == nil {
+		return nil
+	}
+	out := new(BudgetLimits)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GithubConnection) DeepCopyInto(out *GithubConnection) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GithubConnection.
+func (in *GithubConnection) DeepCopy() *GithubConnection {
+	if in == nil {
+		return nil
+	}
+	out := new(GithubConnection)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Organization) DeepCopyInto(out *Organization) {
+	*out = *in
+	if in.Repos != nil {
+		in, out := &in.Repos, &out.Repos
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExcludeRepos != nil {
+		in, out := &in.ExcludeRepos, &out.ExcludeRepos
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Topics != nil {
+		in, out := &in.Topics, &out.Topics
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Organization.
+func (in *Organization) DeepCopy() *Organization {
+	if in == nil {
+		return nil
+	}
+	out := new(Organization)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PredictiveScaling) DeepCopyInto(out *PredictiveScaling) {
+	*out = *in
+	if in.Lookahead != nil {
+		in, out := &in.Lookahead, &out.Lookahead
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PredictiveScaling.
+func (in *PredictiveScaling) DeepCopy() *PredictiveScaling {
+	if in == nil {
+		return nil
+	}
+	out := new(PredictiveScaling)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RedisCache) DeepCopyInto(out *RedisCache) {
+	*out = *in
+	if in.Addrs != nil {
+		in, out := &in.Addrs, &out.Addrs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Storage != nil {
+		in, out := &in.Storage, &out.Storage
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RedisCache.
+func (in *RedisCache) DeepCopy() *RedisCache {
+	if in == nil {
+		return nil
+	}
+	out := new(RedisCache)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Runner) DeepCopyInto(out *Runner) {
 	*out = *in
@@ -103,6 +223,33 @@ func (in *Runner) DeepCopy() *Runner {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RunnerBudget) DeepCopyInto(out *RunnerBudget) {
+	*out = *in
+	if in.Cluster != nil {
+		in, out := &in.Cluster, &out.Cluster
+		*out = new(BudgetLimits)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make(map[string]BudgetLimits, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RunnerBudget.
+func (in *RunnerBudget) DeepCopy() *RunnerBudget {
+	if in == nil {
+		return nil
+	}
+	out := new(RunnerBudget)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ScaledActionRunner) DeepCopyInto(out *ScaledActionRunner) {
 	*out = *in
@@ -222,6 +369,26 @@ func (in *ScaledActionRunnerCoreSpec) DeepCopyInto(out *ScaledActionRunnerCoreSp
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.Github != nil {
+		in, out := &in.Github, &out.Github
+		*out = new(GithubConnection)
+		**out = **in
+	}
+	if in.Budget != nil {
+		in, out := &in.Budget, &out.Budget
+		*out = new(RunnerBudget)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.MetricsApis != nil {
+		in, out := &in.MetricsApis, &out.MetricsApis
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Redis != nil {
+		in, out := &in.Redis, &out.Redis
+		*out = new(RedisCache)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScaledActionRunnerCoreSpec.
@@ -289,6 +456,11 @@ func (in *ScaledActionRunnerSpec) DeepCopyInto(out *ScaledActionRunnerSpec) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.Organization != nil {
+		in, out := &in.Organization, &out.Organization
+		*out = new(Organization)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Scaling != nil {
 		in, out := &in.Scaling, &out.Scaling
 		*out = new(Scaling)
@@ -319,6 +491,28 @@ func (in *ScaledActionRunnerSpec) DeepCopyInto(out *ScaledActionRunnerSpec) {
 		*out = new(v1.Duration)
 		**out = **in
 	}
+	if in.Github != nil {
+		in, out := &in.Github, &out.Github
+		*out = new(GithubConnection)
+		**out = **in
+	}
+	if in.MaxPendingAge != nil {
+		in, out := &in.MaxPendingAge, &out.MaxPendingAge
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.MaxInProgressAge != nil {
+		in, out := &in.MaxInProgressAge, &out.MaxInProgressAge
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.Windows != nil {
+		in, out := &in.Windows, &out.Windows
+		*out = make([]ScheduledWindow, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScaledActionRunnerSpec.
@@ -341,6 +535,13 @@ func (in *ScaledActionRunnerStatus) DeepCopyInto(out *ScaledActionRunnerStatus)
 			(*out)[key] = val
 		}
 	}
+	if in.RunnersLastSeen != nil {
+		in, out := &in.RunnersLastSeen, &out.RunnersLastSeen
+		*out = make(map[string]v1.Time, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScaledActionRunnerStatus.
@@ -371,6 +572,21 @@ func (in *Scaling) DeepCopyInto(out *Scaling) {
 		*out = new(int32)
 		**out = **in
 	}
+	if in.Strategy != nil {
+		in, out := &in.Strategy, &out.Strategy
+		*out = new(ScalingStrategy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Predictive != nil {
+		in, out := &in.Predictive, &out.Predictive
+		*out = new(PredictiveScaling)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.MaxWait != nil {
+		in, out := &in.MaxWait, &out.MaxWait
+		*out = new(v1.Duration)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Scaling.
@@ -382,3 +598,63 @@ func (in *Scaling) DeepCopy() *Scaling {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScalingStep) DeepCopyInto(out *ScalingStep) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScalingStep.
+func (in *ScalingStep) DeepCopy() *ScalingStep {
+	if in == nil {
+		return nil
+	}
+	out := new(ScalingStep)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScalingStrategy) DeepCopyInto(out *ScalingStrategy) {
+	*out = *in
+	if in.Steps != nil {
+		in, out := &in.Steps, &out.Steps
+		*out = make([]ScalingStep, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScalingStrategy.
+func (in *ScalingStrategy) DeepCopy() *ScalingStrategy {
+	if in == nil {
+		return nil
+	}
+	out := new(ScalingStrategy)
+	in.DeepCopyInto(out)
+	return out
+}
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScheduledWindow) DeepCopyInto(out *ScheduledWindow) {
+	*out = *in
+	out.Duration = in.Duration
+	if in.MinRunners != nil {
+		in, out := &in.MinRunners, &out.MinRunners
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxRunners != nil {
+		in, out := &in.MaxRunners, &out.MaxRunners
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScheduledWindow.
+func (in *ScheduledWindow) DeepCopy() *ScheduledWindow {
+	if in == nil {
+		return nil
+	}
+	out := new(ScheduledWindow)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -90,6 +90,11 @@ func (r *ScaledActionRunnerReconciler) Reconcile(ctx context.Context, req ctrl.R
 		return ctrl.Result{}, nil
 	}
 
+	// Settings in the runner take precedence over the cluster wide ones in core. They are applied to a copy so that
+	// runner still matches what is in the cluster.
+	withDefaults := runner.DeepCopy()
+	withDefaults.Spec.Github = runner.Spec.Github.WithDefaults(core.Spec.Github)
+
 	var metricsNamespace, metricsName string
 	if runner.Annotations != nil {
 		metricsName = runner.Annotations["OverrideMetricsName"]
@@ -106,10 +111,22 @@ func (r *ScaledActionRunnerReconciler) Reconcile(ctx context.Context, req ctrl.R
 	if runner.Spec.MetricsSelector != nil && *runner.Spec.MetricsSelector != "" {
 		selector = *runner.Spec.MetricsSelector
 	}
-	metricsUrl := fmt.Sprintf("https://%s/apis/custom.metrics.k8s.io/v1beta1/namespaces/%s/Scaledactionrunners/%s/%s", metricsEndpoint, req.Namespace, req.Name, selector)
+	// Custom metrics are preferred when both are served so that existing ScaledObjects don't change
+	metricsApi := runnerv1alpha1.MetricsApiCustom
+	if !core.Spec.ServesMetricsApi(runnerv1alpha1.MetricsApiCustom) {
+		metricsApi = runnerv1alpha1.MetricsApiExternal
+	}
+	metricsUrl := sargenerator.MetricsUrl(metricsApi, metricsEndpoint, req.Namespace, req.Name, selector)
+	trigger := sargenerator.Trigger{
+		Type:               core.Spec.ScalerTrigger,
+		Url:                metricsUrl,
+		ClusterTriggerName: metricsName,
+		ScalerAddress:      fmt.Sprintf("%s:%d", metricsEndpoint, runnerv1alpha1.ExternalScalerPort),
+		Selector:           selector,
+	}
 
-	setModified, setErr := r.syncStatefulSet(ctx, log, runner, core.Spec.ApiServerNamespace)
-	scaledObjectModified, objErr := r.syncScaledObject(ctx, log, runner, metricsUrl, metricsName)
+	setModified, setErr := r.syncStatefulSet(ctx, log, withDefaults, core.Spec.ApiServerNamespace)
+	scaledObjectModified, objErr := r.syncScaledObject(ctx, log, runner, trigger)
 	if setErr != nil {
 		return ctrl.Result{}, setErr
 	}
@@ -177,12 +194,12 @@ func (r *ScaledActionRunnerReconciler) GetScaledActionRunnerCore(ctx context.Con
 	return metrics, nil
 }
 
-func (r *ScaledActionRunnerReconciler) syncScaledObject(ctx context.Context, log logr.Logger, config *runnerv1alpha1.ScaledActionRunner, metricsUrl string, clusterTriggerName string) (bool, error) {
+func (r *ScaledActionRunnerReconciler) syncScaledObject(ctx context.Context, log logr.Logger, config *runnerv1alpha1.ScaledActionRunner, trigger sargenerator.Trigger) (bool, error) {
 	var so keda.ScaledObject
 	err := r.Get(ctx, types.NamespacedName{Name: config.ObjectMeta.Name, Namespace: config.ObjectMeta.Namespace}, &so)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			so = *sargenerator.GenerateScaledObject(config, metricsUrl, clusterTriggerName)
+			so = *sargenerator.GenerateScaledObject(config, trigger)
 			(resourceLog(log, "Creating a new %s", &so))
 			ctrl.SetControllerReference(config, &so, r.Scheme)
 			err = r.Create(ctx, &so)
@@ -196,7 +213,7 @@ func (r *ScaledActionRunnerReconciler) syncScaledObject(ctx context.Context, log
 		}
 	}
 	updatedSo := so.DeepCopy()
-	modified := assignScaledObjectPropsFromRunner(updatedSo, config, metricsUrl, clusterTriggerName)
+	modified := assignScaledObjectPropsFromRunner(updatedSo, config, trigger)
 
 	if modified {
 		(resourceLog(log, "Updating %s", &so))
@@ -215,7 +232,7 @@ func (r *ScaledActionRunnerReconciler) syncScaledObject(ctx context.Context, log
 	return modified, nil
 }
 
-func assignScaledObjectPropsFromRunner(found *keda.ScaledObject, config *runnerv1alpha1.ScaledActionRunner, metricsUrl string, clusterTriggerName string) bool {
+func assignScaledObjectPropsFromRunner(found *keda.ScaledObject, config *runnerv1alpha1.ScaledActionRunner, trigger sargenerator.Trigger) bool {
 	updated := false
 	if found.ObjectMeta.Name != config.ObjectMeta.Name {
 		found.ObjectMeta.Name = config.ObjectMeta.Name
@@ -237,22 +254,25 @@ func assignScaledObjectPropsFromRunner(found *keda.ScaledObject, config *runnerv
 		spec.CooldownPeriod = config.Spec.Scaling.CooldownPeriod
 		spec.PollingInterval = config.Spec.Scaling.PollingInterval
 	}
-	if spec.MinReplicaCount == nil || *spec.MinReplicaCount != config.Spec.MinRunners {
-		spec.MinReplicaCount = &config.Spec.MinRunners
+	// The same bounds as when the ScaledObject is created so that scheduled windows keep taking effect
+	minReplicas, maxReplicas := config.Spec.ReplicaBounds()
+	if spec.MinReplicaCount == nil || *spec.MinReplicaCount != minReplicas {
+		spec.MinReplicaCount = &minReplicas
 	}
-	if spec.MaxReplicaCount == nil || *spec.MaxReplicaCount != config.Spec.MaxRunners {
-		spec.MaxReplicaCount = &config.Spec.MaxRunners
+	if spec.MaxReplicaCount == nil || *spec.MaxReplicaCount != maxReplicas {
+		spec.MaxReplicaCount = &maxReplicas
 	}
 	if spec.ScaleTargetRef == nil || spec.Triggers == nil || len(spec.Triggers) == 0 {
-		so := sargenerator.GenerateScaledObject(config, metricsUrl, clusterTriggerName)
+		so := sargenerator.GenerateScaledObject(config, trigger)
 		spec = so.Spec
 	}
 	if spec.ScaleTargetRef.Name != config.ObjectMeta.Name {
 		spec.ScaleTargetRef.Name = config.ObjectMeta.Name
 	}
 
-	if metricsUrl != spec.Triggers[0].Metadata["url"] {
-		spec.Triggers[0].Metadata["url"] = metricsUrl
+	// Replacing the triggers picks up changes to the URL and switching between metrics-api and the external scaler
+	if triggers := trigger.ScaleTriggers(); !reflect.DeepEqual(triggers, spec.Triggers) {
+		spec.Triggers = triggers
 	}
 
 	if !reflect.DeepEqual(spec, found.Spec) {
@@ -289,9 +309,9 @@ func (r *ScaledActionRunnerReconciler) getSecretsHash(ctx context.Context, c *ru
 		return sha.Sum(data), nil
 	}
 
-	secretData, err := getHash(c.Spec.GithubTokenSecret, c.ObjectMeta.Namespace)
+	secretData, err := getHash(c.Spec.GithubCredentialsSecret(), c.ObjectMeta.Namespace)
 	if err != nil {
-		secretData, err = getHash(c.Spec.GithubTokenSecret, apiServerNs)
+		secretData, err = getHash(c.Spec.GithubCredentialsSecret(), apiServerNs)
 		if err != nil {
 			return "", err
 		}
@@ -436,6 +456,7 @@ func getScaledSetUpdates(oldSs *appsv1.StatefulSet, config *runnerv1alpha1.Scale
 	}
 
 	updated = sargenerator.SetEnvVars(config, updatedSs) || updated
+	updated = sargenerator.SetInitContainers(config, updatedSs) || updated
 	volumes, volumeMounts := sargenerator.GetVolumes(config)
 	if !reflect.DeepEqual(volumes, oldSs.Spec.Template.Spec.Volumes) {
 		updatedSs.Spec.Template.Spec.Volumes = volumes
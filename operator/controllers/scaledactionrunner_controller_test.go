@@ -143,6 +143,33 @@ var _ = Describe("ScaledActionRunner controller", func() {
 	})
 })
 
+var _ = Describe("ScaledObject updates", func() {
+	It("Should keep the bounds of scheduled windows when updating an existing ScaledObject", func() {
+		zero := int32(0)
+		sar := &runnerv1alpha1.ScaledActionRunner{
+			ObjectMeta: v1.ObjectMeta{Name: testSarName, Namespace: testSarNamespace},
+			Spec:       runnerv1alpha1.ScaledActionRunnerSpec{MinRunners: 1, MaxRunners: 3},
+		}
+		trigger := generators.Trigger{Type: runnerv1alpha1.TriggerMetricsApi, Url: "https://metrics/" + testSarName, ClusterTriggerName: "testname"}
+		so := generators.GenerateScaledObject(sar, trigger)
+		Expect(*so.Spec.MinReplicaCount).To(BeEquivalentTo(1))
+
+		sar.Spec.Windows = []runnerv1alpha1.ScheduledWindow{{
+			Name:       "overnight",
+			Schedule:   "0 20 * * *",
+			Duration:   v1.Duration{Duration: 12 * time.Hour},
+			MinRunners: &zero,
+			MaxRunners: &zero,
+		}}
+		Expect(assignScaledObjectPropsFromRunner(so, sar, trigger)).To(BeTrue())
+		Expect(*so.Spec.MinReplicaCount).To(BeEquivalentTo(0))
+		Expect(*so.Spec.MaxReplicaCount).To(BeEquivalentTo(3))
+		// Reconciling again doesn't put minRunners back
+		Expect(assignScaledObjectPropsFromRunner(so, sar, trigger)).To(BeFalse())
+		Expect(*so.Spec.MinReplicaCount).To(BeEquivalentTo(0))
+	})
+})
+
 func testSarResults(ctx context.Context, test func(*appsv1.StatefulSet, *keda.ScaledObject) bool) {
 	Eventually(func() bool {
 		sSet := appsv1.StatefulSet{}
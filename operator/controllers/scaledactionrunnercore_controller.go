@@ -74,6 +74,11 @@ func (r *ScaledActionRunnerCoreReconciler) Reconcile(ctx context.Context, req ct
 	}
 	objs := []client.Object{}
 	objs = append(objs, o...)
+	o, err = coregenerator.GenerateRedisResources(metrics)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	objs = append(objs, o...)
 	o2 := coregenerator.GenerateMetricsApiServer(metrics)
 	objs = append(objs, o2...)
 	objs = append(objs, coregenerator.GeneratePrometheusServiceMonitor(metrics)...)
@@ -106,9 +111,37 @@ func (r *ScaledActionRunnerCoreReconciler) Reconcile(ctx context.Context, req ct
 		return ctrl.Result{}, err
 	}
 	changed = c || changed
+	if *metrics.Spec.CreateApiServer {
+		if err := r.deleteUnusedApiServices(ctx, log, metrics); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 
 	return ctrl.Result{Requeue: changed}, nil
 }
+
+// deleteUnusedApiServices deletes the APIServices of metrics APIs which are no longer served, APIServices which
+// weren't created by this operator (e.g. prometheus-adapter's) are left alone
+func (r *ScaledActionRunnerCoreReconciler) deleteUnusedApiServices(ctx context.Context, log logr.Logger, crd *runnerv1alpha1.ScaledActionRunnerCore) error {
+	for _, obj := range coregenerator.GenerateUnusedApiServices(crd) {
+		old := unstructured.Unstructured{}
+		old.SetGroupVersionKind(obj.GetObjectKind().GroupVersionKind())
+		if err := r.Get(ctx, client.ObjectKeyFromObject(obj), &old); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if _, ours := old.GetAnnotations()[coregenerator.CrdKey]; !ours {
+			continue
+		}
+		log.Info(fmt.Sprintf("Deleting unused APIService %s", old.GetName()))
+		if err := r.Delete(ctx, &old); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
 func (r *ScaledActionRunnerCoreReconciler) CreateUpdateOrReplace(ctx context.Context, log logr.Logger, crd *runnerv1alpha1.ScaledActionRunnerCore, obj client.Object) (bool, error) {
 	logMsg := func(msg string, obj client.Object) {
 		label := fmt.Sprintf("%s %s/%s", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetNamespace(), obj.GetName())
@@ -174,6 +207,26 @@ func (r *ScaledActionRunnerCoreReconciler) GetScaledActionRunnerCore(ctx context
 	}
 
 	scaledActionRunnerCore.Setup()
+	if scaledActionRunnerCore.Spec.Budget != nil {
+		if err := scaledActionRunnerCore.Spec.Budget.Validate(); err != nil {
+			log.Error(err, "Invalid budget")
+			return nil, err
+		}
+	}
+	if err := runnerv1alpha1.ValidateMetricsApis(scaledActionRunnerCore.Spec.MetricsApis); err != nil {
+		log.Error(err, "Invalid metricsApis")
+		return nil, err
+	}
+	if err := runnerv1alpha1.ValidateScalerTrigger(scaledActionRunnerCore.Spec.ScalerTrigger); err != nil {
+		log.Error(err, "Invalid scalerTrigger")
+		return nil, err
+	}
+	if scaledActionRunnerCore.Spec.Redis != nil {
+		if err := scaledActionRunnerCore.Spec.Redis.Validate(); err != nil {
+			log.Error(err, "Invalid redis")
+			return nil, err
+		}
+	}
 	return scaledActionRunnerCore, nil
 }
 
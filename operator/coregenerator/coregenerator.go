@@ -38,7 +38,7 @@ func getLabels(res metav1.Object) map[string]string {
 	return ls
 }
 func GenerateMemcachedResources(c *runnerv1alpha1.ScaledActionRunnerCore) ([]client.Object, error) {
-	if !*c.Spec.CreateMemcached {
+	if !*c.Spec.CreateMemcached || c.Spec.Redis != nil {
 		return []client.Object{}, nil
 	}
 	ls := getLabels(c)
@@ -123,6 +123,172 @@ func GenerateMemcachedResources(c *runnerv1alpha1.ScaledActionRunnerCore) ([]cli
 	return resources, nil
 }
 
+// GenerateRedisResources generates a Redis server for the API server to use as its cache when Redis is used without
+// any addresses
+func GenerateRedisResources(c *runnerv1alpha1.ScaledActionRunnerCore) ([]client.Object, error) {
+	if c.Spec.Redis == nil || !c.Spec.Redis.Managed() {
+		return []client.Object{}, nil
+	}
+	ls := getLabels(c)
+	annotations := map[string]string{
+		CrdKey: getKey(c),
+	}
+	name := redisName(c)
+	ls["app"] = "redis"
+
+	var ss appsv1.StatefulSet
+	err := yaml.Unmarshal([]byte(JsonRedis), &ss)
+	if err != nil {
+		return nil, err
+	}
+	ss.Labels = ls
+	ss.SetAnnotations(annotations)
+	ss.Spec.Template.Labels = ls
+	ss.Spec.Selector.MatchLabels = ls
+	ss.Name = name
+	ss.Spec.Template.Name = name
+	ss.Spec.ServiceName = name
+	ss.Namespace = c.Spec.ApiServerNamespace
+	container := &ss.Spec.Template.Spec.Containers[0]
+	container.Image = c.Spec.Redis.Image
+	container.Env[0].ValueFrom.SecretKeyRef.Name = redisSecretName(c)
+	// Kubernetes substitutes $(REDIS_PASSWORD) so that the password isn't in the spec
+	container.Args = append(container.Args, "--requirepass", "$(REDIS_PASSWORD)")
+	if c.Spec.Redis.User != "" {
+		container.Args = append(container.Args, "--user", c.Spec.Redis.User, "on", ">$(REDIS_PASSWORD)", "~*", "+@all")
+	}
+	if c.Spec.Redis.Storage != nil {
+		container.Args = append(container.Args, "--appendonly", "yes")
+		ss.Spec.Template.Spec.Volumes = []v1.Volume{}
+		ss.Spec.VolumeClaimTemplates = []v1.PersistentVolumeClaim{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "data"},
+				Spec: v1.PersistentVolumeClaimSpec{
+					AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+					Resources: v1.ResourceRequirements{
+						Requests: v1.ResourceList{v1.ResourceStorage: *c.Spec.Redis.Storage},
+					},
+				},
+			},
+		}
+	} else {
+		container.Args = append(container.Args, "--save", "")
+	}
+
+	svc := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name,
+			Namespace:   c.Spec.ApiServerNamespace,
+			Labels:      ls,
+			Annotations: annotations,
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{
+					Name:       "redis",
+					Port:       runnerv1alpha1.RedisPort,
+					TargetPort: intstr.FromString("redis"),
+				},
+			},
+			Selector: ls,
+		},
+	}
+	svc.TypeMeta.SetGroupVersionKind(schema.FromAPIVersionAndKind("v1", "Service"))
+
+	var resources []client.Object
+	resources = append(resources, &ss, &svc)
+
+	if c.Spec.Redis.CredsSecret == "" {
+		secret := v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   c.Spec.ApiServerNamespace,
+				Labels:      ls,
+				Annotations: annotations,
+			},
+			StringData: map[string]string{
+				runnerv1alpha1.RedisSecretKey: getPass(),
+			},
+		}
+		secret.TypeMeta.SetGroupVersionKind(schema.FromAPIVersionAndKind("v1", "Secret"))
+		resources = append(resources, &secret)
+	}
+	return resources, nil
+}
+
+func redisName(c *runnerv1alpha1.ScaledActionRunnerCore) string {
+	return fmt.Sprintf("%s-redis", c.Spec.ApiServerName)
+}
+
+// redisSecretName is the secret containing the Redis password, it is "" if Redis doesn't have a password
+func redisSecretName(c *runnerv1alpha1.ScaledActionRunnerCore) string {
+	if c.Spec.Redis.CredsSecret != "" {
+		return c.Spec.Redis.CredsSecret
+	}
+	if c.Spec.Redis.Managed() {
+		return redisName(c)
+	}
+	return ""
+}
+
+// getRedisArgs returns the API server's args for connecting to Redis
+func getRedisArgs(c *runnerv1alpha1.ScaledActionRunnerCore) []string {
+	r := c.Spec.Redis
+	addrs := r.Addrs
+	if r.Managed() {
+		addrs = []string{fmt.Sprintf("%s-0.%s:%d", redisName(c), redisName(c), runnerv1alpha1.RedisPort)}
+	}
+	args := []string{
+		fmt.Sprintf("--redis-addrs=%s", strings.Join(addrs, ",")),
+		fmt.Sprintf("--redis-mode=%s", r.Mode),
+	}
+	if r.MasterName != "" {
+		args = append(args, fmt.Sprintf("--redis-master-name=%s", r.MasterName))
+	}
+	if r.User != "" {
+		args = append(args, fmt.Sprintf("--redis-user=%s", r.User))
+	}
+	if r.TLS {
+		args = append(args, "--redis-tls")
+	}
+	if r.CaSecret != "" {
+		args = append(args, fmt.Sprintf("--redis-ca-file=%s/%s", redisCaPath, runnerv1alpha1.RedisCaKey))
+	}
+	if r.SentinelUser != "" {
+		args = append(args, fmt.Sprintf("--redis-sentinel-user=%s", r.SentinelUser))
+	}
+	if r.SentinelTLS {
+		args = append(args, "--redis-sentinel-tls")
+	}
+	if r.SentinelCaSecret != "" {
+		args = append(args, fmt.Sprintf("--redis-sentinel-ca-file=%s/%s", redisSentinelCaPath, runnerv1alpha1.RedisCaKey))
+	}
+	return args
+}
+
+// redisCaPath and redisSentinelCaPath are where CaSecret and SentinelCaSecret are mounted in the API server
+const (
+	redisCaPath         = "/redis-ca"
+	redisSentinelCaPath = "/redis-sentinel-ca"
+)
+
+// mountRedisCa mounts the CA bundle in secret at path in the API server if secret is set
+func mountRedisCa(dep *appsv1.Deployment, name string, secret string, path string) {
+	if secret == "" {
+		return
+	}
+	dep.Spec.Template.Spec.Volumes = append(dep.Spec.Template.Spec.Volumes, corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: secret},
+		},
+	})
+	dep.Spec.Template.Spec.Containers[0].VolumeMounts = append(dep.Spec.Template.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+		Name:      name,
+		MountPath: path,
+		ReadOnly:  true,
+	})
+}
+
 func getPass() string {
 	const (
 		chars  = "1234567890qwertyuiopasdfghjklzxcvbnmQWERTYUIOPASDFGHJKLZXCVBNM"
@@ -160,7 +326,7 @@ func generateExternalMetricsDeployment(c *runnerv1alpha1.ScaledActionRunnerCore,
 	}
 
 	mcServers := ""
-	if *c.Spec.CreateMemcached {
+	if *c.Spec.CreateMemcached && c.Spec.Redis == nil {
 		for i := 0; i < int(c.Spec.MemcachedReplicas); i++ {
 			mcServers = fmt.Sprintf("%s%s-cache-%d.%s-cache:11211", mcServers, c.Spec.ApiServerName, i, c.Spec.ApiServerName)
 			if i+1 < int(c.Spec.MemcachedReplicas) {
@@ -171,12 +337,28 @@ func generateExternalMetricsDeployment(c *runnerv1alpha1.ScaledActionRunnerCore,
 	if c.Spec.MemcacheServers != "" {
 		mcServers = c.Spec.MemcacheServers
 	}
-	if mcServers != "" {
+	if c.Spec.Redis != nil {
+		args = append(args, getRedisArgs(c)...)
+	} else if mcServers != "" {
 		args = append(args, fmt.Sprintf("--memcached-servers=%s", mcServers))
 		if c.Spec.MemcachedAuth && c.Spec.MemcachedUser != nil {
 			args = append(args, fmt.Sprintf("--memcached-user=%s", *c.Spec.MemcachedUser))
 		}
 	}
+	if c.Spec.Github != nil {
+		args = append(args, getGithubArgs(c.Spec.Github)...)
+	}
+	if c.Spec.WebhookSecret != "" {
+		args = append(args, fmt.Sprintf("--webhook-port=%d", runnerv1alpha1.WebhookPort))
+	}
+	if c.Spec.Budget != nil {
+		budget, _ := json.Marshal(c.Spec.Budget)
+		args = append(args, fmt.Sprintf("--budget=%s", string(budget)))
+	}
+	if c.Spec.UsesExternalScaler() {
+		args = append(args, fmt.Sprintf("--external-scaler-port=%d", runnerv1alpha1.ExternalScalerPort))
+	}
+	args = append(args, fmt.Sprintf("--metrics-apis=%s", strings.Join(c.Spec.MetricsApis, ",")))
 	args = append(args, c.Spec.ApiServerExtraArgs...)
 	dep.Spec.Template.Spec.Containers[0].Args = append(dep.Spec.Template.Spec.Containers[0].Args, args...)
 	dep.Spec.Template.Spec.ServiceAccountName = c.Spec.ApiServerName
@@ -192,9 +374,82 @@ func generateExternalMetricsDeployment(c *runnerv1alpha1.ScaledActionRunnerCore,
 		// Blank out env vars that ref secret
 		dep.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{}
 	}
+	if c.Spec.Redis != nil {
+		dep.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{}
+		if secret := redisSecretName(c); secret != "" {
+			dep.Spec.Template.Spec.Containers[0].Env = append(dep.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{
+				Name: "REDIS_PASSWORD",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+						Key:                  runnerv1alpha1.RedisSecretKey,
+					},
+				},
+			})
+		}
+		if secret := c.Spec.Redis.SentinelCredsSecret; secret != "" {
+			dep.Spec.Template.Spec.Containers[0].Env = append(dep.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{
+				Name: "REDIS_SENTINEL_PASSWORD",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+						Key:                  runnerv1alpha1.RedisSentinelSecretKey,
+					},
+				},
+			})
+		}
+		mountRedisCa(&dep, "redis-ca", c.Spec.Redis.CaSecret, redisCaPath)
+		mountRedisCa(&dep, "redis-sentinel-ca", c.Spec.Redis.SentinelCaSecret, redisSentinelCaPath)
+	}
+	if c.Spec.WebhookSecret != "" {
+		dep.Spec.Template.Spec.Containers[0].Env = append(dep.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{
+			Name: "GITHUB_WEBHOOK_SECRET",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: c.Spec.WebhookSecret},
+					Key:                  runnerv1alpha1.WebhookSecretKey,
+				},
+			},
+		})
+		dep.Spec.Template.Spec.Containers[0].Ports = append(dep.Spec.Template.Spec.Containers[0].Ports, corev1.ContainerPort{
+			Name:          "webhook",
+			ContainerPort: runnerv1alpha1.WebhookPort,
+			Protocol:      corev1.ProtocolTCP,
+		})
+	}
+	if c.Spec.UsesExternalScaler() {
+		dep.Spec.Template.Spec.Containers[0].Ports = append(dep.Spec.Template.Spec.Containers[0].Ports, corev1.ContainerPort{
+			Name:          "grpc",
+			ContainerPort: runnerv1alpha1.ExternalScalerPort,
+			Protocol:      corev1.ProtocolTCP,
+		})
+	}
+	if c.Spec.Github != nil && c.Spec.Github.CaBundle != "" {
+		dep.Spec.Template.Spec.Containers[0].Env = append(dep.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{
+			Name:  "GITHUB_CA_BUNDLE",
+			Value: c.Spec.Github.CaBundle,
+		})
+	}
 	return &dep
 }
 
+func getGithubArgs(g *runnerv1alpha1.GithubConnection) []string {
+	var args []string
+	if g.BaseUrl != "" {
+		args = append(args, fmt.Sprintf("--github-base-url=%s", g.BaseUrl))
+	}
+	if g.UploadUrl != "" {
+		args = append(args, fmt.Sprintf("--github-upload-url=%s", g.UploadUrl))
+	}
+	if g.Proxy != "" {
+		args = append(args, fmt.Sprintf("--github-proxy=%s", g.Proxy))
+	}
+	if g.NoProxy != "" {
+		args = append(args, fmt.Sprintf("--github-no-proxy=%s", g.NoProxy))
+	}
+	return args
+}
+
 func generateExternalMetricsRbac(c *runnerv1alpha1.ScaledActionRunnerCore, ls map[string]string) ([]*rbac.ClusterRole, []*rbac.ClusterRoleBinding, []*rbac.Role, []*rbac.RoleBinding) {
 	scaledactionrunnerViewer := rbac.ClusterRoleBinding{
 		ObjectMeta: metav1.ObjectMeta{
@@ -282,6 +537,12 @@ func generateExternalMetricsRbac(c *runnerv1alpha1.ScaledActionRunnerCore, ls ma
 				APIGroups: []string{"admissionregistration.k8s.io"},
 				Resources: []string{"mutatingwebhookconfigurations", "validatingwebhookconfigurations"},
 				Verbs:     []string{"get", "watch", "list"},
+			},
+			rbac.PolicyRule{
+				// Records when each runner was last online
+				APIGroups: []string{runnerv1alpha1.GroupVersion.Group},
+				Resources: []string{"scaledactionrunners/status"},
+				Verbs:     []string{"get", "patch"},
 			}},
 	}
 	aggApiserverClusterRole.TypeMeta.SetGroupVersionKind(schema.FromAPIVersionAndKind("rbac.authorization.k8s.io/v1", "ClusterRole"))
@@ -329,6 +590,14 @@ func GenerateAuthTrigger(c *runnerv1alpha1.ScaledActionRunnerCore) []client.Obje
 			},
 		},
 	}
+	if c.Spec.UsesExternalScaler() {
+		// The external scalers verify the API server's serving certificate with caCert
+		authTrigger.Spec.SecretTargetRef = append(authTrigger.Spec.SecretTargetRef, keda.AuthSecretTargetRef{
+			Name:      certName,
+			Key:       "ca.crt",
+			Parameter: "caCert",
+		})
+	}
 	authTrigger.TypeMeta.SetGroupVersionKind(schema.FromAPIVersionAndKind("keda.sh/v1alpha1", "ClusterTriggerAuthentication"))
 	return []client.Object{&authTrigger}
 }
@@ -381,6 +650,22 @@ func GenerateMetricsApiServer(c *runnerv1alpha1.ScaledActionRunnerCore) []client
 			Selector: ls,
 		},
 	}
+	if c.Spec.WebhookSecret != "" {
+		svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{
+			Name:       "webhook",
+			Protocol:   corev1.ProtocolTCP,
+			Port:       runnerv1alpha1.WebhookPort,
+			TargetPort: intstr.FromInt(runnerv1alpha1.WebhookPort),
+		})
+	}
+	if c.Spec.UsesExternalScaler() {
+		svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{
+			Name:       "grpc",
+			Protocol:   corev1.ProtocolTCP,
+			Port:       runnerv1alpha1.ExternalScalerPort,
+			TargetPort: intstr.FromInt(runnerv1alpha1.ExternalScalerPort),
+		})
+	}
 	svc.TypeMeta.SetGroupVersionKind(schema.FromAPIVersionAndKind("v1", "Service"))
 	sa := v1.ServiceAccount{
 		ObjectMeta: metav1.ObjectMeta{
@@ -391,16 +676,36 @@ func GenerateMetricsApiServer(c *runnerv1alpha1.ScaledActionRunnerCore) []client
 	}
 	sa.TypeMeta.SetGroupVersionKind(schema.FromAPIVersionAndKind("v1", "ServiceAccount"))
 
-	apiservice := &unstructured.Unstructured{
+	var apiservices []*unstructured.Unstructured
+	for _, api := range c.Spec.MetricsApis {
+		if registersApiService(api) {
+			apiservices = append(apiservices, generateApiService(c, api))
+		}
+	}
+	cr, crb, r, rb := generateExternalMetricsRbac(c, ls)
+	output := setKey(c, dep, &svc, &sa, cr, crb, r, rb, apiservices)
+	return output
+}
+
+// registersApiService returns false for external.metrics.k8s.io as its APIService belongs to KEDA's metrics server,
+// pointing it at the API server would stop every other ScaledObject in the cluster from getting metrics. KEDA reads
+// the external API from the API server's URL instead.
+func registersApiService(api string) bool {
+	return api != runnerv1alpha1.MetricsApiExternal
+}
+
+func generateApiService(c *runnerv1alpha1.ScaledActionRunnerCore, api string) *unstructured.Unstructured {
+	group := runnerv1alpha1.MetricsApiGroups[api]
+	return &unstructured.Unstructured{
 		Object: map[string]interface{}{
 			"apiVersion": "apiregistration.k8s.io/v1",
 			"kind":       "APIService",
 			"metadata": map[string]interface{}{
-				"name": "v1beta1.custom.metrics.k8s.io",
+				"name": "v1beta1." + group,
 			},
 			"spec": map[string]interface{}{
 				"insecureSkipTLSVerify": true,
-				"group":                 "custom.metrics.k8s.io",
+				"group":                 group,
 				"groupPriorityMinimum":  100,
 				"versionPriority":       100,
 				"service": map[string]interface{}{
@@ -411,8 +716,17 @@ func GenerateMetricsApiServer(c *runnerv1alpha1.ScaledActionRunnerCore) []client
 			},
 		},
 	}
-	cr, crb, r, rb := generateExternalMetricsRbac(c, ls)
-	output := setKey(c, dep, &svc, &sa, cr, crb, r, rb, apiservice)
+}
+
+// GenerateUnusedApiServices returns the APIServices of the metrics APIs which aren't served so that they can be
+// deleted, otherwise switching to external would leave custom.metrics.k8s.io pointing at the API server
+func GenerateUnusedApiServices(c *runnerv1alpha1.ScaledActionRunnerCore) []client.Object {
+	var output []client.Object
+	for api := range runnerv1alpha1.MetricsApiGroups {
+		if registersApiService(api) && !c.Spec.ServesMetricsApi(api) {
+			output = append(output, generateApiService(c, api))
+		}
+	}
 	return output
 }
 
@@ -428,7 +742,7 @@ func getKey(c *runnerv1alpha1.ScaledActionRunnerCore) string {
 	b := sha1.Sum(j)
 	return fmt.Sprintf("%s_%s_%s/%s%s", bin, base64.RawStdEncoding.EncodeToString(b[:]), c.Spec.ApiServerNamespace, c.Spec.ApiServerName, c.ResourceVersion)
 }
-func setKey(c *runnerv1alpha1.ScaledActionRunnerCore, dep *appsv1.Deployment, svc *v1.Service, sa *v1.ServiceAccount, cr []*rbac.ClusterRole, crb []*rbac.ClusterRoleBinding, r []*rbac.Role, rb []*rbac.RoleBinding, as *unstructured.Unstructured) []client.Object {
+func setKey(c *runnerv1alpha1.ScaledActionRunnerCore, dep *appsv1.Deployment, svc *v1.Service, sa *v1.ServiceAccount, cr []*rbac.ClusterRole, crb []*rbac.ClusterRoleBinding, r []*rbac.Role, rb []*rbac.RoleBinding, as []*unstructured.Unstructured) []client.Object {
 	key := getKey(c)
 	process := func(o client.Object) client.Object {
 		anns := o.GetAnnotations()
@@ -455,10 +769,98 @@ func setKey(c *runnerv1alpha1.ScaledActionRunnerCore, dep *appsv1.Deployment, sv
 	for _, o := range rb {
 		out = append(out, process(o))
 	}
-	out = append(out, process(as))
+	for _, o := range as {
+		out = append(out, process(o))
+	}
 	return out
 }
 
+const JsonRedis = `{
+	"apiVersion": "apps/v1",
+	"kind": "StatefulSet",
+	"metadata": {
+	  "name": "replaced-redis",
+	  "namespace": "replacedns"
+	},
+	"spec": {
+	  "selector": {
+		"matchLabels": {
+		}
+	  },
+	  "replicas": 1,
+	  "serviceName": "replaced-redis",
+	  "template": {
+		"spec": {
+		  "securityContext": {
+			"fsGroup": 999
+		  },
+		  "containers": [
+			{
+			  "name": "redis",
+			  "image": "docker.io/library/redis:latest",
+			  "imagePullPolicy": "Always",
+			  "args": [
+				"redis-server"
+			  ],
+			  "env": [
+				{
+				  "name": "REDIS_PASSWORD",
+				  "valueFrom": {
+					"secretKeyRef": {
+					  "name": "replaced-redis",
+					  "key": "redis-password"
+					}
+				  }
+				}
+			  ],
+			  "ports": [
+				{
+				  "name": "redis",
+				  "containerPort": 6379
+				}
+			  ],
+			  "livenessProbe": {
+				"tcpSocket": {
+				  "port": "redis"
+				},
+				"initialDelaySeconds": 30,
+				"timeoutSeconds": 5,
+				"failureThreshold": 6
+			  },
+			  "readinessProbe": {
+				"tcpSocket": {
+				  "port": "redis"
+				},
+				"initialDelaySeconds": 5,
+				"timeoutSeconds": 3,
+				"periodSeconds": 5
+			  },
+			  "resources": {
+				"limits": {},
+				"requests": {
+				  "cpu": "100m",
+				  "memory": "128Mi"
+				}
+			  },
+			  "volumeMounts": [
+				{
+				  "name": "data",
+				  "mountPath": "/data"
+				}
+			  ]
+			}
+		  ],
+		  "volumes": [
+			{
+			  "name": "data",
+			  "emptyDir": {}
+			}
+		  ]
+		}
+	  }
+	}
+}`
+
 const JsonMemcached = `{
 	"apiVersion": "apps/v1",
 	"kind": "StatefulSet",
@@ -0,0 +1,152 @@
+package coregenerator
+
+import (
+	"testing"
+
+	"github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	keda "github.com/kedacore/keda/v2/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newCore(redis *v1alpha1.RedisCache) *v1alpha1.ScaledActionRunnerCore {
+	c := v1alpha1.ScaledActionRunnerCore{
+		ObjectMeta: v1.ObjectMeta{Name: "core"},
+		Spec:       v1alpha1.ScaledActionRunnerCoreSpec{ApiServerName: "api", ApiServerNamespace: "ns", Redis: redis},
+	}
+	c.Setup()
+	return &c
+}
+
+func TestGeneratesManagedRedis(t *testing.T) {
+	storage := resource.MustParse("1Gi")
+	c := newCore(&v1alpha1.RedisCache{User: "scaler", Storage: &storage})
+	mc, err := GenerateMemcachedResources(c)
+	assert.Nil(t, err)
+	assert.Empty(t, mc)
+
+	resources, err := GenerateRedisResources(c)
+	assert.Nil(t, err)
+	assert.Len(t, resources, 3)
+	ss := resources[0].(*appsv1.StatefulSet)
+	assert.Equal(t, "api-redis", ss.Name)
+	assert.Equal(t, "docker.io/library/redis:6.2.6", ss.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, []string{"redis-server", "--requirepass", "$(REDIS_PASSWORD)", "--user", "scaler", "on", ">$(REDIS_PASSWORD)", "~*", "+@all", "--appendonly", "yes"}, ss.Spec.Template.Spec.Containers[0].Args)
+	assert.Equal(t, "data", ss.Spec.VolumeClaimTemplates[0].Name)
+	assert.Empty(t, ss.Spec.Template.Spec.Volumes)
+	secret := resources[2].(*corev1.Secret)
+	assert.Equal(t, "api-redis", secret.Name)
+	assert.Len(t, secret.StringData[v1alpha1.RedisSecretKey], 32)
+
+	dep := generateExternalMetricsDeployment(c, map[string]string{})
+	args := dep.Spec.Template.Spec.Containers[0].Args
+	assert.Contains(t, args, "--redis-addrs=api-redis-0.api-redis:6379")
+	assert.Contains(t, args, "--redis-user=scaler")
+	for _, arg := range args {
+		assert.NotContains(t, arg, "--memcached-servers")
+	}
+	assert.Equal(t, "REDIS_PASSWORD", dep.Spec.Template.Spec.Containers[0].Env[0].Name)
+	assert.Equal(t, "api-redis", dep.Spec.Template.Spec.Containers[0].Env[0].ValueFrom.SecretKeyRef.Name)
+}
+
+func TestConnectsToExternalRedis(t *testing.T) {
+	c := newCore(&v1alpha1.RedisCache{Addrs: []string{"s1:26379", "s2:26379"}, Mode: v1alpha1.RedisSentinel, MasterName: "primary", TLS: true, CaSecret: "redis-ca",
+		SentinelUser: "sentinel", SentinelCredsSecret: "sentinel-creds", SentinelTLS: true, SentinelCaSecret: "sentinel-ca"})
+	assert.Nil(t, c.Spec.Redis.Validate())
+	resources, err := GenerateRedisResources(c)
+	assert.Nil(t, err)
+	assert.Empty(t, resources)
+
+	dep := generateExternalMetricsDeployment(c, map[string]string{})
+	args := dep.Spec.Template.Spec.Containers[0].Args
+	assert.Contains(t, args, "--redis-addrs=s1:26379,s2:26379")
+	assert.Contains(t, args, "--redis-mode=sentinel")
+	assert.Contains(t, args, "--redis-master-name=primary")
+	assert.Contains(t, args, "--redis-tls")
+	assert.Contains(t, args, "--redis-ca-file=/redis-ca/ca.crt")
+	assert.Contains(t, args, "--redis-sentinel-user=sentinel")
+	assert.Contains(t, args, "--redis-sentinel-tls")
+	assert.Contains(t, args, "--redis-sentinel-ca-file=/redis-sentinel-ca/ca.crt")
+	env := dep.Spec.Template.Spec.Containers[0].Env
+	assert.Len(t, env, 1)
+	assert.Equal(t, "REDIS_SENTINEL_PASSWORD", env[0].Name)
+	assert.Equal(t, "sentinel-creds", env[0].ValueFrom.SecretKeyRef.Name)
+	assert.Equal(t, v1alpha1.RedisSentinelSecretKey, env[0].ValueFrom.SecretKeyRef.Key)
+	volumes := dep.Spec.Template.Spec.Volumes
+	assert.Equal(t, "redis-ca", volumes[len(volumes)-2].Secret.SecretName)
+	assert.Equal(t, "sentinel-ca", volumes[len(volumes)-1].Secret.SecretName)
+}
+
+func TestValidatesRedis(t *testing.T) {
+	assert.Nil(t, newCore(&v1alpha1.RedisCache{}).Spec.Redis.Validate())
+	assert.NotNil(t, newCore(&v1alpha1.RedisCache{Mode: v1alpha1.RedisCluster}).Spec.Redis.Validate())
+	assert.NotNil(t, newCore(&v1alpha1.RedisCache{TLS: true}).Spec.Redis.Validate())
+	assert.NotNil(t, newCore(&v1alpha1.RedisCache{Addrs: []string{"s1:26379"}, Mode: v1alpha1.RedisSentinel}).Spec.Redis.Validate())
+	assert.NotNil(t, newCore(&v1alpha1.RedisCache{Addrs: []string{"redis:6379"}, CaSecret: "redis-ca"}).Spec.Redis.Validate())
+	assert.NotNil(t, newCore(&v1alpha1.RedisCache{Addrs: []string{"redis:6379"}, SentinelTLS: true}).Spec.Redis.Validate())
+	assert.NotNil(t, newCore(&v1alpha1.RedisCache{Addrs: []string{"s1:26379"}, Mode: v1alpha1.RedisSentinel, MasterName: "primary", SentinelCaSecret: "sentinel-ca"}).Spec.Redis.Validate())
+}
+
+func TestExposesExternalScalerOnApiServerService(t *testing.T) {
+	grpcPorts := func(c *v1alpha1.ScaledActionRunnerCore) []corev1.ServicePort {
+		var ports []corev1.ServicePort
+		for _, o := range GenerateMetricsApiServer(c) {
+			if svc, ok := o.(*corev1.Service); ok {
+				for _, p := range svc.Spec.Ports {
+					if p.Name == "grpc" {
+						ports = append(ports, p)
+					}
+				}
+			}
+		}
+		return ports
+	}
+	c := newCore(nil)
+	assert.Empty(t, grpcPorts(c))
+
+	c.Spec.ScalerTrigger = v1alpha1.TriggerExternalPush
+	ports := grpcPorts(c)
+	assert.Len(t, ports, 1)
+	assert.Equal(t, int32(v1alpha1.ExternalScalerPort), ports[0].Port)
+	assert.Equal(t, v1alpha1.ExternalScalerPort, ports[0].TargetPort.IntValue())
+}
+
+func TestAuthTriggerHasCaCertForExternalScaler(t *testing.T) {
+	params := func(c *v1alpha1.ScaledActionRunnerCore) map[string]string {
+		found := map[string]string{}
+		for _, ref := range GenerateAuthTrigger(c)[0].(*keda.ClusterTriggerAuthentication).Spec.SecretTargetRef {
+			found[ref.Parameter] = ref.Key
+		}
+		return found
+	}
+	c := newCore(nil)
+	c.Spec.SslCertSecret = "cert"
+	assert.NotContains(t, params(c), "caCert")
+
+	c.Spec.ScalerTrigger = v1alpha1.TriggerExternal
+	assert.Equal(t, "ca.crt", params(c)["caCert"])
+}
+
+func TestDoesntRegisterKedasExternalMetricsApiService(t *testing.T) {
+	names := func(objs []client.Object) []string {
+		var found []string
+		for _, o := range objs {
+			if o.GetObjectKind().GroupVersionKind().Kind == "APIService" {
+				found = append(found, o.GetName())
+			}
+		}
+		return found
+	}
+	c := newCore(nil)
+	c.Spec.MetricsApis = []string{v1alpha1.MetricsApiCustom, v1alpha1.MetricsApiExternal}
+	assert.Equal(t, []string{"v1beta1.custom.metrics.k8s.io"}, names(GenerateMetricsApiServer(c)))
+	assert.Empty(t, names(GenerateUnusedApiServices(c)))
+
+	c.Spec.MetricsApis = []string{v1alpha1.MetricsApiExternal}
+	assert.Empty(t, names(GenerateMetricsApiServer(c)))
+	assert.Equal(t, []string{"v1beta1.custom.metrics.k8s.io"}, names(GenerateUnusedApiServices(c)))
+}
@@ -0,0 +1,323 @@
+// Package expression evaluates the arithmetic expressions used by the expression scaling strategy e.g.
+// ceil(queued*1.5)+busy. Expressions can only do arithmetic on numbers and known variables with a small set of
+// functions, there are no loops or side effects so they are safe to evaluate in the API server.
+package expression
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxLength = 256
+	maxDepth  = 32
+)
+
+type node interface {
+	eval(vars map[string]float64) (float64, error)
+}
+
+type number float64
+
+func (n number) eval(vars map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+type variable string
+
+func (v variable) eval(vars map[string]float64) (float64, error) {
+	value, found := vars[string(v)]
+	if !found {
+		return 0, fmt.Errorf("no value for %s", string(v))
+	}
+	return value, nil
+}
+
+type unary struct {
+	operand node
+}
+
+func (u unary) eval(vars map[string]float64) (float64, error) {
+	v, err := u.operand.eval(vars)
+	return -v, err
+}
+
+type binary struct {
+	op          byte
+	left, right node
+}
+
+func (b binary) eval(vars map[string]float64) (float64, error) {
+	l, err := b.left.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	r, err := b.right.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	switch b.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	case '/':
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	case '%':
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return math.Mod(l, r), nil
+	}
+	return math.Pow(l, r), nil
+}
+
+type function struct {
+	name string
+	args []node
+}
+
+var functions = map[string]struct {
+	arity int
+	f     func(args []float64) float64
+}{
+	"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"round": {1, func(a []float64) float64 { return math.Round(a[0]) }},
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"log":   {1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"min":   {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"max":   {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+}
+
+func (f function) eval(vars map[string]float64) (float64, error) {
+	args := make([]float64, len(f.args))
+	for i, a := range f.args {
+		v, err := a.eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	return functions[f.name].f(args), nil
+}
+
+// Expression is a parsed expression which can be evaluated many times
+type Expression struct {
+	source string
+	root   node
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Evaluate returns the value of the expression, it errors if a variable is missing or the result isn't a finite number
+func (e *Expression) Evaluate(vars map[string]float64) (float64, error) {
+	v, err := e.root.eval(vars)
+	if err != nil {
+		return 0, fmt.Errorf("error evaluating '%s'. %s", e.source, err.Error())
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("error evaluating '%s'. result is not a number", e.source)
+	}
+	return v, nil
+}
+
+// Parse parses an expression which may only refer to the given variables. Supported are numbers, + - * / % ^,
+// parentheses and the functions ceil, floor, round, abs, sqrt, log, min and max.
+func Parse(source string, vars []string) (*Expression, error) {
+	if len(source) > maxLength {
+		return nil, fmt.Errorf("expression is longer than %d characters", maxLength)
+	}
+	p := parser{source: source, vars: map[string]bool{}}
+	for _, v := range vars {
+		p.vars[v] = true
+	}
+	if strings.TrimSpace(source) == "" {
+		return nil, fmt.Errorf("expression is empty")
+	}
+	root, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.source) {
+		return nil, p.errorf("unexpected '%c'", p.source[p.pos])
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+type parser struct {
+	source string
+	pos    int
+	vars   map[string]bool
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at position %d of '%s'", fmt.Sprintf(format, args...), p.pos+1, p.source)
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.source) && p.source[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *parser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.source) {
+		return p.source[p.pos]
+	}
+	return 0
+}
+
+// parseExpression handles + and -
+func (p *parser) parseExpression(depth int) (node, error) {
+	if depth > maxDepth {
+		return nil, p.errorf("expression is nested too deeply")
+	}
+	left, err := p.parseTerm(depth)
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		right, err := p.parseTerm(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseTerm handles *, / and %
+func (p *parser) parseTerm(depth int) (node, error) {
+	left, err := p.parsePower(depth)
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/' || op == '%'; op = p.peek() {
+		p.pos++
+		right, err := p.parsePower(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// parsePower handles ^ which is right associative
+func (p *parser) parsePower(depth int) (node, error) {
+	base, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == '^' {
+		p.pos++
+		exponent, err := p.parsePower(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return binary{op: '^', left: base, right: exponent}, nil
+	}
+	return base, nil
+}
+
+func (p *parser) parseUnary(depth int) (node, error) {
+	if p.peek() == '-' {
+		p.pos++
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return unary{operand: operand}, nil
+	}
+	return p.parsePrimary(depth)
+}
+
+func (p *parser) parsePrimary(depth int) (node, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		inner, err := p.parseExpression(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected ')'")
+		}
+		p.pos++
+		return inner, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.source) && (p.source[p.pos] == '.' || (p.source[p.pos] >= '0' && p.source[p.pos] <= '9')) {
+			p.pos++
+		}
+		literal := p.source[start:p.pos]
+		v, err := strconv.ParseFloat(literal, 64)
+		if err != nil {
+			p.pos = start
+			return nil, p.errorf("invalid number '%s'", literal)
+		}
+		return number(v), nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.source) && (p.source[p.pos] == '_' || unicode.IsLetter(rune(p.source[p.pos])) || unicode.IsDigit(rune(p.source[p.pos]))) {
+			p.pos++
+		}
+		name := p.source[start:p.pos]
+		if p.peek() == '(' {
+			return p.parseCall(name, start, depth)
+		}
+		if !p.vars[name] {
+			p.pos = start
+			return nil, p.errorf("unknown variable '%s'", name)
+		}
+		return variable(name), nil
+	case c == 0:
+		return nil, p.errorf("unexpected end of expression")
+	}
+	return nil, p.errorf("unexpected '%c'", c)
+}
+
+func (p *parser) parseCall(name string, start int, depth int) (node, error) {
+	f, found := functions[name]
+	if !found {
+		p.pos = start
+		return nil, p.errorf("unknown function '%s'", name)
+	}
+	p.pos++
+	var args []node
+	for p.peek() != ')' {
+		if len(args) > 0 {
+			if p.peek() != ',' {
+				return nil, p.errorf("expected ',' or ')'")
+			}
+			p.pos++
+		}
+		arg, err := p.parseExpression(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.pos++
+	if len(args) != f.arity {
+		p.pos = start
+		return nil, p.errorf("%s expects %d argument(s) but got %d", name, f.arity, len(args))
+	}
+	return function{name: name, args: args}, nil
+}
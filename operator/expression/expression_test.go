@@ -0,0 +1,59 @@
+package expression
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var vars = []string{"queued", "busy"}
+
+func TestEvaluatesExpressions(t *testing.T) {
+	values := map[string]float64{"queued": 3, "busy": 2}
+	for source, expected := range map[string]float64{
+		"ceil(queued*1.5)+busy":              7,
+		"queued + busy * 2":                  7,
+		"(queued + busy) * 2":                10,
+		"-queued + 10":                       7,
+		"2 ^ 3 ^ 2":                          512,
+		"max(queued, busy) % 2":              1,
+		"min(floor(queued / 2), round(0.5))": 1,
+		"sqrt(queued * 12)":                  6,
+	} {
+		e, err := Parse(source, vars)
+		if assert.Nil(t, err, source) {
+			v, err := e.Evaluate(values)
+			assert.Nil(t, err, source)
+			assert.Equal(t, expected, v, source)
+		}
+	}
+}
+
+func TestRejectsInvalidExpressions(t *testing.T) {
+	for source, message := range map[string]string{
+		"":               "expression is empty",
+		"queued +":       "unexpected end of expression",
+		"queued * (busy": "expected ')'",
+		"pending + 1":    "unknown variable 'pending'",
+		"exec(queued)":   "unknown function 'exec'",
+		"max(queued)":    "max expects 2 argument(s) but got 1",
+		"queued; busy":   "unexpected ';'",
+		"1..2":           "invalid number '1..2'",
+		"queued busy":    "unexpected 'b'",
+	} {
+		_, err := Parse(source, vars)
+		if assert.NotNil(t, err, source) {
+			assert.Contains(t, err.Error(), message, source)
+		}
+	}
+}
+
+func TestErrorsIfResultIsNotANumber(t *testing.T) {
+	e, err := Parse("queued / busy", vars)
+	assert.Nil(t, err)
+	_, err = e.Evaluate(map[string]float64{"queued": 1, "busy": 0})
+	assert.NotNil(t, err)
+	e, _ = Parse("log(queued)", vars)
+	_, err = e.Evaluate(map[string]float64{"queued": 0, "busy": 0})
+	assert.NotNil(t, err)
+}
@@ -3,13 +3,13 @@ module github.com/devjoes/github-runner-autoscaler/operator
 go 1.15
 
 require (
-	github.com/evanphx/json-patch v4.9.0+incompatible // indirect
+	github.com/evanphx/json-patch v4.9.0+incompatible
 	github.com/go-logr/logr v0.4.0
 	github.com/kedacore/keda/v2 v2.2.0
 	github.com/onsi/ginkgo v1.15.2
 	github.com/onsi/gomega v1.11.0
 	github.com/pingcap/errors v0.11.4
-	github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring v0.46.0 // indirect
+	github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring v0.46.0
 	github.com/r3labs/diff v1.1.0
 	github.com/stretchr/testify v1.7.0
 	k8s.io/api v0.20.5
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"reflect"
 
 	runnerv1alpha1 "github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
@@ -20,6 +21,11 @@ const AnnotationRunnerRef = "runner-ref"
 const AnnotationSecretsHash = "runner-secrets-hash"
 const AnnotationRunnerPatchHash = "patch-hash"
 
+// githubCaPath is where the init container writes the system CA certificates along with the GHES CA bundle, the runner
+// image doesn't install GITHUB_CA_BUNDLE itself
+const githubCaPath = "/github-ca"
+const githubCaFile = githubCaPath + "/ca-certificates.crt"
+
 func getLabels(res metav1.Object) map[string]string {
 	ls := res.GetLabels()
 	if ls == nil {
@@ -28,30 +34,81 @@ func getLabels(res metav1.Object) map[string]string {
 	return ls
 }
 
-//TODO: Take this approach for StatefulSets too
-func UpdateScaledObjectSpec(c *runnerv1alpha1.ScaledActionRunner, url string, spec *keda.ScaledObjectSpec, clusterTriggerName string) {
-	spec.ScaleTargetRef = &keda.ScaleTarget{
-		Kind:       "StatefulSet",
-		Name:       c.ObjectMeta.Name,
-		APIVersion: "apps/v1",
+// MetricsUrl is the URL that KEDA reads the metric of a ScaledActionRunner from. custom.metrics.k8s.io takes the
+// selector as the metric name, external.metrics.k8s.io names the metric after the runner and takes the selector as
+// a labelSelector.
+func MetricsUrl(api string, endpoint string, namespace string, name string, selector string) string {
+	if api == runnerv1alpha1.MetricsApiExternal {
+		metricsUrl := fmt.Sprintf("https://%s/apis/external.metrics.k8s.io/v1beta1/namespaces/%s/%s", endpoint, namespace, name)
+		if selector != "*" {
+			metricsUrl = fmt.Sprintf("%s?labelSelector=%s", metricsUrl, url.QueryEscape(selector))
+		}
+		return metricsUrl
+	}
+	return fmt.Sprintf("https://%s/apis/custom.metrics.k8s.io/v1beta1/namespaces/%s/Scaledactionrunners/%s/%s", endpoint, namespace, name, selector)
+}
+
+// Trigger is how KEDA gets the metric of a ScaledActionRunner from the API server
+type Trigger struct {
+	// Type is metrics-api, external or external-push
+	Type string
+	// Url is the metrics API URL that metrics-api reads
+	Url string
+	// ClusterTriggerName is the ClusterTriggerAuthentication with the certificates that metrics-api uses and the caCert
+	// that external and external-push verify the API server with
+	ClusterTriggerName string
+	// ScalerAddress is the host:port of the API server's gRPC external scaler
+	ScalerAddress string
+	// Selector filters the jobs counted by the external scaler
+	Selector string
+}
+
+// ScaleTriggers returns the KEDA triggers for t
+func (t Trigger) ScaleTriggers() []keda.ScaleTriggers {
+	if t.Type == runnerv1alpha1.TriggerExternal || t.Type == runnerv1alpha1.TriggerExternalPush {
+		return []keda.ScaleTriggers{
+			{
+				Type: t.Type,
+				AuthenticationRef: &keda.ScaledObjectAuthRef{
+					Name: t.ClusterTriggerName,
+					Kind: "ClusterTriggerAuthentication",
+				},
+				Metadata: map[string]string{
+					"scalerAddress":   t.ScalerAddress,
+					"metricsSelector": t.Selector,
+				},
+			},
+		}
 	}
-	spec.MinReplicaCount = &c.Spec.MinRunners
-	spec.MaxReplicaCount = &c.Spec.MaxRunners
-	spec.Triggers = []keda.ScaleTriggers{
+	return []keda.ScaleTriggers{
 		{
-			Type: "metrics-api",
+			Type: runnerv1alpha1.TriggerMetricsApi,
 			AuthenticationRef: &keda.ScaledObjectAuthRef{
-				Name: clusterTriggerName,
+				Name: t.ClusterTriggerName,
 				Kind: "ClusterTriggerAuthentication",
 			},
 			Metadata: map[string]string{
 				"targetValue":   "1",
-				"url":           url,
+				"url":           t.Url,
 				"valueLocation": "items.0.value",
 				"authMode":      "tls",
 			},
 		},
 	}
+}
+
+//TODO: Take this approach for StatefulSets too
+func UpdateScaledObjectSpec(c *runnerv1alpha1.ScaledActionRunner, trigger Trigger, spec *keda.ScaledObjectSpec) {
+	spec.ScaleTargetRef = &keda.ScaleTarget{
+		Kind:       "StatefulSet",
+		Name:       c.ObjectMeta.Name,
+		APIVersion: "apps/v1",
+	}
+	// Scheduled windows are applied by the metric so the ScaledObject has to allow the lowest of them
+	minReplicas, maxReplicas := c.Spec.ReplicaBounds()
+	spec.MinReplicaCount = &minReplicas
+	spec.MaxReplicaCount = &maxReplicas
+	spec.Triggers = trigger.ScaleTriggers()
 	if c.Spec.Scaling != nil {
 		spec.CooldownPeriod = c.Spec.Scaling.CooldownPeriod
 		spec.PollingInterval = c.Spec.Scaling.PollingInterval
@@ -65,10 +122,10 @@ func UpdateScaledObjectSpec(c *runnerv1alpha1.ScaledActionRunner, url string, sp
 	}
 }
 
-func GenerateScaledObject(c *runnerv1alpha1.ScaledActionRunner, url string, clusterTriggerName string) *keda.ScaledObject {
+func GenerateScaledObject(c *runnerv1alpha1.ScaledActionRunner, trigger Trigger) *keda.ScaledObject {
 	ls := getLabels(c)
 	spec := keda.ScaledObjectSpec{}
-	UpdateScaledObjectSpec(c, url, &spec, clusterTriggerName)
+	UpdateScaledObjectSpec(c, trigger, &spec)
 
 	resource := keda.ScaledObject{
 		ObjectMeta: metav1.ObjectMeta{Name: c.ObjectMeta.Name, Namespace: c.ObjectMeta.Namespace, Labels: ls},
@@ -128,6 +185,7 @@ func GenerateStatefulSet(c *runnerv1alpha1.ScaledActionRunner, secretsHash strin
 		},
 	}
 	SetEnvVars(c, &resource)
+	SetInitContainers(c, &resource)
 
 	volumes, volumeMounts := GetVolumes(c)
 	resource.Spec.Template.Spec.Volumes = volumes
@@ -162,6 +220,16 @@ func GetVolumes(c *runnerv1alpha1.ScaledActionRunner) ([]corev1.Volume, []corev1
 			MountPath: "/var/run/docker.sock",
 		})
 	}
+	if c.Spec.Github != nil && c.Spec.Github.CaBundle != "" {
+		volumes = append(volumes, corev1.Volume{
+			Name:         "github-ca",
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      "github-ca",
+			MountPath: githubCaPath,
+		})
+	}
 
 	for i := 0; i < int(c.Spec.MaxRunners); i++ {
 		name := fmt.Sprintf("%s-%d", c.ObjectMeta.Name, i)
@@ -194,10 +262,6 @@ func GetVolumes(c *runnerv1alpha1.ScaledActionRunner) ([]corev1.Volume, []corev1
 func SetEnvVars(c *runnerv1alpha1.ScaledActionRunner, statefulSet *appsv1.StatefulSet) bool {
 	modified := false
 	toSet := map[string]corev1.EnvVar{
-		"REPO_URL": {
-			Name:  "REPO_URL",
-			Value: fmt.Sprintf("git@github.com:%s/%s.git", c.Spec.Owner, c.Spec.Repo),
-		},
 		"RUNNER_NAME": {
 			Name: "RUNNER_NAME",
 			ValueFrom: &corev1.EnvVarSource{
@@ -213,12 +277,29 @@ func SetEnvVars(c *runnerv1alpha1.ScaledActionRunner, statefulSet *appsv1.Statef
 			Value: "true",
 		},
 	}
+	for _, e := range getGithubEnvVars(c.Spec.Github) {
+		toSet[e.Name] = e
+	}
+	scopeVars, toRemove := getScopeEnvVars(c)
+	for _, e := range scopeVars {
+		toSet[e.Name] = e
+	}
 	for _, e := range c.Spec.Runner.Env {
 		toSet[e.Name] = e
+		delete(toRemove, e.Name)
 	}
 	if c.Spec.Runner.RunnerLabels != "" {
 		toSet["LABELS"] = corev1.EnvVar{Name: "LABELS", Value: c.Spec.Runner.RunnerLabels}
 	}
+	env := statefulSet.Spec.Template.Spec.Containers[0].Env[:0]
+	for _, e := range statefulSet.Spec.Template.Spec.Containers[0].Env {
+		if toRemove[e.Name] {
+			modified = true
+			continue
+		}
+		env = append(env, e)
+	}
+	statefulSet.Spec.Template.Spec.Containers[0].Env = env
 	for i, e := range statefulSet.Spec.Template.Spec.Containers[0].Env {
 		if newVal, found := toSet[e.Name]; found {
 			if !reflect.DeepEqual(e, newVal) {
@@ -240,6 +321,90 @@ func SetEnvVars(c *runnerv1alpha1.ScaledActionRunner, statefulSet *appsv1.Statef
 	return modified
 }
 
+// getScopeEnvVars returns the variables that point the runner at either a repo or an organization along with the names
+// of any which were set for the other scope
+func getScopeEnvVars(c *runnerv1alpha1.ScaledActionRunner) ([]corev1.EnvVar, map[string]bool) {
+	if !c.Spec.IsOrganization() {
+		return []corev1.EnvVar{{
+			Name:  "REPO_URL",
+			Value: fmt.Sprintf("git@%s:%s/%s.git", c.Spec.Github.Host(), c.Spec.Owner, c.Spec.Repo),
+		}}, map[string]bool{"RUNNER_SCOPE": true, "ORG_NAME": true, "RUNNER_GROUP": true}
+	}
+	vars := []corev1.EnvVar{
+		{Name: "RUNNER_SCOPE", Value: "org"},
+		{Name: "ORG_NAME", Value: c.Spec.Owner},
+	}
+	toRemove := map[string]bool{"REPO_URL": true}
+	if c.Spec.Organization.RunnerGroup != "" {
+		vars = append(vars, corev1.EnvVar{Name: "RUNNER_GROUP", Value: c.Spec.Organization.RunnerGroup})
+	} else {
+		toRemove["RUNNER_GROUP"] = true
+	}
+	return vars, toRemove
+}
+
+func getGithubEnvVars(g *runnerv1alpha1.GithubConnection) []corev1.EnvVar {
+	var vars []corev1.EnvVar
+	if g == nil {
+		return vars
+	}
+	if g.IsEnterprise() {
+		vars = append(vars, corev1.EnvVar{Name: "GITHUB_HOST", Value: g.Host()})
+	}
+	if g.Proxy != "" {
+		for _, n := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+			vars = append(vars, corev1.EnvVar{Name: n, Value: g.Proxy})
+		}
+	}
+	if g.NoProxy != "" {
+		for _, n := range []string{"NO_PROXY", "no_proxy"} {
+			vars = append(vars, corev1.EnvVar{Name: n, Value: g.NoProxy})
+		}
+	}
+	if g.CaBundle != "" {
+		vars = append(vars, corev1.EnvVar{Name: "GITHUB_CA_BUNDLE", Value: g.CaBundle})
+		// The runner, git and node actions each read the trusted certificates from a different variable
+		for _, n := range []string{"SSL_CERT_FILE", "GIT_SSL_CAINFO", "NODE_EXTRA_CA_CERTS"} {
+			vars = append(vars, corev1.EnvVar{Name: n, Value: githubCaFile})
+		}
+	}
+	return vars
+}
+
+// getInitContainers returns the init container which adds the GHES CA bundle to the certificates that the runner trusts
+func getInitContainers(c *runnerv1alpha1.ScaledActionRunner) []corev1.Container {
+	if c.Spec.Github == nil || c.Spec.Github.CaBundle == "" {
+		return []corev1.Container{}
+	}
+	return []corev1.Container{{
+		Name:    "github-ca",
+		Image:   c.Spec.Runner.Image,
+		Command: []string{"/bin/bash", "-c", fmt.Sprintf(`cat /etc/ssl/certs/ca-certificates.crt > %[1]s && echo "$GITHUB_CA_BUNDLE" >> %[1]s`, githubCaFile)},
+		Env:     []corev1.EnvVar{{Name: "GITHUB_CA_BUNDLE", Value: c.Spec.Github.CaBundle}},
+		VolumeMounts: []corev1.VolumeMount{{
+			Name:      "github-ca",
+			MountPath: githubCaPath,
+		}},
+	}}
+}
+
+// SetInitContainers sets the init containers of statefulSet and returns true if they changed. Fields which Kubernetes
+// defaults are ignored when comparing them.
+func SetInitContainers(c *runnerv1alpha1.ScaledActionRunner, statefulSet *appsv1.StatefulSet) bool {
+	wanted := getInitContainers(c)
+	old := statefulSet.Spec.Template.Spec.InitContainers
+	modified := len(old) != len(wanted)
+	for i := 0; !modified && i < len(wanted); i++ {
+		modified = old[i].Name != wanted[i].Name || old[i].Image != wanted[i].Image ||
+			!reflect.DeepEqual(old[i].Command, wanted[i].Command) || !reflect.DeepEqual(old[i].Env, wanted[i].Env) ||
+			!reflect.DeepEqual(old[i].VolumeMounts, wanted[i].VolumeMounts)
+	}
+	if modified {
+		statefulSet.Spec.Template.Spec.InitContainers = wanted
+	}
+	return modified
+}
+
 func PatchStatefulSet(statefulSet *appsv1.StatefulSet, config *runnerv1alpha1.ScaledActionRunner) (*appsv1.StatefulSet, string, error) {
 	if config.Spec.Runner == nil || config.Spec.Runner.Patch == "" {
 		return nil, "", nil
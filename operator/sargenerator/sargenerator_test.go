@@ -4,9 +4,11 @@ import (
 	"testing"
 
 	"github.com/devjoes/github-runner-autoscaler/operator/api/v1alpha1"
+	keda "github.com/kedacore/keda/v2/api/v1alpha1"
 	"github.com/stretchr/testify/assert"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -20,12 +22,51 @@ func TestCreatesScaledObject(t *testing.T) {
 			MaxRunners: 10,
 		},
 	}
-	so := GenerateScaledObject(&sar, "https://foo/bar", "baz")
+	so := GenerateScaledObject(&sar, Trigger{Type: v1alpha1.TriggerMetricsApi, Url: "https://foo/bar", ClusterTriggerName: "baz"})
 	assert.NotNil(t, so)
 	assert.Equal(t, sar.ObjectMeta.Name, so.Name)
 	assert.Equal(t, sar.ObjectMeta.Namespace, so.Namespace)
 }
 
+func TestExternalPushTriggerUsesScaler(t *testing.T) {
+	sar := v1alpha1.ScaledActionRunner{
+		ObjectMeta: v1.ObjectMeta{Name: "Foo", Namespace: "Bar"},
+		Spec:       v1alpha1.ScaledActionRunnerSpec{MaxRunners: 10},
+	}
+	so := GenerateScaledObject(&sar, Trigger{Type: v1alpha1.TriggerExternalPush, Url: "https://foo/bar", ClusterTriggerName: "baz", ScalerAddress: "api.ns.svc:6000", Selector: "os=linux"})
+	assert.Len(t, so.Spec.Triggers, 1)
+	assert.Equal(t, "external-push", so.Spec.Triggers[0].Type)
+	assert.Equal(t, map[string]string{"scalerAddress": "api.ns.svc:6000", "metricsSelector": "os=linux"}, so.Spec.Triggers[0].Metadata)
+	assert.Equal(t, &keda.ScaledObjectAuthRef{Name: "baz", Kind: "ClusterTriggerAuthentication"}, so.Spec.Triggers[0].AuthenticationRef)
+}
+
+func TestMetricsUrlForEachApi(t *testing.T) {
+	assert.Equal(t, "https://api.ns.svc/apis/custom.metrics.k8s.io/v1beta1/namespaces/Bar/Scaledactionrunners/Foo/*",
+		MetricsUrl(v1alpha1.MetricsApiCustom, "api.ns.svc", "Bar", "Foo", "*"))
+	assert.Equal(t, "https://api.ns.svc/apis/external.metrics.k8s.io/v1beta1/namespaces/Bar/Foo",
+		MetricsUrl(v1alpha1.MetricsApiExternal, "api.ns.svc", "Bar", "Foo", "*"))
+	assert.Equal(t, "https://api.ns.svc/apis/external.metrics.k8s.io/v1beta1/namespaces/Bar/Foo?labelSelector=os%3Dlinux%2Carch+in+%28x64%29",
+		MetricsUrl(v1alpha1.MetricsApiExternal, "api.ns.svc", "Bar", "Foo", "os=linux,arch in (x64)"))
+}
+
+func TestScaledObjectAllowsScheduledWindows(t *testing.T) {
+	zero, two := int32(0), int32(2)
+	sar := v1alpha1.ScaledActionRunner{
+		ObjectMeta: v1.ObjectMeta{Name: "Foo", Namespace: "Bar"},
+		Spec: v1alpha1.ScaledActionRunnerSpec{
+			MinRunners: 1,
+			MaxRunners: 10,
+			Windows: []v1alpha1.ScheduledWindow{
+				{Name: "office-hours", MinRunners: &two},
+				{Name: "freeze", MaxRunners: &zero},
+			},
+		},
+	}
+	so := GenerateScaledObject(&sar, Trigger{Type: v1alpha1.TriggerMetricsApi, Url: "https://foo/bar", ClusterTriggerName: "baz"})
+	assert.Equal(t, int32(0), *so.Spec.MinReplicaCount)
+	assert.Equal(t, int32(10), *so.Spec.MaxReplicaCount)
+}
+
 func TestDoesNothingIfPatchIsMissing(t *testing.T) {
 	ss := getTestSs()
 	result, hash, err := PatchStatefulSet(ss, &v1alpha1.ScaledActionRunner{
@@ -140,6 +181,121 @@ func TestTriggersDeletionIfPatchChanges(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestSetsGithubEnterpriseEnvVars(t *testing.T) {
+	ss := getTestSs()
+	requests := map[corev1.ResourceName]resource.Quantity{}
+	sar := v1alpha1.ScaledActionRunner{
+		Spec: v1alpha1.ScaledActionRunnerSpec{
+			Owner: "owner",
+			Repo:  "repo",
+			Runner: &v1alpha1.Runner{
+				Requests: &requests,
+				Limits:   &requests,
+			},
+			Github: &v1alpha1.GithubConnection{
+				BaseUrl:  "https://github.example.com/api/v3/",
+				Proxy:    "http://proxy:3128",
+				CaBundle: "pem",
+			},
+		},
+	}
+	assert.True(t, SetEnvVars(&sar, ss))
+	env := map[string]string{}
+	for _, e := range ss.Spec.Template.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	assert.Equal(t, "git@github.example.com:owner/repo.git", env["REPO_URL"])
+	assert.Equal(t, "github.example.com", env["GITHUB_HOST"])
+	assert.Equal(t, "http://proxy:3128", env["https_proxy"])
+	assert.Equal(t, "pem", env["GITHUB_CA_BUNDLE"])
+
+	sar.Spec.Github = nil
+	ss = getTestSs()
+	SetEnvVars(&sar, ss)
+	for _, e := range ss.Spec.Template.Spec.Containers[0].Env {
+		assert.NotEqual(t, "GITHUB_HOST", e.Name)
+		if e.Name == "REPO_URL" {
+			assert.Equal(t, "git@github.com:owner/repo.git", e.Value)
+		}
+	}
+}
+
+func TestInstallsGithubCaBundleInRunnerPods(t *testing.T) {
+	sar := v1alpha1.ScaledActionRunner{
+		ObjectMeta: v1.ObjectMeta{Name: "foo", Namespace: "bar"},
+		Spec: v1alpha1.ScaledActionRunnerSpec{
+			Owner:  "owner",
+			Repo:   "repo",
+			Github: &v1alpha1.GithubConnection{BaseUrl: "https://github.example.com/api/v3/", CaBundle: "pem"},
+		},
+	}
+	v1alpha1.Setup(&sar, "bar")
+	ss := GenerateStatefulSet(&sar, "")
+	pod := ss.Spec.Template.Spec
+	assert.Len(t, pod.InitContainers, 1)
+	init := pod.InitContainers[0]
+	assert.Equal(t, v1alpha1.DefaultImage, init.Image)
+	assert.Contains(t, init.Env, corev1.EnvVar{Name: "GITHUB_CA_BUNDLE", Value: "pem"})
+	assert.Contains(t, init.Command[2], "/github-ca/ca-certificates.crt")
+	assert.Contains(t, init.VolumeMounts, corev1.VolumeMount{Name: "github-ca", MountPath: "/github-ca"})
+	assert.Contains(t, pod.Volumes, corev1.Volume{Name: "github-ca", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}})
+
+	runner := pod.Containers[0]
+	assert.Contains(t, runner.VolumeMounts, corev1.VolumeMount{Name: "github-ca", MountPath: "/github-ca"})
+	for _, n := range []string{"SSL_CERT_FILE", "GIT_SSL_CAINFO", "NODE_EXTRA_CA_CERTS"} {
+		assert.Contains(t, runner.Env, corev1.EnvVar{Name: n, Value: "/github-ca/ca-certificates.crt"})
+	}
+	// Kubernetes defaults fields of the init container which shouldn't cause an update
+	ss.Spec.Template.Spec.InitContainers[0].ImagePullPolicy = corev1.PullAlways
+	assert.False(t, SetInitContainers(&sar, ss))
+
+	sar.Spec.Github.CaBundle = ""
+	assert.True(t, SetInitContainers(&sar, ss))
+	assert.Empty(t, ss.Spec.Template.Spec.InitContainers)
+	volumes, _ := GetVolumes(&sar)
+	for _, v := range volumes {
+		assert.NotEqual(t, "github-ca", v.Name)
+	}
+}
+
+func TestSetsOrganizationEnvVars(t *testing.T) {
+	ss := getTestSs()
+	requests := map[corev1.ResourceName]resource.Quantity{}
+	sar := v1alpha1.ScaledActionRunner{
+		Spec: v1alpha1.ScaledActionRunnerSpec{
+			Owner: "owner",
+			Repo:  "repo",
+			Runner: &v1alpha1.Runner{
+				Requests: &requests,
+				Limits:   &requests,
+			},
+		},
+	}
+	SetEnvVars(&sar, ss)
+	getEnv := func() map[string]string {
+		env := map[string]string{}
+		for _, e := range ss.Spec.Template.Spec.Containers[0].Env {
+			env[e.Name] = e.Value
+		}
+		return env
+	}
+	assert.Contains(t, getEnv(), "REPO_URL")
+
+	sar.Spec.Repo = ""
+	sar.Spec.Organization = &v1alpha1.Organization{RunnerGroup: "group"}
+	assert.True(t, SetEnvVars(&sar, ss))
+	env := getEnv()
+	assert.NotContains(t, env, "REPO_URL")
+	assert.Equal(t, "org", env["RUNNER_SCOPE"])
+	assert.Equal(t, "owner", env["ORG_NAME"])
+	assert.Equal(t, "group", env["RUNNER_GROUP"])
+	assert.False(t, SetEnvVars(&sar, ss))
+
+	sar.Spec.Organization.RunnerGroup = ""
+	assert.True(t, SetEnvVars(&sar, ss))
+	assert.NotContains(t, getEnv(), "RUNNER_GROUP")
+}
+
 func getTestSs() *appsv1.StatefulSet {
 	var replicas int32 = 2
 	ss := appsv1.StatefulSet{
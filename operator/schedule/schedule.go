@@ -0,0 +1,175 @@
+// Package schedule parses the standard 5 field cron expressions used by scheduled runner windows e.g. "0 9 * * 1-5".
+// Each field can be *, a number, a range (1-5), a step (*/15 or 0-30/10) or a comma separated list of these. Day of
+// week is 0-7 where 0 and 7 are both Sunday, names and the non standard extensions (@daily, L, W etc) aren't supported.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// The apiserver and operator images are distroless so they don't have a zoneinfo database
+	_ "time/tzdata"
+)
+
+// MaxDuration is the longest that a window can last for, Active searches back this far for the start of a window
+const MaxDuration = 31 * 24 * time.Hour
+
+type field struct {
+	name string
+	min  int
+	max  int
+}
+
+var fields = []field{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12},
+	{name: "day of week", min: 0, max: 7},
+}
+
+// Schedule is a parsed cron expression
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar are needed because when both are restricted a day matches if either of them matches
+	domStar, dowStar bool
+}
+
+// Parse parses a 5 field cron expression
+func Parse(spec string) (*Schedule, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("expected %d fields in '%s' but found %d", len(fields), spec, len(parts))
+	}
+	bits := make([]uint64, len(fields))
+	for i, f := range fields {
+		b, err := parseField(parts[i], f)
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = b
+	}
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &Schedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: strings.HasPrefix(parts[2], "*"),
+		dowStar: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+func parseField(value string, f field) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(value, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			rng = item[:i]
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step '%s' in %s", item[i+1:], f.name)
+			}
+		}
+		start, end := f.min, f.max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if start, err = parseNumber(bounds[0], f); err != nil {
+				return 0, err
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = parseNumber(bounds[1], f); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				end = f.max
+			}
+			if end < start {
+				return 0, fmt.Errorf("range '%s' in %s ends before it starts", rng, f.name)
+			}
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func parseNumber(value string, f field) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value '%s' in %s", value, f.name)
+	}
+	if n < f.min || n > f.max {
+		return 0, fmt.Errorf("%s must be between %d and %d but was %d", f.name, f.min, f.max, n)
+	}
+	return n, nil
+}
+
+// Matches returns true if the schedule fires at the minute containing t, t should already be in the right time zone
+func (s *Schedule) Matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 || s.hour&(1<<uint(t.Hour())) == 0 || s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	return s.matchesDay(t)
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Active returns true if the schedule fired less than duration before now. Times are compared in loc so that windows
+// follow daylight saving changes.
+func (s *Schedule) Active(now time.Time, duration time.Duration, loc *time.Location) bool {
+	if duration > MaxDuration {
+		duration = MaxDuration
+	}
+	now = now.In(loc)
+	earliest := now.Add(-duration)
+	fired, found := s.Prev(now, earliest)
+	return found && fired.After(earliest)
+}
+
+// Prev returns the latest minute at or before t that the schedule fires at, it gives up once it is before earliest.
+// Rather than checking every minute it skips back over whole months, days and hours which don't match, so searching
+// back MaxDuration takes at most a few hundred steps.
+func (s *Schedule) Prev(t time.Time, earliest time.Time) (time.Time, bool) {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	for !t.Before(earliest) {
+		var start time.Time
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		case !s.matchesDay(t):
+			start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			start = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			start = t
+		default:
+			return t, true
+		}
+		// When the clocks go back the start of a repeated hour can be the later of the two so it is stepped through
+		// a minute at a time
+		if prev := start.Add(-time.Minute); prev.Before(t) {
+			t = prev
+		} else {
+			t = t.Add(-time.Minute)
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,77 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsesFields(t *testing.T) {
+	s, err := Parse("*/15 9-17 * * 1-5")
+	assert.Nil(t, err)
+	// Monday
+	assert.True(t, s.Matches(time.Date(2021, 5, 3, 9, 0, 0, 0, time.UTC)))
+	assert.True(t, s.Matches(time.Date(2021, 5, 3, 17, 45, 0, 0, time.UTC)))
+	assert.False(t, s.Matches(time.Date(2021, 5, 3, 9, 10, 0, 0, time.UTC)))
+	assert.False(t, s.Matches(time.Date(2021, 5, 3, 18, 0, 0, 0, time.UTC)))
+	// Sunday
+	assert.False(t, s.Matches(time.Date(2021, 5, 2, 9, 0, 0, 0, time.UTC)))
+
+	s, err = Parse("0 0 1,15 * 7")
+	assert.Nil(t, err)
+	// Day of month or day of week matches when both are restricted
+	assert.True(t, s.Matches(time.Date(2021, 5, 15, 0, 0, 0, 0, time.UTC)))
+	assert.True(t, s.Matches(time.Date(2021, 5, 2, 0, 0, 0, 0, time.UTC)))
+	assert.False(t, s.Matches(time.Date(2021, 5, 3, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestRejectsInvalidExpressions(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "* * 0 * *", "a * * * *", "@daily"} {
+		_, err := Parse(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestActiveForDurationInTimezone(t *testing.T) {
+	s, _ := Parse("0 9 * * 1-5")
+	loc, _ := time.LoadLocation("Europe/London")
+	// 09:00 in London during BST is 08:00 UTC
+	assert.False(t, s.Active(time.Date(2021, 5, 3, 7, 59, 0, 0, time.UTC), 8*time.Hour, loc))
+	assert.True(t, s.Active(time.Date(2021, 5, 3, 8, 0, 0, 0, time.UTC), 8*time.Hour, loc))
+	assert.True(t, s.Active(time.Date(2021, 5, 3, 15, 59, 0, 0, time.UTC), 8*time.Hour, loc))
+	assert.False(t, s.Active(time.Date(2021, 5, 3, 16, 0, 0, 0, time.UTC), 8*time.Hour, loc))
+	// Friday's window runs over in to Saturday
+	assert.True(t, s.Active(time.Date(2021, 5, 8, 1, 0, 0, 0, time.UTC), 20*time.Hour, loc))
+	assert.False(t, s.Active(time.Date(2021, 5, 9, 1, 0, 0, 0, time.UTC), 20*time.Hour, loc))
+}
+
+func TestPrevMatchesScanningEveryMinute(t *testing.T) {
+	loc, _ := time.LoadLocation("Europe/London")
+	specs := []string{"0 9 * * 1-5", "*/15 9-17 * * 1-5", "30 1 * * *", "0 0 1,15 * 7", "0 0 29 2 *", "45 23 31 * *", "* * * * *"}
+	// Including the night that the clocks go back and the night they go forward
+	starts := []time.Time{
+		time.Date(2021, 3, 28, 3, 0, 0, 0, loc),
+		time.Date(2021, 10, 31, 1, 30, 0, 0, time.UTC),
+		time.Date(2021, 5, 3, 8, 7, 0, 0, loc),
+		time.Date(2021, 3, 1, 0, 0, 0, 0, loc),
+	}
+	for _, spec := range specs {
+		s, err := Parse(spec)
+		assert.Nil(t, err)
+		for _, now := range starts {
+			now = now.In(loc)
+			earliest := now.Add(-MaxDuration)
+			var expected time.Time
+			for m := now.Truncate(time.Minute); !m.Before(earliest); m = m.Add(-time.Minute) {
+				if s.Matches(m) {
+					expected = m
+					break
+				}
+			}
+			actual, found := s.Prev(now, earliest)
+			assert.Equal(t, !expected.IsZero(), found, "%s %s", spec, now)
+			assert.True(t, expected.Equal(actual), "%s %s expected %s but was %s", spec, now, expected, actual)
+		}
+	}
+}
@@ -9,6 +9,11 @@ _LABELS=${LABELS:-default}
 _RUNNER_GROUP=${RUNNER_GROUP:-Default}
 _SHORT_URL=${REPO_URL}
 
+if [[ -n "${GITHUB_CA_BUNDLE}" ]]; then
+  echo "${GITHUB_CA_BUNDLE}" > /usr/local/share/ca-certificates/github-ca-bundle.crt
+  update-ca-certificates
+fi
+
 if [[ -n "${ACCESS_TOKEN}" ]]; then
   _TOKEN=$(bash /token.sh)
   RUNNER_TOKEN=$(echo "${_TOKEN}" | jq -r .token)